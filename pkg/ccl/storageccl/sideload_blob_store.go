@@ -0,0 +1,140 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package storageccl
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+
+	gcs "cloud.google.com/go/storage"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/storage"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	storage.RegisterSideloadBlobStoreFactory(makeSideloadBlobStore)
+}
+
+// sideloadBlobStoreKey identifies the object stores shared by the sideloaded
+// storages of all replicas of a node.
+type sideloadBlobStoreKey struct {
+	uri      string
+	settings *cluster.Settings
+}
+
+var sideloadBlobStores struct {
+	syncutil.Mutex
+	m map[sideloadBlobStoreKey]*sideloadBlobStore
+}
+
+// makeSideloadBlobStore is the storage.SideloadBlobStoreFactory which backs
+// kv.raft_log.sideloading.external_uri with an ExportStorage. Only providers
+// which report missing files in a way that can be told apart from other
+// failures are supported, since the sideloaded storage relies on that. The
+// ExportStorage is created once per URI and shared by all replicas.
+func makeSideloadBlobStore(
+	ctx context.Context, uri string, settings *cluster.Settings,
+) (storage.SideloadBlobStore, error) {
+	conf, err := ExportStorageConfFromURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch conf.Provider {
+	case roachpb.ExportStorageProvider_LocalFile,
+		roachpb.ExportStorageProvider_S3,
+		roachpb.ExportStorageProvider_GoogleCloud,
+		roachpb.ExportStorageProvider_Azure:
+	default:
+		return nil, errors.Errorf("unsupported storage provider for sideloaded payloads: %s", conf.Provider)
+	}
+
+	key := sideloadBlobStoreKey{uri: uri, settings: settings}
+	sideloadBlobStores.Lock()
+	defer sideloadBlobStores.Unlock()
+	if s, ok := sideloadBlobStores.m[key]; ok {
+		return s, nil
+	}
+	es, err := MakeExportStorage(ctx, conf, settings)
+	if err != nil {
+		return nil, err
+	}
+	s := &sideloadBlobStore{es: es}
+	if sideloadBlobStores.m == nil {
+		sideloadBlobStores.m = make(map[sideloadBlobStoreKey]*sideloadBlobStore)
+	}
+	sideloadBlobStores.m[key] = s
+	return s, nil
+}
+
+// sideloadBlobStore adapts an ExportStorage to storage.SideloadBlobStore.
+type sideloadBlobStore struct {
+	es ExportStorage
+}
+
+var _ storage.SideloadBlobStore = &sideloadBlobStore{}
+
+// ReadFile implements storage.SideloadBlobStore.
+func (s *sideloadBlobStore) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	r, err := s.es.ReadFile(ctx, name)
+	if err != nil {
+		return nil, sideloadNotExistError(name, err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, sideloadNotExistError(name, err)
+	}
+	return b, nil
+}
+
+// WriteFile implements storage.SideloadBlobStore.
+func (s *sideloadBlobStore) WriteFile(ctx context.Context, name string, content []byte) error {
+	return s.es.WriteFile(ctx, name, bytes.NewReader(content))
+}
+
+// Delete implements storage.SideloadBlobStore.
+func (s *sideloadBlobStore) Delete(ctx context.Context, name string) error {
+	if err := s.es.Delete(ctx, name); err != nil && !isNotExistErr(err) {
+		return err
+	}
+	return nil
+}
+
+// sideloadNotExistError converts the supplied error into one which satisfies
+// os.IsNotExist if it reports that the named file doesn't exist.
+func sideloadNotExistError(name string, err error) error {
+	if isNotExistErr(err) {
+		return &os.PathError{Op: "read", Path: name, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+// isNotExistErr returns whether the supplied error, returned by an
+// ExportStorage, reports that a file doesn't exist.
+func isNotExistErr(err error) bool {
+	err = errors.Cause(err)
+	if os.IsNotExist(err) || err == gcs.ErrObjectNotExist {
+		return true
+	}
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return true
+	}
+	if azErr, ok := err.(azblob.StorageError); ok && azErr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+		return true
+	}
+	return false
+}
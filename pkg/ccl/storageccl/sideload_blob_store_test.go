@@ -0,0 +1,69 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package storageccl
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestSideloadBlobStore(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+	st := cluster.MakeTestingClusterSettings()
+	st.ExternalIODir = p
+
+	if _, err := makeSideloadBlobStore(
+		ctx, "http://localhost/sideload", st,
+	); !testutils.IsError(err, "unsupported storage provider") {
+		t.Fatalf("expected unsupported provider error, got %v", err)
+	}
+
+	const uri = "nodelocal:///sideload"
+	s, err := makeSideloadBlobStore(ctx, uri, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, err := makeSideloadBlobStore(ctx, uri, st); err != nil {
+		t.Fatal(err)
+	} else if other != s {
+		t.Fatal("expected the object store to be shared")
+	}
+
+	const name = "1/2/i3.t4"
+	if _, err := s.ReadFile(ctx, name); !os.IsNotExist(err) {
+		t.Fatalf("expected a missing object, got %v", err)
+	}
+	if err := s.WriteFile(ctx, name, []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := s.ReadFile(ctx, name); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(b, []byte("foo")) {
+		t.Fatalf("expected foo, got %q", b)
+	}
+	// Deleting an object twice isn't an error.
+	for i := 0; i < 2; i++ {
+		if err := s.Delete(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.ReadFile(ctx, name); !os.IsNotExist(err) {
+		t.Fatalf("expected a missing object, got %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package urlcheck
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// robotsUserAgent is the user agent whose robots.txt rules are honored. Rules
+// for the wildcard user agent apply if a host has none specifically for it.
+const robotsUserAgent = "cockroach-urlcheck"
+
+// robotsFetchTimeout bounds the time spent fetching the robots.txt of a host.
+// Hosts whose robots.txt can't be fetched in time are checked without
+// restrictions.
+const robotsFetchTimeout = 10 * time.Second
+
+// maxRobotsSize limits the size of robots.txt files which are parsed.
+const maxRobotsSize = 500 << 10
+
+// errDisallowedByRobots is returned when a URL is not checked because the
+// robots.txt of its host disallows it.
+type errDisallowedByRobots struct{}
+
+func (errDisallowedByRobots) Error() string { return "disallowed by robots.txt" }
+
+// robotsRules are the rules of a robots.txt file which apply to a user agent.
+type robotsRules struct {
+	allow, disallow []string
+	crawlDelay      time.Duration
+}
+
+// allowed returns whether the rules permit fetching the given path. The most
+// specific (that is, longest) matching rule wins; if an allow and a disallow
+// rule are equally specific, the allow rule wins.
+func (r *robotsRules) allowed(path string) bool {
+	longest := func(prefixes []string) int {
+		n := -1
+		for _, p := range prefixes {
+			if strings.HasPrefix(path, p) && len(p) > n {
+				n = len(p)
+			}
+		}
+		return n
+	}
+	return longest(r.allow) >= longest(r.disallow)
+}
+
+// parseRobots parses a robots.txt file and returns the rules for the given
+// user agent. Only prefix rules are supported; the wildcards of some robots.txt
+// dialects are matched literally.
+//
+// A group applies to the user agent if its User-agent line names the user
+// agent's product token, case-insensitively and ignoring any version suffix
+// such as "/1.0".
+func parseRobots(r io.Reader, userAgent string) robotsRules {
+	userAgent = strings.ToLower(userAgent)
+	var specific, wildcard robotsRules
+	var haveSpecific bool
+	// groups are the rules the current group of lines applies to. Consecutive
+	// User-agent lines form a single group.
+	var groups []*robotsRules
+	inAgents := false
+
+	scanner := bufio.NewScanner(io.LimitReader(r, maxRobotsSize))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		i := strings.IndexByte(line, ':')
+		if i == -1 {
+			continue
+		}
+		field := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+
+		if field == "user-agent" {
+			if !inAgents {
+				groups = groups[:0]
+				inAgents = true
+			}
+			agent := strings.ToLower(value)
+			if i := strings.IndexByte(agent, '/'); i != -1 {
+				agent = agent[:i]
+			}
+			switch {
+			case agent == "*":
+				groups = append(groups, &wildcard)
+			case agent == userAgent:
+				groups = append(groups, &specific)
+				haveSpecific = true
+			}
+			continue
+		}
+		inAgents = false
+		for _, g := range groups {
+			switch field {
+			case "allow":
+				if value != "" {
+					g.allow = append(g.allow, value)
+				}
+			case "disallow":
+				// An empty Disallow rule allows everything.
+				if value != "" {
+					g.disallow = append(g.disallow, value)
+				}
+			case "crawl-delay":
+				if secs, err := strconv.ParseFloat(value, 64); err == nil && secs > 0 {
+					g.crawlDelay = time.Duration(secs * float64(time.Second))
+				}
+			}
+		}
+	}
+	if haveSpecific {
+		return specific
+	}
+	return wildcard
+}
+
+// robotsHost holds the robots.txt rules of a host and spaces the requests to
+// it according to its crawl delay.
+type robotsHost struct {
+	once  sync.Once
+	rules robotsRules
+
+	mu struct {
+		sync.Mutex
+		// next is the earliest time at which the next check of a URL on the
+		// host may start.
+		next time.Time
+	}
+}
+
+// robotsCache fetches and caches the robots.txt rules of the hosts checked.
+type robotsCache struct {
+	client    *http.Client
+	userAgent string
+
+	mu    sync.Mutex
+	hosts map[string]*robotsHost
+}
+
+func newRobotsCache(client *http.Client, userAgent string) *robotsCache {
+	return &robotsCache{
+		client:    client,
+		userAgent: userAgent,
+		hosts:     map[string]*robotsHost{},
+	}
+}
+
+// host returns the robotsHost for the host of u, fetching its robots.txt if
+// this is the first URL of the host.
+func (c *robotsCache) host(u *url.URL) *robotsHost {
+	key := u.Scheme + "://" + u.Host
+	c.mu.Lock()
+	h, ok := c.hosts[key]
+	if !ok {
+		h = &robotsHost{}
+		c.hosts[key] = h
+	}
+	c.mu.Unlock()
+
+	h.once.Do(func() {
+		h.rules = c.fetch(key + "/robots.txt")
+	})
+	return h
+}
+
+// fetch retrieves and parses the robots.txt at the given URL. A robots.txt
+// which is missing or can't be fetched imposes no restrictions.
+func (c *robotsCache) fetch(robotsURL string) robotsRules {
+	ctx, cancel := context.WithTimeout(context.Background(), robotsFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", robotsURL, nil)
+	if err != nil {
+		return robotsRules{}
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		log.Printf("Fetching %s: %s", robotsURL, err)
+		return robotsRules{}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return robotsRules{}
+	}
+	return parseRobots(resp.Body, c.userAgent)
+}
+
+// reserve returns the time at which the given URL may be checked, unless the
+// robots.txt of its host disallows it, in which case errDisallowedByRobots is
+// returned. The checks of URLs on a host with a crawl delay are assigned start
+// times spaced by the delay. Callers wait for their start time on their own,
+// so that waiting for a slow host doesn't hold up the checks of other hosts.
+func (c *robotsCache) reserve(rawURL string) (time.Time, error) {
+	now := time.Now()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// Let the check report the invalid URL.
+		return now, nil
+	}
+	h := c.host(u)
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if !h.rules.allowed(path) {
+		return time.Time{}, errDisallowedByRobots{}
+	}
+	if h.rules.crawlDelay == 0 {
+		return now, nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	start := h.mu.next
+	if start.Before(now) {
+		start = now
+	}
+	h.mu.next = start.Add(h.rules.crawlDelay)
+	return start, nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package urlcheck
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRobots(t *testing.T) {
+	const robotsTxt = `
+# Comments are ignored.
+User-agent: *
+Crawl-delay: 2
+Disallow: /private
+Allow: /private/public
+
+User-agent: other-bot
+User-agent: cockroach-urlcheck
+Crawl-delay: 0.5
+Disallow: /slow # trailing comment
+Disallow:
+`
+	wildcard := parseRobots(strings.NewReader(robotsTxt), "some-agent")
+	if wildcard.crawlDelay != 2*time.Second {
+		t.Errorf("expected wildcard crawl delay 2s, got %s", wildcard.crawlDelay)
+	}
+	specific := parseRobots(strings.NewReader(robotsTxt), robotsUserAgent)
+	if specific.crawlDelay != 500*time.Millisecond {
+		t.Errorf("expected specific crawl delay 500ms, got %s", specific.crawlDelay)
+	}
+
+	// Groups apply to the user agent's product token, with or without a
+	// version, but not to other agents whose name merely overlaps with it.
+	for _, agent := range []string{"c", "cockroach", "urlcheck", "cockroach-urlcheck-bot"} {
+		rules := parseRobots(strings.NewReader("User-agent: "+agent+"\nDisallow: /\n"), robotsUserAgent)
+		if !rules.allowed("/") {
+			t.Errorf("expected the rules for %q not to apply to %s", agent, robotsUserAgent)
+		}
+	}
+	for _, agent := range []string{"Cockroach-URLCheck", "cockroach-urlcheck/1.0"} {
+		rules := parseRobots(strings.NewReader("User-agent: "+agent+"\nDisallow: /\n"), robotsUserAgent)
+		if rules.allowed("/") {
+			t.Errorf("expected the rules for %q to apply to %s", agent, robotsUserAgent)
+		}
+	}
+
+	for _, tc := range []struct {
+		rules   robotsRules
+		path    string
+		allowed bool
+	}{
+		{wildcard, "/", true},
+		{wildcard, "/private", false},
+		{wildcard, "/private/x", false},
+		{wildcard, "/private/public/x", true},
+		{wildcard, "/slow", true},
+		{specific, "/private", true},
+		{specific, "/slow/x", false},
+	} {
+		if a := tc.rules.allowed(tc.path); a != tc.allowed {
+			t.Errorf("%+v: expected allowed(%q) = %t, got %t", tc.rules, tc.path, tc.allowed, a)
+		}
+	}
+}
+
+// TestCheckURLsRobots verifies that checkURLs honors the disallow rules and
+// crawl delay of a host's robots.txt when asked to.
+func TestCheckURLsRobots(t *testing.T) {
+	const crawlDelay = 200 * time.Millisecond
+	var mu struct {
+		sync.Mutex
+		robotsFetches int
+		requests      map[string][]time.Time
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/robots.txt" {
+			mu.robotsFetches++
+			fmt.Fprintf(w, "User-agent: *\nCrawl-delay: %g\nDisallow: /private\n", crawlDelay.Seconds())
+			return
+		}
+		mu.requests[r.URL.Path] = append(mu.requests[r.URL.Path], time.Now())
+	}))
+	defer srv.Close()
+
+	urls := map[string][]string{
+		srv.URL + "/a":         {"a"},
+		srv.URL + "/b":         {"b"},
+		srv.URL + "/private/c": {"c"},
+	}
+	for _, respect := range []bool{false, true} {
+		t.Run(fmt.Sprintf("respect=%t", respect), func(t *testing.T) {
+			mu.Lock()
+			mu.robotsFetches = 0
+			mu.requests = map[string][]time.Time{}
+			mu.Unlock()
+
+			if err := checkURLs(urls, Options{RespectRobotsTxt: respect}); err != nil {
+				t.Fatal(err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !respect {
+				if mu.robotsFetches != 0 || len(mu.requests["/private/c"]) == 0 {
+					t.Fatalf("expected robots.txt to be ignored, got %d fetches and requests %v",
+						mu.robotsFetches, mu.requests)
+				}
+				return
+			}
+			if mu.robotsFetches != 1 {
+				t.Errorf("expected robots.txt to be fetched once, got %d", mu.robotsFetches)
+			}
+			if reqs := mu.requests["/private/c"]; len(reqs) != 0 {
+				t.Errorf("expected disallowed URL not to be requested, got %d requests", len(reqs))
+			}
+			a, b := mu.requests["/a"], mu.requests["/b"]
+			if len(a) == 0 || len(b) == 0 {
+				t.Fatalf("expected allowed URLs to be requested, got %v", mu.requests)
+			}
+			// The checks of both URLs are spaced by the crawl delay.
+			first, second := a[len(a)-1], b[0]
+			if b[0].Before(a[0]) {
+				first, second = b[len(b)-1], a[0]
+			}
+			if d := second.Sub(first); d < crawlDelay {
+				t.Errorf("expected requests to be spaced by at least %s, got %s", crawlDelay, d)
+			}
+		})
+	}
+}
+
+// TestCheckURLsRobotsCrawlDelayConcurrency verifies that waiting for the crawl
+// delay of a host doesn't keep the URLs of other hosts from being checked.
+func TestCheckURLsRobotsCrawlDelayConcurrency(t *testing.T) {
+	const crawlDelay = 50 * time.Millisecond
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			fmt.Fprintf(w, "User-agent: *\nCrawl-delay: %g\n", crawlDelay.Seconds())
+		}
+	}))
+	defer slow.Close()
+	var lastFastChecked time.Time
+	var mu sync.Mutex
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/robots.txt" {
+			mu.Lock()
+			if now := time.Now(); now.After(lastFastChecked) {
+				lastFastChecked = now
+			}
+			mu.Unlock()
+		}
+	}))
+	defer fast.Close()
+
+	// There are more URLs on the slow host than requests may be in flight,
+	// and checking all of them takes a while due to the crawl delay.
+	const numSlow, numFast = 3 * maxConcurrentRequests, maxConcurrentRequests
+	urls := map[string][]string{}
+	for i := 0; i < numFast; i++ {
+		urls[fmt.Sprintf("%s/%d", fast.URL, i)] = []string{"fast"}
+	}
+	for i := 0; i < numSlow; i++ {
+		urls[fmt.Sprintf("%s/%d", slow.URL, i)] = []string{"slow"}
+	}
+	start := time.Now()
+	if err := checkURLs(urls, Options{RespectRobotsTxt: true}); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < (numSlow-1)*crawlDelay {
+		t.Fatalf("expected the checks of the slow host to take at least %s, took %s",
+			(numSlow-1)*crawlDelay, d)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if d := lastFastChecked.Sub(start); d > numSlow*crawlDelay/4 {
+		t.Errorf("expected the fast host to be checked without waiting for the slow one, took %s", d)
+	}
+}
@@ -156,9 +156,53 @@ func checkURLWithRetries(client *http.Client, url string) error {
 	return fmt.Errorf("timed out on %d separate tries, giving up", timeoutRetries)
 }
 
+// DefaultUserAgent is the User-Agent sent with requests by default. Some
+// servers reject requests with a missing or generic user agent, such as the
+// one of Go's HTTP client.
+const DefaultUserAgent = "cockroach-urlcheck (CockroachDB documentation link checker)"
+
+// DefaultTrailingPunctuation is the set of characters which are stripped from
+// the end of matched URLs by default. They commonly follow a URL in prose or
+// code, but rarely end one.
+const DefaultTrailingPunctuation = ".,;)]>\"'`\\"
+
+// Options configures CheckURLsFromGrepOutputWithOptions.
+type Options struct {
+	// TrailingPunctuation is the set of characters which are stripped from the
+	// end of matched URLs before they are checked. A closing parenthesis or
+	// bracket is only stripped if it has no matching opening one in the URL, so
+	// that URLs such as https://en.wikipedia.org/wiki/Go_(programming_language)
+	// are preserved.
+	TrailingPunctuation string
+	// RespectRobotsTxt, if set, makes the check fetch the robots.txt of each
+	// host and honor it: URLs which it disallows are skipped and reported as
+	// such, and the requests to hosts with a crawl delay are spaced
+	// accordingly. It is off by default since many internal hosts don't serve a
+	// robots.txt.
+	RespectRobotsTxt bool
+	// UserAgent is the User-Agent sent with every request, including those for
+	// robots.txt. If empty, the default of Go's HTTP client is sent.
+	UserAgent string
+	// Headers are additional headers sent with every request. A User-Agent
+	// header among them is overridden by UserAgent, if set.
+	Headers http.Header
+}
+
 // CheckURLsFromGrepOutput runs the specified cmd, which should be
 // grepping using the URLRE regular expression defined above.
 func CheckURLsFromGrepOutput(cmd *exec.Cmd) error {
+	return CheckURLsFromGrepOutputWithOptions(cmd, Options{
+		TrailingPunctuation: DefaultTrailingPunctuation,
+		UserAgent:           DefaultUserAgent,
+	})
+}
+
+// CheckURLsFromGrepOutputWithOptions is like CheckURLsFromGrepOutput, but
+// allows configuring how matched URLs are cleaned up before they are checked
+// and how they are requested.
+// Failures are reported along with the original, untrimmed lines in which the
+// URLs were found.
+func CheckURLsFromGrepOutputWithOptions(cmd *exec.Cmd, opts Options) error {
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		log.Fatal(err)
@@ -171,7 +215,7 @@ func CheckURLsFromGrepOutput(cmd *exec.Cmd) error {
 		log.Fatal(err)
 	}
 
-	uniqueURLs, err := getURLs(filter)
+	uniqueURLs, err := getURLs(filter, opts.TrailingPunctuation)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -179,26 +223,17 @@ func CheckURLsFromGrepOutput(cmd *exec.Cmd) error {
 	if err := cmd.Wait(); err != nil {
 		log.Fatalf("err=%s, stderr=%s", err, stderr.String())
 	}
-	return checkURLs(uniqueURLs)
+	return checkURLs(uniqueURLs, opts)
 }
 
-// getURLs extracts URLs from the given filter.
-func getURLs(filter stream.Filter) (map[string][]string, error) {
+// getURLs extracts URLs from the given filter, stripping the given trailing
+// punctuation from them.
+func getURLs(filter stream.Filter, trailing string) (map[string][]string, error) {
 	uniqueURLs := map[string][]string{}
 
 	if err := stream.ForEach(filter, func(s string) {
 	outer:
-		for _, match := range re.FindAllString(s, -1) {
-			// Discard any characters after the first unbalanced ')' or ']'.
-			match = chompUnbalanced('(', ')', match)
-			match = chompUnbalanced('[', ']', match)
-			// Remove punctuation after the URL.
-			match = strings.TrimRight(match, ".,;\\\">`]")
-			// Remove the HTML target.
-			n := strings.LastIndexByte(match, '#')
-			if n != -1 {
-				match = match[:n]
-			}
+		for _, match := range extractURLs(s, trailing) {
 			// Add the source reference to the list.
 			if len(s) > 150 {
 				s = s[:150] + "..."
@@ -217,25 +252,95 @@ func getURLs(filter stream.Filter) (map[string][]string, error) {
 	return uniqueURLs, nil
 }
 
+// extractURLs returns the URLs contained in s. The matches of URLRE are
+// cleaned up by discarding unbalanced brackets, the given trailing punctuation
+// and HTML targets, none of which are excluded by the regular expression
+// itself.
+func extractURLs(s string, trailing string) []string {
+	matches := re.FindAllString(s, -1)
+	for i, match := range matches {
+		// Discard any characters after the first unbalanced ')' or ']'.
+		match = chompUnbalanced('(', ')', match)
+		match = chompUnbalanced('[', ']', match)
+		// Remove punctuation after the URL.
+		match = trimTrailing(match, trailing)
+		// Remove the HTML target.
+		n := strings.LastIndexByte(match, '#')
+		if n != -1 {
+			match = match[:n]
+		}
+		matches[i] = match
+	}
+	return matches
+}
+
+// trimTrailing strips the characters in trailing from the end of url. Closing
+// parentheses and brackets are only stripped if they are unbalanced.
+// Example: trimTrailing('https://a.com/b_(c)).', ".)") -> 'https://a.com/b_(c)'
+func trimTrailing(url, trailing string) string {
+	for url != "" {
+		c := url[len(url)-1]
+		if strings.IndexByte(trailing, c) == -1 {
+			break
+		}
+		if (c == ')' && balanced('(', ')', url)) || (c == ']' && balanced('[', ']', url)) {
+			break
+		}
+		url = url[:len(url)-1]
+	}
+	return url
+}
+
+// balanced returns whether every right rune in s is preceded by a matching
+// left rune.
+func balanced(left, right rune, s string) bool {
+	return chompUnbalanced(left, right, s) == s
+}
+
 // checkURLs checks the provided unique URLs
-func checkURLs(uniqueURLs map[string][]string) error {
+func checkURLs(uniqueURLs map[string][]string, opts Options) error {
 	sem := make(chan struct{}, maxConcurrentRequests)
 	errChan := make(chan error, len(uniqueURLs))
 
 	client := &http.Client{
-		Transport: &http.Transport{
-			// This test doesn't care that https certificates are invalid.
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		Transport: &headerTransport{
+			base: &http.Transport{
+				// This test doesn't care that https certificates are invalid.
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+			userAgent: opts.UserAgent,
+			headers:   opts.Headers,
 		},
 		Timeout: time.Minute,
 	}
+	var robots *robotsCache
+	if opts.RespectRobotsTxt {
+		robots = newRobotsCache(client, robotsUserAgent)
+	}
 
 	for url, locs := range uniqueURLs {
 		sem <- struct{}{}
 		go func(url string, locs []string) {
 			defer func() { <-sem }()
+			if robots != nil {
+				start, err := robots.reserve(url)
+				if err != nil {
+					log.Printf("Skipping %s: %s", url, err)
+					errChan <- nil
+					return
+				}
+				if wait := time.Until(start); wait > 0 {
+					// Give up the request slot while waiting for the crawl
+					// delay of the host, which would otherwise keep the
+					// checks of other hosts waiting too.
+					<-sem
+					time.Sleep(wait)
+					sem <- struct{}{}
+				}
+			}
 			log.Printf("Checking %s...", url)
-			if err := checkURLWithRetries(client, url); err != nil {
+			err := checkURLWithRetries(client, url)
+			if err != nil {
 				var buf bytes.Buffer
 				fmt.Fprintf(&buf, "%s : %s\n", url, err)
 				for _, loc := range locs {
@@ -264,3 +369,33 @@ func checkURLs(uniqueURLs map[string][]string) error {
 	}
 	return nil
 }
+
+// headerTransport adds the configured User-Agent and headers to every request
+// before passing it on to the base transport.
+type headerTransport struct {
+	base      http.RoundTripper
+	userAgent string
+	headers   http.Header
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.userAgent == "" && len(t.headers) == 0 {
+		return t.base.RoundTrip(req)
+	}
+	// A RoundTripper must not modify the request, so add the headers to a
+	// copy.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+len(t.headers)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	for k, v := range t.headers {
+		r.Header[k] = v
+	}
+	if t.userAgent != "" {
+		r.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.base.RoundTrip(r)
+}
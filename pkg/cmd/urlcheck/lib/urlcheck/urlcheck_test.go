@@ -0,0 +1,167 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package urlcheck
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// urlCorpus is a curated set of samples which URLRE is expected to handle
+// correctly. It covers plain URLs, URLs embedded in code, comments and
+// markdown, and trailing punctuation which is not part of the URL.
+var urlCorpus = []URLSample{
+	// Plain URLs.
+	{Input: "https://www.cockroachlabs.com", Expected: []string{"https://www.cockroachlabs.com"}},
+	{Input: "see http://example.com/a/b?c=d&e=f for details",
+		Expected: []string{"http://example.com/a/b?c=d&e=f"}},
+	{Input: "// https://github.com/cockroachdb/cockroach/issues/12345",
+		Expected: []string{"https://github.com/cockroachdb/cockroach/issues/12345"}},
+	{Input: "http://a.com and https://b.com/c", Expected: []string{"http://a.com", "https://b.com/c"}},
+	// HTML targets are removed.
+	{Input: "https://golang.org/ref/spec#Comparison_operators",
+		Expected: []string{"https://golang.org/ref/spec"}},
+	// Trailing punctuation is not part of the URL.
+	{Input: "Go to https://example.com/docs.", Expected: []string{"https://example.com/docs"}},
+	{Input: "https://example.com/a, https://example.com/b;",
+		Expected: []string{"https://example.com/a", "https://example.com/b"}},
+	{Input: "(see https://example.com/foo)", Expected: []string{"https://example.com/foo"}},
+	{Input: "(see https://example.com/foo).", Expected: []string{"https://example.com/foo"}},
+	{Input: "[link](https://example.com/foo), more", Expected: []string{"https://example.com/foo"}},
+	{Input: "https://en.wikipedia.org/wiki/Cockroach_(disambiguation)",
+		Expected: []string{"https://en.wikipedia.org/wiki/Cockroach_(disambiguation)"}},
+	{Input: "(https://en.wikipedia.org/wiki/Cockroach_(disambiguation))",
+		Expected: []string{"https://en.wikipedia.org/wiki/Cockroach_(disambiguation)"}},
+	{Input: `url := "https://example.com/path"`, Expected: []string{"https://example.com/path"}},
+	{Input: "`https://example.com/quoted`", Expected: []string{"https://example.com/quoted"}},
+	{Input: `<a href="https://example.com/html">link</a>`, Expected: []string{"https://example.com/html"}},
+	// URL-ish strings which are not URLs.
+	{Input: "http:// is a scheme"},
+	{Input: "https://?query"},
+	{Input: "ftp://example.com/not/http"},
+	{Input: "httpx://example.com"},
+}
+
+func TestURLRegex(t *testing.T) {
+	for _, m := range ValidateURLRegex(urlCorpus) {
+		t.Errorf("URL detection mismatch for %s", m)
+	}
+}
+
+func TestValidateURLRegex(t *testing.T) {
+	mismatches := ValidateURLRegex([]URLSample{
+		{Input: "https://example.com/a", Expected: []string{"https://example.com/a"}},
+		{Input: "https://example.com/b", Expected: []string{"https://example.com/c"}},
+		{Input: "no urls here", Expected: []string{"https://example.com/d"}},
+	})
+	if len(mismatches) != 2 {
+		t.Fatalf("expected 2 mismatches, got %v", mismatches)
+	}
+	if m := mismatches[0]; len(m.FalsePositives) != 1 || m.FalsePositives[0] != "https://example.com/b" ||
+		len(m.FalseNegatives) != 1 || m.FalseNegatives[0] != "https://example.com/c" {
+		t.Errorf("unexpected mismatch %s", m)
+	}
+	if m := mismatches[1]; len(m.FalsePositives) != 0 ||
+		len(m.FalseNegatives) != 1 || m.FalseNegatives[0] != "https://example.com/d" {
+		t.Errorf("unexpected mismatch %s", m)
+	}
+}
+
+func TestExtractURLsTrailingPunctuation(t *testing.T) {
+	const url = "https://example.com/page"
+	const wiki = "https://en.wikipedia.org/wiki/Go_(programming_language)"
+	testCases := []struct {
+		input    string
+		trailing string
+		expected string
+	}{
+		{url, DefaultTrailingPunctuation, url},
+		{url + ").", DefaultTrailingPunctuation, url},
+		{url + ".", DefaultTrailingPunctuation, url},
+		{url + ",", DefaultTrailingPunctuation, url},
+		{url + "],", DefaultTrailingPunctuation, url},
+		{"<" + url + ">", DefaultTrailingPunctuation, url},
+		{"'" + url + "'", DefaultTrailingPunctuation, url},
+		{`"` + url + `",`, DefaultTrailingPunctuation, url},
+		{url + `.'">`, DefaultTrailingPunctuation, url},
+		{wiki, DefaultTrailingPunctuation, wiki},
+		{wiki + ".", DefaultTrailingPunctuation, wiki},
+		{"(" + wiki + ").", DefaultTrailingPunctuation, wiki},
+		{"[" + wiki + "],", DefaultTrailingPunctuation, wiki},
+		// Only the configured characters are stripped.
+		{url + ".,", ".", url + ".,"},
+		{url + ",.", ".", url + ","},
+		{url + "'", "", url + "'"},
+	}
+	for _, tc := range testCases {
+		urls := extractURLs(tc.input, tc.trailing)
+		if len(urls) != 1 || urls[0] != tc.expected {
+			t.Errorf("%q with trailing punctuation %q: expected %q, got %q",
+				tc.input, tc.trailing, tc.expected, urls)
+		}
+	}
+}
+
+func TestTrimTrailing(t *testing.T) {
+	testCases := []struct {
+		url      string
+		expected string
+	}{
+		{"https://a.com/b_(c)", "https://a.com/b_(c)"},
+		{"https://a.com/b_(c)).", "https://a.com/b_(c)"},
+		{"https://a.com/b)", "https://a.com/b"},
+		{"https://a.com/b[c]", "https://a.com/b[c]"},
+		{"https://a.com/b]", "https://a.com/b"},
+	}
+	for _, tc := range testCases {
+		if actual := trimTrailing(tc.url, DefaultTrailingPunctuation); actual != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.url, tc.expected, actual)
+		}
+	}
+}
+
+// TestCheckURLsUserAgent verifies that the configured User-Agent and headers
+// are sent with every request, for servers which reject Go's default one.
+func TestCheckURLsUserAgent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.UserAgent(), "Go-http-client/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/header" && r.Header.Get("X-Check") != "urlcheck" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}))
+	defer srv.Close()
+
+	urls := map[string][]string{srv.URL + "/a": {"a"}}
+	if err := checkURLs(urls, Options{}); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("expected the default Go user agent to be rejected, got %v", err)
+	}
+	if err := checkURLs(urls, Options{UserAgent: DefaultUserAgent}); err != nil {
+		t.Fatal(err)
+	}
+
+	urls = map[string][]string{srv.URL + "/header": {"header"}}
+	headers := http.Header{}
+	headers.Add("X-Check", "urlcheck")
+	if err := checkURLs(urls, Options{UserAgent: "ci", Headers: headers}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkURLs(urls, Options{UserAgent: "ci"}); err == nil {
+		t.Fatal("expected the request without the header to fail")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package urlcheck
+
+import "fmt"
+
+// URLSample is a line of input together with the URLs expected to be found in
+// it.
+type URLSample struct {
+	Input    string
+	Expected []string
+}
+
+// Mismatch describes a sample for which the URLs found differ from the
+// expected ones.
+type Mismatch struct {
+	Input string
+	// FalsePositives are URLs which were found but not expected.
+	FalsePositives []string
+	// FalseNegatives are URLs which were expected but not found.
+	FalseNegatives []string
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("%q: unexpected %q, missing %q", m.Input, m.FalsePositives, m.FalseNegatives)
+}
+
+// ValidateURLRegex runs URLRE, along with the cleanup applied to its matches
+// using DefaultTrailingPunctuation, against the supplied samples and returns a
+// Mismatch for each sample whose URLs were not detected exactly. It is meant to
+// guard changes to URLRE.
+func ValidateURLRegex(samples []URLSample) []Mismatch {
+	var mismatches []Mismatch
+	for _, sample := range samples {
+		found := extractURLs(sample.Input, DefaultTrailingPunctuation)
+		m := Mismatch{
+			Input:          sample.Input,
+			FalsePositives: missingFrom(found, sample.Expected),
+			FalseNegatives: missingFrom(sample.Expected, found),
+		}
+		if len(m.FalsePositives) > 0 || len(m.FalseNegatives) > 0 {
+			mismatches = append(mismatches, m)
+		}
+	}
+	return mismatches
+}
+
+// missingFrom returns the elements of a which are not in b, taking duplicates
+// into account.
+func missingFrom(a, b []string) []string {
+	counts := make(map[string]int, len(b))
+	for _, s := range b {
+		counts[s]++
+	}
+	var missing []string
+	for _, s := range a {
+		if counts[s] > 0 {
+			counts[s]--
+			continue
+		}
+		missing = append(missing, s)
+	}
+	return missing
+}
@@ -13,16 +13,58 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os/exec"
+	"strings"
 
 	"github.com/cockroachdb/cockroach/pkg/cmd/urlcheck/lib/urlcheck"
 )
 
+var userAgent = flag.String("user-agent", urlcheck.DefaultUserAgent,
+	"User-Agent to send with every request")
+
+var respectRobotsTxt = flag.Bool("respect-robots-txt", false,
+	"skip URLs disallowed by the robots.txt of their host, and honor its crawl delay")
+
+// headerFlag is a repeatable flag of "Name: value" headers.
+type headerFlag http.Header
+
+// String implements flag.Value.
+func (h headerFlag) String() string {
+	var headers []string
+	for k, vs := range h {
+		for _, v := range vs {
+			headers = append(headers, k+": "+v)
+		}
+	}
+	return strings.Join(headers, ", ")
+}
+
+// Set implements flag.Value.
+func (h headerFlag) Set(s string) error {
+	i := strings.IndexByte(s, ':')
+	if i <= 0 {
+		return fmt.Errorf("invalid header %q, expected \"Name: value\"", s)
+	}
+	http.Header(h).Add(strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]))
+	return nil
+}
+
 func main() {
+	headers := headerFlag{}
+	flag.Var(headers, "header", "additional `Name: value` header to send with every request; may be repeated")
+	flag.Parse()
+
 	cmd := exec.Command("git", "grep", "-nE", urlcheck.URLRE)
-	if err := urlcheck.CheckURLsFromGrepOutput(cmd); err != nil {
+	if err := urlcheck.CheckURLsFromGrepOutputWithOptions(cmd, urlcheck.Options{
+		TrailingPunctuation: urlcheck.DefaultTrailingPunctuation,
+		RespectRobotsTxt:    *respectRobotsTxt,
+		UserAgent:           *userAgent,
+		Headers:             http.Header(headers),
+	}); err != nil {
 		log.Fatalf("%+v\nFAIL", err)
 	}
 	fmt.Println("PASS")
@@ -151,6 +151,10 @@ var (
 	// last verification timestamp (for checking integrity of on-disk data).
 	// Note: DEPRECATED.
 	LocalRangeLastVerificationTimestampSuffixDeprecated = []byte("rlvt")
+	// LocalRangeTSMaintenanceCheckpointSuffix is the suffix for the progress
+	// of the time series maintenance of a range, so that it can resume after
+	// a restart.
+	LocalRangeTSMaintenanceCheckpointSuffix = []byte("rtsm")
 	// LocalRangePrefix is the prefix identifying per-range data indexed
 	// by range key (either start key, or some key in the range). The
 	// key is appended to this prefix, encoded using EncodeBytes. The
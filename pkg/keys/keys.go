@@ -346,6 +346,12 @@ func RangeLastReplicaGCTimestampKey(rangeID roachpb.RangeID) roachpb.Key {
 	return MakeRangeIDPrefixBuf(rangeID).RangeLastReplicaGCTimestampKey()
 }
 
+// RangeTSMaintenanceCheckpointKey returns a range-local key for the
+// checkpoint of the range's time series maintenance.
+func RangeTSMaintenanceCheckpointKey(rangeID roachpb.RangeID) roachpb.Key {
+	return MakeRangeIDPrefixBuf(rangeID).RangeTSMaintenanceCheckpointKey()
+}
+
 // RangeLastVerificationTimestampKeyDeprecated returns a range-local
 // key for the range's last verification timestamp.
 func RangeLastVerificationTimestampKeyDeprecated(rangeID roachpb.RangeID) roachpb.Key {
@@ -972,6 +978,12 @@ func (b RangeIDPrefixBuf) RangeLastReplicaGCTimestampKey() roachpb.Key {
 	return append(b.unreplicatedPrefix(), LocalRangeLastReplicaGCTimestampSuffix...)
 }
 
+// RangeTSMaintenanceCheckpointKey returns a range-local key for the
+// checkpoint of the range's time series maintenance.
+func (b RangeIDPrefixBuf) RangeTSMaintenanceCheckpointKey() roachpb.Key {
+	return append(b.unreplicatedPrefix(), LocalRangeTSMaintenanceCheckpointSuffix...)
+}
+
 // RangeLastVerificationTimestampKeyDeprecated returns a range-local
 // key for the range's last verification timestamp.
 func (b RangeIDPrefixBuf) RangeLastVerificationTimestampKeyDeprecated() roachpb.Key {
@@ -405,6 +405,11 @@ func (n *Node) start(
 	// Start the closed timestamp subsystem.
 	n.storeCfg.ClosedTimestamp.Start(n.Descriptor.NodeID)
 
+	// Any of the node's engines may hold sideloaded storages relocated from
+	// another store's engine.
+	n.storeCfg.SideloadEngines = append(
+		append([]engine.Engine(nil), initializedEngines...), emptyEngines...)
+
 	// Create stores from the engines that were already bootstrapped.
 	for _, e := range initializedEngines {
 		s := storage.NewStore(ctx, n.storeCfg, e, &n.Descriptor)
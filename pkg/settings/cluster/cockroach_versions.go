@@ -70,6 +70,8 @@ const (
 	VersionQueryTxnTimestamp
 	VersionStickyBit
 	VersionParallelCommits
+	VersionSnapshotLogEntryCompression
+	VersionShardedSideloadedStorage
 
 	// Add new versions here (step one of two).
 
@@ -477,6 +479,19 @@ var versionsSingleton = keyedVersions([]keyedVersion{
 		Key:     VersionParallelCommits,
 		Version: roachpb.Version{Major: 19, Minor: 1, Unstable: 4},
 	},
+	{
+		// VersionSnapshotLogEntryCompression allows snapshots to carry compressed
+		// raft log entries, which receivers from earlier versions can't decode.
+		Key:     VersionSnapshotLogEntryCompression,
+		Version: roachpb.Version{Major: 19, Minor: 1, Unstable: 5},
+	},
+	{
+		// VersionShardedSideloadedStorage places sideloaded files in
+		// subdirectories of the sideloaded directory of a range, which earlier
+		// versions don't look for them in.
+		Key:     VersionShardedSideloadedStorage,
+		Version: roachpb.Version{Major: 19, Minor: 1, Unstable: 6},
+	},
 
 	// Add new versions here (step two of two).
 
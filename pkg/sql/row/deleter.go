@@ -109,13 +109,16 @@ func makeRowDeleterWithoutCascader(
 		}
 	}
 
+	rh, err := newRowHelper(tableDesc, indexes)
+	if err != nil {
+		return Deleter{}, err
+	}
 	rd := Deleter{
-		Helper:               newRowHelper(tableDesc, indexes),
+		Helper:               rh,
 		FetchCols:            fetchCols,
 		FetchColIDtoRowIndex: fetchColIDtoRowIndex,
 	}
 	if checkFKs == CheckFKs {
-		var err error
 		if rd.Fks, err = makeFkExistenceCheckHelperForDelete(txn, tableDesc, fkTables,
 			fetchColIDtoRowIndex, alloc); err != nil {
 			return Deleter{}, err
@@ -13,8 +13,12 @@
 package row
 
 import (
+	"bytes"
+	"fmt"
 	"sort"
 
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
@@ -25,9 +29,21 @@ import (
 type rowHelper struct {
 	TableDesc *sqlbase.ImmutableTableDescriptor
 	// Secondary indexes.
-	Indexes      []sqlbase.IndexDescriptor
+	Indexes []sqlbase.IndexDescriptor
+	// indexEntries is the scratch space of encodeSecondaryIndexes. Inverted
+	// indexes can encode any number of entries per row, so its capacity is the
+	// largest number of entries encoded for a row so far.
 	indexEntries []sqlbase.IndexEntry
 
+	// validateColumnMapping, if set, makes encodeIndexes check the column
+	// mapping of each row with checkColumnMapping before encoding it.
+	// Callers which construct the mapping from the same descriptor can leave
+	// it unset to avoid the overhead on their hot path.
+	validateColumnMapping bool
+	// validators are run by encodeIndexes on the entries of each row. See
+	// AddValidator.
+	validators []IndexEntriesValidator
+
 	// Computed during initialization for pretty-printing.
 	primIndexValDirs []encoding.Direction
 	secIndexValDirs  [][]encoding.Direction
@@ -38,9 +54,21 @@ type rowHelper struct {
 	sortedColumnFamilies  map[sqlbase.FamilyID][]sqlbase.ColumnID
 }
 
+// IndexEntriesValidator checks the index entries encoded for a row by
+// encodeIndexes, and returns an error to reject the row. It must not modify or
+// retain the entries, which are only valid until the next row is encoded.
+type IndexEntriesValidator func(
+	primaryIndexKey []byte, secondaryIndexEntries []sqlbase.IndexEntry,
+) error
+
+// newRowHelper returns a rowHelper for the given table and secondary indexes.
+// It returns an error if the descriptor can't be used to encode rows.
 func newRowHelper(
 	desc *sqlbase.ImmutableTableDescriptor, indexes []sqlbase.IndexDescriptor,
-) rowHelper {
+) (rowHelper, error) {
+	if err := checkPrimaryIndexColumnFamilies(desc); err != nil {
+		return rowHelper{}, err
+	}
 	rh := rowHelper{TableDesc: desc, Indexes: indexes}
 
 	// Pre-compute the encoding directions of the index key values for
@@ -52,7 +80,28 @@ func newRowHelper(
 		rh.secIndexValDirs[i] = sqlbase.IndexKeyValDirs(&rh.Indexes[i])
 	}
 
-	return rh
+	return rh, nil
+}
+
+// checkPrimaryIndexColumnFamilies returns an error if any column of the
+// primary index is assigned to a column family other than family 0. Rows of
+// such a table can't be encoded (see skipColumnInPK), and checking the
+// descriptor once up front reports this before the first row is processed.
+func checkPrimaryIndexColumnFamilies(desc *sqlbase.ImmutableTableDescriptor) error {
+	for _, family := range desc.Families {
+		if family.ID == 0 {
+			continue
+		}
+		for _, colID := range family.ColumnIDs {
+			for _, pkColID := range desc.PrimaryIndex.ColumnIDs {
+				if colID == pkColID {
+					return errors.Errorf("primary index column %d must be in family 0, was %d",
+						colID, family.ID)
+				}
+			}
+		}
+	}
+	return nil
 }
 
 // encodeIndexes encodes the primary and secondary index keys. The
@@ -61,12 +110,12 @@ func newRowHelper(
 func (rh *rowHelper) encodeIndexes(
 	colIDtoRowIndex map[sqlbase.ColumnID]int, values []tree.Datum,
 ) (primaryIndexKey []byte, secondaryIndexEntries []sqlbase.IndexEntry, err error) {
-	if rh.primaryIndexKeyPrefix == nil {
-		rh.primaryIndexKeyPrefix = sqlbase.MakeIndexKeyPrefix(rh.TableDesc.TableDesc(),
-			rh.TableDesc.PrimaryIndex.ID)
+	if rh.validateColumnMapping {
+		if err := rh.checkColumnMapping(colIDtoRowIndex, values); err != nil {
+			return nil, nil, err
+		}
 	}
-	primaryIndexKey, _, err = sqlbase.EncodeIndexKey(
-		rh.TableDesc.TableDesc(), &rh.TableDesc.PrimaryIndex, colIDtoRowIndex, values, rh.primaryIndexKeyPrefix)
+	primaryIndexKey, err = rh.encodePrimaryIndexKey(colIDtoRowIndex, values)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -74,24 +123,172 @@ func (rh *rowHelper) encodeIndexes(
 	if err != nil {
 		return nil, nil, err
 	}
+	for _, validate := range rh.validators {
+		if err := validate(primaryIndexKey, secondaryIndexEntries); err != nil {
+			return nil, nil, err
+		}
+	}
 	return primaryIndexKey, secondaryIndexEntries, nil
 }
 
+// AddValidator registers a validator which encodeIndexes runs on the encoded
+// entries of every row, in the order of registration, before returning them.
+// This allows extensions to enforce additional invariants on the encoding of
+// rows. Rows are encoded without any overhead while no validator is
+// registered.
+func (rh *rowHelper) AddValidator(v IndexEntriesValidator) {
+	rh.validators = append(rh.validators, v)
+}
+
+// checkColumnMapping returns an error if the given mapping from column IDs to
+// positions in values can't be used to encode the indexes of the helper. Every
+// key column of the primary and secondary indexes must be mapped, and every
+// column used by them which is mapped must point within values. The encoding
+// functions treat unmapped columns as NULL and index values without bounds
+// checks, so such mistakes would otherwise surface as opaque errors or panics.
+func (rh *rowHelper) checkColumnMapping(
+	colIDtoRowIndex map[sqlbase.ColumnID]int, values []tree.Datum,
+) error {
+	if err := rh.checkIndexColumnMapping(&rh.TableDesc.PrimaryIndex, colIDtoRowIndex, values); err != nil {
+		return err
+	}
+	for i := range rh.Indexes {
+		if err := rh.checkIndexColumnMapping(&rh.Indexes[i], colIDtoRowIndex, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkIndexColumnMapping performs the checks of checkColumnMapping for a
+// single index.
+func (rh *rowHelper) checkIndexColumnMapping(
+	index *sqlbase.IndexDescriptor, colIDtoRowIndex map[sqlbase.ColumnID]int, values []tree.Datum,
+) error {
+	check := func(colID sqlbase.ColumnID, required bool) error {
+		idx, ok := colIDtoRowIndex[colID]
+		if !ok {
+			if !required {
+				return nil
+			}
+			return pgerror.AssertionFailedf("column %s required by index %q is missing from the row",
+				rh.columnName(colID), index.Name)
+		}
+		if idx < 0 || idx >= len(values) {
+			return pgerror.AssertionFailedf(
+				"column %s used by index %q maps to position %d, but the row has %d values",
+				rh.columnName(colID), index.Name, idx, len(values))
+		}
+		return nil
+	}
+	for _, colIDs := range [][]sqlbase.ColumnID{index.ColumnIDs, index.ExtraColumnIDs} {
+		for _, colID := range colIDs {
+			if err := check(colID, true /* required */); err != nil {
+				return err
+			}
+		}
+	}
+	for _, colIDs := range [][]sqlbase.ColumnID{index.StoreColumnIDs, index.CompositeColumnIDs} {
+		for _, colID := range colIDs {
+			if err := check(colID, false /* required */); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// columnName returns a description of the column with the given ID for use in
+// error messages.
+func (rh *rowHelper) columnName(colID sqlbase.ColumnID) string {
+	if col, err := rh.TableDesc.FindColumnByID(colID); err == nil {
+		return fmt.Sprintf("%q (%d)", col.Name, colID)
+	}
+	return fmt.Sprintf("%d", colID)
+}
+
+// encodePrimaryIndexKey encodes the primary index key, including the
+// table/index prefix.
+func (rh *rowHelper) encodePrimaryIndexKey(
+	colIDtoRowIndex map[sqlbase.ColumnID]int, values []tree.Datum,
+) ([]byte, error) {
+	if rh.primaryIndexKeyPrefix == nil {
+		rh.primaryIndexKeyPrefix = sqlbase.MakeIndexKeyPrefix(rh.TableDesc.TableDesc(),
+			rh.TableDesc.PrimaryIndex.ID)
+	}
+	primaryIndexKey, _, err := sqlbase.EncodeIndexKey(
+		rh.TableDesc.TableDesc(), &rh.TableDesc.PrimaryIndex, colIDtoRowIndex, values, rh.primaryIndexKeyPrefix)
+	return primaryIndexKey, err
+}
+
+// encodePrimaryKeySuffix encodes the primary index key without the
+// table/index prefix (primaryIndexKeyPrefix), which is the same for all rows
+// of the table. Suffixes of the same table sort like the full keys do, so they
+// can be used for prefix-free comparisons and compact in-memory indexes.
+// Prepending primaryIndexKeyPrefix to the suffix yields the full primary key.
+func (rh *rowHelper) encodePrimaryKeySuffix(
+	colIDtoRowIndex map[sqlbase.ColumnID]int, values []tree.Datum,
+) ([]byte, error) {
+	primaryIndexKey, err := rh.encodePrimaryIndexKey(colIDtoRowIndex, values)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(primaryIndexKey, rh.primaryIndexKeyPrefix) {
+		return nil, pgerror.AssertionFailedf("primary index key %x does not start with prefix %x",
+			primaryIndexKey, rh.primaryIndexKeyPrefix)
+	}
+	return primaryIndexKey[len(rh.primaryIndexKeyPrefix):], nil
+}
+
 // encodeSecondaryIndexes encodes the secondary index keys. The
 // secondaryIndexEntries are only valid until the next call to encodeIndexes or
 // encodeSecondaryIndexes.
 func (rh *rowHelper) encodeSecondaryIndexes(
 	colIDtoRowIndex map[sqlbase.ColumnID]int, values []tree.Datum,
 ) (secondaryIndexEntries []sqlbase.IndexEntry, err error) {
-	if len(rh.indexEntries) != len(rh.Indexes) {
+	if cap(rh.indexEntries) < len(rh.Indexes) {
 		rh.indexEntries = make([]sqlbase.IndexEntry, len(rh.Indexes))
 	}
-	rh.indexEntries, err = sqlbase.EncodeSecondaryIndexes(
-		rh.TableDesc.TableDesc(), rh.Indexes, colIDtoRowIndex, values, rh.indexEntries)
+	// EncodeSecondaryIndexes appends the additional entries of inverted
+	// indexes, which reuses the capacity left over from previous rows before
+	// growing the backing array.
+	secondaryIndexEntries, err = sqlbase.EncodeSecondaryIndexes(
+		rh.TableDesc.TableDesc(), rh.Indexes, colIDtoRowIndex, values, rh.indexEntries[:len(rh.Indexes)])
 	if err != nil {
 		return nil, err
 	}
-	return rh.indexEntries, nil
+	rh.indexEntries = secondaryIndexEntries
+	return secondaryIndexEntries, nil
+}
+
+// encodeSecondaryIndexesIter is like encodeSecondaryIndexes, but calls fn with
+// each secondary index entry as it is encoded instead of returning all of them
+// at once. Only the entries of one index are held in memory at a time, which
+// lowers the peak memory usage of encoding wide rows of tables with many
+// indexes. The entries of each index are passed in turn, in the order of the
+// indexes, so the entries of inverted indexes aren't passed last as
+// encodeSecondaryIndexes returns them. fn must not retain the entry past its
+// return, as its storage may be reused for the following entries, but the
+// encoded key and value aren't reused and can be added to a batch. An error
+// returned by fn stops the iteration and is returned.
+func (rh *rowHelper) encodeSecondaryIndexesIter(
+	colIDtoRowIndex map[sqlbase.ColumnID]int,
+	values []tree.Datum,
+	fn func(sqlbase.IndexEntry) error,
+) error {
+	for i := range rh.Indexes {
+		entries, err := sqlbase.EncodeSecondaryIndex(
+			rh.TableDesc.TableDesc(), &rh.Indexes[i], colIDtoRowIndex, values)
+		if err != nil {
+			return err
+		}
+		for j := range entries {
+			if err := fn(entries[j]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // skipColumnInPK returns true if the value at column colID does not need
@@ -137,3 +334,181 @@ func (rh *rowHelper) sortedColumnFamily(famID sqlbase.FamilyID) ([]sqlbase.Colum
 	colIDs, ok := rh.sortedColumnFamilies[famID]
 	return colIDs, ok
 }
+
+// familyValueSizes returns, for each column family of the table, the size in
+// bytes of the value that the write path would store for the given row. The
+// values are encoded the same way as in prepareInsertOrUpdateBatch, but the
+// encoded bytes are not retained. Families for which no value would be written
+// (i.e. non-zero families in which every column is NULL) are omitted.
+func (rh *rowHelper) familyValueSizes(
+	colIDtoRowIndex map[sqlbase.ColumnID]int, values []tree.Datum,
+) (map[sqlbase.FamilyID]int, error) {
+	sizes := make(map[sqlbase.FamilyID]int, len(rh.TableDesc.Families))
+	var rawValueBuf []byte
+	for i := range rh.TableDesc.Families {
+		family := &rh.TableDesc.Families[i]
+
+		if len(family.ColumnIDs) == 1 && family.ColumnIDs[0] == family.DefaultColumnID {
+			// Single column families store the column's value directly.
+			idx, ok := colIDtoRowIndex[family.DefaultColumnID]
+			if !ok || values[idx] == tree.DNull {
+				continue
+			}
+			col, err := rh.TableDesc.FindColumnByID(family.DefaultColumnID)
+			if err != nil {
+				return nil, err
+			}
+			value, err := sqlbase.MarshalColumnValue(col, values[idx])
+			if err != nil {
+				return nil, err
+			}
+			if value.RawBytes != nil {
+				sizes[family.ID] = len(value.RawBytes)
+			}
+			continue
+		}
+
+		rawValueBuf = rawValueBuf[:0]
+		var lastColID sqlbase.ColumnID
+		familySortedColumnIDs, ok := rh.sortedColumnFamily(family.ID)
+		if !ok {
+			return nil, pgerror.AssertionFailedf("invalid family sorted column id map")
+		}
+		for _, colID := range familySortedColumnIDs {
+			idx, ok := colIDtoRowIndex[colID]
+			if !ok || values[idx] == tree.DNull {
+				continue
+			}
+			if skip, err := rh.skipColumnInPK(colID, family.ID, values[idx]); err != nil {
+				return nil, err
+			} else if skip {
+				continue
+			}
+			colIDDiff := colID - lastColID
+			lastColID = colID
+			var err error
+			rawValueBuf, err = sqlbase.EncodeTableValue(rawValueBuf, colIDDiff, values[idx], nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if family.ID != 0 && len(rawValueBuf) == 0 {
+			continue
+		}
+		var value roachpb.Value
+		value.SetTuple(rawValueBuf)
+		sizes[family.ID] = len(value.RawBytes)
+	}
+	return sizes, nil
+}
+
+// IndexEntryDiffKind describes how the entries of an index differ between two
+// encodings of a row.
+type IndexEntryDiffKind int
+
+const (
+	// IndexEntriesAdded means that the index only exists in the new encoding.
+	IndexEntriesAdded IndexEntryDiffKind = iota
+	// IndexEntriesRemoved means that the index only exists in the old encoding.
+	IndexEntriesRemoved
+	// IndexEntriesChanged means that the index exists in both encodings, but
+	// its keys or values differ.
+	IndexEntriesChanged
+)
+
+func (k IndexEntryDiffKind) String() string {
+	switch k {
+	case IndexEntriesAdded:
+		return "added"
+	case IndexEntriesRemoved:
+		return "removed"
+	case IndexEntriesChanged:
+		return "changed"
+	}
+	return fmt.Sprintf("IndexEntryDiffKind(%d)", int(k))
+}
+
+// IndexEntryDiff describes the difference between the entries a row encodes to
+// in a single index, as encoded by two rowHelpers.
+type IndexEntryDiff struct {
+	IndexID sqlbase.IndexID
+	Kind    IndexEntryDiffKind
+	// Old and New are the entries encoded by the old and new rowHelper,
+	// respectively. The entries of the primary index only have a key, which
+	// is the key of the row without a column family suffix.
+	Old, New []sqlbase.IndexEntry
+}
+
+// DiffRowEncodings encodes the same row with two rowHelpers, typically for
+// the versions of a table descriptor before and after a schema change, and
+// returns the differences between the resulting index entries, ordered by
+// index ID. Indexes are matched up by their ID; indexes whose entries are
+// identical in both encodings are omitted.
+func DiffRowEncodings(
+	oldHelper, newHelper rowHelper, colIDtoRowIndex map[sqlbase.ColumnID]int, values []tree.Datum,
+) ([]IndexEntryDiff, error) {
+	oldEntries, err := oldHelper.encodeIndexEntriesByID(colIDtoRowIndex, values)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding row with old helper")
+	}
+	newEntries, err := newHelper.encodeIndexEntriesByID(colIDtoRowIndex, values)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding row with new helper")
+	}
+
+	var diffs []IndexEntryDiff
+	for id, oldIdxEntries := range oldEntries {
+		newIdxEntries, ok := newEntries[id]
+		if !ok {
+			diffs = append(diffs, IndexEntryDiff{IndexID: id, Kind: IndexEntriesRemoved, Old: oldIdxEntries})
+		} else if !indexEntriesEqual(oldIdxEntries, newIdxEntries) {
+			diffs = append(diffs, IndexEntryDiff{
+				IndexID: id, Kind: IndexEntriesChanged, Old: oldIdxEntries, New: newIdxEntries,
+			})
+		}
+	}
+	for id, newIdxEntries := range newEntries {
+		if _, ok := oldEntries[id]; !ok {
+			diffs = append(diffs, IndexEntryDiff{IndexID: id, Kind: IndexEntriesAdded, New: newIdxEntries})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].IndexID < diffs[j].IndexID })
+	return diffs, nil
+}
+
+// encodeIndexEntriesByID encodes the primary and secondary index entries of a
+// row, grouped by index ID. Unlike encodeSecondaryIndexes, it retains the
+// association of each entry with its index, since inverted indexes can encode
+// any number of entries.
+func (rh *rowHelper) encodeIndexEntriesByID(
+	colIDtoRowIndex map[sqlbase.ColumnID]int, values []tree.Datum,
+) (map[sqlbase.IndexID][]sqlbase.IndexEntry, error) {
+	entries := make(map[sqlbase.IndexID][]sqlbase.IndexEntry, len(rh.Indexes)+1)
+	primaryIndexKey, err := rh.encodePrimaryIndexKey(colIDtoRowIndex, values)
+	if err != nil {
+		return nil, err
+	}
+	entries[rh.TableDesc.PrimaryIndex.ID] = []sqlbase.IndexEntry{{Key: primaryIndexKey}}
+	for i := range rh.Indexes {
+		index := &rh.Indexes[i]
+		indexEntries, err := sqlbase.EncodeSecondaryIndex(
+			rh.TableDesc.TableDesc(), index, colIDtoRowIndex, values)
+		if err != nil {
+			return nil, err
+		}
+		entries[index.ID] = indexEntries
+	}
+	return entries, nil
+}
+
+func indexEntriesEqual(a, b []sqlbase.IndexEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Key.Equal(b[i].Key) || !a[i].Value.EqualData(b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
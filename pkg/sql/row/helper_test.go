@@ -0,0 +1,653 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package row
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/pkg/errors"
+)
+
+// TestRowHelperFamilyValueSizes verifies that familyValueSizes agrees with the
+// sizes of the values actually written for each column family of a row.
+func TestRowHelperFamilyValueSizes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	r := sqlutils.MakeSQLRunner(sqlDB)
+	r.Exec(t, `CREATE DATABASE t`)
+	r.Exec(t, `CREATE TABLE t.fam (
+	a INT PRIMARY KEY,
+	b INT,
+	c STRING,
+	d STRING,
+	e INT,
+	f INT,
+	FAMILY f0 (a, b),
+	FAMILY f1 (c),
+	FAMILY f2 (d, e),
+	FAMILY f3 (f)
+)`)
+	r.Exec(t, `INSERT INTO t.fam VALUES (1, 2, 'hello', 'a somewhat longer string', 3, NULL)`)
+
+	desc := sqlbase.GetImmutableTableDescriptor(kvDB, "t", "fam")
+	values := []tree.Datum{
+		tree.NewDInt(1),
+		tree.NewDInt(2),
+		tree.NewDString("hello"),
+		tree.NewDString("a somewhat longer string"),
+		tree.NewDInt(3),
+		tree.DNull,
+	}
+
+	rh, err := newRowHelper(desc, nil /* indexes */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	colIDtoRowIndex := desc.ColumnIdxMap()
+	sizes, err := rh.familyValueSizes(colIDtoRowIndex, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primaryIndexKey, _, err := rh.encodeIndexes(colIDtoRowIndex, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, family := range desc.Families {
+		key := keys.MakeFamilyKey(append([]byte(nil), primaryIndexKey...), uint32(family.ID))
+		kv, err := kvDB.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, ok := sizes[family.ID]
+		if kv.Value == nil {
+			if ok {
+				t.Errorf("family %d: no value written, but reported size %d", family.ID, size)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("family %d: value of size %d written, but no size reported",
+				family.ID, len(kv.Value.RawBytes))
+		} else if e := len(kv.Value.RawBytes); size != e {
+			t.Errorf("family %d: expected size %d, got %d", family.ID, e, size)
+		}
+	}
+	if _, ok := sizes[3]; ok {
+		t.Errorf("expected NULL family to be omitted, got %v", sizes)
+	}
+}
+
+// TestRowHelperEncodePrimaryKeySuffix verifies that the primary key suffix
+// combined with the table/index prefix yields the full primary key, including
+// for interleaved tables.
+func TestRowHelperEncodePrimaryKeySuffix(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	r := sqlutils.MakeSQLRunner(sqlDB)
+	r.Exec(t, `CREATE DATABASE t`)
+	r.Exec(t, `CREATE TABLE t.parent (a INT, b STRING, PRIMARY KEY (a, b DESC))`)
+	r.Exec(t, `CREATE TABLE t.child (a INT, b STRING, c INT, PRIMARY KEY (a, b DESC, c))
+	INTERLEAVE IN PARENT t.parent (a, b)`)
+
+	for _, tc := range []struct {
+		table string
+		rows  [][]tree.Datum
+	}{
+		{"parent", [][]tree.Datum{
+			{tree.NewDInt(1), tree.NewDString("x")},
+			{tree.NewDInt(1), tree.NewDString("a")},
+			{tree.NewDInt(2), tree.NewDString("")},
+		}},
+		{"child", [][]tree.Datum{
+			{tree.NewDInt(1), tree.NewDString("x"), tree.NewDInt(3)},
+			{tree.NewDInt(1), tree.NewDString("x"), tree.NewDInt(7)},
+			{tree.NewDInt(2), tree.NewDString("a"), tree.NewDInt(1)},
+		}},
+	} {
+		t.Run(tc.table, func(t *testing.T) {
+			desc := sqlbase.GetImmutableTableDescriptor(kvDB, "t", tc.table)
+			rh, err := newRowHelper(desc, nil /* indexes */)
+			if err != nil {
+				t.Fatal(err)
+			}
+			colIDtoRowIndex := desc.ColumnIdxMap()
+
+			var prevSuffix, prevKey []byte
+			for i, values := range tc.rows {
+				suffix, err := rh.encodePrimaryKeySuffix(colIDtoRowIndex, values)
+				if err != nil {
+					t.Fatal(err)
+				}
+				primaryIndexKey, _, err := rh.encodeIndexes(colIDtoRowIndex, values)
+				if err != nil {
+					t.Fatal(err)
+				}
+				fullKey := append(append([]byte(nil), rh.primaryIndexKeyPrefix...), suffix...)
+				if !bytes.Equal(fullKey, primaryIndexKey) {
+					t.Fatalf("row %d: prefix %x and suffix %x don't make up primary key %x",
+						i, rh.primaryIndexKeyPrefix, suffix, primaryIndexKey)
+				}
+				// Suffixes sort like the full keys.
+				if i > 0 {
+					if a, e := bytes.Compare(prevSuffix, suffix), bytes.Compare(prevKey, primaryIndexKey); a != e {
+						t.Errorf("row %d: suffixes compare as %d, but keys compare as %d", i, a, e)
+					}
+				}
+				prevSuffix, prevKey = suffix, primaryIndexKey
+			}
+		})
+	}
+}
+
+// TestRowHelperPrimaryKeyFamilyCheck verifies that newRowHelper rejects a
+// descriptor which assigns a primary index column to a non-zero family.
+func TestRowHelperPrimaryKeyFamilyCheck(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	r := sqlutils.MakeSQLRunner(sqlDB)
+	r.Exec(t, `CREATE DATABASE t`)
+	r.Exec(t, `CREATE TABLE t.fam (a INT PRIMARY KEY, b INT, c INT, FAMILY f0 (a, b), FAMILY f1 (c))`)
+
+	desc := sqlbase.GetTableDescriptor(kvDB, "t", "fam")
+	if _, err := newRowHelper(sqlbase.NewImmutableTableDescriptor(*desc), nil /* indexes */); err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the primary key column a to family f1.
+	pkColID := desc.PrimaryIndex.ColumnIDs[0]
+	var f0ColIDs []sqlbase.ColumnID
+	var f0ColNames []string
+	for i, colID := range desc.Families[0].ColumnIDs {
+		if colID != pkColID {
+			f0ColIDs = append(f0ColIDs, colID)
+			f0ColNames = append(f0ColNames, desc.Families[0].ColumnNames[i])
+		}
+	}
+	desc.Families[0].ColumnIDs, desc.Families[0].ColumnNames = f0ColIDs, f0ColNames
+	desc.Families[1].ColumnIDs = append(desc.Families[1].ColumnIDs, pkColID)
+	desc.Families[1].ColumnNames = append(desc.Families[1].ColumnNames, "a")
+
+	_, err := newRowHelper(sqlbase.NewImmutableTableDescriptor(*desc), nil /* indexes */)
+	if !testutils.IsError(err, "primary index column 1 must be in family 0, was 1") {
+		t.Fatalf("expected primary key family error, got %v", err)
+	}
+}
+
+// TestDiffRowEncodings verifies that DiffRowEncodings reports exactly the
+// entries of an index added by a schema change.
+func TestDiffRowEncodings(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	r := sqlutils.MakeSQLRunner(sqlDB)
+	r.Exec(t, `CREATE DATABASE t`)
+	r.Exec(t, `CREATE TABLE t.tbl (a INT PRIMARY KEY, b INT, c STRING, INDEX b_idx (b))`)
+	oldDesc := sqlbase.GetImmutableTableDescriptor(kvDB, "t", "tbl")
+	r.Exec(t, `CREATE INDEX c_idx ON t.tbl (c)`)
+	newDesc := sqlbase.GetImmutableTableDescriptor(kvDB, "t", "tbl")
+
+	oldHelper, err := newRowHelper(oldDesc, oldDesc.Indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newHelper, err := newRowHelper(newDesc, newDesc.Indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []tree.Datum{tree.NewDInt(1), tree.NewDInt(2), tree.NewDString("x")}
+	colIDtoRowIndex := newDesc.ColumnIdxMap()
+
+	// A helper doesn't differ from itself.
+	diffs, err := DiffRowEncodings(oldHelper, oldHelper, colIDtoRowIndex, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Fatalf("expected no differences, got %+v", diffs)
+	}
+
+	newIdx, _, err := newDesc.FindIndexByName("c_idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err = DiffRowEncodings(oldHelper, newHelper, colIDtoRowIndex, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 {
+		t.Fatalf("expected a single difference, got %+v", diffs)
+	}
+	if d := diffs[0]; d.IndexID != newIdx.ID || d.Kind != IndexEntriesAdded || len(d.Old) != 0 || len(d.New) != 1 {
+		t.Fatalf("expected index %d to be added with one entry, got %+v", newIdx.ID, d)
+	}
+
+	// Swapping the helpers reports the index as removed.
+	diffs, err = DiffRowEncodings(newHelper, oldHelper, colIDtoRowIndex, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || diffs[0].IndexID != newIdx.ID || diffs[0].Kind != IndexEntriesRemoved {
+		t.Fatalf("expected index %d to be removed, got %+v", newIdx.ID, diffs)
+	}
+}
+
+// TestRowHelperEncodeSecondaryIndexesScratch verifies that the entries
+// returned by encodeSecondaryIndexes have the length of the actual number of
+// entries of each row, even though the number of entries of an inverted index
+// varies per row, and that the scratch space is reused across rows.
+func TestRowHelperEncodeSecondaryIndexesScratch(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	r := sqlutils.MakeSQLRunner(sqlDB)
+	r.Exec(t, `CREATE DATABASE t`)
+	r.Exec(t, `CREATE TABLE t.inv (a INT PRIMARY KEY, b INT, j JSONB, INDEX (b), INVERTED INDEX (j))`)
+
+	desc := sqlbase.GetImmutableTableDescriptor(kvDB, "t", "inv")
+	rh, err := newRowHelper(desc, desc.Indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	colIDtoRowIndex := desc.ColumnIdxMap()
+
+	var prev *sqlbase.IndexEntry
+	for i, tc := range []struct {
+		json     string
+		expected int
+	}{
+		{`{"a": 1}`, 2},
+		{`{"a": 1, "b": 2, "c": 3}`, 4},
+		{`{"a": 1, "b": 2}`, 3},
+		{`{"a": 1}`, 2},
+	} {
+		j, err := tree.ParseDJSON(tc.json)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := []tree.Datum{tree.NewDInt(tree.DInt(i)), tree.NewDInt(1), j}
+
+		entries, err := rh.encodeSecondaryIndexes(colIDtoRowIndex, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != tc.expected {
+			t.Fatalf("%s: expected %d entries, got %d", tc.json, tc.expected, len(entries))
+		}
+		var expected []sqlbase.IndexEntry
+		for k := range desc.Indexes {
+			idxEntries, err := sqlbase.EncodeSecondaryIndex(desc.TableDesc(), &desc.Indexes[k], colIDtoRowIndex, values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected = append(expected, idxEntries...)
+		}
+		// EncodeSecondaryIndexes places the first entry of each index first,
+		// so compare the keys irrespective of their order.
+		keys := make(map[string]struct{}, len(entries))
+		for _, e := range entries {
+			keys[string(e.Key)] = struct{}{}
+		}
+		for _, e := range expected {
+			if _, ok := keys[string(e.Key)]; !ok {
+				t.Fatalf("%s: missing entry with key %s", tc.json, e.Key)
+			}
+		}
+		// Once the scratch space has grown to fit the largest row, it is
+		// reused for smaller rows.
+		if i == 3 && &entries[0] != prev {
+			t.Fatalf("%s: expected scratch space to be reused", tc.json)
+		}
+		prev = &entries[0]
+	}
+}
+
+// TestRowHelperCheckColumnMapping verifies that encodeIndexes reports a
+// column mapping which doesn't fit the row when validation is enabled.
+func TestRowHelperCheckColumnMapping(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	r := sqlutils.MakeSQLRunner(sqlDB)
+	r.Exec(t, `CREATE DATABASE t`)
+	r.Exec(t, `CREATE TABLE t.kv (a INT PRIMARY KEY, b INT, c INT, INDEX idx_b (b) STORING (c))`)
+
+	desc := sqlbase.GetImmutableTableDescriptor(kvDB, "t", "kv")
+	rh, err := newRowHelper(desc, desc.Indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []tree.Datum{tree.NewDInt(1), tree.NewDInt(2), tree.NewDInt(3)}
+
+	for _, tc := range []struct {
+		name     string
+		mutate   func(map[sqlbase.ColumnID]int)
+		expected string
+	}{
+		{"valid", func(map[sqlbase.ColumnID]int) {}, ""},
+		{
+			"missing primary key column",
+			func(m map[sqlbase.ColumnID]int) { delete(m, 1) },
+			`column "a" \(1\) required by index "primary" is missing from the row`,
+		},
+		{
+			"missing secondary key column",
+			func(m map[sqlbase.ColumnID]int) { delete(m, 2) },
+			`column "b" \(2\) required by index "idx_b" is missing from the row`,
+		},
+		{
+			// Stored columns may be omitted, in which case they are NULL.
+			"missing stored column",
+			func(m map[sqlbase.ColumnID]int) { delete(m, 3) },
+			"",
+		},
+		{
+			"out of range",
+			func(m map[sqlbase.ColumnID]int) { m[3] = 5 },
+			`column "c" \(3\) used by index "idx_b" maps to position 5, but the row has 3 values`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			colIDtoRowIndex := desc.ColumnIdxMap()
+			tc.mutate(colIDtoRowIndex)
+
+			rh.validateColumnMapping = true
+			_, _, err := rh.encodeIndexes(colIDtoRowIndex, values)
+			if tc.expected == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if !testutils.IsError(err, tc.expected) {
+				t.Fatalf("expected error %q, got %v", tc.expected, err)
+			}
+		})
+	}
+
+	// Without validation, a missing key column is encoded as NULL.
+	rh.validateColumnMapping = false
+	colIDtoRowIndex := desc.ColumnIdxMap()
+	delete(colIDtoRowIndex, 2)
+	if _, _, err := rh.encodeIndexes(colIDtoRowIndex, values); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRowHelperValidators verifies that the validators registered with a
+// rowHelper can reject the encoded entries of a row.
+func TestRowHelperValidators(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	r := sqlutils.MakeSQLRunner(sqlDB)
+	r.Exec(t, `CREATE DATABASE t`)
+	r.Exec(t, `CREATE TABLE t.kv (k STRING PRIMARY KEY, v INT, INDEX idx_v (v))`)
+
+	desc := sqlbase.GetImmutableTableDescriptor(kvDB, "t", "kv")
+	rh, err := newRowHelper(desc, desc.Indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const maxKeyLen = 20
+	var calls int
+	rh.AddValidator(func(primaryIndexKey []byte, secondaryIndexEntries []sqlbase.IndexEntry) error {
+		calls++
+		if len(secondaryIndexEntries) != 1 {
+			return errors.Errorf("expected 1 secondary index entry, got %d", len(secondaryIndexEntries))
+		}
+		if len(primaryIndexKey) > maxKeyLen {
+			return errors.Errorf("primary key of %d bytes exceeds %d bytes", len(primaryIndexKey), maxKeyLen)
+		}
+		return nil
+	})
+
+	colIDtoRowIndex := desc.ColumnIdxMap()
+	for _, tc := range []struct {
+		key      string
+		expected string
+	}{
+		{"short", ""},
+		{strings.Repeat("k", maxKeyLen), `primary key of \d+ bytes exceeds 20 bytes`},
+		{"", ""},
+	} {
+		values := []tree.Datum{tree.NewDString(tc.key), tree.NewDInt(1)}
+		_, _, err := rh.encodeIndexes(colIDtoRowIndex, values)
+		if tc.expected == "" {
+			if err != nil {
+				t.Fatalf("%q: %v", tc.key, err)
+			}
+		} else if !testutils.IsError(err, tc.expected) {
+			t.Fatalf("%q: expected error %q, got %v", tc.key, tc.expected, err)
+		}
+	}
+	if calls != 3 {
+		t.Fatalf("expected the validator to be called 3 times, got %d", calls)
+	}
+}
+
+// TestRowHelperEncodeSecondaryIndexesIter verifies that
+// encodeSecondaryIndexesIter yields the same entries as
+// encodeSecondaryIndexes, and stops at the first error returned by the
+// callback.
+func TestRowHelperEncodeSecondaryIndexesIter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	s, sqlDB, kvDB := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	r := sqlutils.MakeSQLRunner(sqlDB)
+	r.Exec(t, `CREATE DATABASE t`)
+	r.Exec(t, `CREATE TABLE t.inv (
+	a INT PRIMARY KEY,
+	b INT,
+	c STRING,
+	j JSONB,
+	INDEX (b),
+	UNIQUE INDEX (c) STORING (b),
+	INVERTED INDEX (j)
+)`)
+
+	desc := sqlbase.GetImmutableTableDescriptor(kvDB, "t", "inv")
+	rh, err := newRowHelper(desc, desc.Indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	colIDtoRowIndex := desc.ColumnIdxMap()
+
+	for i, json := range []string{`{"a": 1}`, `{"a": 1, "b": [2, 3], "c": "d"}`, `{}`} {
+		j, err := tree.ParseDJSON(json)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := []tree.Datum{tree.NewDInt(tree.DInt(i)), tree.NewDInt(1), tree.NewDString(json), j}
+
+		// The entries returned by encodeSecondaryIndexes are only valid until
+		// the next call, so render them before iterating.
+		entries, err := rh.encodeSecondaryIndexes(colIDtoRowIndex, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := make(map[string]string, len(entries))
+		for _, e := range entries {
+			expected[string(e.Key)] = string(e.Value.RawBytes)
+		}
+
+		var n int
+		if err := rh.encodeSecondaryIndexesIter(colIDtoRowIndex, values, func(e sqlbase.IndexEntry) error {
+			n++
+			if v, ok := expected[string(e.Key)]; !ok {
+				return errors.Errorf("unexpected entry with key %s", e.Key)
+			} else if v != string(e.Value.RawBytes) {
+				return errors.Errorf("entry with key %s: expected value %x, got %x", e.Key, v, e.Value.RawBytes)
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %v", json, err)
+		}
+		if n != len(entries) {
+			t.Fatalf("%s: expected %d entries, got %d", json, len(entries), n)
+		}
+
+		n = 0
+		stop := errors.New("stop")
+		if err := rh.encodeSecondaryIndexesIter(colIDtoRowIndex, values, func(sqlbase.IndexEntry) error {
+			n++
+			return stop
+		}); err != stop {
+			t.Fatalf("%s: expected %v, got %v", json, stop, err)
+		}
+		if n != 1 {
+			t.Fatalf("%s: expected the iteration to stop after 1 entry, got %d", json, n)
+		}
+	}
+}
+
+// BenchmarkRowHelperEncodeSecondaryIndexes measures the encoding of the
+// secondary index entries of rows of a table with an inverted index, whose
+// number of entries varies per row.
+func BenchmarkRowHelperEncodeSecondaryIndexes(b *testing.B) {
+	ctx := context.Background()
+
+	s, sqlDB, kvDB := serverutils.StartServer(b, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	r := sqlutils.MakeSQLRunner(sqlDB)
+	r.Exec(b, `CREATE DATABASE t`)
+	r.Exec(b, `CREATE TABLE t.inv (a INT PRIMARY KEY, b INT, j JSONB, INDEX (b), INVERTED INDEX (j))`)
+
+	desc := sqlbase.GetImmutableTableDescriptor(kvDB, "t", "inv")
+	rh, err := newRowHelper(desc, desc.Indexes)
+	if err != nil {
+		b.Fatal(err)
+	}
+	colIDtoRowIndex := desc.ColumnIdxMap()
+
+	var rows [][]tree.Datum
+	for i, json := range []string{
+		`{"a": 1}`,
+		`{"a": 1, "b": 2, "c": 3, "d": 4}`,
+		`{"a": 1, "b": 2}`,
+		`{"a": [1, 2, 3]}`,
+	} {
+		j, err := tree.ParseDJSON(json)
+		if err != nil {
+			b.Fatal(err)
+		}
+		rows = append(rows, []tree.Datum{tree.NewDInt(tree.DInt(i)), tree.NewDInt(1), j})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := rh.encodeSecondaryIndexes(colIDtoRowIndex, rows[i%len(rows)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRowHelperEncodeSecondaryIndexesIter compares the encoding of the
+// secondary index entries of wide rows of a table with many indexes by
+// encodeSecondaryIndexes and encodeSecondaryIndexesIter. The entries are
+// copied into a batch as a writer would.
+func BenchmarkRowHelperEncodeSecondaryIndexesIter(b *testing.B) {
+	ctx := context.Background()
+
+	s, sqlDB, kvDB := serverutils.StartServer(b, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	const numIndexes = 32
+	var cols, indexes []string
+	for i := 0; i < numIndexes; i++ {
+		cols = append(cols, fmt.Sprintf("c%d STRING", i))
+		indexes = append(indexes, fmt.Sprintf("INDEX (c%d)", i))
+	}
+	r := sqlutils.MakeSQLRunner(sqlDB)
+	r.Exec(b, `CREATE DATABASE t`)
+	r.Exec(b, fmt.Sprintf(`CREATE TABLE t.wide (a INT PRIMARY KEY, %s, %s)`,
+		strings.Join(cols, ", "), strings.Join(indexes, ", ")))
+
+	desc := sqlbase.GetImmutableTableDescriptor(kvDB, "t", "wide")
+	rh, err := newRowHelper(desc, desc.Indexes)
+	if err != nil {
+		b.Fatal(err)
+	}
+	colIDtoRowIndex := desc.ColumnIdxMap()
+
+	values := []tree.Datum{tree.NewDInt(1)}
+	for i := 0; i < numIndexes; i++ {
+		values = append(values, tree.NewDString(strings.Repeat("x", 1024)))
+	}
+
+	b.Run("Slice", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			entries, err := rh.encodeSecondaryIndexes(colIDtoRowIndex, values)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var batch client.Batch
+			for _, e := range entries {
+				batch.CPut(&e.Key, &e.Value, nil)
+			}
+		}
+	})
+	b.Run("Iter", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var batch client.Batch
+			if err := rh.encodeSecondaryIndexesIter(colIDtoRowIndex, values, func(e sqlbase.IndexEntry) error {
+				batch.CPut(&e.Key, &e.Value, nil)
+				return nil
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
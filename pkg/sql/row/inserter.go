@@ -49,8 +49,12 @@ func MakeInserter(
 	checkFKs checkFKConstraints,
 	alloc *sqlbase.DatumAlloc,
 ) (Inserter, error) {
+	rh, err := newRowHelper(tableDesc, tableDesc.WritableIndexes())
+	if err != nil {
+		return Inserter{}, err
+	}
 	ri := Inserter{
-		Helper:                newRowHelper(tableDesc, tableDesc.WritableIndexes()),
+		Helper:                rh,
 		InsertCols:            insertCols,
 		InsertColIDtoRowIndex: ColIDtoRowIndexFromCols(insertCols),
 		marshaled:             make([]roachpb.Value, len(insertCols)),
@@ -63,7 +67,6 @@ func MakeInserter(
 	}
 
 	if checkFKs == CheckFKs {
-		var err error
 		if ri.Fks, err = makeFkExistenceCheckHelperForInsert(txn, tableDesc, fkTables,
 			ri.InsertColIDtoRowIndex, alloc); err != nil {
 			return ri, err
@@ -172,12 +172,19 @@ func makeUpdaterWithoutCascader(
 
 	var deleteOnlyHelper *rowHelper
 	if len(deleteOnlyIndexes) > 0 {
-		rh := newRowHelper(tableDesc, deleteOnlyIndexes)
+		rh, err := newRowHelper(tableDesc, deleteOnlyIndexes)
+		if err != nil {
+			return Updater{}, err
+		}
 		deleteOnlyHelper = &rh
 	}
 
+	rh, err := newRowHelper(tableDesc, includeIndexes)
+	if err != nil {
+		return Updater{}, err
+	}
 	ru := Updater{
-		Helper:                newRowHelper(tableDesc, includeIndexes),
+		Helper:                rh,
 		DeleteHelper:          deleteOnlyHelper,
 		UpdateCols:            updateCols,
 		UpdateColIDtoRowIndex: updateColIDtoRowIndex,
@@ -190,7 +197,6 @@ func makeUpdaterWithoutCascader(
 		// These fields are only used when the primary key is changing.
 		// When changing the primary key, we delete the old values and reinsert
 		// them, so request them all.
-		var err error
 		if ru.rd, err = makeRowDeleterWithoutCascader(
 			txn, tableDesc, fkTables, tableCols, SkipFKs, alloc,
 		); err != nil {
@@ -263,7 +269,6 @@ func makeUpdaterWithoutCascader(
 		}
 	}
 
-	var err error
 	if ru.Fks, err = makeFkExistenceCheckHelperForUpdate(txn, tableDesc, fkTables,
 		ru.FetchColIDtoRowIndex, alloc); err != nil {
 		return Updater{}, err
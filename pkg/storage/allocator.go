@@ -189,6 +189,11 @@ var _ purgatoryError = &allocatorError{}
 type allocatorRand struct {
 	*syncutil.Mutex
 	*rand.Rand
+	// deterministic, if set, makes the allocator break ties between equally
+	// good candidates in favor of the lowest store ID, instead of choosing
+	// randomly. It is only set in tests, see
+	// StoreTestingKnobs.DeterministicAllocator.
+	deterministic bool
 }
 
 func makeAllocatorRand(source rand.Source) allocatorRand {
@@ -249,6 +254,15 @@ func MakeAllocator(
 	}
 }
 
+// applyTestingKnobs configures the allocator according to the supplied
+// testing knobs.
+func (a *Allocator) applyTestingKnobs(knobs *StoreTestingKnobs) {
+	if knobs.DeterministicAllocator {
+		a.randGen = makeAllocatorRand(rand.NewSource(777))
+		a.randGen.deterministic = true
+	}
+}
+
 // GetNeededReplicas calculates the number of replicas a range should
 // have given its zone config and the number of nodes available for
 // up-replication (i.e. not dead and not decommissioning).
@@ -820,6 +834,15 @@ func (a *Allocator) TransferLeaseTarget(
 		}
 		return roachpb.ReplicaDescriptor{}
 	}
+	if a.randGen.deterministic {
+		best := candidates[0]
+		for _, repl := range candidates[1:] {
+			if repl.StoreID < best.StoreID {
+				best = repl
+			}
+		}
+		return best
+	}
 	a.randGen.Lock()
 	defer a.randGen.Unlock()
 	return candidates[a.randGen.Intn(len(candidates))]
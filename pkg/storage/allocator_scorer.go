@@ -332,6 +332,9 @@ func (cl candidateList) selectGood(randGen allocatorRand) *candidate {
 	if len(cl) == 1 {
 		return &cl[0]
 	}
+	if randGen.deterministic {
+		return cl.selectDeterministic(func(c, other candidate) bool { return other.less(c) })
+	}
 	randGen.Lock()
 	order := randGen.Perm(len(cl))
 	randGen.Unlock()
@@ -354,6 +357,9 @@ func (cl candidateList) selectBad(randGen allocatorRand) *candidate {
 	if len(cl) == 1 {
 		return &cl[0]
 	}
+	if randGen.deterministic {
+		return cl.selectDeterministic(func(c, other candidate) bool { return c.less(other) })
+	}
 	randGen.Lock()
 	order := randGen.Perm(len(cl))
 	randGen.Unlock()
@@ -366,6 +372,21 @@ func (cl candidateList) selectBad(randGen allocatorRand) *candidate {
 	return worst
 }
 
+// selectDeterministic chooses the candidate which is preferred over all others
+// according to the supplied function, breaking ties in favor of the lowest
+// store ID. It replaces the random choice of selectGood and selectBad when the
+// allocator is deterministic.
+func (cl candidateList) selectDeterministic(preferred func(c, other candidate) bool) *candidate {
+	choice := &cl[0]
+	for i := 1; i < len(cl); i++ {
+		c := &cl[i]
+		if preferred(*c, *choice) || (!preferred(*choice, *c) && c.store.StoreID < choice.store.StoreID) {
+			choice = c
+		}
+	}
+	return choice
+}
+
 // removeCandidate remove the specified candidate from candidateList.
 func (cl candidateList) removeCandidate(c candidate) candidateList {
 	for i := 0; i < len(cl); i++ {
@@ -430,6 +430,54 @@ func TestAllocatorNoAvailableDisks(t *testing.T) {
 	}
 }
 
+// TestAllocatorDeterministic verifies that the allocator makes reproducible
+// decisions when the DeterministicAllocator testing knob is set, breaking ties
+// between equally good stores in favor of the lowest store ID.
+func TestAllocatorDeterministic(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper, g, _, a, _ := createTestAllocator(5, false /* deterministic */)
+	defer stopper.Stop(context.Background())
+	a.applyTestingKnobs(&StoreTestingKnobs{DeterministicAllocator: true})
+	gossiputil.NewStoreGossiper(g).GossipStores(sameDCStores, t)
+	ctx := context.Background()
+	zone := config.ZoneConfig{NumReplicas: proto.Int32(3)}
+
+	// All stores are equally good targets.
+	for _, tc := range []struct {
+		existing []roachpb.ReplicaDescriptor
+		expected roachpb.StoreID
+	}{
+		{replicas(), 1},
+		{replicas(1), 2},
+		{replicas(1, 2), 3},
+		{replicas(2, 4), 1},
+	} {
+		for i := 0; i < 10; i++ {
+			result, _, err := a.AllocateTarget(ctx, &zone, tc.existing, testRangeInfo(tc.existing, firstRange))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.StoreID != tc.expected {
+				t.Fatalf("%d: expected existing replicas %v to be joined by s%d, got s%d",
+					i, tc.existing, tc.expected, result.StoreID)
+			}
+		}
+	}
+
+	// All replicas are equally good candidates for removal.
+	existing := replicas(2, 3, 4, 5)
+	for i := 0; i < 10; i++ {
+		result, _, err := a.RemoveTarget(ctx, &zone, existing, testRangeInfo(existing, firstRange))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.StoreID != 2 {
+			t.Fatalf("%d: expected s2 to be removed, got s%d", i, result.StoreID)
+		}
+	}
+}
+
 func TestAllocatorTwoDatacenters(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
@@ -16,8 +16,10 @@ import (
 	"context"
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/storage/batcheval/result"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/storagepb"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 )
 
@@ -25,6 +27,22 @@ func init() {
 	RegisterCommand(roachpb.DeleteRange, DefaultDeclareKeys, DeleteRange)
 }
 
+// InlineDeleteCompactionHintEnabled controls whether DeleteRange commands
+// which delete inline values suggest a compaction of the deleted span to the
+// stores of all replicas. Inline values, such as time series data, are not
+// versioned, so deleting them leaves no MVCC tombstones for GC to collect:
+// they are removed at once, and only the deletion tombstones of the storage
+// engine remain until it compacts the span. After a large deletion, such as
+// the pruning of time series, these tombstones slow down scans of the span,
+// which the suggested compaction avoids. Since the values aren't versioned,
+// this doesn't affect reads at historical timestamps.
+var InlineDeleteCompactionHintEnabled = settings.RegisterBoolSetting(
+	"kv.delete_range.inline_compaction_hint.enabled",
+	"if set, range deletions of inline values, such as time series pruning, "+
+		"suggest a compaction of the deleted span",
+	false,
+)
+
 // DeleteRange deletes the range of key/value pairs specified by
 // start and end keys.
 func DeleteRange(
@@ -38,6 +56,7 @@ func DeleteRange(
 	if !args.Inline {
 		timestamp = h.Timestamp
 	}
+	bytesBefore := cArgs.Stats.Total()
 	deleted, resumeSpan, num, err := engine.MVCCDeleteRange(
 		ctx, batch, cArgs.Stats, args.Key, args.EndKey, cArgs.MaxKeys, timestamp, h.Txn, args.ReturnKeys,
 	)
@@ -49,5 +68,23 @@ func DeleteRange(
 		reply.ResumeSpan = resumeSpan
 		reply.ResumeReason = roachpb.RESUME_KEY_LIMIT
 	}
-	return result.Result{}, err
+	var pd result.Result
+	if err == nil && args.Inline && num > 0 &&
+		InlineDeleteCompactionHintEnabled.Get(&cArgs.EvalCtx.ClusterSettings().SV) {
+		span := roachpb.Span{Key: args.Key, EndKey: args.EndKey}
+		if resumeSpan != nil {
+			span.EndKey = resumeSpan.Key
+		}
+		pd.Replicated.SuggestedCompactions = []storagepb.SuggestedCompaction{
+			{
+				StartKey: span.Key,
+				EndKey:   span.EndKey,
+				Compaction: storagepb.Compaction{
+					Bytes:            bytesBefore - cArgs.Stats.Total(),
+					SuggestedAtNanos: h.Timestamp.WallTime,
+				},
+			},
+		}
+	}
+	return pd, err
 }
@@ -110,6 +110,14 @@ func (s *Store) SplitQueuePurgatoryLength() int {
 	return s.splitQueue.PurgatoryLength()
 }
 
+// MakeReplicaTimeSeriesMaintenanceCheckpointer returns the checkpointer used by
+// the time series maintenance queue for the given range.
+func MakeReplicaTimeSeriesMaintenanceCheckpointer(
+	eng engine.Engine, rangeID roachpb.RangeID,
+) TimeSeriesMaintenanceCheckpointer {
+	return replicaTimeSeriesMaintenanceCheckpointer{eng: eng, rangeID: rangeID}
+}
+
 // SetRaftLogQueueActive enables or disables the raft log queue.
 func (s *Store) SetRaftLogQueueActive(active bool) {
 	s.setRaftLogQueueActive(active)
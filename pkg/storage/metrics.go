@@ -941,6 +941,42 @@ var (
 		Measurement: "Ingestions",
 		Unit:        metric.Unit_COUNT,
 	}
+	metaAddSSTableSideloadCacheHits = metric.Metadata{
+		Name:        "addsstable.sideload_cache.hits",
+		Help:        "Number of reads of sideloaded SSTables served from the in-memory cache",
+		Measurement: "Reads",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaAddSSTableSideloadCacheMisses = metric.Metadata{
+		Name:        "addsstable.sideload_cache.misses",
+		Help:        "Number of reads of sideloaded SSTables not found in the in-memory cache",
+		Measurement: "Reads",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaSideloadBytesWritten = metric.Metadata{
+		Name:        "addsstable.sideload.bytes_written",
+		Help:        "Number of bytes of payloads written to sideloaded storage",
+		Measurement: "Storage",
+		Unit:        metric.Unit_BYTES,
+	}
+	metaSideloadBytesTruncated = metric.Metadata{
+		Name:        "addsstable.sideload.bytes_truncated",
+		Help:        "Number of bytes of payloads removed from sideloaded storage by log truncations",
+		Measurement: "Storage",
+		Unit:        metric.Unit_BYTES,
+	}
+	metaSideloadBytesResident = metric.Metadata{
+		Name:        "addsstable.sideload.bytes_resident",
+		Help:        "Number of bytes of payloads held in sideloaded storage",
+		Measurement: "Storage",
+		Unit:        metric.Unit_BYTES,
+	}
+	metaSideloadExternalErrors = metric.Metadata{
+		Name:        "addsstable.sideload.external_errors",
+		Help:        "Number of operations on the external object store of sideloaded payloads which failed or timed out",
+		Measurement: "Operations",
+		Unit:        metric.Unit_COUNT,
+	}
 
 	// Encryption-at-rest metrics.
 	// TODO(mberhault): metrics for key age, per-key file/bytes counts.
@@ -1155,6 +1191,17 @@ type StoreMetrics struct {
 	AddSSTableProposals         *metric.Counter
 	AddSSTableApplications      *metric.Counter
 	AddSSTableApplicationCopies *metric.Counter
+	// How many reads of sideloaded SSTables were served by the sideloadCache?
+	AddSSTableSideloadCacheHits   *metric.Counter
+	AddSSTableSideloadCacheMisses *metric.Counter
+	// How many bytes of payloads were written to and truncated from sideloaded
+	// storage, and how many does it hold?
+	SideloadBytesWritten   *metric.Counter
+	SideloadBytesTruncated *metric.Counter
+	SideloadBytesResident  *metric.Gauge
+	// How many operations on the external object store of sideloaded storage
+	// failed?
+	SideloadExternalErrors *metric.Counter
 
 	// Encryption-at-rest stats.
 	// EncryptionAlgorithm is an enum representing the cipher in use, so we use a gauge.
@@ -1358,9 +1405,15 @@ func newStoreMetrics(histogramWindow time.Duration) *StoreMetrics {
 		BackpressuredOnSplitRequests: metric.NewGauge(metaBackpressuredOnSplitRequests),
 
 		// AddSSTable proposal + applications counters.
-		AddSSTableProposals:         metric.NewCounter(metaAddSSTableProposals),
-		AddSSTableApplications:      metric.NewCounter(metaAddSSTableApplications),
-		AddSSTableApplicationCopies: metric.NewCounter(metaAddSSTableApplicationCopies),
+		AddSSTableProposals:           metric.NewCounter(metaAddSSTableProposals),
+		AddSSTableApplications:        metric.NewCounter(metaAddSSTableApplications),
+		AddSSTableApplicationCopies:   metric.NewCounter(metaAddSSTableApplicationCopies),
+		AddSSTableSideloadCacheHits:   metric.NewCounter(metaAddSSTableSideloadCacheHits),
+		AddSSTableSideloadCacheMisses: metric.NewCounter(metaAddSSTableSideloadCacheMisses),
+		SideloadBytesWritten:          metric.NewCounter(metaSideloadBytesWritten),
+		SideloadBytesTruncated:        metric.NewCounter(metaSideloadBytesTruncated),
+		SideloadBytesResident:         metric.NewGauge(metaSideloadBytesResident),
+		SideloadExternalErrors:        metric.NewCounter(metaSideloadExternalErrors),
 
 		// Encryption-at-rest.
 		EncryptionAlgorithm: metric.NewGauge(metaEncryptionAlgorithm),
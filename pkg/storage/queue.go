@@ -16,6 +16,7 @@ import (
 	"container/heap"
 	"context"
 	"fmt"
+	"sort"
 	"sync/atomic"
 	"time"
 
@@ -481,6 +482,30 @@ func (bq *baseQueue) lockProcessing() func() {
 	}
 }
 
+// lockProcessingWithContext is like lockProcessing, but gives up and returns
+// the context's error if the context is canceled before all processing could
+// be locked.
+func (bq *baseQueue) lockProcessingWithContext(ctx context.Context) (func(), error) {
+	semCount := cap(bq.processSem)
+	release := func(n int) {
+		for i := 0; i < n; i++ {
+			<-bq.processSem
+		}
+	}
+
+	// Drain process semaphore.
+	for i := 0; i < semCount; i++ {
+		select {
+		case bq.processSem <- struct{}{}:
+		case <-ctx.Done():
+			release(i)
+			return nil, ctx.Err()
+		}
+	}
+
+	return func() { release(semCount) }, nil
+}
+
 // Start launches a goroutine to process entries in the queue. The
 // provided stopper is used to finish processing.
 func (bq *baseQueue) Start(stopper *stop.Stopper) {
@@ -1256,3 +1281,57 @@ func (bq *baseQueue) DrainQueue(stopper *stop.Stopper) {
 		bq.finishProcessingReplica(annotatedCtx, stopper, repl, err)
 	}
 }
+
+// drainAndWait locks the queue and processes the currently queued replicas as
+// well as those currently in purgatory, one at a time and in priority order.
+// It returns once there is no more processable work left in the queue.
+//
+// Replicas in purgatory are retried exactly once. Those that fail again with a
+// purgatory error are considered stuck: they are returned to purgatory, not
+// waited on, and their range IDs are returned in increasing order. The context
+// is checked before each replica is processed, and its error is returned if it
+// is canceled.
+func (bq *baseQueue) drainAndWait(
+	ctx context.Context, stopper *stop.Stopper,
+) (stuck []roachpb.RangeID, _ error) {
+	// Lock processing while draining for the same reasons as DrainQueue does.
+	unlock, err := bq.lockProcessingWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Move everything in purgatory back into the priority queue so that it
+	// gets one more processing attempt below. Replicas that fail again are
+	// put back into purgatory by finishProcessingReplica and since they're
+	// then no longer in the priority queue, we won't pick them up again.
+	bq.mu.Lock()
+	for rangeID := range bq.mu.purgatory {
+		item := bq.mu.replicas[rangeID]
+		bq.removeFromPurgatoryLocked(item)
+		bq.addLocked(item)
+	}
+	bq.mu.Unlock()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		repl := bq.pop()
+		if repl == nil {
+			break
+		}
+		annotatedCtx := repl.AnnotateCtx(ctx)
+		err := bq.processReplica(annotatedCtx, repl)
+		bq.finishProcessingReplica(annotatedCtx, stopper, repl, err)
+	}
+
+	bq.mu.Lock()
+	for rangeID := range bq.mu.purgatory {
+		stuck = append(stuck, rangeID)
+	}
+	bq.mu.Unlock()
+
+	sort.Slice(stuck, func(i, j int) bool { return stuck[i] < stuck[j] })
+	return stuck, nil
+}
@@ -15,6 +15,7 @@ package storage
 import (
 	"container/heap"
 	"context"
+	"reflect"
 	"strconv"
 	"sync/atomic"
 	"testing"
@@ -829,6 +830,117 @@ func TestBaseQueuePurgatory(t *testing.T) {
 	}
 }
 
+// stuckQueueImpl implements queueImpl, failing processing with a purgatory
+// error for the replicas marked as stuck.
+type stuckQueueImpl struct {
+	testQueueImpl
+	stuck map[roachpb.RangeID]bool
+}
+
+func (sq *stuckQueueImpl) process(
+	ctx context.Context, repl *Replica, cfg *config.SystemConfig,
+) error {
+	if err := sq.testQueueImpl.process(ctx, repl, cfg); err != nil {
+		return err
+	}
+	if sq.stuck[repl.RangeID] {
+		return &testPurgatoryError{}
+	}
+	return nil
+}
+
+// TestBaseQueueDrainAndWait verifies that drainAndWait processes queued and
+// purgatory replicas to completion without waiting on replicas that remain
+// stuck in purgatory, and that it honors context cancellation.
+func TestBaseQueueDrainAndWait(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	const replicaCount = 5
+	repls := createReplicas(t, &tc, replicaCount)
+
+	testQueue := &stuckQueueImpl{
+		testQueueImpl: testQueueImpl{
+			shouldQueueFn: func(now hlc.Timestamp, r *Replica) (shouldQueue bool, priority float64) {
+				return true, float64(r.RangeID)
+			},
+			pChan: make(chan time.Time, 1),
+		},
+		stuck: map[roachpb.RangeID]bool{
+			repls[0].RangeID: true,
+			repls[1].RangeID: true,
+		},
+	}
+	// NB: the queue is intentionally not started, so all processing happens
+	// inside of drainAndWait.
+	bq := makeTestBaseQueue("test", testQueue, tc.store, tc.gossip, queueConfig{maxSize: replicaCount})
+
+	ctx := context.Background()
+	for _, r := range repls {
+		bq.maybeAdd(ctx, r, hlc.Timestamp{})
+	}
+
+	expect := func(stuck []roachpb.RangeID, processed, purgatory int) {
+		t.Helper()
+		if len(stuck) != purgatory {
+			t.Fatalf("expected %d stuck replicas; got %v", purgatory, stuck)
+		}
+		if pc := testQueue.getProcessed(); pc != processed {
+			t.Fatalf("expected %d processed replicas; got %d", processed, pc)
+		}
+		if l := bq.PurgatoryLength(); l != purgatory {
+			t.Fatalf("expected purgatory size of %d; got %d", purgatory, l)
+		}
+		if l := bq.Length(); l != 0 {
+			t.Fatalf("expected empty priorityQ; got %d", l)
+		}
+	}
+
+	// All replicas are processed once and the stuck ones end up in purgatory.
+	stuck, err := bq.drainAndWait(ctx, stopper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(stuck, replicaCount, 2)
+	if exp := []roachpb.RangeID{repls[0].RangeID, repls[1].RangeID}; !reflect.DeepEqual(stuck, exp) {
+		t.Fatalf("expected stuck replicas %v; got %v", exp, stuck)
+	}
+
+	// Draining again retries the purgatory replicas exactly once.
+	stuck, err = bq.drainAndWait(ctx, stopper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(stuck, replicaCount+2, 2)
+
+	// Once a replica becomes unstuck, it leaves purgatory on the next drain.
+	delete(testQueue.stuck, repls[0].RangeID)
+	stuck, err = bq.drainAndWait(ctx, stopper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(stuck, replicaCount+4, 1)
+
+	// A canceled context returns without processing anything.
+	for _, r := range repls[2:] {
+		bq.maybeAdd(ctx, r, hlc.Timestamp{})
+	}
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := bq.drainAndWait(cancelCtx, stopper); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if pc := testQueue.getProcessed(); pc != replicaCount+4 {
+		t.Fatalf("expected %d processed replicas; got %d", replicaCount+4, pc)
+	}
+	if l := bq.Length(); l != replicaCount-2 {
+		t.Fatalf("expected %d queued replicas; got %d", replicaCount-2, l)
+	}
+}
+
 type processTimeoutQueueImpl struct {
 	testQueueImpl
 }
@@ -15,6 +15,7 @@ package storage
 import (
 	"context"
 	"fmt"
+	"math"
 	"sort"
 	"strings"
 	"time"
@@ -229,6 +230,26 @@ func newTruncateDecision(ctx context.Context, r *Replica) (truncateDecision, err
 	return decision, nil
 }
 
+// MinSafeTruncationIndex returns the highest index to which the Raft log of
+// the replica can currently be truncated, that is the lowest index which has
+// to remain in the log. It accounts for the progress of the recently active
+// followers as well as for the snapshots in flight, whose recipients catch up
+// from the log once they have applied them (see computeTruncateDecision).
+//
+// Only the Raft leader knows the progress of the followers. On other replicas,
+// as well as on replicas without a Raft group, no truncation is safe and the
+// current first index is returned.
+func (r *Replica) MinSafeTruncationIndex(ctx context.Context) (uint64, error) {
+	decision, err := newTruncateDecision(ctx, r)
+	if err != nil {
+		return 0, err
+	}
+	if decision.NewFirstIndex == 0 {
+		return r.GetFirstIndex()
+	}
+	return decision.NewFirstIndex, nil
+}
+
 func updateRaftProgressFromActivity(
 	ctx context.Context,
 	prs map[uint64]raft.Progress,
@@ -262,6 +283,7 @@ const (
 	truncatableIndexChosenViaPendingSnap     = "pending snapshot"
 	truncatableIndexChosenViaFirstIndex      = "first index"
 	truncatableIndexChosenViaLastIndex       = "last index"
+	truncatableIndexChosenViaMinSafeIndex    = "min safe index"
 )
 
 type truncateDecisionInput struct {
@@ -484,6 +506,10 @@ func getQuorumIndex(raftStatus *raft.Status) uint64 {
 func (rlq *raftLogQueue) shouldQueue(
 	ctx context.Context, now hlc.Timestamp, r *Replica, _ *config.SystemConfig,
 ) (shouldQ bool, priority float64) {
+	if r.NeedsSnapshot() {
+		// The entries whose sideloaded payloads were quarantined have to go.
+		return true, math.MaxFloat64
+	}
 	decision, err := newTruncateDecision(ctx, r)
 	if err != nil {
 		log.Warning(ctx, err)
@@ -524,6 +550,31 @@ func (rlq *raftLogQueue) shouldQueueImpl(
 // leader and if the total number of the range's raft log's stale entries
 // exceeds RaftLogQueueStaleThreshold.
 func (rlq *raftLogQueue) process(ctx context.Context, r *Replica, _ *config.SystemConfig) error {
+	if sideloadReadRepairEnabled.Get(&r.store.cfg.Settings.SV) {
+		// Repair is best effort, and mustn't prevent the log from being
+		// truncated.
+		if n, err := r.repairSideloaded(ctx); err != nil {
+			log.Warningf(ctx, "unable to repair sideloaded files: %s", err)
+		} else if n > 0 {
+			log.Infof(ctx, "restored %d missing sideloaded files", n)
+		}
+	}
+
+	// A replica whose sideloaded storage was quarantined can't serve the
+	// affected entries, so they are truncated from the log of the range, even
+	// though this may cut off followers. The truncation is requested through
+	// the leaseholder, so this works on any replica.
+	if index, ok := r.quarantinedLogTruncation(ctx); ok {
+		log.Infof(ctx, "truncating Raft log up to index %d to recover from quarantined sideloaded storage", index)
+		b := &client.Batch{}
+		b.AddRawRequest(&roachpb.TruncateLogRequest{
+			RequestHeader: roachpb.RequestHeader{Key: r.Desc().StartKey.AsRawKey()},
+			Index:         index,
+			RangeID:       r.RangeID,
+		})
+		return rlq.db.Run(ctx, b)
+	}
+
 	decision, err := newTruncateDecision(ctx, r)
 	if err != nil {
 		return err
@@ -559,6 +610,20 @@ func (rlq *raftLogQueue) process(ctx context.Context, r *Replica, _ *config.Syst
 		}
 	}
 
+	// Snapshots may have started since the decision was made, for example while
+	// the log size was being recomputed, and the entries they need must not be
+	// truncated.
+	if decision.ShouldTruncate() {
+		safeIndex, err := r.MinSafeTruncationIndex(ctx)
+		if err != nil {
+			return err
+		}
+		if decision.NewFirstIndex > safeIndex {
+			decision.NewFirstIndex = safeIndex
+			decision.ChosenVia = truncatableIndexChosenViaMinSafeIndex
+		}
+	}
+
 	// Can and should the raft logs be truncated?
 	if decision.ShouldTruncate() {
 		if n := decision.NumNewRaftSnapshots(); log.V(1) || n > 0 && rlq.logSnapshots.ShouldProcess(timeutil.Now()) {
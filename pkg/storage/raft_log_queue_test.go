@@ -358,18 +358,9 @@ func TestTruncateDecisionNumSnapshots(t *testing.T) {
 
 func verifyLogSizeInSync(t *testing.T, r *Replica) {
 	t.Helper()
-	r.raftMu.Lock()
-	defer r.raftMu.Unlock()
-	r.mu.Lock()
-	raftLogSize := r.mu.raftLogSize
-	r.mu.Unlock()
-	actualRaftLogSize, err := ComputeRaftLogSize(context.Background(), r.RangeID, r.Engine(), r.SideloadedRaftMuLocked())
-	if err != nil {
+	if err := r.AssertRaftLogSizeInSync(context.Background()); err != nil {
 		t.Fatal(err)
 	}
-	if actualRaftLogSize != raftLogSize {
-		t.Fatalf("replica claims raft log size %d, but computed %d", raftLogSize, actualRaftLogSize)
-	}
 }
 
 func TestUpdateRaftStatusActivity(t *testing.T) {
@@ -706,6 +697,90 @@ func TestSnapshotLogTruncationConstraints(t *testing.T) {
 	assert.Equal(t, r.mu.snapshotLogTruncationConstraints, map[uuid.UUID]snapTruncationInfo(nil))
 }
 
+// TestMinSafeTruncationIndex verifies that Replica.MinSafeTruncationIndex
+// doesn't allow truncating the entries needed by a snapshot in flight, and
+// that the raft log queue respects it.
+func TestMinSafeTruncationIndex(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	store, _ := createTestStore(t,
+		testStoreOpts{
+			// This test was written before test stores could start with more than one
+			// range and was not adapted.
+			createSystemRanges: false,
+		},
+		stopper)
+	store.SetRaftLogQueueActive(false)
+
+	r, err := store.GetReplica(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2*RaftLogQueueStaleThreshold; i++ {
+		key := roachpb.Key(fmt.Sprintf("key%02d", i))
+		args := putArgs(key, []byte(fmt.Sprintf("value%02d", i)))
+		if _, err := client.SendWrapped(ctx, store.TestSender(), &args); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without snapshots in flight, the index is the one the queue would
+	// truncate to.
+	decision, err := newTruncateDecision(ctx, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	safeIndex, err := r.MinSafeTruncationIndex(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if safeIndex != decision.NewFirstIndex {
+		t.Fatalf("expected %d, got %d", decision.NewFirstIndex, safeIndex)
+	}
+	firstIndex := decision.Input.FirstIndex
+	if safeIndex <= firstIndex+RaftLogQueueStaleThreshold {
+		t.Fatalf("expected more than %d truncatable entries, got %d",
+			RaftLogQueueStaleThreshold, safeIndex-firstIndex)
+	}
+
+	// A snapshot in flight holds back the index.
+	snapIndex := firstIndex + RaftLogQueueStaleThreshold
+	r.mu.Lock()
+	r.addSnapshotLogTruncationConstraintLocked(ctx, uuid.MakeV4(), snapIndex)
+	r.mu.Unlock()
+	if safeIndex, err := r.MinSafeTruncationIndex(ctx); err != nil {
+		t.Fatal(err)
+	} else if safeIndex != snapIndex {
+		t.Fatalf("expected %d, got %d", snapIndex, safeIndex)
+	}
+
+	// The queue truncates up to the snapshot's index, but not further.
+	store.SetRaftLogQueueActive(true)
+	store.MustForceRaftLogScanAndProcess()
+	store.SetRaftLogQueueActive(false)
+	testutils.SucceedsSoon(t, func() error {
+		if newFirstIndex, err := r.GetFirstIndex(); err != nil {
+			t.Fatal(err)
+		} else if newFirstIndex != snapIndex {
+			return errors.Errorf("expected first index %d, got %d", snapIndex, newFirstIndex)
+		}
+		return nil
+	})
+
+	// Once the snapshot is gone, the index advances again.
+	r.mu.Lock()
+	r.mu.snapshotLogTruncationConstraints = nil
+	r.mu.Unlock()
+	if safeIndex, err := r.MinSafeTruncationIndex(ctx); err != nil {
+		t.Fatal(err)
+	} else if safeIndex <= snapIndex {
+		t.Fatalf("expected an index above %d, got %d", snapIndex, safeIndex)
+	}
+}
+
 // TestTruncateLog verifies that the TruncateLog command removes a
 // prefix of the raft logs (modifying FirstIndex() and making them
 // inaccessible via Entries()).
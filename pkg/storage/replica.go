@@ -198,6 +198,9 @@ type Replica struct {
 		stateLoader stateloader.StateLoader
 		// on-disk storage for sideloaded SSTables. nil when there's no ReplicaID.
 		sideloaded SideloadStorage
+		// addSSTableApplications tracks the rate at which AddSSTable commands
+		// are applied, to trigger compactions of the range's span.
+		addSSTableApplications addSSTableApplicationTracker
 	}
 
 	// Contains the lease history when enabled.
@@ -259,6 +262,11 @@ type Replica struct {
 		// If raftLogSizeTrusted is false, don't trust the above raftLogSize until
 		// it has been recomputed.
 		raftLogSizeTrusted bool
+		// quarantinedIndex is the last index of the Raft log at the time the
+		// sideloaded storage of the replica was quarantined (see
+		// quarantineSideloaded), or zero. It is reset once the entries up to it
+		// have been truncated or a snapshot has been applied.
+		quarantinedIndex uint64
 		// raftLogLastCheckSize is the value of raftLogSize the last time the Raft
 		// log was checked for truncation or at the time of the last Raft log
 		// truncation.
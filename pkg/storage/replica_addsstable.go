@@ -0,0 +1,278 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/storagepb"
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/raft/raftpb"
+)
+
+// AddSSTableInfo describes an AddSSTable command in the Raft log of a
+// replica.
+type AddSSTableInfo struct {
+	Index, Term uint64
+	// KeySpan is the span of the keys in the SSTable.
+	KeySpan roachpb.Span
+	// Bytes is the size of the SSTable.
+	Bytes int64
+}
+
+// RecentAddSSTables returns the most recent AddSSTable commands, at most
+// limit of them, which have been applied and are still in the Raft log of the
+// replica, in increasing order of index. The payloads of sideloaded entries
+// are inlined to determine the key spans of the SSTables. Since it reads the
+// entire Raft log and blocks the Raft processing of the replica while doing
+// so, it can be expensive.
+func (r *Replica) RecentAddSSTables(ctx context.Context, limit int) ([]AddSSTableInfo, error) {
+	if limit <= 0 {
+		return nil, errors.Errorf("limit must be positive, got %d", limit)
+	}
+	// Holding raftMu prevents the log from being truncated, and the sideloaded
+	// payloads from being removed, while they're read.
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+	r.mu.RLock()
+	lo := r.mu.state.TruncatedState.Index + 1
+	hi := r.mu.state.RaftAppliedIndex + 1
+	r.mu.RUnlock()
+
+	var infos []AddSSTableInfo
+	var ent raftpb.Entry
+	scanFunc := func(kv roachpb.KeyValue) (bool, error) {
+		if err := kv.Value.GetProto(&ent); err != nil {
+			return false, err
+		}
+		if ent.Type != raftpb.EntryNormal || len(ent.Data) == 0 {
+			return false, nil
+		}
+		// AddSSTable commands normally use the sideloaded encoding, but are
+		// kept inline in the standard encoding if sideloading is disabled.
+		inlined, err := maybeInlineSideloadedRaftCommand(
+			ctx, nil /* st */, r.RangeID, ent, r.raftMu.sideloaded, r.store.raftEntryCache,
+		)
+		if err != nil {
+			return false, errors.Wrapf(err, "inlining entry at index %d term %d", ent.Index, ent.Term)
+		}
+		if inlined != nil {
+			ent = *inlined
+		}
+		var command storagepb.RaftCommand
+		_, data := DecodeRaftCommand(ent.Data)
+		if err := protoutil.Unmarshal(data, &command); err != nil {
+			return false, err
+		}
+		addSST := command.ReplicatedEvalResult.AddSSTable
+		if addSST == nil {
+			return false, nil
+		}
+		span, err := sstKeySpan(addSST.Data)
+		if err != nil {
+			return false, errors.Wrapf(err, "reading SSTable at index %d term %d", ent.Index, ent.Term)
+		}
+		if len(infos) == limit {
+			infos = append(infos[:0], infos[1:]...)
+		}
+		infos = append(infos, AddSSTableInfo{
+			Index:   ent.Index,
+			Term:    ent.Term,
+			KeySpan: span,
+			Bytes:   int64(len(addSST.Data)),
+		})
+		return false, nil
+	}
+	if err := iterateEntries(ctx, r.store.Engine(), r.RangeID, lo, hi, scanFunc); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// sstKeySpan returns the span of the keys in the given SSTable, which is empty
+// if the SSTable is.
+func sstKeySpan(data []byte) (roachpb.Span, error) {
+	iter, err := engine.NewMemSSTIterator(data, false /* verify */)
+	if err != nil {
+		return roachpb.Span{}, err
+	}
+	defer iter.Close()
+	var span roachpb.Span
+	for iter.Seek(engine.MVCCKey{}); ; iter.NextKey() {
+		if ok, err := iter.Valid(); err != nil {
+			return roachpb.Span{}, err
+		} else if !ok {
+			break
+		}
+		key := iter.UnsafeKey().Key
+		if span.Key == nil {
+			span.Key = append(roachpb.Key(nil), key...)
+		}
+		span.EndKey = append(span.EndKey[:0], key...)
+	}
+	if span.Key != nil {
+		span.EndKey = span.EndKey.Next()
+	}
+	return span, nil
+}
+
+// VerifyStatus is the outcome of the verification of an AddSSTable command by
+// Replica.VerifyAddSSTable.
+type VerifyStatus int
+
+const (
+	// VerifyOK means that the payload matches the command and is a valid
+	// SSTable.
+	VerifyOK VerifyStatus = iota
+	// VerifyCRCMismatch means that the payload doesn't match the CRC of the
+	// command, or the checksum kept alongside the sideloaded payload.
+	VerifyCRCMismatch
+	// VerifyMalformed means that the payload matches the command but isn't a
+	// valid SSTable.
+	VerifyMalformed
+	// VerifyMissing means that the sideloaded payload doesn't exist.
+	VerifyMissing
+)
+
+func (s VerifyStatus) String() string {
+	switch s {
+	case VerifyOK:
+		return "ok"
+	case VerifyCRCMismatch:
+		return "crc-mismatch"
+	case VerifyMalformed:
+		return "malformed"
+	case VerifyMissing:
+		return "missing"
+	default:
+		return fmt.Sprintf("VerifyStatus(%d)", int(s))
+	}
+}
+
+// VerifyResult describes the verification of an AddSSTable command by
+// Replica.VerifyAddSSTable.
+type VerifyResult struct {
+	Index, Term uint64
+	Status      VerifyStatus
+	// Sideloaded is whether the payload is sideloaded rather than inline.
+	Sideloaded bool
+	// Bytes is the size of the payload, if it exists.
+	Bytes int64
+	// Detail describes the problem, if any.
+	Detail string
+}
+
+// VerifyAddSSTable verifies the AddSSTable command at the given index of the
+// Raft log, which must have been applied: its payload is read from the entry
+// or the sideloaded storage, checked against the CRC of the command, and
+// opened as an SSTable, all of whose entries are read. The payload is read
+// from storage rather than from the Raft entry cache, so that the stored copy
+// is verified. Nothing is modified; in particular, missing payloads aren't
+// repaired.
+//
+// An error is returned if the entry doesn't exist or isn't an AddSSTable
+// command, or if the verification couldn't be carried out; problems with the
+// payload are reported in the result instead.
+func (r *Replica) VerifyAddSSTable(ctx context.Context, index uint64) (VerifyResult, error) {
+	// Holding raftMu prevents the entry from being truncated away, and its
+	// payload from being removed, while they're read.
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+	r.mu.RLock()
+	truncatedIndex := r.mu.state.TruncatedState.Index
+	appliedIndex := r.mu.state.RaftAppliedIndex
+	r.mu.RUnlock()
+	if index <= truncatedIndex || index > appliedIndex {
+		return VerifyResult{}, errors.Errorf(
+			"index %d is not in the applied part of the Raft log (%d, %d]",
+			index, truncatedIndex, appliedIndex)
+	}
+
+	var ent raftpb.Entry
+	if ok, err := engine.MVCCGetProto(
+		ctx, r.store.Engine(), keys.RaftLogKey(r.RangeID, index), hlc.Timestamp{}, &ent,
+		engine.MVCCGetOptions{},
+	); err != nil {
+		return VerifyResult{}, err
+	} else if !ok {
+		return VerifyResult{}, errors.Errorf("no Raft log entry at index %d", index)
+	}
+	notAddSSTable := errors.Errorf("entry at index %d is not an AddSSTable command", index)
+	if ent.Type != raftpb.EntryNormal || len(ent.Data) == 0 {
+		return VerifyResult{}, notAddSSTable
+	}
+	var command storagepb.RaftCommand
+	_, data := DecodeRaftCommand(ent.Data)
+	if err := protoutil.Unmarshal(data, &command); err != nil {
+		return VerifyResult{}, err
+	}
+	addSST := command.ReplicatedEvalResult.AddSSTable
+	if addSST == nil {
+		return VerifyResult{}, notAddSSTable
+	}
+
+	res := VerifyResult{Index: ent.Index, Term: ent.Term}
+	payload := addSST.Data
+	if len(payload) == 0 {
+		res.Sideloaded = true
+		var err error
+		payload, err = r.raftMu.sideloaded.Get(ctx, ent.Index, ent.Term)
+		if err != nil {
+			if errors.Cause(err) == errSideloadedFileNotFound {
+				res.Status, res.Detail = VerifyMissing, err.Error()
+				return res, nil
+			}
+			if _, ok := errors.Cause(err).(*sideloadChecksumMismatchError); ok {
+				res.Status, res.Detail = VerifyCRCMismatch, err.Error()
+				return res, nil
+			}
+			return VerifyResult{}, err
+		}
+	}
+	res.Bytes = int64(len(payload))
+
+	if crc := util.CRC32(payload); crc != addSST.CRC32 {
+		res.Status = VerifyCRCMismatch
+		res.Detail = fmt.Sprintf("payload has CRC %x, command has %x", crc, addSST.CRC32)
+		return res, nil
+	}
+	if err := verifySSTable(payload); err != nil {
+		res.Status, res.Detail = VerifyMalformed, err.Error()
+		return res, nil
+	}
+	return res, nil
+}
+
+// verifySSTable reads all entries of the given SSTable, verifying their
+// checksums.
+func verifySSTable(data []byte) error {
+	iter, err := engine.NewMemSSTIterator(data, true /* verify */)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for iter.Seek(engine.MVCCKey{}); ; iter.Next() {
+		if ok, err := iter.Valid(); err != nil {
+			return err
+		} else if !ok {
+			return nil
+		}
+	}
+}
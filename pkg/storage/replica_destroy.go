@@ -109,9 +109,23 @@ func (r *Replica) postDestroyRaftMuLocked(ctx context.Context, ms enginepb.MVCCS
 	// call to postDestroyRaftMuLocked will currently leave the files around
 	// forever.
 	if r.raftMu.sideloaded != nil {
-		return r.raftMu.sideloaded.Clear(ctx)
+		if err := r.raftMu.sideloaded.Clear(ctx); err != nil {
+			return err
+		}
 	}
-	return nil
+	if err := r.clearSideloadQuarantineRaftMuLocked(); err != nil {
+		return err
+	}
+	// A later replica of the range picks its sideloaded storage anew.
+	ssBase, ssEng, err := r.store.sideloadLocation(r.RangeID)
+	if err != nil {
+		return err
+	}
+	if err := removeSideloadExternalMarker(ssEng, ssBase, r.RangeID); err != nil {
+		return err
+	}
+	// A later replica of the range uses the store's engine again.
+	return r.store.setSideloadLocation(r.RangeID, r.store.engine)
 }
 
 // destroyRaftMuLocked deletes data associated with a replica, leaving a
@@ -201,23 +201,33 @@ func (r *Replica) setReplicaIDRaftMuLockedMuLocked(replicaID roachpb.ReplicaID)
 	//
 	// Note that we can't race with a concurrent replicaGC here because both that
 	// and this is under raftMu.
-	ssBase := r.store.Engine().GetAuxiliaryDir()
 	rangeID := r.mu.state.Desc.RangeID
+	ssBase, ssEng, err := r.store.sideloadLocation(rangeID)
+	if err != nil {
+		return errors.Wrap(err, "while locating sideloaded storage")
+	}
 	if err := moveSideloadedData(r.raftMu.sideloaded, ssBase, rangeID, replicaID); err != nil {
 		return err
 	}
 
-	var err error
-	if r.raftMu.sideloaded, err = newDiskSideloadStorage(
+	if r.raftMu.sideloaded, err = newSideloadStorage(
+		r.AnnotateCtx(context.TODO()),
 		r.store.cfg.Settings,
+		r.store.StoreID(),
 		rangeID,
 		replicaID,
 		ssBase,
 		r.store.limiters.BulkIOWriteRate,
-		r.store.engine,
+		r.store.sideloadWriteLimiter,
+		r.store.sideloadCache,
+		r.store.sideloadMetrics,
+		ssEng,
 	); err != nil {
 		return errors.Wrap(err, "while initializing sideloaded storage")
 	}
+	if err := r.loadSideloadQuarantineRaftMuLockedMuLocked(); err != nil {
+		return errors.Wrap(err, "while loading sideloaded quarantine marker")
+	}
 
 	previousReplicaID := r.mu.replicaID
 	r.mu.replicaID = replicaID
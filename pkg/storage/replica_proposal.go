@@ -391,6 +391,22 @@ func (r *Replica) leasePostApply(ctx context.Context, newLease roachpb.Lease, pe
 	}
 }
 
+// limitAddSSTableIngest waits until the given limiter permits another SSTable
+// to be ingested. The command has been committed and must be applied no matter
+// what, so if the context is canceled (or its deadline doesn't leave enough time
+// to wait), the ingestion proceeds without being paced.
+func limitAddSSTableIngest(ctx context.Context, limiter *rate.Limiter) {
+	if limiter == nil || limiter.Limit() == rate.Inf {
+		return
+	}
+	begin := timeutil.Now()
+	if err := limiter.Wait(ctx); err != nil {
+		log.Warningf(ctx, "not pacing AddSSTable ingestion: %v", err)
+		return
+	}
+	log.Eventf(ctx, "paced AddSSTable ingestion for %s", timeutil.Since(begin))
+}
+
 func addSSTablePreApply(
 	ctx context.Context,
 	st *cluster.Settings,
@@ -399,6 +415,7 @@ func addSSTablePreApply(
 	term, index uint64,
 	sst storagepb.ReplicatedEvalResult_AddSSTable,
 	limiter *rate.Limiter,
+	ingestLimiter *rate.Limiter,
 ) bool {
 	checksum := util.CRC32(sst.Data)
 
@@ -417,6 +434,7 @@ func addSSTablePreApply(
 		log.Fatalf(ctx, "sideloaded SSTable at term %d, index %d is missing", term, index)
 	}
 
+	limitAddSSTableIngest(ctx, ingestLimiter)
 	eng.PreIngestDelay(ctx)
 
 	// as of VersionUnreplicatedRaftTruncatedState we were on rocksdb 5.17 so this
@@ -431,6 +449,9 @@ func addSSTablePreApply(
 		if err := inmem.WriteFile(path, sst.Data); err != nil {
 			panic(err)
 		}
+		// The write into the in-memory environment is a copy, but whether it
+		// counts as one is up to the setting.
+		copied = addSSTableCountInMemCopies.Get(&st.SV)
 	} else {
 		ingestPath := path + ".ingested"
 
@@ -444,7 +465,12 @@ func addSSTablePreApply(
 		// tell Rocks that it is not allowed to modify the file, in which case it
 		// will return and error if it would have tried to do so, at which point we
 		// can fall back to writing a new copy for Rocks to ingest.
-		if _, links, err := sysutil.StatAndLinkCount(path); err == nil {
+		//
+		// A compressed sideloaded file (see sideloadCompressionEnabled) isn't an
+		// SSTable, so a copy is always ingested instead.
+		if compressed, _, err := readSideloadCompressionHeader(path); err == nil && compressed {
+			log.Eventf(ctx, "SSTable at index %d term %d is stored compressed -- ingesting a copy", index, term)
+		} else if _, links, err := sysutil.StatAndLinkCount(path); err == nil {
 			// HACK: RocksDB does not like ingesting the same file (by inode) twice.
 			// See facebook/rocksdb#5133. We can tell that we have tried to ingest
 			// this file already if it has more than one link – one from the file raft
@@ -598,13 +624,14 @@ func (r *Replica) handleReplicatedEvalResult(
 			// could rot.
 			{
 				log.Eventf(ctx, "truncating sideloaded storage up to (and including) index %d", newTruncState.Index)
-				if size, _, err := r.raftMu.sideloaded.TruncateTo(ctx, newTruncState.Index+1); err != nil {
+				size, _, err := r.raftMu.sideloaded.TruncateTo(ctx, newTruncState.Index+1)
+				if err != nil {
 					// We don't *have* to remove these entries for correctness. Log a
 					// loud error, but keep humming along.
 					log.Errorf(ctx, "while removing sideloaded files during log truncation: %s", err)
-				} else {
-					rResult.RaftLogDelta -= size
 				}
+				// The files removed before an error are gone nevertheless.
+				rResult.RaftLogDelta -= size
 			}
 		}
 
@@ -21,6 +21,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/storage/batcheval/result"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
@@ -439,9 +440,13 @@ func defaultSubmitProposalLocked(r *Replica, p *ProposalData) error {
 		if p.command.ReplicatedEvalResult.AddSSTable.Data == nil {
 			return errors.New("cannot sideload empty SSTable")
 		}
-		encodingVersion = raftVersionSideloaded
 		r.store.metrics.AddSSTableProposals.Inc(1)
-		log.Event(p.ctx, "sideloadable proposal detected")
+		if sideloadingEnabled.Get(&r.ClusterSettings().SV) {
+			encodingVersion = raftVersionSideloaded
+			log.Event(p.ctx, "sideloadable proposal detected")
+		} else {
+			log.Event(p.ctx, "sideloadable proposal detected, but sideloading is disabled")
+		}
 	}
 	encodeRaftCommandPrefix(data[:raftCommandPrefixLen], encodingVersion, p.idKey)
 
@@ -1875,11 +1880,18 @@ func (r *Replica) processRaftCommand(
 				raftIndex,
 				*raftCmd.ReplicatedEvalResult.AddSSTable,
 				r.store.limiters.BulkIOWriteRate,
+				r.store.ingestLimiter,
 			)
 			r.store.metrics.AddSSTableApplications.Inc(1)
 			if copied {
 				r.store.metrics.AddSSTableApplicationCopies.Inc(1)
 			}
+			r.maybeSuggestAddSSTableCompactionRaftMuLocked(
+				ctx, int64(len(raftCmd.ReplicatedEvalResult.AddSSTable.Data)),
+			)
+			r.maybeSuggestIngestedSSTableCompactionRaftMuLocked(
+				ctx, raftCmd.ReplicatedEvalResult.AddSSTable.Data,
+			)
 			raftCmd.ReplicatedEvalResult.AddSSTable = nil
 		}
 
@@ -2535,6 +2547,19 @@ func handleTruncatedStateBelowRaft(
 func ComputeRaftLogSize(
 	ctx context.Context, rangeID roachpb.RangeID, reader engine.Reader, sideloaded SideloadStorage,
 ) (int64, error) {
+	entriesBytes, sideloadedBytes, err := computeRaftLogSizeComponents(ctx, rangeID, reader, sideloaded)
+	if err != nil {
+		return 0, err
+	}
+	return entriesBytes + sideloadedBytes, nil
+}
+
+// computeRaftLogSizeComponents is like ComputeRaftLogSize, but returns the size
+// of the Raft log entries in the storage engine and that of the sideloaded
+// files separately.
+func computeRaftLogSizeComponents(
+	ctx context.Context, rangeID roachpb.RangeID, reader engine.Reader, sideloaded SideloadStorage,
+) (entriesBytes, sideloadedBytes int64, _ error) {
 	prefix := keys.RaftLogPrefix(rangeID)
 	prefixEnd := prefix.PrefixEnd()
 	iter := reader.NewIterator(engine.IterOptions{
@@ -2546,7 +2571,7 @@ func ComputeRaftLogSize(
 	to := engine.MakeMVCCMetadataKey(prefixEnd)
 	ms, err := iter.ComputeStats(from, to, 0 /* nowNanos */)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 	var totalSideloaded int64
 	if sideloaded != nil {
@@ -2555,8 +2580,145 @@ func ComputeRaftLogSize(
 		// gives us the number of bytes in the storage back.
 		_, totalSideloaded, err = sideloaded.TruncateTo(ctx, 0)
 		if err != nil {
-			return 0, err
+			return 0, 0, err
 		}
 	}
-	return ms.SysBytes + totalSideloaded, nil
+	return ms.SysBytes, totalSideloaded, nil
+}
+
+// RaftLogSizeBreakdown describes the components of a replica's Raft log size,
+// as tracked in memory and as recomputed from storage. A discrepancy between
+// Tracked and Recomputed indicates that the size accounting has drifted.
+type RaftLogSizeBreakdown struct {
+	// EntriesBytes is the size of the Raft log entries in the storage engine.
+	EntriesBytes int64
+	// SideloadedBytes is the size of the sideloaded payloads of the entries.
+	SideloadedBytes int64
+	// Tracked is the Raft log size tracked by the replica, which is the value
+	// used to decide when to truncate the log.
+	Tracked int64
+	// TrackedTrusted is false if Tracked is known to be inaccurate, for
+	// example after a restart.
+	TrackedTrusted bool
+	// Recomputed is the sum of EntriesBytes and SideloadedBytes.
+	Recomputed int64
+}
+
+// RaftLogSizeBreakdown recomputes the size of the replica's Raft log from
+// storage and returns it together with its components and the size tracked by
+// the replica. It does not modify the tracked size, even if it is found to be
+// inaccurate. Like ComputeRaftLogSize, it can be expensive.
+func (r *Replica) RaftLogSizeBreakdown(ctx context.Context) (RaftLogSizeBreakdown, error) {
+	// Holding raftMu prevents the log from changing while it's being
+	// recomputed, so that the tracked size can be compared to the result.
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+	entriesBytes, sideloadedBytes, err := computeRaftLogSizeComponents(
+		ctx, r.RangeID, r.store.Engine(), r.raftMu.sideloaded,
+	)
+	if err != nil {
+		return RaftLogSizeBreakdown{}, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return RaftLogSizeBreakdown{
+		EntriesBytes:    entriesBytes,
+		SideloadedBytes: sideloadedBytes,
+		Tracked:         r.mu.raftLogSize,
+		TrackedTrusted:  r.mu.raftLogSizeTrusted,
+		Recomputed:      entriesBytes + sideloadedBytes,
+	}, nil
+}
+
+// raftLogSizeReconcileMaxDelta is the largest discrepancy between the tracked
+// and the recomputed size of a trusted Raft log which ReconcileRaftLogSize
+// corrects. Larger discrepancies hint at a bug in the size accounting which
+// shouldn't be papered over.
+var raftLogSizeReconcileMaxDelta = settings.RegisterByteSizeSetting(
+	"kv.raft_log.size_reconciliation_max_delta",
+	"the largest discrepancy between the tracked and the actual size of a raft log that is corrected when reconciling it",
+	1<<20,
+)
+
+// ReconcileRaftLogSize recomputes the size of the replica's Raft log from
+// storage and, if it differs from the size tracked by the replica, corrects
+// the tracked size. It returns whether the tracked size was corrected and the
+// difference between the recomputed and the tracked size. If the tracked size
+// is trusted but off by more than kv.raft_log.size_reconciliation_max_delta,
+// it is left alone and a *RaftLogSizeMismatchError is returned instead. A
+// tracked size which isn't trusted is always corrected.
+func (r *Replica) ReconcileRaftLogSize(
+	ctx context.Context,
+) (corrected bool, delta int64, _ error) {
+	// Holding raftMu prevents the log from changing between recomputing its
+	// size and correcting the tracked size.
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+	entriesBytes, sideloadedBytes, err := computeRaftLogSizeComponents(
+		ctx, r.RangeID, r.store.Engine(), r.raftMu.sideloaded,
+	)
+	if err != nil {
+		return false, 0, err
+	}
+	recomputed := entriesBytes + sideloadedBytes
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delta = recomputed - r.mu.raftLogSize
+	if delta == 0 {
+		r.mu.raftLogSizeTrusted = true
+		return false, 0, nil
+	}
+	maxDelta := raftLogSizeReconcileMaxDelta.Get(&r.store.cfg.Settings.SV)
+	if r.mu.raftLogSizeTrusted && (delta > maxDelta || -delta > maxDelta) {
+		return false, delta, &RaftLogSizeMismatchError{
+			RangeID: r.RangeID,
+			RaftLogSizeBreakdown: RaftLogSizeBreakdown{
+				EntriesBytes:    entriesBytes,
+				SideloadedBytes: sideloadedBytes,
+				Tracked:         r.mu.raftLogSize,
+				TrackedTrusted:  r.mu.raftLogSizeTrusted,
+				Recomputed:      recomputed,
+			},
+		}
+	}
+	log.Infof(ctx, "correcting tracked raft log size %s (trusted: %t) by %d bytes to %s",
+		humanizeutil.IBytes(r.mu.raftLogSize), r.mu.raftLogSizeTrusted, delta,
+		humanizeutil.IBytes(recomputed))
+	r.mu.raftLogSize = recomputed
+	r.mu.raftLogLastCheckSize = recomputed
+	r.mu.raftLogSizeTrusted = true
+	return true, delta, nil
+}
+
+// RaftLogSizeMismatchError is returned from AssertRaftLogSizeInSync if the
+// Raft log size tracked by a replica differs from the size recomputed from
+// storage.
+type RaftLogSizeMismatchError struct {
+	RangeID roachpb.RangeID
+	RaftLogSizeBreakdown
+}
+
+func (e *RaftLogSizeMismatchError) Error() string {
+	return fmt.Sprintf("r%d: tracked raft log size %d (trusted: %t) is off by %d bytes from the "+
+		"recomputed size %d (%d bytes of entries, %d bytes of sideloaded payloads)",
+		e.RangeID, e.Tracked, e.TrackedTrusted, e.Tracked-e.Recomputed,
+		e.Recomputed, e.EntriesBytes, e.SideloadedBytes)
+}
+
+// AssertRaftLogSizeInSync recomputes the size of the replica's Raft log and
+// returns a *RaftLogSizeMismatchError if it differs from the size tracked by
+// the replica. It is safe to call on a live replica, but blocks the processing
+// of Raft ready updates while the size is recomputed, which can take a while
+// for large logs.
+func (r *Replica) AssertRaftLogSizeInSync(ctx context.Context) error {
+	breakdown, err := r.RaftLogSizeBreakdown(ctx)
+	if err != nil {
+		return err
+	}
+	log.VEventf(ctx, 2, "raft log size breakdown: %+v", breakdown)
+	if breakdown.Tracked != breakdown.Recomputed {
+		return &RaftLogSizeMismatchError{RangeID: r.RangeID, RaftLogSizeBreakdown: breakdown}
+	}
+	return nil
 }
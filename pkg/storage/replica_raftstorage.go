@@ -21,6 +21,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/storage/raftentry"
@@ -85,8 +86,8 @@ func (r *replicaRaftStorage) Entries(lo, hi, maxBytes uint64) ([]raftpb.Entry, e
 	if r.raftMu.sideloaded == nil {
 		return nil, errors.New("sideloaded storage is uninitialized")
 	}
-	return entries(ctx, r.mu.stateLoader, readonly, r.RangeID, r.store.raftEntryCache,
-		r.raftMu.sideloaded, lo, hi, maxBytes)
+	return entries(ctx, r.store.cfg.Settings, r.mu.stateLoader, readonly, r.RangeID,
+		r.store.raftEntryCache, r.raftMu.sideloaded, lo, hi, maxBytes)
 }
 
 // raftEntriesLocked requires that r.mu is held.
@@ -97,9 +98,11 @@ func (r *Replica) raftEntriesLocked(lo, hi, maxBytes uint64) ([]raftpb.Entry, er
 // entries retrieves entries from the engine. To accommodate loading the term,
 // `sideloaded` can be supplied as nil, in which case sideloaded entries will
 // not be inlined, the raft entry cache will not be populated with *any* of the
-// loaded entries, and maxBytes will not be applied to the payloads.
+// loaded entries, and maxBytes will not be applied to the payloads. The
+// settings are only consulted when inlining sideloaded entries and may be nil.
 func entries(
 	ctx context.Context,
+	st *cluster.Settings,
 	rsl stateloader.StateLoader,
 	e engine.Reader,
 	rangeID roachpb.RangeID,
@@ -148,7 +151,7 @@ func entries(
 			canCache = canCache && sideloaded != nil
 			if sideloaded != nil {
 				newEnt, err := maybeInlineSideloadedRaftCommand(
-					ctx, rangeID, ent, sideloaded, eCache,
+					ctx, st, rangeID, ent, sideloaded, eCache,
 				)
 				if err != nil {
 					return true, err
@@ -277,7 +280,8 @@ func term(
 ) (uint64, error) {
 	// entries() accepts a `nil` sideloaded storage and will skip inlining of
 	// sideloaded entries. We only need the term, so this is what we do.
-	ents, err := entries(ctx, rsl, eng, rangeID, eCache, nil /* sideloaded */, i, i+1, math.MaxUint64 /* maxBytes */)
+	ents, err := entries(ctx, nil /* st */, rsl, eng, rangeID, eCache, nil, /* sideloaded */
+		i, i+1, math.MaxUint64 /* maxBytes */)
 	if err == raft.ErrCompacted {
 		ts, _, err := rsl.LoadRaftTruncatedState(ctx, eng)
 		if err != nil {
@@ -1003,6 +1007,9 @@ func (r *Replica) applySnapshot(
 	// Snapshots typically have fewer log entries than the leaseholder. The next
 	// time we hold the lease, recompute the log size before making decisions.
 	r.mu.raftLogSizeTrusted = false
+	// The snapshot replaces the log entries whose sideloaded payloads may have
+	// been quarantined.
+	quarantined := r.mu.quarantinedIndex != 0
 	r.assertStateLocked(ctx, r.store.Engine())
 	r.mu.Unlock()
 
@@ -1013,6 +1020,12 @@ func (r *Replica) applySnapshot(
 		roachpb.RangeFeedRetryError_REASON_RAFT_SNAPSHOT,
 	)
 
+	if quarantined {
+		if err := r.clearSideloadQuarantineRaftMuLocked(); err != nil {
+			log.Warningf(ctx, "unable to clear sideloaded quarantine marker: %s", err)
+		}
+	}
+
 	// Update the replica's cached byte thresholds. This is a no-op if the system
 	// config is not available, in which case we rely on the next gossip update
 	// to perform the update.
@@ -13,31 +13,268 @@
 package storage
 
 import (
+	"archive/tar"
 	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/storage/raftentry"
+	"github.com/cockroachdb/cockroach/pkg/storage/storagebase"
 	"github.com/cockroachdb/cockroach/pkg/storage/storagepb"
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/pkg/errors"
 	"go.etcd.io/etcd/raft/raftpb"
 )
 
+// sideloadingEnabled controls whether AddSSTable proposals use the sideloaded
+// Raft command encoding. When disabled, new proposals use the standard
+// encoding and keep their payloads inline in the Raft log. Entries which were
+// sideloaded before the setting was changed can still be inlined as usual.
+var sideloadingEnabled = settings.RegisterBoolSetting(
+	"kv.raft_log.sideloading.enabled",
+	"set to false to keep AddSSTable payloads inline in the Raft log instead of sideloading them",
+	true,
+)
+
+// sideloadReadRepairEnabled controls whether the Raft log queue restores the
+// missing sideloaded files of entries in the Raft log from the payloads held
+// by the Raft entry cache (see Replica.repairSideloaded).
+var sideloadReadRepairEnabled = settings.RegisterBoolSetting(
+	"kv.raft_log.sideloading.read_repair.enabled",
+	"if set, missing sideloaded files of untruncated Raft entries are restored from the Raft entry cache",
+	false,
+)
+
+// sideloadSkipRemovalPending controls whether replicas which are pending
+// removal keep the payloads of the entries they append inline in the Raft log
+// instead of sideloading them. Their sideloaded files would be deleted along
+// with the replica shortly after being written. Inlined entries are applied
+// like sideloaded ones, so that the replica keeps working if it isn't removed
+// after all. It is disabled by default, as it makes the Raft log of such
+// replicas larger.
+var sideloadSkipRemovalPending = settings.RegisterBoolSetting(
+	"kv.raft_log.sideloading.skip_removal_pending.enabled",
+	"if set, replicas pending removal keep the payloads of appended Raft entries inline instead of sideloading them",
+	false,
+)
+
+// sideloadCRCVerificationEnabled controls whether inlining a sideloaded
+// entry verifies the payload read from the sideloaded storage against the
+// CRC32 computed when the command was proposed. This catches the corruption
+// of sideloaded files before a corrupt SSTable is applied.
+var sideloadCRCVerificationEnabled = settings.RegisterBoolSetting(
+	"kv.raft_log.sideloading.verify_crc.enabled",
+	"if set, sideloaded payloads are verified against the checksum of their command when they are inlined",
+	true,
+)
+
+// sideloadCRCVerificationAlwaysBelow is the size below which sideloaded
+// payloads are always verified when they are inlined. Larger payloads, for
+// which computing the CRC32 adds noticeably to the CPU cost of snapshots, are
+// verified at the rate given by sideloadCRCVerificationSampleRate.
+var sideloadCRCVerificationAlwaysBelow = settings.RegisterByteSizeSetting(
+	"kv.raft_log.sideloading.verify_crc.always_below_size",
+	"sideloaded payloads smaller than this size are always verified against the checksum of their command when they are inlined",
+	1<<20, // 1 MiB
+)
+
+// sideloadCRCVerificationSampleRate controls how many of the inlined
+// sideloaded payloads of at least sideloadCRCVerificationAlwaysBelow bytes are
+// verified: one in every this many. A corrupt payload is thus caught with a
+// probability of one in this many per read, and eventually if it is read
+// repeatedly, as by the snapshots of a lagging follower.
+var sideloadCRCVerificationSampleRate = settings.RegisterPositiveIntSetting(
+	"kv.raft_log.sideloading.verify_crc.sample_rate",
+	"one in this many sideloaded payloads above kv.raft_log.sideloading.verify_crc.always_below_size is verified against the checksum of its command when inlined",
+	10,
+)
+
+// sideloadCRCVerificationSampledReads counts the inlined sideloaded payloads
+// which were subject to sampling. Counting, rather than drawing random
+// numbers, verifies exactly one in every sample rate payloads.
+var sideloadCRCVerificationSampledReads uint64
+
+// shouldVerifySideloadedCRC returns whether a sideloaded payload of the given
+// size which is being inlined is to be verified against the CRC32 of its
+// command. Passing nil settings always verifies.
+func shouldVerifySideloadedCRC(st *cluster.Settings, size int) bool {
+	if st == nil {
+		return true
+	}
+	if !sideloadCRCVerificationEnabled.Get(&st.SV) {
+		return false
+	}
+	if int64(size) < sideloadCRCVerificationAlwaysBelow.Get(&st.SV) {
+		return true
+	}
+	rate := uint64(sideloadCRCVerificationSampleRate.Get(&st.SV))
+	return atomic.AddUint64(&sideloadCRCVerificationSampledReads, 1)%rate == 0
+}
+
+// sideloadCompactionTriggerEnabled controls whether a compaction is suggested
+// for the span of a range which applies AddSSTable commands at a high rate.
+// Each applied SSTable is ingested as a separate file, so that continuous
+// ingestion into a range increases read amplification until the files are
+// compacted.
+var sideloadCompactionTriggerEnabled = settings.RegisterBoolSetting(
+	"kv.raft_log.sideloading.compaction_trigger.enabled",
+	"if set, a compaction is suggested for the span of ranges which apply AddSSTable commands at a high rate",
+	false,
+)
+
+// sideloadCompactionTriggerThreshold is the number of AddSSTable commands a
+// range has to apply within sideloadCompactionTriggerWindow for a compaction
+// of its span to be suggested.
+var sideloadCompactionTriggerThreshold = settings.RegisterPositiveIntSetting(
+	"kv.raft_log.sideloading.compaction_trigger.threshold",
+	"the number of AddSSTable commands applied to a range within a minute above which a compaction of its span is suggested",
+	100,
+)
+
+// sideloadIngestCompactionHintEnabled controls whether a compaction is
+// suggested for the key span of each applied AddSSTable command, which lets the
+// compactor prioritize the spans that received bulk ingestions. The compactor
+// only acts on the suggestions which meet its thresholds.
+var sideloadIngestCompactionHintEnabled = settings.RegisterBoolSetting(
+	"kv.raft_log.sideloading.ingest_compaction_hint.enabled",
+	"if set, a compaction is suggested for the key span of each applied AddSSTable command",
+	true,
+)
+
+// addSSTableCountInMemCopies controls whether the in-memory engines used by
+// tests and benchmarks count the SSTables they ingest as copies in
+// AddSSTableApplicationCopies. Such engines always write a copy of the SSTable
+// into their in-memory environment, which, unlike the copies written for
+// on-disk engines, isn't counted by default.
+var addSSTableCountInMemCopies = settings.RegisterBoolSetting(
+	"kv.bulk_ingest.count_in_memory_copies.enabled",
+	"if set, SSTables ingested by in-memory engines count as copies in the addsstable.copies metric",
+	false,
+)
+
+// sideloadCompactionTriggerWindow is the period over which AddSSTable
+// applications are counted against sideloadCompactionTriggerThreshold.
+const sideloadCompactionTriggerWindow = time.Minute
+
 var errSideloadedFileNotFound = errors.New("sideloaded file not found")
 
+// errSideloadRemovedConcurrently is returned from Get when the requested file
+// existed but was removed while the Get was in progress, for example by a
+// Clear or TruncateTo racing with it. Unlike a plain errSideloadedFileNotFound,
+// this doesn't mean that the payload was never there, and callers working off
+// a consistent view of the Raft log (such as a snapshot) may retry.
+//
+// Its cause is errSideloadedFileNotFound, so that callers which don't care
+// about the distinction can keep checking for the latter.
+type errSideloadRemovedConcurrently struct {
+	index, term uint64
+}
+
+func (e *errSideloadRemovedConcurrently) Error() string {
+	return fmt.Sprintf("sideloaded file at index %d term %d was removed concurrently", e.index, e.term)
+}
+
+// Cause implements errors.causer.
+func (e *errSideloadRemovedConcurrently) Cause() error {
+	return errSideloadedFileNotFound
+}
+
+// errSideloadExists is returned from PutIfAbsent when the slot at the given
+// index and term is already occupied by a different payload.
+var errSideloadExists = errors.New("sideloaded file already exists with different contents")
+
+// sideloadTermRegressionError is returned from PutMonotonic when a payload
+// already exists at the given index with a higher term than the one being
+// written.
+type sideloadTermRegressionError struct {
+	index, term, existingTerm uint64
+}
+
+func (e *sideloadTermRegressionError) Error() string {
+	return fmt.Sprintf("refusing to write sideloaded payload at index %d term %d: "+
+		"term %d is already present", e.index, e.term, e.existingTerm)
+}
+
+// sideloadStorageFullError is returned when writing a payload to a storage
+// which already holds the maximum number of files allowed for a range (see
+// sideloadMaxFilesPerRange), none of which can be removed. Nothing has been
+// written when it is returned.
+type sideloadStorageFullError struct {
+	index, term uint64
+	maxFiles    int64
+}
+
+func (e *sideloadStorageFullError) Error() string {
+	return fmt.Sprintf("cannot sideload payload at index %d term %d: storage holds the maximum of %d files, "+
+		"none of which belong to truncated entries", e.index, e.term, e.maxFiles)
+}
+
 // SideloadStorage is the interface used for Raft SSTable sideloading.
 // Implementations do not need to be thread safe.
 type SideloadStorage interface {
 	// The directory in which the sideloaded files are stored. May or may not
 	// exist.
 	Dir() string
+	// Identity returns the range and replica ID this storage was created for.
+	// Note that the on-disk location of the storage no longer depends on the
+	// replica ID (see sideloadedPath).
+	Identity() (roachpb.RangeID, roachpb.ReplicaID)
 	// Writes the given contents to the file specified by the given index and
 	// term. Overwrites the file if it already exists.
 	Put(_ context.Context, index, term uint64, contents []byte) error
+	// PutMany is like calling Put for each of the given entries, in order,
+	// but allows implementations to amortize the cost of durably writing the
+	// files across the batch. If it returns an error, the files written by the
+	// call have been removed again, so that no payload of the batch is left
+	// behind without its entry having been appended.
+	PutMany(_ context.Context, entries []storagebase.SideloadEntry) error
+	// PutIfAbsent is like Put, but never overwrites an existing file. If the
+	// file at the given index and term already exists, it returns false and
+	// either no error (if the contents match) or errSideloadExists (if they
+	// differ).
+	PutIfAbsent(_ context.Context, index, term uint64, contents []byte) (bool, error)
+	// PutMonotonic is like Put, but returns a *sideloadTermRegressionError if
+	// a file at the given index but a higher term already exists. Writing at
+	// the same or a higher term than any existing file is allowed; callers that
+	// mean to replace a higher term must use Put explicitly.
+	PutMonotonic(_ context.Context, index, term uint64, contents []byte) error
 	// Load the file at the given index and term. Return errSideloadedFileNotFound when no
-	// such file is present.
+	// such file is present, or an *errSideloadRemovedConcurrently (whose cause
+	// is errSideloadedFileNotFound) if the file is known to have existed but
+	// was removed concurrently.
 	Get(_ context.Context, index, term uint64) ([]byte, error)
+	// HasEntry returns whether a file exists at the given index and term,
+	// without reading it. A file for which it returns true may still fail to
+	// be read by Get, for instance because it is corrupt or was removed
+	// concurrently.
+	HasEntry(_ context.Context, index, term uint64) (bool, error)
+	// Stat returns the size and modification time of the payload at the given
+	// index and term without reading it, or errSideloadedFileNotFound if there
+	// is no such payload.
+	Stat(_ context.Context, index, term uint64) (storagebase.SideloadFileInfo, error)
+	// GetRange is like Get, but returns an SSTable holding only the entries of
+	// the stored SSTable whose keys lie in [start, end), or nil if there are
+	// none. Implementations avoid reading the parts of the payload outside of
+	// the range where possible.
+	GetRange(_ context.Context, index, term uint64, start, end roachpb.Key) ([]byte, error)
 	// Purge removes the file at the given index and term. It may also
 	// remove any leftover files at the same index and earlier terms, but
 	// is not required to do so. When no file at the given index and term
@@ -48,12 +285,568 @@ type SideloadStorage interface {
 	// Clear files that may have been written by this SideloadStorage.
 	Clear(context.Context) error
 	// TruncateTo removes all files belonging to an index strictly smaller than
-	// the given one. Returns the number of bytes freed, the number of bytes in
-	// files that remain, or an error.
+	// the given one. Returns the number of bytes freed and the number of bytes
+	// in files that remain. On error, the bytes freed by the files removed
+	// before it occurred are returned along with it.
 	TruncateTo(_ context.Context, index uint64) (freed, retained int64, _ error)
 	// Returns an absolute path to the file that Get() would return the contents
-	// of. Does not check whether the file actually exists.
+	// of. Does not check whether the file actually exists. The file may hold
+	// the contents in compressed form (see sideloadCompressionEnabled).
 	Filename(_ context.Context, index, term uint64) (string, error)
+	// ForEach calls visit with the index, term and size of each stored
+	// payload, in increasing order of index and then term, regardless of the
+	// implementation. The size is that of the payload, as accounted for in the
+	// size of the Raft log. Iteration stops at the first error returned from
+	// visit, which is passed through. The storage must not be modified by
+	// visit.
+	ForEach(_ context.Context, visit func(index, term uint64, size int64) error) error
+	// IsEmpty returns whether the storage holds no payloads. It is cheaper
+	// than enumerating the payloads when only their presence matters.
+	IsEmpty(context.Context) (bool, error)
+	// State returns whether the location backing the storage (for example
+	// the directory of the disk storage) has been created, and if so whether
+	// it holds any payloads. Errors encountered while determining the state
+	// are treated as the location being non-empty.
+	State() storagebase.SideloadDirState
+	// BytesUsed returns the number of bytes taken up by the storage.
+	BytesUsed(context.Context) (int64, error)
+}
+
+// sideloadMetrics holds the store metrics which the sideloaded storages of a
+// store update as they write and remove payloads. A nil *sideloadMetrics is
+// valid and updates nothing.
+//
+// The storages only learn the total size of their payloads lazily, for example
+// on the first truncation after a restart. Until then, the payloads a storage
+// held before it was created aren't part of the resident bytes.
+type sideloadMetrics struct {
+	bytesWritten   *metric.Counter
+	bytesTruncated *metric.Counter
+	bytesResident  *metric.Gauge
+	externalErrors *metric.Counter
+}
+
+func newSideloadMetrics(m *StoreMetrics) *sideloadMetrics {
+	return &sideloadMetrics{
+		bytesWritten:   m.SideloadBytesWritten,
+		bytesTruncated: m.SideloadBytesTruncated,
+		bytesResident:  m.SideloadBytesResident,
+		externalErrors: m.SideloadExternalErrors,
+	}
+}
+
+// externalFailed records that an operation on the external object store of a
+// cloud sideloaded storage failed or timed out.
+func (m *sideloadMetrics) externalFailed() {
+	if m == nil {
+		return
+	}
+	m.externalErrors.Inc(1)
+}
+
+// written records that payloads of the given total size were written.
+func (m *sideloadMetrics) written(bytes int64) {
+	if m == nil {
+		return
+	}
+	m.bytesWritten.Inc(bytes)
+}
+
+// truncated records that payloads of the given total size were removed by a
+// truncation.
+func (m *sideloadMetrics) truncated(bytes int64) {
+	if m == nil {
+		return
+	}
+	m.bytesTruncated.Inc(bytes)
+}
+
+// updateResident records that a storage now holds payloads of the given total
+// size. accounted is the size the storage reported last, which is updated.
+func (m *sideloadMetrics) updateResident(accounted *int64, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.bytesResident.Inc(bytes - *accounted)
+	*accounted = bytes
+}
+
+// sideloadedSSTableRange returns an SSTable holding the entries of the
+// SSTable read by the given iterator whose keys lie in [start, end), or nil if
+// there are none. The iterator is closed.
+func sideloadedSSTableRange(iter engine.SimpleIterator, start, end roachpb.Key) ([]byte, error) {
+	defer iter.Close()
+	sst, err := engine.MakeRocksDBSstFileWriter()
+	if err != nil {
+		return nil, err
+	}
+	defer sst.Close()
+	var empty = true
+	for iter.Seek(engine.MakeMVCCMetadataKey(start)); ; iter.Next() {
+		if ok, err := iter.Valid(); err != nil {
+			return nil, err
+		} else if !ok || !iter.UnsafeKey().Key.Less(end) {
+			break
+		}
+		if err := sst.Add(engine.MVCCKeyValue{Key: iter.UnsafeKey(), Value: iter.UnsafeValue()}); err != nil {
+			return nil, err
+		}
+		empty = false
+	}
+	if empty {
+		return nil, nil
+	}
+	return sst.Finish()
+}
+
+// sideloadFilename returns the base name of the file holding the payload at
+// the given index and term.
+func sideloadFilename(index, term uint64) string {
+	return fmt.Sprintf("i%d.t%d", index, term)
+}
+
+// sortSideloadKeys sorts the given keys in increasing order of index and then
+// term, which is the order in which SideloadStorage.ForEach visits payloads.
+func sortSideloadKeys(keys []slKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].index != keys[j].index {
+			return keys[i].index < keys[j].index
+		}
+		return keys[i].term < keys[j].term
+	})
+}
+
+// parseSideloadFilename is the inverse of sideloadFilename.
+func parseSideloadFilename(name string) (index, term uint64, _ error) {
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "i") || !strings.HasPrefix(parts[1], "t") {
+		return 0, 0, errors.Errorf("malformed sideloaded file name %q", name)
+	}
+	index, err := strconv.ParseUint(parts[0][1:], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "while parsing %q", name)
+	}
+	term, err = strconv.ParseUint(parts[1][1:], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "while parsing %q", name)
+	}
+	return index, term, nil
+}
+
+// writeSideloadArchive writes all payloads stored in ss into a tar archive, in
+// increasing order of index and then term (see SideloadStorage.ForEach). Each
+// entry is named like the file backing it (see sideloadFilename), and all
+// header fields which aren't derived from the payload are left at their zero
+// value so that the output only depends on the stored data.
+func writeSideloadArchive(ctx context.Context, w io.Writer, ss SideloadStorage) error {
+	var keys []slKey
+	if err := ss.ForEach(ctx, func(index, term uint64, _ int64) error {
+		keys = append(keys, slKey{index: index, term: term})
+		return nil
+	}); err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data, err := ss.Get(ctx, k.index, k.term)
+		if err != nil {
+			return errors.Wrapf(err, "while archiving index %d term %d", k.index, k.term)
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     sideloadFilename(k.index, k.term),
+			Mode:     0644,
+			Size:     int64(len(data)),
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// restoreSideloadArchive reads a tar archive written by writeSideloadArchive
+// and puts each contained payload into ss, overwriting any existing ones.
+func restoreSideloadArchive(ctx context.Context, r io.Reader, ss SideloadStorage) error {
+	tr := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "while reading sideloaded archive")
+		}
+		index, term, err := parseSideloadFilename(hdr.Name)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return errors.Wrapf(err, "while reading %q from sideloaded archive", hdr.Name)
+		}
+		if err := ss.Put(ctx, index, term, data); err != nil {
+			return err
+		}
+	}
+}
+
+// moveSideloadStorage moves all payloads stored in src into dst, under the
+// same indexes and terms, and then clears src. Like the renaming of the
+// directory of a disk storage when the replica ID changes (see
+// moveSideloadedData), it relocates the payloads of a replica, but it works
+// for any pair of storages, for example ones backed by different engines.
+//
+// All payloads are copied before src is cleared, so that an error while
+// copying leaves src intact and dst holding a subset of the payloads. Since the
+// copies overwrite the payloads already in dst, the move can simply be retried
+// after it is interrupted. Once all payloads have been copied, dst is
+// complete, so a failure to clear src is logged rather than returned.
+func moveSideloadStorage(ctx context.Context, src, dst SideloadStorage) error {
+	if err := copySideloadStorage(ctx, src, dst); err != nil {
+		return err
+	}
+	if err := src.Clear(ctx); err != nil {
+		log.Warningf(ctx, "unable to clear sideloaded storage %s after moving it to %s: %s",
+			src.Dir(), dst.Dir(), err)
+	}
+	return nil
+}
+
+// copySideloadStorage copies all payloads stored in src into dst, under the
+// same indexes and terms. It is the first step of moveSideloadStorage.
+func copySideloadStorage(ctx context.Context, src, dst SideloadStorage) error {
+	var keys []slKey
+	if err := src.ForEach(ctx, func(index, term uint64, _ int64) error {
+		keys = append(keys, slKey{index: index, term: term})
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data, err := src.Get(ctx, k.index, k.term)
+		if err != nil {
+			return errors.Wrapf(err, "while moving index %d term %d", k.index, k.term)
+		}
+		if err := dst.Put(ctx, k.index, k.term, data); err != nil {
+			return errors.Wrapf(err, "while moving index %d term %d", k.index, k.term)
+		}
+	}
+	return nil
+}
+
+// SideloadKey identifies a sideloaded payload by the index and term of the
+// Raft log entry it belongs to.
+type SideloadKey struct {
+	Index, Term uint64
+}
+
+// CanSnapshotInline checks whether all sideloaded entries in the Raft log
+// index range [lo, hi) can currently be inlined, i.e. whether a snapshot
+// containing them could be sent. It returns false along with the index and term
+// of each entry whose payload can't be found. Snapshot senders can use this to
+// fail fast instead of running into errMustRetrySnapshotDueToTruncation midway
+// through streaming the snapshot.
+//
+// Note that log truncations may still remove payloads after this method
+// returns, so senders must continue to handle that error.
+func (r *Replica) CanSnapshotInline(
+	ctx context.Context, lo, hi uint64,
+) (bool, []SideloadKey, error) {
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+
+	var missing []SideloadKey
+	var ent raftpb.Entry
+	scanFunc := func(kv roachpb.KeyValue) (bool, error) {
+		if err := kv.Value.GetProto(&ent); err != nil {
+			return false, err
+		}
+		if !sniffSideloadedRaftCommand(ent.Data) {
+			return false, nil
+		}
+		if ok, err := hasSideloadedPayload(
+			ctx, r.RangeID, ent, r.raftMu.sideloaded, r.store.raftEntryCache,
+		); err != nil {
+			return false, err
+		} else if !ok {
+			missing = append(missing, SideloadKey{Index: ent.Index, Term: ent.Term})
+		}
+		return false, nil
+	}
+	if err := iterateEntries(ctx, r.store.Engine(), r.RangeID, lo, hi, scanFunc); err != nil {
+		return false, nil, err
+	}
+	return len(missing) == 0, missing, nil
+}
+
+// SideloadedIndexBounds returns the lowest and highest index of the payloads
+// currently held by the sideloaded storage of the replica, or false if it holds
+// none. Comparing the lowest index to the truncated index of the Raft log shows
+// how far the removal of sideloaded payloads lags behind log truncation.
+func (r *Replica) SideloadedIndexBounds(
+	ctx context.Context,
+) (oldest, newest uint64, ok bool, _ error) {
+	// Holding raftMu prevents the sideloaded storage from being modified while
+	// it is read.
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+
+	sideloaded := r.raftMu.sideloaded
+	if sideloaded == nil {
+		return 0, 0, false, errors.New("replica has no sideloaded storage")
+	}
+	if err := sideloaded.ForEach(ctx, func(index, _ uint64, _ int64) error {
+		// ForEach visits the payloads in increasing order of index.
+		if !ok {
+			oldest, ok = index, true
+		}
+		newest = index
+		return nil
+	}); err != nil {
+		return 0, 0, false, err
+	}
+	return oldest, newest, ok, nil
+}
+
+// SideloadTruncationLag reports how far the removal of the sideloaded payloads
+// of the replica lags behind its Raft log. It returns the lowest index of the
+// payloads held by the sideloaded storage (zero if it holds none), the
+// committed index of the Raft log, and the number of payloads at indexes below
+// the one to which the log can currently be truncated (see
+// MinSafeTruncationIndex), all of which are pending reclamation.
+//
+// Many payloads pending reclamation point to truncation falling behind, while
+// sideloaded growth without them points to payloads being ingested faster than
+// the log can be truncated.
+func (r *Replica) SideloadTruncationLag(
+	ctx context.Context,
+) (oldestIndex, committedIndex uint64, estimatedFiles int, _ error) {
+	safeIndex, err := r.MinSafeTruncationIndex(ctx)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	r.mu.RLock()
+	if status := r.raftStatusRLocked(); status != nil {
+		committedIndex = status.Commit
+	} else {
+		// Without a Raft group, the applied index is the best lower bound.
+		committedIndex = r.mu.state.RaftAppliedIndex
+	}
+	r.mu.RUnlock()
+
+	// Holding raftMu prevents the sideloaded storage from being modified while
+	// it is read.
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+
+	sideloaded := r.raftMu.sideloaded
+	if sideloaded == nil {
+		return 0, 0, 0, errors.New("replica has no sideloaded storage")
+	}
+	var found bool
+	if err := sideloaded.ForEach(ctx, func(index, _ uint64, _ int64) error {
+		// ForEach visits the payloads in increasing order of index.
+		if !found {
+			oldestIndex, found = index, true
+		}
+		if index < safeIndex {
+			estimatedFiles++
+		}
+		return nil
+	}); err != nil {
+		return 0, 0, 0, err
+	}
+	return oldestIndex, committedIndex, estimatedFiles, nil
+}
+
+// sideloadQuarantineMarkerPath returns the path of the file which records that
+// the sideloaded storage of the given range was quarantined, along with the
+// last index of the Raft log at that time, so that the replica keeps trying to
+// recover across restarts (see NeedsSnapshot). It is kept next to the
+// directory which the storage uses on the store's engine.
+func sideloadQuarantineMarkerPath(baseDir string, rangeID roachpb.RangeID) string {
+	return sideloadedPath(baseDir, rangeID) + ".quarantined"
+}
+
+// quarantineSideloaded moves the files of the sideloaded storage of the
+// replica into the quarantine area, where they are preserved for
+// investigation, and marks the replica as needing the affected entries to be
+// removed from its Raft log (see NeedsSnapshot). This is meant for a
+// sideloaded storage found to be corrupt, whose payloads would otherwise fail
+// every read. Once the replica has been marked, further calls are no-ops until
+// it has recovered.
+func (r *Replica) quarantineSideloaded(ctx context.Context) error {
+	// Holding raftMu prevents the sideloaded storage from being used while its
+	// files are moved.
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+
+	if r.NeedsSnapshot() {
+		return nil
+	}
+	r.mu.RLock()
+	lastIndex := r.mu.lastIndex
+	r.mu.RUnlock()
+
+	sideloaded := r.raftMu.sideloaded
+	if sideloaded == nil {
+		return errors.New("replica has no sideloaded storage")
+	}
+	// The marker is written first, so that a crash while the files are moved
+	// doesn't leave the replica without the payloads and unaware of it.
+	path := sideloadQuarantineMarkerPath(r.store.engine.GetAuxiliaryDir(), r.RangeID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := writeFileSyncing(
+		ctx, path, []byte(strconv.FormatUint(lastIndex, 10)), r.store.engine, 0644, r.ClusterSettings(),
+	); err != nil {
+		return errors.Wrap(err, "while marking sideloaded storage as quarantined")
+	}
+	if disk, ok := sideloaded.(*diskSideloadStorage); ok {
+		to, err := disk.quarantine(ctx)
+		if err != nil {
+			return err
+		}
+		if to != "" {
+			log.Warningf(ctx, "moved sideloaded directory %s to %s", disk.Dir(), to)
+		}
+	}
+	if err := sideloaded.Clear(ctx); err != nil {
+		return err
+	}
+	// The cached entries may hold payloads which were inlined from the
+	// quarantined files.
+	r.store.raftEntryCache.Drop(r.RangeID)
+
+	r.mu.Lock()
+	r.mu.quarantinedIndex = lastIndex
+	r.mu.Unlock()
+	return nil
+}
+
+// loadSideloadQuarantineRaftMuLockedMuLocked restores the index
+// recorded by quarantineSideloaded, if any, when the replica is initialized.
+func (r *Replica) loadSideloadQuarantineRaftMuLockedMuLocked() error {
+	path := sideloadQuarantineMarkerPath(r.store.engine.GetAuxiliaryDir(), r.RangeID)
+	if ok, err := exists(path); err != nil || !ok {
+		return err
+	}
+	b, err := r.store.engine.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	index, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "parsing %s", path)
+	}
+	r.mu.quarantinedIndex = index
+	return nil
+}
+
+// clearSideloadQuarantineRaftMuLocked forgets that the sideloaded storage of
+// the replica was quarantined, once the affected entries have been removed
+// from its Raft log.
+func (r *Replica) clearSideloadQuarantineRaftMuLocked() error {
+	r.mu.Lock()
+	r.mu.quarantinedIndex = 0
+	r.mu.Unlock()
+	path := sideloadQuarantineMarkerPath(r.store.engine.GetAuxiliaryDir(), r.RangeID)
+	if ok, err := exists(path); err != nil || !ok {
+		return err
+	}
+	return r.store.engine.DeleteFile(path)
+}
+
+// NeedsSnapshot returns whether the sideloaded storage of the replica has been
+// quarantined, and the Raft log of the replica still holds entries whose
+// payloads were lost in the process. The replica recovers once these entries
+// have been truncated from its log (see quarantinedLogTruncation) or replaced
+// by a snapshot.
+func (r *Replica) NeedsSnapshot() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.needsSnapshotRLocked()
+}
+
+func (r *Replica) needsSnapshotRLocked() bool {
+	return r.mu.quarantinedIndex > r.mu.state.TruncatedState.Index
+}
+
+// quarantinedLogTruncation returns the first index to keep when truncating the
+// Raft log of a replica whose sideloaded storage was quarantined, and false if
+// no such truncation is necessary or possible. Only applied entries are
+// truncated; the remaining affected ones are truncated on a later attempt,
+// after they have been applied. Once the replica has recovered, the
+// quarantine is cleared.
+func (r *Replica) quarantinedLogTruncation(ctx context.Context) (uint64, bool) {
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+	r.mu.RLock()
+	quarantinedIndex := r.mu.quarantinedIndex
+	needsSnapshot := r.needsSnapshotRLocked()
+	index := r.mu.state.RaftAppliedIndex
+	truncatedIndex := r.mu.state.TruncatedState.Index
+	r.mu.RUnlock()
+
+	if quarantinedIndex == 0 {
+		return 0, false
+	}
+	if !needsSnapshot {
+		if err := r.clearSideloadQuarantineRaftMuLocked(); err != nil {
+			log.Warningf(ctx, "unable to clear sideloaded quarantine marker: %s", err)
+		}
+		return 0, false
+	}
+	if quarantinedIndex < index {
+		index = quarantinedIndex
+	}
+	if index <= truncatedIndex {
+		return 0, false
+	}
+	return index + 1, true
+}
+
+// ExpectedSideloadedFiles returns the keys of the payloads which sideloaded
+// storage should hold for the given Raft log entries, in the order of the
+// entries. These are the entries carrying a sideloaded command whose payload
+// has been removed from the entry. Comparing the result against the
+// payloads visited by SideloadStorage.ForEach reveals missing and extraneous
+// files.
+func ExpectedSideloadedFiles(_ context.Context, entries []raftpb.Entry) ([]SideloadKey, error) {
+	var keys []SideloadKey
+	for _, ent := range entries {
+		if !sniffSideloadedRaftCommand(ent.Data) {
+			continue
+		}
+		_, data := DecodeRaftCommand(ent.Data)
+		var command storagepb.RaftCommand
+		if err := protoutil.Unmarshal(data, &command); err != nil {
+			return nil, errors.Wrapf(err, "while decoding entry at index %d term %d", ent.Index, ent.Term)
+		}
+		field, ok := findSideloadableField(&command)
+		if !ok {
+			return nil, errors.Errorf(
+				"sideloaded entry at index %d term %d has no %s", ent.Index, ent.Term, sideloadableFieldNames())
+		}
+		if payload, _ := field.get(&command); len(payload) > 0 {
+			// The entry is already inlined, see maybeInlineSideloadedRaftCommand.
+			continue
+		}
+		keys = append(keys, SideloadKey{Index: ent.Index, Term: ent.Term})
+	}
+	return keys, nil
 }
 
 // maybeSideloadEntriesRaftMuLocked should be called with a slice of "fat"
@@ -67,18 +860,73 @@ type SideloadStorage interface {
 func (r *Replica) maybeSideloadEntriesRaftMuLocked(
 	ctx context.Context, entriesToAppend []raftpb.Entry,
 ) (_ []raftpb.Entry, sideloadedEntriesSize int64, _ error) {
-	return maybeSideloadEntriesImpl(ctx, entriesToAppend, r.raftMu.sideloaded)
+	if sideloadSkipRemovalPending.Get(&r.ClusterSettings().SV) {
+		r.mu.RLock()
+		removalPending := r.mu.destroyStatus.reason == destroyReasonRemovalPending
+		r.mu.RUnlock()
+		if removalPending {
+			log.Event(ctx, "replica is pending removal; keeping payloads inline")
+			return entriesToAppend, 0, nil
+		}
+	}
+	return maybeSideloadEntriesImpl(
+		ctx, r.ClusterSettings(), entriesToAppend, r.raftMu.sideloaded, r.store.cfg.SideloadPlacementPolicy,
+	)
 }
 
+// SideloadPlacementInfo describes a sideloadable entry to a
+// SideloadPlacementPolicy.
+type SideloadPlacementInfo struct {
+	Index, Term uint64
+	// Size is the size of the payload in bytes.
+	Size int
+	// Command is the Raft command carrying the payload, with the payload
+	// inlined. It must not be mutated.
+	Command *storagepb.RaftCommand
+}
+
+// SideloadPlacementPolicy decides whether the payload of an entry is
+// sideloaded (true) or kept inline in the Raft log (false). Entries kept inline
+// retain the sideloaded command encoding; the inlining path recognizes them as
+// already inlined, so both choices are transparent to snapshots and to the
+// application of the entry.
+type SideloadPlacementPolicy func(SideloadPlacementInfo) bool
+
 // maybeSideloadEntriesImpl iterates through the provided slice of entries. If
 // no sideloadable entries are found, it returns the same slice. Otherwise, it
 // returns a new slice in which all applicable entries have been sideloaded to
 // the specified SideloadStorage.
+//
+// When sideloading is disabled via the kv.raft_log.sideloading.enabled cluster
+// setting, the entries are returned unchanged. This also covers sideloadable
+// entries that were proposed before the setting change propagated; these are
+// written to the log with their payloads inlined, which the inlining path
+// handles transparently.
+//
+// If a placement policy is supplied, entries for which it returns false keep
+// their payloads inline. A nil policy sideloads all sideloadable entries.
+//
+// If the storage refuses the payloads because it holds the maximum number of
+// files allowed for the range, they are kept inline as well. Failing here
+// would be fatal to the replica, while the log simply grows larger until it
+// is truncated.
 func maybeSideloadEntriesImpl(
-	ctx context.Context, entriesToAppend []raftpb.Entry, sideloaded SideloadStorage,
+	ctx context.Context,
+	st *cluster.Settings,
+	entriesToAppend []raftpb.Entry,
+	sideloaded SideloadStorage,
+	policy SideloadPlacementPolicy,
 ) (_ []raftpb.Entry, sideloadedEntriesSize int64, _ error) {
+	if !sideloadingEnabled.Get(&st.SV) {
+		log.Event(ctx, "sideloading disabled; keeping payloads inline")
+		return entriesToAppend, 0, nil
+	}
 
 	cow := false
+	var toSideload []storagebase.SideloadEntry
+	// fat holds the original data of the entries in toSideload, in case they
+	// have to be kept inline after all.
+	var fat [][]byte
 	for i := range entriesToAppend {
 		if sniffSideloadedRaftCommand(entriesToAppend[i].Data) {
 			log.Event(ctx, "sideloading command in append")
@@ -99,39 +947,164 @@ func maybeSideloadEntriesImpl(
 				return nil, 0, err
 			}
 
-			if strippedCmd.ReplicatedEvalResult.AddSSTable == nil {
-				// Still no AddSSTable; someone must've proposed a v2 command
-				// but not because it contains an inlined SSTable. Strange, but
-				// let's be future proof.
+			field, ok := findSideloadableField(&strippedCmd)
+			if !ok {
+				// Still no sideloadable field; someone must've proposed a v2
+				// command but not because it contains an inlined payload.
+				// Strange, but let's be future proof.
 				log.Warning(ctx, "encountered sideloaded Raft command without inlined payload")
 				continue
 			}
 
-			// Actually strip the command.
-			dataToSideload := strippedCmd.ReplicatedEvalResult.AddSSTable.Data
-			strippedCmd.ReplicatedEvalResult.AddSSTable.Data = nil
-
-			// Marshal the command and attach to the Raft entry.
-			{
-				data := make([]byte, raftCommandPrefixLen+strippedCmd.Size())
-				encodeRaftCommandPrefix(data[:raftCommandPrefixLen], raftVersionSideloaded, cmdID)
-				_, err := protoutil.MarshalToWithoutFuzzing(&strippedCmd, data[raftCommandPrefixLen:])
-				if err != nil {
-					return nil, 0, errors.Wrap(err, "while marshaling stripped sideloaded command")
-				}
-				ent.Data = data
+			payload, _ := field.get(&strippedCmd)
+			if policy != nil && !policy(SideloadPlacementInfo{
+				Index:   ent.Index,
+				Term:    ent.Term,
+				Size:    len(payload),
+				Command: &strippedCmd,
+			}) {
+				log.Eventf(ctx, "keeping payload at index=%d term=%d inline", ent.Index, ent.Term)
+				continue
 			}
 
-			log.Eventf(ctx, "writing payload at index=%d term=%d", ent.Index, ent.Term)
-			if err := sideloaded.Put(ctx, ent.Index, ent.Term, dataToSideload); err != nil {
+			// Actually strip the command and attach it to the Raft entry.
+			data, dataToSideload, err := stripSideloadedRaftCommand(cmdID, &strippedCmd, field)
+			if err != nil {
 				return nil, 0, err
 			}
+			fat = append(fat, ent.Data)
+			ent.Data = data
+
+			log.Eventf(ctx, "writing payload at index=%d term=%d", ent.Index, ent.Term)
+			toSideload = append(toSideload, storagebase.SideloadEntry{
+				Index: ent.Index, Term: ent.Term, Contents: dataToSideload,
+			})
 			sideloadedEntriesSize += int64(len(dataToSideload))
 		}
 	}
+	// Writing the payloads together allows the SideloadStorage to sync them
+	// all at once.
+	var err error
+	switch len(toSideload) {
+	case 0:
+	case 1:
+		e := toSideload[0]
+		err = sideloaded.Put(ctx, e.Index, e.Term, e.Contents)
+	default:
+		err = sideloaded.PutMany(ctx, toSideload)
+	}
+	if keepSideloadedPayloadsInline(err) {
+		log.Eventf(ctx, "keeping %d payloads inline: %s", len(toSideload), err)
+		// toSideload and fat follow the order of the entries.
+		for i, j := 0, 0; j < len(toSideload); i++ {
+			if ent := &entriesToAppend[i]; ent.Index == toSideload[j].Index {
+				ent.Data = fat[j]
+				j++
+			}
+		}
+		return entriesToAppend, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
 	return entriesToAppend, sideloadedEntriesSize, nil
 }
 
+// keepSideloadedPayloadsInline returns whether the given error, returned from
+// writing the payloads of a Raft append to the sideloaded storage, is resolved
+// by keeping the payloads inline in the Raft log.
+func keepSideloadedPayloadsInline(err error) bool {
+	switch errors.Cause(err).(type) {
+	case *sideloadStorageFullError, *sideloadExternalStoreError:
+		return true
+	default:
+		return false
+	}
+}
+
+// sideloadableField describes a field of a Raft command which holds a large
+// payload that can be sideloaded. A sideloaded command carries the field with
+// its payload removed, and the payload is stored in SideloadStorage under the
+// index and term of the entry.
+type sideloadableField struct {
+	// name identifies the field in errors and traces.
+	name string
+	// get returns the payload of the field and whether the command carries the
+	// field. A carried field whose payload is empty has been sideloaded.
+	get func(*storagepb.RaftCommand) (payload []byte, ok bool)
+	// set replaces the payload of the field, which the command carries.
+	set func(_ *storagepb.RaftCommand, payload []byte)
+	// checksum returns the CRC32 of the payload computed at proposal time, or
+	// zero if it wasn't computed. The command carries the field.
+	checksum func(*storagepb.RaftCommand) uint32
+}
+
+// addSSTableSideloadableField is the payload of an AddSSTable command. The
+// sideloaded file holds the SSTable as is, which allows it to be ingested
+// directly (see addSSTablePreApply).
+var addSSTableSideloadableField = sideloadableField{
+	name: "AddSSTable",
+	get: func(cmd *storagepb.RaftCommand) ([]byte, bool) {
+		if as := cmd.ReplicatedEvalResult.AddSSTable; as != nil {
+			return as.Data, true
+		}
+		return nil, false
+	},
+	set: func(cmd *storagepb.RaftCommand, payload []byte) {
+		cmd.ReplicatedEvalResult.AddSSTable.Data = payload
+	},
+	checksum: func(cmd *storagepb.RaftCommand) uint32 {
+		return cmd.ReplicatedEvalResult.AddSSTable.CRC32
+	},
+}
+
+// sideloadableFields are the fields of Raft commands which can be sideloaded,
+// in order of precedence. At most one field is sideloaded per command, since
+// SideloadStorage holds a single payload per entry: the first field which the
+// command carries. The order must therefore never change for existing fields,
+// as it determines which field the payload of an existing sideloaded entry is
+// restored into.
+var sideloadableFields = []sideloadableField{
+	addSSTableSideloadableField,
+}
+
+// findSideloadableField returns the field of the command which is (or would
+// be) sideloaded, if any.
+func findSideloadableField(cmd *storagepb.RaftCommand) (sideloadableField, bool) {
+	for _, field := range sideloadableFields {
+		if _, ok := field.get(cmd); ok {
+			return field, true
+		}
+	}
+	return sideloadableField{}, false
+}
+
+// sideloadableFieldNames returns the names of the sideloadable fields, for use
+// in errors.
+func sideloadableFieldNames() string {
+	names := make([]string, len(sideloadableFields))
+	for i, field := range sideloadableFields {
+		names[i] = field.name
+	}
+	return strings.Join(names, " or ")
+}
+
+// stripSideloadedRaftCommand removes the payload of the given field from the
+// supplied command, which is mutated, and returns the command encoded with the
+// sideloaded encoding along with the payload.
+func stripSideloadedRaftCommand(
+	cmdID storagebase.CmdIDKey, cmd *storagepb.RaftCommand, field sideloadableField,
+) (data, payload []byte, _ error) {
+	payload, _ = field.get(cmd)
+	field.set(cmd, nil)
+
+	data = make([]byte, raftCommandPrefixLen+cmd.Size())
+	encodeRaftCommandPrefix(data[:raftCommandPrefixLen], raftVersionSideloaded, cmdID)
+	if _, err := protoutil.MarshalToWithoutFuzzing(cmd, data[raftCommandPrefixLen:]); err != nil {
+		return nil, nil, errors.Wrap(err, "while marshaling stripped sideloaded command")
+	}
+	return data, payload, nil
+}
+
 func sniffSideloadedRaftCommand(data []byte) (sideloaded bool) {
 	return len(data) > 0 && data[0] == byte(raftVersionSideloaded)
 }
@@ -143,8 +1116,16 @@ func sniffSideloadedRaftCommand(data []byte) (sideloaded bool) {
 //
 // If a payload is missing, returns an error whose Cause() is
 // errSideloadedFileNotFound.
+//
+// A payload read from the SideloadStorage is verified against the CRC32 of
+// its sideloadable field unless disabled (see sideloadCRCVerificationEnabled),
+// or the CRC32 is zero, which is taken to mean that it wasn't computed. Large
+// payloads are only verified at the configured sample rate (see
+// shouldVerifySideloadedCRC). A mismatch returns an
+// *sideloadChecksumMismatchError. Passing nil settings verifies all payloads.
 func maybeInlineSideloadedRaftCommand(
 	ctx context.Context,
+	st *cluster.Settings,
 	rangeID roachpb.RangeID,
 	ent raftpb.Entry,
 	sideloaded SideloadStorage,
@@ -179,7 +1160,12 @@ func maybeInlineSideloadedRaftCommand(
 		return nil, err
 	}
 
-	if len(command.ReplicatedEvalResult.AddSSTable.Data) > 0 {
+	field, ok := findSideloadableField(&command)
+	if !ok {
+		return nil, errors.Errorf("sideloaded entry at index %d term %d has no %s",
+			ent.Index, ent.Term, sideloadableFieldNames())
+	}
+	if payload, _ := field.get(&command); len(payload) > 0 {
 		// The entry we started out with was already "fat". This happens when
 		// the entry reached us through a preemptive snapshot (when we didn't
 		// have a ReplicaID yet).
@@ -191,7 +1177,15 @@ func maybeInlineSideloadedRaftCommand(
 	if err != nil {
 		return nil, errors.Wrap(err, "loading sideloaded data")
 	}
-	command.ReplicatedEvalResult.AddSSTable.Data = sideloadedData
+	if expected := field.checksum(&command); expected != 0 &&
+		shouldVerifySideloadedCRC(st, len(sideloadedData)) {
+		if checksum := util.CRC32(sideloadedData); checksum != expected {
+			return nil, &sideloadChecksumMismatchError{
+				index: ent.Index, term: ent.Term, commandCRC: true, expected: expected, actual: checksum,
+			}
+		}
+	}
+	field.set(&command, sideloadedData)
 	{
 		data := make([]byte, raftCommandPrefixLen+command.Size())
 		encodeRaftCommandPrefix(data[:raftCommandPrefixLen], raftVersionSideloaded, cmdID)
@@ -204,6 +1198,152 @@ func maybeInlineSideloadedRaftCommand(
 	return &ent, nil
 }
 
+// hasSideloadedPayload returns whether maybeInlineSideloadedRaftCommand would
+// find the payload of the given entry, without reading the payload from the
+// SideloadStorage. Entries which aren't sideloaded, or already inlined, need
+// no payload. Unlike maybeInlineSideloadedRaftCommand, it doesn't detect
+// corrupt payloads. Passing a nil entryCache only consults the SideloadStorage.
+func hasSideloadedPayload(
+	ctx context.Context,
+	rangeID roachpb.RangeID,
+	ent raftpb.Entry,
+	sideloaded SideloadStorage,
+	entryCache *raftentry.Cache,
+) (bool, error) {
+	if !sniffSideloadedRaftCommand(ent.Data) {
+		return true, nil
+	}
+	if entryCache != nil {
+		cachedSingleton, _, _, _ := entryCache.Scan(
+			nil, rangeID, ent.Index, ent.Index+1, 1<<20,
+		)
+		if len(cachedSingleton) > 0 {
+			return true, nil
+		}
+	}
+
+	var command storagepb.RaftCommand
+	_, data := DecodeRaftCommand(ent.Data)
+	if err := protoutil.Unmarshal(data, &command); err != nil {
+		return false, err
+	}
+	field, ok := findSideloadableField(&command)
+	if !ok {
+		return false, errors.Errorf("sideloaded entry at index %d term %d has no %s",
+			ent.Index, ent.Term, sideloadableFieldNames())
+	}
+	if payload, _ := field.get(&command); len(payload) > 0 {
+		return true, nil
+	}
+	return sideloaded.HasEntry(ctx, ent.Index, ent.Term)
+}
+
+// maybeRepairSideloadedFile writes the payload of the given fat entry, which
+// was retrieved from the Raft entry cache, to the sideloaded storage if no file
+// exists for it yet. The payload is only written if it matches the checksum
+// computed at proposal time. Repair is best effort; failures are logged but
+// otherwise ignored, as the entry itself is still usable.
+//
+// Like all writes to the sideloaded storage, this requires Replica.raftMu to
+// be held.
+func maybeRepairSideloadedFile(ctx context.Context, ent raftpb.Entry, sideloaded SideloadStorage) {
+	var command storagepb.RaftCommand
+	_, data := DecodeRaftCommand(ent.Data)
+	if err := protoutil.Unmarshal(data, &command); err != nil {
+		log.Warningf(ctx, "unable to decode cached entry %d for read-repair: %s", ent.Index, err)
+		return
+	}
+	field, ok := findSideloadableField(&command)
+	if !ok {
+		return
+	}
+	payload, _ := field.get(&command)
+	if len(payload) == 0 {
+		// The cached entry is thin, so there is nothing to repair from.
+		return
+	}
+	if expected, checksum := field.checksum(&command), util.CRC32(payload); checksum != expected {
+		log.Warningf(ctx, "not repairing sideloaded file for index %d term %d: "+
+			"checksum mismatch (expected %x, computed %x)", ent.Index, ent.Term, expected, checksum)
+		return
+	}
+	created, err := sideloaded.PutIfAbsent(ctx, ent.Index, ent.Term, payload)
+	if err != nil {
+		log.Warningf(ctx, "unable to repair sideloaded file for index %d term %d: %s",
+			ent.Index, ent.Term, err)
+		return
+	}
+	if created {
+		log.Infof(ctx, "restored missing sideloaded file for index %d term %d from the entry cache",
+			ent.Index, ent.Term)
+	}
+}
+
+// recoverSideloadedRaftMuLocked attempts to restore the missing payload of the
+// sideloaded entry at the given index and term from the Raft entry cache (see
+// maybeRepairSideloadedFile), and returns whether the payload is present
+// afterwards. Payloads of entries which have been truncated from the Raft log
+// are never restored, as nothing would remove them again.
+func (r *Replica) recoverSideloadedRaftMuLocked(
+	ctx context.Context, index, term uint64,
+) (bool, error) {
+	r.mu.RLock()
+	truncatedIndex := r.mu.state.TruncatedState.Index
+	r.mu.RUnlock()
+	if index <= truncatedIndex {
+		return false, nil
+	}
+	ent, ok := r.store.raftEntryCache.Get(r.RangeID, index)
+	if !ok || ent.Term != term {
+		return false, nil
+	}
+	maybeRepairSideloadedFile(ctx, ent, r.raftMu.sideloaded)
+	return r.raftMu.sideloaded.HasEntry(ctx, index, term)
+}
+
+// repairSideloaded restores the missing sideloaded files of the untruncated
+// entries of the Raft log from the payloads held by the Raft entry cache (see
+// recoverSideloadedRaftMuLocked), and returns the number of files restored.
+// It is run by the Raft log queue if enabled (see sideloadReadRepairEnabled)
+// so that reads of the Raft log never write to the sideloaded storage.
+func (r *Replica) repairSideloaded(ctx context.Context) (int, error) {
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+	if r.raftMu.sideloaded == nil {
+		return 0, nil
+	}
+
+	r.mu.RLock()
+	lo, hi := r.mu.state.TruncatedState.Index+1, r.mu.lastIndex+1
+	r.mu.RUnlock()
+
+	var repaired int
+	var ent raftpb.Entry
+	scanFunc := func(kv roachpb.KeyValue) (bool, error) {
+		if err := kv.Value.GetProto(&ent); err != nil {
+			return false, err
+		}
+		if !sniffSideloadedRaftCommand(ent.Data) {
+			return false, nil
+		}
+		if ok, err := hasSideloadedPayload(
+			ctx, r.RangeID, ent, r.raftMu.sideloaded, nil, /* entryCache */
+		); err != nil || ok {
+			return false, err
+		}
+		if ok, err := r.recoverSideloadedRaftMuLocked(ctx, ent.Index, ent.Term); err != nil {
+			return false, err
+		} else if ok {
+			repaired++
+		}
+		return false, nil
+	}
+	if err := iterateEntries(ctx, r.store.Engine(), r.RangeID, lo, hi, scanFunc); err != nil {
+		return repaired, err
+	}
+	return repaired, nil
+}
+
 // assertSideloadedRaftCommandInlined asserts that if the provided entry is a
 // sideloaded entry, then its payload has already been inlined. Doing so
 // requires unmarshalling the raft command, so this assertion should be kept out
@@ -219,10 +1359,13 @@ func assertSideloadedRaftCommandInlined(ctx context.Context, ent *raftpb.Entry)
 		log.Fatal(ctx, err)
 	}
 
-	if len(command.ReplicatedEvalResult.AddSSTable.Data) == 0 {
-		// The entry is "thin", which is what this assertion is checking for.
-		log.Fatalf(ctx, "found thin sideloaded raft command: %+v", command)
+	if field, ok := findSideloadableField(&command); ok {
+		if payload, _ := field.get(&command); len(payload) > 0 {
+			return
+		}
 	}
+	// The entry is "thin", which is what this assertion is checking for.
+	log.Fatalf(ctx, "found thin sideloaded raft command: %+v", command)
 }
 
 // maybePurgeSideloaded removes [firstIndex, ..., lastIndex] at the given term
@@ -241,3 +1384,384 @@ func maybePurgeSideloaded(
 	}
 	return totalSize, nil
 }
+
+// purgeStaleSideloadedTerms removes the payloads stored in ss whose term
+// differs from the term that keepTerm returns for their index, and returns the
+// number of bytes freed. This reclaims the space used by proposals which were
+// superseded at a higher term without waiting for their index to be
+// truncated. Payloads at indexes for which keepTerm returns zero are retained.
+func purgeStaleSideloadedTerms(
+	ctx context.Context, ss SideloadStorage, keepTerm func(index uint64) uint64,
+) (int64, error) {
+	var stale []slKey
+	if err := ss.ForEach(ctx, func(index, term uint64, _ int64) error {
+		if authoritative := keepTerm(index); authoritative != 0 && authoritative != term {
+			stale = append(stale, slKey{index: index, term: term})
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	var freed int64
+	for _, k := range stale {
+		log.Eventf(ctx, "purging sideloaded file at index=%d of stale term %d", k.index, k.term)
+		size, err := ss.Purge(ctx, k.index, k.term)
+		if err != nil && errors.Cause(err) != errSideloadedFileNotFound {
+			return freed, err
+		}
+		freed += size
+	}
+	return freed, nil
+}
+
+// addSSTableApplicationTracker counts the AddSSTable commands applied by a
+// replica in the current sideloadCompactionTriggerWindow.
+type addSSTableApplicationTracker struct {
+	windowStart time.Time
+	count       int64
+	bytes       int64
+}
+
+// maybeSuggestAddSSTableCompactionRaftMuLocked records the application of an
+// AddSSTable command with an SSTable of the given size and, if the replica has
+// applied more of them within the current window than allowed by
+// sideloadCompactionTriggerThreshold, suggests a compaction of the range's
+// span to the store's compactor. Whether the suggested compaction is carried
+// out is up to the compactor.
+func (r *Replica) maybeSuggestAddSSTableCompactionRaftMuLocked(
+	ctx context.Context, sstBytes int64,
+) {
+	st := r.store.cfg.Settings
+	if !sideloadCompactionTriggerEnabled.Get(&st.SV) {
+		return
+	}
+	tracker := &r.raftMu.addSSTableApplications
+	now := timeutil.Now()
+	if now.Sub(tracker.windowStart) > sideloadCompactionTriggerWindow {
+		*tracker = addSSTableApplicationTracker{windowStart: now}
+	}
+	tracker.count++
+	tracker.bytes += sstBytes
+	if tracker.count < sideloadCompactionTriggerThreshold.Get(&st.SV) {
+		return
+	}
+
+	desc := r.Desc()
+	log.VEventf(ctx, 2, "suggesting compaction after applying %d AddSSTable commands (%d bytes) in %s",
+		tracker.count, tracker.bytes, now.Sub(tracker.windowStart))
+	r.store.compactor.Suggest(ctx, storagepb.SuggestedCompaction{
+		StartKey: roachpb.Key(desc.StartKey),
+		EndKey:   roachpb.Key(desc.EndKey),
+		Compaction: storagepb.Compaction{
+			Bytes:            tracker.bytes,
+			SuggestedAtNanos: now.UnixNano(),
+		},
+	})
+	*tracker = addSSTableApplicationTracker{windowStart: now}
+}
+
+// maybeSuggestIngestedSSTableCompactionRaftMuLocked suggests a compaction for
+// the key span of the given SSTable, which has just been ingested, unless
+// disabled through kv.raft_log.sideloading.ingest_compaction_hint.enabled.
+func (r *Replica) maybeSuggestIngestedSSTableCompactionRaftMuLocked(ctx context.Context, sst []byte) {
+	if !sideloadIngestCompactionHintEnabled.Get(&r.store.cfg.Settings.SV) {
+		return
+	}
+	span, err := sstableKeySpan(sst)
+	if err != nil {
+		log.Warningf(ctx, "unable to determine the key span of the ingested SSTable: %s", err)
+		return
+	}
+	if span.Key == nil {
+		return
+	}
+	r.store.compactor.Suggest(ctx, storagepb.SuggestedCompaction{
+		StartKey: span.Key,
+		EndKey:   span.EndKey,
+		Compaction: storagepb.Compaction{
+			Bytes:            int64(len(sst)),
+			SuggestedAtNanos: timeutil.Now().UnixNano(),
+		},
+	})
+}
+
+// sstableKeySpan returns the span of the keys in the given SSTable, which is
+// empty if the SSTable is.
+func sstableKeySpan(sst []byte) (roachpb.Span, error) {
+	iter, err := engine.NewMemSSTIterator(sst, false /* verify */)
+	if err != nil {
+		return roachpb.Span{}, err
+	}
+	defer iter.Close()
+	var span roachpb.Span
+	var last []byte
+	for iter.Seek(engine.NilKey); ; iter.Next() {
+		if ok, err := iter.Valid(); err != nil {
+			return roachpb.Span{}, err
+		} else if !ok {
+			break
+		}
+		key := iter.UnsafeKey().Key
+		if span.Key == nil {
+			span.Key = append(roachpb.Key(nil), key...)
+		}
+		last = append(last[:0], key...)
+	}
+	if span.Key != nil {
+		span.EndKey = roachpb.Key(last).Next()
+	}
+	return span, nil
+}
+
+// SideloadCommittedEntry moves the AddSSTable payload of the committed Raft
+// log entry at the given index into the sideloaded storage and rewrites the
+// entry in its thin form. This shrinks the log of ranges whose payloads were
+// kept inline when they were appended, for example because sideloading was
+// disabled at the time or because of a SideloadPlacementPolicy.
+//
+// The index and term of the entry, as well as the payload and its checksum,
+// are preserved, and inlining the rewritten entry reconstructs the original
+// one. Commands which were proposed with the standard encoding are re-encoded
+// with the sideloaded one, which is all that differs for them after inlining.
+//
+// The payload is written to the sideloaded storage before the entry is
+// rewritten, so that a crash in between leaves behind the intact inline entry
+// and a superfluous file which is removed when the log is truncated. If the
+// entry fails to be rewritten, the file is removed right away.
+func (r *Replica) SideloadCommittedEntry(ctx context.Context, index uint64) error {
+	// Holding raftMu prevents the log from being appended to or truncated
+	// concurrently.
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+
+	sideloaded := r.raftMu.sideloaded
+	if sideloaded == nil {
+		return errors.New("replica has no sideloaded storage")
+	}
+	eng := r.store.Engine()
+	rsl := r.raftMu.stateLoader
+
+	lo, hi, err := r.committedLogBoundsRaftMuLocked(ctx)
+	if err != nil {
+		return err
+	}
+	if index < lo || index >= hi {
+		return errors.Errorf("index %d is outside of the committed Raft log (%d, %d]",
+			index, lo-1, hi-1)
+	}
+
+	key := rsl.RaftLogKey(index)
+	var ent raftpb.Entry
+	if ok, err := engine.MVCCGetProto(
+		ctx, eng, key, hlc.Timestamp{}, &ent, engine.MVCCGetOptions{},
+	); err != nil {
+		return err
+	} else if !ok {
+		return errors.Errorf("no Raft log entry at index %d", index)
+	}
+	thin, fat, payload, err := thinInlineAddSSTable(ent)
+	if err != nil {
+		return err
+	}
+
+	if err := sideloaded.Put(ctx, ent.Index, ent.Term, payload); err != nil {
+		return err
+	}
+
+	batch := eng.NewBatch()
+	defer batch.Close()
+	var diff enginepb.MVCCStats
+	err = putThinEntry(ctx, batch, &diff, key, thin)
+	if err == nil {
+		err = batch.Commit(true /* sync */)
+	}
+	if err != nil {
+		purgeUnreferencedSideloaded(ctx, sideloaded, []slKey{{index: ent.Index, term: ent.Term}})
+		return err
+	}
+	log.Eventf(ctx, "sideloaded payload of committed entry at index=%d term=%d", ent.Index, ent.Term)
+
+	r.mu.Lock()
+	// The entry shrank, but its payload now counts towards the log size as a
+	// sideloaded file.
+	r.mu.raftLogSize += diff.SysBytes + int64(len(payload))
+	r.mu.Unlock()
+	// Make sure a cached copy of the entry matches the rewritten one.
+	r.store.raftEntryCache.Add(r.RangeID, []raftpb.Entry{fat}, false /* truncate */)
+	return nil
+}
+
+// MigrateInlineAddSSTablesToSideloaded is like SideloadCommittedEntry, but
+// sideloads the payloads of all AddSSTable commands which are kept inline in
+// the committed Raft log, for example after an upgrade from a version which
+// didn't sideload them, or after a period in which sideloading was disabled.
+// Other entries are left alone. It returns the number of entries which were
+// rewritten.
+//
+// All payloads are written to the sideloaded storage before the entries are
+// rewritten in a single batch, and removed again if that fails. The cached
+// entries of the range are dropped, since they may hold the rewritten entries
+// in their original encoding.
+func (r *Replica) MigrateInlineAddSSTablesToSideloaded(ctx context.Context) (int, error) {
+	// Holding raftMu prevents the log from being appended to or truncated
+	// concurrently.
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+
+	sideloaded := r.raftMu.sideloaded
+	if sideloaded == nil {
+		return 0, errors.New("replica has no sideloaded storage")
+	}
+	eng := r.store.Engine()
+	rsl := r.raftMu.stateLoader
+
+	lo, hi, err := r.committedLogBoundsRaftMuLocked(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	batch := eng.NewBatch()
+	defer batch.Close()
+	var diff enginepb.MVCCStats
+	var written []slKey
+	var payloadBytes int64
+	var ent raftpb.Entry
+	scanFunc := func(kv roachpb.KeyValue) (bool, error) {
+		if err := kv.Value.GetProto(&ent); err != nil {
+			return false, err
+		}
+		thin, _, payload, err := thinInlineAddSSTable(ent)
+		if _, ok := err.(*notInlineAddSSTableError); ok {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if err := sideloaded.Put(ctx, ent.Index, ent.Term, payload); err != nil {
+			return false, err
+		}
+		written = append(written, slKey{index: ent.Index, term: ent.Term})
+		if err := putThinEntry(ctx, batch, &diff, rsl.RaftLogKey(ent.Index), thin); err != nil {
+			return false, err
+		}
+		payloadBytes += int64(len(payload))
+		return false, nil
+	}
+	err = iterateEntries(ctx, eng, r.RangeID, lo, hi, scanFunc)
+	if err == nil && len(written) > 0 {
+		err = batch.Commit(true /* sync */)
+	}
+	if err != nil {
+		purgeUnreferencedSideloaded(ctx, sideloaded, written)
+		return 0, err
+	}
+	migrated := len(written)
+	if migrated == 0 {
+		return 0, nil
+	}
+	log.Eventf(ctx, "sideloaded payloads of %d committed entries", migrated)
+
+	r.mu.Lock()
+	// The entries shrank, but their payloads now count towards the log size
+	// as sideloaded files.
+	r.mu.raftLogSize += diff.SysBytes + payloadBytes
+	r.mu.Unlock()
+	r.store.raftEntryCache.Drop(r.RangeID)
+	return migrated, nil
+}
+
+// purgeUnreferencedSideloaded removes the given files, which were written to
+// the sideloaded storage for entries that failed to be rewritten in their thin
+// form. The entries still hold their payloads inline, so the files aren't
+// accounted for in the Raft log size, from which truncating them would
+// otherwise subtract their sizes. Failures are logged.
+func purgeUnreferencedSideloaded(ctx context.Context, ss SideloadStorage, keys []slKey) {
+	for _, k := range keys {
+		if _, err := ss.Purge(ctx, k.index, k.term); err != nil && err != errSideloadedFileNotFound {
+			log.Warningf(ctx, "unable to remove sideloaded file at index %d term %d: %s",
+				k.index, k.term, err)
+		}
+	}
+}
+
+// committedLogBoundsRaftMuLocked returns the bounds [lo, hi) of the indexes of
+// the entries in the committed part of the Raft log which haven't been
+// truncated.
+func (r *Replica) committedLogBoundsRaftMuLocked(ctx context.Context) (lo, hi uint64, _ error) {
+	eng := r.store.Engine()
+	rsl := r.raftMu.stateLoader
+	truncState, _, err := rsl.LoadRaftTruncatedState(ctx, eng)
+	if err != nil {
+		return 0, 0, err
+	}
+	hs, err := rsl.LoadHardState(ctx, eng)
+	if err != nil {
+		return 0, 0, err
+	}
+	return truncState.Index + 1, hs.Commit + 1, nil
+}
+
+// notInlineAddSSTableError is returned by thinInlineAddSSTable for entries
+// which don't hold the payload of an AddSSTable command inline.
+type notInlineAddSSTableError struct {
+	msg string
+}
+
+func (e *notInlineAddSSTableError) Error() string {
+	return e.msg
+}
+
+// thinInlineAddSSTable returns the thin form of the given entry, which holds
+// the payload of an AddSSTable command inline, along with the entry that
+// inlining the thin one returns and the payload to sideload. The checksum of
+// the payload is verified.
+func thinInlineAddSSTable(ent raftpb.Entry) (thin, fat raftpb.Entry, payload []byte, _ error) {
+	if ent.Type != raftpb.EntryNormal || len(ent.Data) < raftCommandPrefixLen ||
+		(ent.Data[0] != byte(raftVersionStandard) && ent.Data[0] != byte(raftVersionSideloaded)) {
+		return thin, fat, nil, &notInlineAddSSTableError{
+			msg: fmt.Sprintf("Raft log entry at index %d is not a sideloadable command", ent.Index),
+		}
+	}
+	cmdID, data := DecodeRaftCommand(ent.Data)
+	var cmd storagepb.RaftCommand
+	if err := protoutil.Unmarshal(data, &cmd); err != nil {
+		return thin, fat, nil, err
+	}
+	sst := cmd.ReplicatedEvalResult.AddSSTable
+	if sst == nil {
+		return thin, fat, nil, &notInlineAddSSTableError{
+			msg: fmt.Sprintf("Raft log entry at index %d is not an AddSSTable command", ent.Index),
+		}
+	}
+	if len(sst.Data) == 0 {
+		return thin, fat, nil, &notInlineAddSSTableError{
+			msg: fmt.Sprintf("AddSSTable at index %d is already sideloaded", ent.Index),
+		}
+	}
+	if checksum := util.CRC32(sst.Data); checksum != sst.CRC32 {
+		return thin, fat, nil, errors.Errorf("checksum of AddSSTable at index %d does not match: expected %x, found %x",
+			ent.Index, sst.CRC32, checksum)
+	}
+
+	// This is what inlining the thin entry returns.
+	fat = ent
+	fat.Data = encodeRaftCommand(raftVersionSideloaded, cmdID, data)
+	thin = ent
+	var err error
+	thin.Data, payload, err = stripSideloadedRaftCommand(cmdID, &cmd, addSSTableSideloadableField)
+	if err != nil {
+		return raftpb.Entry{}, raftpb.Entry{}, nil, err
+	}
+	return thin, fat, payload, nil
+}
+
+// putThinEntry writes the given thin entry to the Raft log key of its index.
+func putThinEntry(
+	ctx context.Context, batch engine.ReadWriter, ms *enginepb.MVCCStats, key roachpb.Key, thin raftpb.Entry,
+) error {
+	var value roachpb.Value
+	if err := value.SetProto(&thin); err != nil {
+		return err
+	}
+	value.InitChecksum(key)
+	return engine.MVCCPut(ctx, batch, ms, key, hlc.Timestamp{}, value, nil /* txn */)
+}
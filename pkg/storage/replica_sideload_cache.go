@@ -0,0 +1,186 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package storage
+
+import (
+	"github.com/biogo/store/llrb"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/cache"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// sideloadCacheSize bounds the total size of the payloads held by the
+// sideloadCache of a store. Payloads larger than that aren't cached at all.
+var sideloadCacheSize = settings.RegisterByteSizeSetting(
+	"kv.sideload.cache.size",
+	"the maximum total size of sideloaded Raft payloads a store caches in memory after reading them from disk (0 to disable)",
+	0,
+)
+
+// sideloadCacheKey identifies a payload in a sideloadCache. Keys are ordered
+// by range and then index, so that the payloads of a range below a given index
+// can be found efficiently.
+type sideloadCacheKey struct {
+	rangeID     roachpb.RangeID
+	index, term uint64
+}
+
+// Compare implements llrb.Comparable.
+func (k sideloadCacheKey) Compare(b llrb.Comparable) int {
+	o := b.(sideloadCacheKey)
+	switch {
+	case k.rangeID != o.rangeID:
+		if k.rangeID < o.rangeID {
+			return -1
+		}
+		return 1
+	case k.index != o.index:
+		if k.index < o.index {
+			return -1
+		}
+		return 1
+	case k.term != o.term:
+		if k.term < o.term {
+			return -1
+		}
+		return 1
+	default:
+		return 0
+	}
+}
+
+// sideloadCache is an LRU cache of the payloads the disk sideloaded storages
+// of a store read from disk, which is shared by all of them. It saves
+// repeated reads of the same payloads, for example when a range is the source
+// of a snapshot while also serving reads of its log.
+//
+// The storages keep the cache up to date with their mutations, so that it
+// never returns a payload which was overwritten or removed since it was
+// cached. Payloads are only cached after they have been verified against
+// their checksum file, if any, so hits aren't verified again. The cache holds
+// its own copies of the payloads, and returns copies of them, so that callers
+// are free to modify the payloads they put or get.
+//
+// A nil *sideloadCache is valid and caches nothing.
+type sideloadCache struct {
+	st           *cluster.Settings
+	hits, misses *metric.Counter
+
+	mu struct {
+		syncutil.Mutex
+		cache *cache.OrderedCache
+		// bytes is the total size of the cached payloads.
+		bytes int64
+	}
+}
+
+func newSideloadCache(st *cluster.Settings, hits, misses *metric.Counter) *sideloadCache {
+	c := &sideloadCache{st: st, hits: hits, misses: misses}
+	c.mu.cache = cache.NewOrderedCache(cache.Config{
+		Policy: cache.CacheLRU,
+		ShouldEvict: func(_ int, _, _ interface{}) bool {
+			return c.mu.bytes > sideloadCacheSize.Get(&st.SV)
+		},
+		OnEvicted: func(_, value interface{}) {
+			c.mu.bytes -= int64(len(value.([]byte)))
+		},
+	})
+	sideloadCacheSize.SetOnChange(&st.SV, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.mu.bytes > sideloadCacheSize.Get(&st.SV) {
+			c.mu.cache.Clear()
+		}
+	})
+	return c
+}
+
+func (c *sideloadCache) enabled() bool {
+	return c != nil && sideloadCacheSize.Get(&c.st.SV) > 0
+}
+
+// get returns a copy of the cached payload at the given index and term of the
+// given range, if any.
+func (c *sideloadCache) get(rangeID roachpb.RangeID, index, term uint64) ([]byte, bool) {
+	if !c.enabled() {
+		return nil, false
+	}
+	c.mu.Lock()
+	v, ok := c.mu.cache.Get(sideloadCacheKey{rangeID: rangeID, index: index, term: term})
+	c.mu.Unlock()
+	if !ok {
+		c.misses.Inc(1)
+		return nil, false
+	}
+	c.hits.Inc(1)
+	return append([]byte(nil), v.([]byte)...), true
+}
+
+// put caches a copy of the given payload, which was read from disk and
+// verified, replacing any previously cached one.
+func (c *sideloadCache) put(rangeID roachpb.RangeID, index, term uint64, payload []byte) {
+	if !c.enabled() || int64(len(payload)) > sideloadCacheSize.Get(&c.st.SV) {
+		return
+	}
+	k := sideloadCacheKey{rangeID: rangeID, index: index, term: term}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Adding a key which is already present replaces the value without
+	// evicting the previous one, which would throw off the accounting.
+	c.mu.cache.Del(k)
+	c.mu.bytes += int64(len(payload))
+	c.mu.cache.Add(k, append([]byte(nil), payload...))
+}
+
+// invalidate removes the payload at the given index and term of the given
+// range from the cache.
+func (c *sideloadCache) invalidate(rangeID roachpb.RangeID, index, term uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mu.cache.Del(sideloadCacheKey{rangeID: rangeID, index: index, term: term})
+}
+
+// invalidateBelow removes the payloads of the given range at indexes below the
+// given one from the cache.
+func (c *sideloadCache) invalidateBelow(rangeID roachpb.RangeID, index uint64) {
+	c.invalidateSpan(sideloadCacheKey{rangeID: rangeID}, sideloadCacheKey{rangeID: rangeID, index: index})
+}
+
+// invalidateRange removes all payloads of the given range from the cache.
+func (c *sideloadCache) invalidateRange(rangeID roachpb.RangeID) {
+	c.invalidateSpan(sideloadCacheKey{rangeID: rangeID}, sideloadCacheKey{rangeID: rangeID + 1})
+}
+
+// invalidateSpan removes the payloads with keys in [from, to) from the cache.
+func (c *sideloadCache) invalidateSpan(from, to sideloadCacheKey) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Entries can't be removed while iterating over them.
+	var entries []*cache.Entry
+	c.mu.cache.DoRangeEntry(func(e *cache.Entry) bool {
+		entries = append(entries, e)
+		return false
+	}, from, to)
+	for _, e := range entries {
+		c.mu.cache.DelEntry(e)
+	}
+}
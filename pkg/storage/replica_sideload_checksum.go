@@ -0,0 +1,127 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/pkg/errors"
+)
+
+// sideloadChecksumAlgorithm identifies the algorithm of the checksums which
+// the disk sideloaded storage optionally keeps for its payloads, in addition
+// to the CRC32 carried by the Raft command. The CRC32 remains authoritative;
+// these checksums only guard against corruption of the local files.
+type sideloadChecksumAlgorithm int64
+
+const (
+	// sideloadChecksumNone disables the checksums.
+	sideloadChecksumNone sideloadChecksumAlgorithm = iota
+	// sideloadChecksumSHA256 keeps SHA-256 checksums.
+	sideloadChecksumSHA256
+)
+
+var sideloadChecksumSetting = settings.RegisterEnumSetting(
+	"kv.raft_log.sideloading.checksum",
+	"the algorithm of the checksums stored alongside sideloaded Raft payloads and verified when they are read",
+	"none",
+	map[int64]string{
+		int64(sideloadChecksumNone):   "none",
+		int64(sideloadChecksumSHA256): "sha256",
+	},
+)
+
+// sideloadChecksumVersion is the version of the format of checksum files. A
+// checksum file consists of a version byte, an algorithm byte and the
+// checksum. The checksum can't be stored in the payload file itself, since
+// that file is ingested into RocksDB as is and thus has to remain a valid
+// SSTable.
+const sideloadChecksumVersion = 1
+
+// sideloadChecksumFilename returns the name of the checksum file for the
+// payload at the given index and term. It deliberately doesn't match the
+// pattern of payload files (see sideloadFilename).
+func sideloadChecksumFilename(index, term uint64) string {
+	return fmt.Sprintf("c%d.t%d", index, term)
+}
+
+// String implements fmt.Stringer.
+func (a sideloadChecksumAlgorithm) String() string {
+	switch a {
+	case sideloadChecksumNone:
+		return "none"
+	case sideloadChecksumSHA256:
+		return "sha256"
+	default:
+		return fmt.Sprintf("unknown(%d)", int64(a))
+	}
+}
+
+// sideloadChecksumMismatchError is returned when reading a sideloaded payload
+// which doesn't match its checksum file, or when inlining one which doesn't
+// match the CRC32 computed when its command was proposed.
+type sideloadChecksumMismatchError struct {
+	index, term uint64
+	algorithm   sideloadChecksumAlgorithm
+	// commandCRC is set if the payload was verified against the CRC32 of its
+	// command, with the expected and the computed CRC32, instead of its
+	// checksum file.
+	commandCRC       bool
+	expected, actual uint32
+}
+
+func (e *sideloadChecksumMismatchError) Error() string {
+	if e.commandCRC {
+		return fmt.Sprintf("sideloaded payload at index %d term %d does not match the checksum of its command: "+
+			"expected %x, computed %x", e.index, e.term, e.expected, e.actual)
+	}
+	return fmt.Sprintf("sideloaded payload at index %d term %d does not match its %s checksum",
+		e.index, e.term, e.algorithm)
+}
+
+// encodeSideloadChecksum returns the contents of the checksum file for the
+// given payload, or nil if the algorithm is sideloadChecksumNone.
+func encodeSideloadChecksum(algorithm sideloadChecksumAlgorithm, contents []byte) []byte {
+	switch algorithm {
+	case sideloadChecksumSHA256:
+		sum := sha256.Sum256(contents)
+		return append([]byte{sideloadChecksumVersion, byte(algorithm)}, sum[:]...)
+	default:
+		return nil
+	}
+}
+
+// verifySideloadChecksum checks the payload at the given index and term
+// against the contents of its checksum file.
+func verifySideloadChecksum(index, term uint64, contents, checksumFile []byte) error {
+	if len(checksumFile) < 2 {
+		return errors.Errorf("sideloaded checksum file at index %d term %d is truncated", index, term)
+	}
+	if v := checksumFile[0]; v != sideloadChecksumVersion {
+		return errors.Errorf("sideloaded checksum file at index %d term %d has unknown version %d",
+			index, term, v)
+	}
+	algorithm := sideloadChecksumAlgorithm(checksumFile[1])
+	expected := encodeSideloadChecksum(algorithm, contents)
+	if expected == nil {
+		return errors.Errorf("sideloaded checksum file at index %d term %d has unknown algorithm %s",
+			index, term, algorithm)
+	}
+	if !bytes.Equal(expected, checksumFile) {
+		return &sideloadChecksumMismatchError{index: index, term: term, algorithm: algorithm}
+	}
+	return nil
+}
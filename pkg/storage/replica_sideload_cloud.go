@@ -0,0 +1,730 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/storagebase"
+	"github.com/cockroachdb/cockroach/pkg/util/contextutil"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+// sideloadExternalURI is the URI of the external object store, such as S3 or
+// GCS, in which replicas store their sideloaded payloads instead of on the
+// local disk. It requires a SideloadBlobStoreFactory to be registered for the
+// URI to take effect, which CCL builds do for the cloud storage providers
+// supported by BACKUP and IMPORT.
+//
+// The setting is consulted when the sideloaded storage of a replica is
+// created, and payloads are only ever read from the storage they were written
+// to. A replica which has payloads on the local disk keeps using it, and a
+// replica which uses an external object store records it durably (see
+// sideloadExternalMarkerPath) and keeps using it until it is destroyed, even
+// if the setting is changed or cleared.
+var sideloadExternalURI = func() *settings.StringSetting {
+	s := settings.RegisterStringSetting(
+		"kv.raft_log.sideloading.external_uri",
+		"if set, sideloaded Raft payloads of replicas initialized afterwards are stored in this external object store",
+		"",
+	)
+	s.SetSensitive()
+	return s
+}()
+
+// sideloadExternalTimeout bounds each operation of the cloud sideloaded storage
+// on its external object store. Payloads are written while appending to the
+// Raft log, which blocks the Raft processing of the replica, so an
+// unresponsive object store must not hold it up indefinitely.
+var sideloadExternalTimeout = settings.RegisterNonNegativeDurationSetting(
+	"kv.raft_log.sideloading.external_timeout",
+	"maximum duration of an operation on the external object store of sideloaded Raft payloads, "+
+		"after which payloads being written are kept inline in the Raft log (0 to disable)",
+	10*time.Second,
+)
+
+// sideloadExternalStoreError is returned by the cloud sideloaded storage when
+// it fails to write payloads to its object store, including when the
+// operation times out (see sideloadExternalTimeout). Like a full storage, it
+// makes the payloads of a Raft append be kept inline (see
+// maybeSideloadEntriesImpl), so that an unavailable object store doesn't fail
+// the append.
+type sideloadExternalStoreError struct {
+	err error
+}
+
+func (e *sideloadExternalStoreError) Error() string {
+	return fmt.Sprintf("writing sideloaded payloads to external object store: %s", e.err)
+}
+
+// SideloadBlobStore is the interface to the external object store used by the
+// cloud sideloaded storage. Objects are addressed by slash-separated names.
+// Implementations need to be safe for concurrent use, since they are shared by
+// the sideloaded storages of all replicas.
+type SideloadBlobStore interface {
+	// ReadFile returns the contents of the named object. If it doesn't exist,
+	// the returned error satisfies os.IsNotExist.
+	ReadFile(ctx context.Context, name string) ([]byte, error)
+	// WriteFile creates or overwrites the named object.
+	WriteFile(ctx context.Context, name string, content []byte) error
+	// Delete removes the named object. Removing an object which doesn't exist
+	// isn't an error.
+	Delete(ctx context.Context, name string) error
+}
+
+// SideloadBlobStoreFactory returns a SideloadBlobStore for the given URI.
+type SideloadBlobStoreFactory func(
+	ctx context.Context, uri string, st *cluster.Settings,
+) (SideloadBlobStore, error)
+
+var sideloadBlobStoreFactory struct {
+	syncutil.Mutex
+	factory SideloadBlobStoreFactory
+}
+
+// sideloadNoFactoryLogLimiter limits the warnings logged when
+// kv.raft_log.sideloading.external_uri is set but no SideloadBlobStoreFactory
+// is registered, which would otherwise be logged for every replica.
+var sideloadNoFactoryLogLimiter = log.Every(time.Minute)
+
+// RegisterSideloadBlobStoreFactory registers the factory which makes the
+// external object stores configured through
+// kv.raft_log.sideloading.external_uri available to the sideloaded storage.
+// The object stores are implemented outside of this package, which is why
+// they have to be registered.
+func RegisterSideloadBlobStoreFactory(f SideloadBlobStoreFactory) {
+	sideloadBlobStoreFactory.Lock()
+	defer sideloadBlobStoreFactory.Unlock()
+	sideloadBlobStoreFactory.factory = f
+}
+
+// sideloadExternalMarkerPath returns the path of the file which records that
+// the sideloaded storage of the given range keeps its payloads in an external
+// object store, along with the URI of that store. It is kept next to the
+// directory which the storage would use on the local disk.
+func sideloadExternalMarkerPath(baseDir string, rangeID roachpb.RangeID) string {
+	return sideloadedPath(baseDir, rangeID) + ".external"
+}
+
+// removeSideloadExternalMarker removes the file written by newSideloadStorage
+// when the sideloaded storage of the given range started using an external
+// object store, if it exists.
+func removeSideloadExternalMarker(eng engine.Engine, baseDir string, rangeID roachpb.RangeID) error {
+	if err := eng.DeleteFile(sideloadExternalMarkerPath(baseDir, rangeID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// newSideloadStorage creates the sideloaded storage of a replica. A replica
+// which uses an external object store always reopens the one it recorded, and
+// fails if that isn't possible, since its payloads can't be found anywhere
+// else. Otherwise, the payloads are stored in the external object store
+// configured through kv.raft_log.sideloading.external_uri, if any, and on the
+// local disk if not. The local disk is also used if no
+// SideloadBlobStoreFactory is registered, if the object store can't be
+// created, or if the replica already has payloads on the local disk.
+func newSideloadStorage(
+	ctx context.Context,
+	st *cluster.Settings,
+	storeID roachpb.StoreID,
+	rangeID roachpb.RangeID,
+	replicaID roachpb.ReplicaID,
+	baseDir string,
+	limiter *rate.Limiter,
+	sideloadLimiter *rate.Limiter,
+	cache *sideloadCache,
+	metrics *sideloadMetrics,
+	eng engine.Engine,
+) (SideloadStorage, error) {
+	disk, err := newDiskSideloadStorage(
+		st, rangeID, replicaID, baseDir, limiter, sideloadLimiter, cache, eng,
+	)
+	if err != nil {
+		return nil, err
+	}
+	disk.metrics = metrics
+	sideloadBlobStoreFactory.Lock()
+	factory := sideloadBlobStoreFactory.factory
+	sideloadBlobStoreFactory.Unlock()
+
+	markerPath := sideloadExternalMarkerPath(baseDir, rangeID)
+	if b, err := eng.ReadFile(markerPath); err == nil {
+		uri := string(b)
+		if factory == nil {
+			return nil, errors.Errorf("r%d: sideloaded payloads are kept in an external object store, "+
+				"but none is available", rangeID)
+		}
+		store, err := factory(ctx, uri, st)
+		if err != nil {
+			return nil, errors.Wrapf(err, "r%d: unable to open external object store of sideloaded payloads",
+				rangeID)
+		}
+		cloud := newCloudSideloadStorage(st, storeID, rangeID, replicaID, baseDir, store)
+		cloud.metrics = metrics
+		return cloud, nil
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "reading %s", markerPath)
+	}
+
+	uri := sideloadExternalURI.Get(&st.SV)
+	if uri == "" {
+		return disk, nil
+	}
+	if factory == nil {
+		if sideloadNoFactoryLogLimiter.ShouldLog() {
+			log.Warningf(ctx, "kv.raft_log.sideloading.external_uri is set, but external object stores "+
+				"for sideloaded payloads require a CCL binary; using local disk")
+		}
+		return disk, nil
+	}
+	if empty, err := disk.IsEmpty(ctx); err != nil {
+		return nil, err
+	} else if !empty {
+		log.Infof(ctx, "r%d: sideloaded payloads exist on local disk; not using external object store",
+			rangeID)
+		return disk, nil
+	}
+	store, err := factory(ctx, uri, st)
+	if err != nil {
+		log.Warningf(ctx, "r%d: unable to open external object store for sideloaded payloads; "+
+			"using local disk: %s", rangeID, err)
+		return disk, nil
+	}
+	// The choice is recorded before any payload is written to the object
+	// store, so that the replica keeps finding its payloads there.
+	if err := os.MkdirAll(filepath.Dir(markerPath), 0755); err != nil {
+		return nil, err
+	}
+	if err := writeFileSyncing(ctx, markerPath, []byte(uri), eng, 0644, st); err != nil {
+		return nil, errors.Wrap(err, "while recording external object store of sideloaded payloads")
+	}
+	cloud := newCloudSideloadStorage(st, storeID, rangeID, replicaID, baseDir, store)
+	cloud.metrics = metrics
+	return cloud, nil
+}
+
+var _ SideloadStorage = &cloudSideloadStorage{}
+
+// cloudSideloadManifest is the name of the object, relative to the prefix of
+// a cloud sideloaded storage, which lists the stored payloads. Object stores
+// can't necessarily list their objects, so the manifest is the authoritative
+// record of which payloads exist.
+const cloudSideloadManifest = "MANIFEST"
+
+// cloudSideloadStorage is a SideloadStorage which keeps the payloads of a
+// replica in an external object store, under a prefix derived from the store
+// and range IDs. The object store is shared by all nodes of the cluster, and
+// each replica of a range truncates its payloads independently, so the
+// replicas of a range must not share objects. Like the disk storage, it
+// doesn't depend on the replica ID.
+//
+// Every operation on the object store is synchronous, and bounded by
+// kv.raft_log.sideloading.external_timeout. In particular, Put and PutMany
+// write to the object store while the Raft log is appended to, with raftMu
+// held, so a slow object store delays the Raft processing of the replica by up
+// to that timeout per append. If they fail, they return a
+// *sideloadExternalStoreError, which keeps the payloads inline.
+//
+// The payloads are listed in a manifest object, which is written after
+// payloads are written, so that every payload which Put or PutMany stored is
+// found after a restart. A crash in between writing an object and the manifest
+// may leave behind an object which the manifest never references, but the Raft
+// log entry of such a payload was never appended. Conversely, payloads are only
+// dropped from the manifest once their objects have been deleted, so that an
+// object which fails to be deleted stays listed and is deleted by a later
+// truncation, instead of being leaked. The manifest may thus reference missing
+// objects, but only those of truncated Raft log entries, which aren't read
+// anymore.
+type cloudSideloadStorage struct {
+	st        *cluster.Settings
+	rangeID   roachpb.RangeID
+	replicaID roachpb.ReplicaID
+	store     SideloadBlobStore
+	prefix    string
+	// stagingDir is the local directory in which Filename places the files
+	// of payloads, which only exist there while they are ingested.
+	stagingDir string
+
+	// files maps the stored payloads to their sizes. It is loaded lazily from
+	// the manifest.
+	files  map[slKey]int64
+	loaded bool
+
+	// metrics is shared by all sideloaded storages on a store. It may be nil.
+	// residentBytes is the size of the payloads in files as last reported to
+	// it.
+	metrics       *sideloadMetrics
+	residentBytes int64
+}
+
+func cloudSideloadPrefix(storeID roachpb.StoreID, rangeID roachpb.RangeID) string {
+	return path.Join("sideloading", fmt.Sprintf("s%d", storeID), fmt.Sprintf("r%d", rangeID))
+}
+
+func newCloudSideloadStorage(
+	st *cluster.Settings,
+	storeID roachpb.StoreID,
+	rangeID roachpb.RangeID,
+	replicaID roachpb.ReplicaID,
+	baseDir string,
+	store SideloadBlobStore,
+) *cloudSideloadStorage {
+	return &cloudSideloadStorage{
+		st:         st,
+		rangeID:    rangeID,
+		replicaID:  replicaID,
+		store:      store,
+		prefix:     cloudSideloadPrefix(storeID, rangeID),
+		stagingDir: filepath.Join(baseDir, "sideloading-external", fmt.Sprintf("r%d", rangeID)),
+	}
+}
+
+func (ss *cloudSideloadStorage) objectName(index, term uint64) string {
+	return path.Join(ss.prefix, sideloadFilename(index, term))
+}
+
+// runObjectOp runs the given operation on the object store, bounded by
+// kv.raft_log.sideloading.external_timeout, and counts it if it fails.
+func (ss *cloudSideloadStorage) runObjectOp(
+	ctx context.Context, op string, f func(context.Context) error,
+) error {
+	err := contextutil.RunWithTimeout(ctx, op, sideloadExternalTimeout.Get(&ss.st.SV), f)
+	if err != nil && !os.IsNotExist(err) {
+		ss.metrics.externalFailed()
+	}
+	return err
+}
+
+func (ss *cloudSideloadStorage) readObject(ctx context.Context, name string) ([]byte, error) {
+	var b []byte
+	err := ss.runObjectOp(ctx, "reading sideloaded object "+name, func(ctx context.Context) error {
+		var err error
+		b, err = ss.store.ReadFile(ctx, name)
+		return err
+	})
+	return b, err
+}
+
+func (ss *cloudSideloadStorage) writeObject(ctx context.Context, name string, content []byte) error {
+	return ss.runObjectOp(ctx, "writing sideloaded object "+name, func(ctx context.Context) error {
+		return ss.store.WriteFile(ctx, name, content)
+	})
+}
+
+func (ss *cloudSideloadStorage) deleteObject(ctx context.Context, name string) error {
+	return ss.runObjectOp(ctx, "deleting sideloaded object "+name, func(ctx context.Context) error {
+		return ss.store.Delete(ctx, name)
+	})
+}
+
+// load loads the manifest unless it has been loaded already. A missing
+// manifest means that no payloads are stored.
+func (ss *cloudSideloadStorage) load(ctx context.Context) error {
+	if ss.loaded {
+		return nil
+	}
+	files := make(map[slKey]int64)
+	b, err := ss.readObject(ctx, path.Join(ss.prefix, cloudSideloadManifest))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "reading sideloaded manifest")
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return errors.Errorf("malformed line in sideloaded manifest: %q", line)
+		}
+		index, term, err := parseSideloadFilename(fields[0])
+		if err != nil {
+			return err
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "malformed line in sideloaded manifest: %q", line)
+		}
+		files[slKey{index: index, term: term}] = size
+	}
+	ss.files, ss.loaded = files, true
+	return nil
+}
+
+// find returns the size of the payload at the given index and term, and
+// whether the manifest lists it.
+func (ss *cloudSideloadStorage) find(ctx context.Context, index, term uint64) (int64, bool, error) {
+	if err := ss.load(ctx); err != nil {
+		return 0, false, err
+	}
+	size, ok := ss.files[slKey{index: index, term: term}]
+	return size, ok, nil
+}
+
+// saveManifest writes the manifest, which lists the payloads in the order in
+// which ForEach visits them.
+//
+// The whole manifest is rewritten synchronously by every Put, PutMany and
+// truncation, with raftMu held, which costs one object store write of a size
+// proportional to the number of payloads in the untruncated part of the Raft
+// log. Raft log truncation keeps that number small, so the writes aren't
+// batched.
+func (ss *cloudSideloadStorage) saveManifest(ctx context.Context) error {
+	var buf bytes.Buffer
+	for _, k := range ss.sortedKeys() {
+		fmt.Fprintf(&buf, "%s %d\n", sideloadFilename(k.index, k.term), ss.files[k])
+	}
+	if err := ss.writeObject(ctx, path.Join(ss.prefix, cloudSideloadManifest), buf.Bytes()); err != nil {
+		// The manifest may or may not have been written.
+		ss.loaded = false
+		return errors.Wrap(err, "writing sideloaded manifest")
+	}
+	return nil
+}
+
+// updateResidentBytes reports the size of the payloads listed by the manifest
+// to the metrics, if it is loaded.
+func (ss *cloudSideloadStorage) updateResidentBytes() {
+	if !ss.loaded {
+		return
+	}
+	var bytes int64
+	for _, size := range ss.files {
+		bytes += size
+	}
+	ss.metrics.updateResident(&ss.residentBytes, bytes)
+}
+
+// sortedKeys returns the keys of all stored payloads in the order in which
+// ForEach visits them. The manifest must have been loaded.
+func (ss *cloudSideloadStorage) sortedKeys() []slKey {
+	keys := make([]slKey, 0, len(ss.files))
+	for k := range ss.files {
+		keys = append(keys, k)
+	}
+	sortSideloadKeys(keys)
+	return keys
+}
+
+// Dir implements SideloadStorage. The payloads aren't stored in a local
+// directory.
+func (ss *cloudSideloadStorage) Dir() string {
+	return ""
+}
+
+// Identity implements SideloadStorage.
+func (ss *cloudSideloadStorage) Identity() (roachpb.RangeID, roachpb.ReplicaID) {
+	return ss.rangeID, ss.replicaID
+}
+
+// Put implements SideloadStorage. The manifest is written once the object has
+// been written.
+func (ss *cloudSideloadStorage) Put(ctx context.Context, index, term uint64, contents []byte) error {
+	if err := ss.load(ctx); err != nil {
+		return &sideloadExternalStoreError{err: err}
+	}
+	if err := ss.writeObject(ctx, ss.objectName(index, term), contents); err != nil {
+		return &sideloadExternalStoreError{err: err}
+	}
+	ss.files[slKey{index: index, term: term}] = int64(len(contents))
+	defer ss.updateResidentBytes()
+	if err := ss.saveManifest(ctx); err != nil {
+		return &sideloadExternalStoreError{err: err}
+	}
+	ss.metrics.written(int64(len(contents)))
+	return nil
+}
+
+// PutMany implements SideloadStorage. Like Put, it writes the manifest once
+// all objects have been written. If an object can't be written, the objects
+// written before are deleted again.
+func (ss *cloudSideloadStorage) PutMany(
+	ctx context.Context, entries []storagebase.SideloadEntry,
+) error {
+	if err := ss.load(ctx); err != nil {
+		return &sideloadExternalStoreError{err: err}
+	}
+	for i, e := range entries {
+		if err := ss.writeObject(ctx, ss.objectName(e.Index, e.Term), e.Contents); err != nil {
+			for _, w := range entries[:i] {
+				if _, ok := ss.files[slKey{index: w.Index, term: w.Term}]; ok {
+					// The object was overwritten, and is still referenced by the
+					// manifest.
+					continue
+				}
+				if err := ss.deleteObject(ctx, ss.objectName(w.Index, w.Term)); err != nil {
+					log.Warningf(ctx, "unable to delete sideloaded object of failed batch: %s", err)
+				}
+			}
+			return &sideloadExternalStoreError{err: err}
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	for _, e := range entries {
+		ss.files[slKey{index: e.Index, term: e.Term}] = int64(len(e.Contents))
+	}
+	defer ss.updateResidentBytes()
+	if err := ss.saveManifest(ctx); err != nil {
+		return &sideloadExternalStoreError{err: err}
+	}
+	for _, e := range entries {
+		ss.metrics.written(int64(len(e.Contents)))
+	}
+	return nil
+}
+
+// PutIfAbsent implements SideloadStorage.
+func (ss *cloudSideloadStorage) PutIfAbsent(
+	ctx context.Context, index, term uint64, contents []byte,
+) (bool, error) {
+	existing, err := ss.Get(ctx, index, term)
+	if err == nil {
+		if !bytes.Equal(existing, contents) {
+			return false, errSideloadExists
+		}
+		return false, nil
+	} else if errors.Cause(err) != errSideloadedFileNotFound {
+		return false, err
+	}
+	if err := ss.Put(ctx, index, term, contents); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PutMonotonic implements SideloadStorage.
+func (ss *cloudSideloadStorage) PutMonotonic(
+	ctx context.Context, index, term uint64, contents []byte,
+) error {
+	if err := ss.load(ctx); err != nil {
+		return &sideloadExternalStoreError{err: err}
+	}
+	for k := range ss.files {
+		if k.index == index && k.term > term {
+			return &sideloadTermRegressionError{index: index, term: term, existingTerm: k.term}
+		}
+	}
+	return ss.Put(ctx, index, term, contents)
+}
+
+// Get implements SideloadStorage.
+func (ss *cloudSideloadStorage) Get(ctx context.Context, index, term uint64) ([]byte, error) {
+	if err := ss.load(ctx); err != nil {
+		return nil, err
+	}
+	if _, ok := ss.files[slKey{index: index, term: term}]; !ok {
+		return nil, errSideloadedFileNotFound
+	}
+	b, err := ss.readObject(ctx, ss.objectName(index, term))
+	if os.IsNotExist(err) {
+		// The object is listed, so it was removed behind the storage's back.
+		return nil, &errSideloadRemovedConcurrently{index: index, term: term}
+	} else if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// HasEntry implements SideloadStorage. It doesn't access the object.
+func (ss *cloudSideloadStorage) HasEntry(ctx context.Context, index, term uint64) (bool, error) {
+	_, ok, err := ss.find(ctx, index, term)
+	return ok, err
+}
+
+// Stat implements SideloadStorage. Modification times aren't tracked.
+func (ss *cloudSideloadStorage) Stat(
+	ctx context.Context, index, term uint64,
+) (storagebase.SideloadFileInfo, error) {
+	size, ok, err := ss.find(ctx, index, term)
+	if err != nil {
+		return storagebase.SideloadFileInfo{}, err
+	}
+	if !ok {
+		return storagebase.SideloadFileInfo{}, errSideloadedFileNotFound
+	}
+	return storagebase.SideloadFileInfo{Size: size}, nil
+}
+
+// GetRange implements SideloadStorage. Objects can't be read partially, so the
+// whole payload is read.
+func (ss *cloudSideloadStorage) GetRange(
+	ctx context.Context, index, term uint64, start, end roachpb.Key,
+) ([]byte, error) {
+	data, err := ss.Get(ctx, index, term)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := engine.NewMemSSTIterator(data, false /* verify */)
+	if err != nil {
+		return nil, err
+	}
+	return sideloadedSSTableRange(iter, start, end)
+}
+
+// Filename implements SideloadStorage. The returned path is in a local
+// staging directory, where the payload doesn't exist, so that AddSSTable
+// commands ingest a copy of their payload.
+func (ss *cloudSideloadStorage) Filename(_ context.Context, index, term uint64) (string, error) {
+	return filepath.Join(ss.stagingDir, sideloadFilename(index, term)), nil
+}
+
+// Purge implements SideloadStorage.
+func (ss *cloudSideloadStorage) Purge(ctx context.Context, index, term uint64) (int64, error) {
+	size, ok, err := ss.find(ctx, index, term)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errSideloadedFileNotFound
+	}
+	if _, err := ss.deleteObjects(ctx, []slKey{{index: index, term: term}}); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// Clear implements SideloadStorage.
+func (ss *cloudSideloadStorage) Clear(ctx context.Context) error {
+	if err := ss.load(ctx); err != nil {
+		return err
+	}
+	_, err := ss.deleteObjects(ctx, ss.sortedKeys())
+	return err
+}
+
+// deleteObjects deletes the objects of the given payloads in order, and then
+// writes the manifest without the payloads whose objects were deleted. If an
+// object fails to be deleted, it and the following ones stay listed. Returns
+// the size of the deleted payloads, also along with an error.
+func (ss *cloudSideloadStorage) deleteObjects(ctx context.Context, keys []slKey) (int64, error) {
+	var freed int64
+	var deleted int
+	var err error
+	for _, k := range keys {
+		if err = ss.deleteObject(ctx, ss.objectName(k.index, k.term)); err != nil {
+			break
+		}
+		freed += ss.files[k]
+		delete(ss.files, k)
+		deleted++
+	}
+	if deleted == 0 {
+		return 0, err
+	}
+	defer ss.updateResidentBytes()
+	if saveErr := ss.saveManifest(ctx); err == nil {
+		err = saveErr
+	}
+	return freed, err
+}
+
+// TruncateTo implements SideloadStorage.
+func (ss *cloudSideloadStorage) TruncateTo(
+	ctx context.Context, index uint64,
+) (freed, retained int64, _ error) {
+	if err := ss.load(ctx); err != nil {
+		return 0, 0, err
+	}
+	var truncated []slKey
+	for k, size := range ss.files {
+		if k.index < index {
+			truncated = append(truncated, k)
+		} else {
+			retained += size
+		}
+	}
+	if len(truncated) == 0 {
+		return 0, retained, nil
+	}
+	sortSideloadKeys(truncated)
+	freed, err := ss.deleteObjects(ctx, truncated)
+	ss.metrics.truncated(freed)
+	// Payloads whose objects failed to be deleted remain.
+	for _, k := range truncated {
+		retained += ss.files[k]
+	}
+	return freed, retained, err
+}
+
+// ForEach implements SideloadStorage.
+func (ss *cloudSideloadStorage) ForEach(
+	ctx context.Context, visit func(index, term uint64, size int64) error,
+) error {
+	if err := ss.load(ctx); err != nil {
+		return err
+	}
+	for _, k := range ss.sortedKeys() {
+		if err := visit(k.index, k.term, ss.files[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsEmpty implements SideloadStorage.
+func (ss *cloudSideloadStorage) IsEmpty(ctx context.Context) (bool, error) {
+	if err := ss.load(ctx); err != nil {
+		return false, err
+	}
+	return len(ss.files) == 0, nil
+}
+
+// State implements SideloadStorage. Object stores have no directories to
+// create, so like the in-memory storage it is never reported as not created.
+// If the object store can't be reached within
+// kv.raft_log.sideloading.external_timeout, the storage is reported as
+// non-empty.
+func (ss *cloudSideloadStorage) State() storagebase.SideloadDirState {
+	var empty bool
+	if err := contextutil.RunWithTimeout(
+		context.Background(), "checking sideloaded objects", sideloadExternalTimeout.Get(&ss.st.SV),
+		func(ctx context.Context) error {
+			var err error
+			empty, err = ss.IsEmpty(ctx)
+			return err
+		},
+	); err == nil && empty {
+		return storagebase.SideloadDirEmpty
+	}
+	return storagebase.SideloadDirNonEmpty
+}
+
+// BytesUsed implements SideloadStorage. It only accounts for the payloads,
+// which take up space in the object store rather than on the local disk.
+func (ss *cloudSideloadStorage) BytesUsed(ctx context.Context) (int64, error) {
+	if err := ss.load(ctx); err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, size := range ss.files {
+		total += size
+	}
+	return total, nil
+}
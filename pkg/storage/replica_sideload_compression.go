@@ -0,0 +1,119 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+// sideloadCompressionEnabled makes the disk sideloaded storage compress the
+// payloads it writes. Payloads are decompressed transparently when read, so
+// that the setting can be changed at any time: files written under either
+// setting remain readable.
+var sideloadCompressionEnabled = settings.RegisterBoolSetting(
+	"kv.raft_log.sideloading.compression.enabled",
+	"if enabled, sideloaded Raft payloads are compressed with snappy before they are written to disk",
+	false,
+)
+
+// sideloadCompressionMagic starts every compressed sideloaded file. It is
+// followed by a version byte and the payload in the snappy block format,
+// which records the length of the uncompressed payload up front.
+//
+// Uncompressed files hold an SSTable, whose format doesn't reserve a prefix
+// that would rule out a collision with the magic. The magic is long enough to
+// make one vanishingly unlikely, and a false positive is caught by the
+// decompression failing, and ultimately by the CRC32 carried by the Raft
+// command.
+var sideloadCompressionMagic = []byte("\xf7crdbsz")
+
+// sideloadCompressionVersion is the version of the format of compressed
+// sideloaded files.
+const sideloadCompressionVersion = 1
+
+// sideloadCompressionHeaderLen is the length of the header of compressed
+// sideloaded files, consisting of the magic and the version.
+var sideloadCompressionHeaderLen = len(sideloadCompressionMagic) + 1
+
+// isCompressedSideloadPayload returns whether the given file contents start
+// with the magic of compressed sideloaded files.
+func isCompressedSideloadPayload(b []byte) bool {
+	return bytes.HasPrefix(b, sideloadCompressionMagic)
+}
+
+// compressSideloadPayload returns the contents of a compressed sideloaded file
+// holding the given payload.
+func compressSideloadPayload(payload []byte) []byte {
+	b := make([]byte, sideloadCompressionHeaderLen, sideloadCompressionHeaderLen+snappy.MaxEncodedLen(len(payload)))
+	copy(b, sideloadCompressionMagic)
+	b[len(sideloadCompressionMagic)] = sideloadCompressionVersion
+	// The payload is encoded in place, right after the header.
+	encoded := snappy.Encode(b[sideloadCompressionHeaderLen:cap(b)], payload)
+	return b[:sideloadCompressionHeaderLen+len(encoded)]
+}
+
+// decompressSideloadPayload returns the payload held by the given contents of
+// a sideloaded file, decompressing it if the file is compressed.
+func decompressSideloadPayload(index, term uint64, b []byte) ([]byte, error) {
+	if !isCompressedSideloadPayload(b) {
+		return b, nil
+	}
+	if len(b) < sideloadCompressionHeaderLen {
+		return nil, errors.Errorf("compressed sideloaded file at index %d term %d is truncated", index, term)
+	}
+	if v := b[len(sideloadCompressionMagic)]; v != sideloadCompressionVersion {
+		return nil, errors.Errorf("compressed sideloaded file at index %d term %d has unknown version %d",
+			index, term, v)
+	}
+	payload, err := snappy.Decode(nil, b[sideloadCompressionHeaderLen:])
+	if err != nil {
+		return nil, errors.Wrapf(err, "decompressing sideloaded file at index %d term %d", index, term)
+	}
+	return payload, nil
+}
+
+// readSideloadCompressionHeader reads the beginning of the given sideloaded
+// file. If the file is compressed, it returns true along with the length of
+// the uncompressed payload, which is -1 if the header can't be decoded.
+func readSideloadCompressionHeader(filename string) (compressed bool, payloadLen int64, _ error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, 0, err
+	}
+	defer f.Close()
+	// The header is followed by the uncompressed length as a uvarint.
+	buf := make([]byte, sideloadCompressionHeaderLen+binary.MaxVarintLen64)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, 0, err
+	}
+	buf = buf[:n]
+	if !isCompressedSideloadPayload(buf) {
+		return false, 0, nil
+	}
+	if len(buf) < sideloadCompressionHeaderLen || buf[len(sideloadCompressionMagic)] != sideloadCompressionVersion {
+		return true, -1, nil
+	}
+	l, err := snappy.DecodedLen(buf[sideloadCompressionHeaderLen:])
+	if err != nil {
+		return true, -1, nil
+	}
+	return true, int64(l), nil
+}
@@ -13,28 +13,133 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/storagebase"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/pkg/errors"
 	"golang.org/x/time/rate"
 )
 
 var _ SideloadStorage = &diskSideloadStorage{}
 
+// sideloadUnknownFilesPolicy controls how TruncateTo handles files in the
+// sideloaded directory which weren't written by the sideloaded storage, and
+// which thus prevent the directory from being removed once all sideloaded
+// files have been truncated away.
+type sideloadUnknownFilesPolicy int64
+
+const (
+	// sideloadUnknownFilesStrict fails the truncation.
+	sideloadUnknownFilesStrict sideloadUnknownFilesPolicy = iota
+	// sideloadUnknownFilesWarnAndSkip logs the unknown files and leaves them,
+	// and thus the directory, in place.
+	sideloadUnknownFilesWarnAndSkip
+	// sideloadUnknownFilesQuarantine moves the unknown files into a quarantine
+	// directory (see sideloadQuarantinePath) and then removes the directory.
+	sideloadUnknownFilesQuarantine
+)
+
+var sideloadUnknownFilesPolicySetting = settings.RegisterEnumSetting(
+	"kv.raft_log.sideloading.unknown_files_policy",
+	"how to handle unknown files which prevent the removal of a fully truncated sideloaded directory",
+	"strict",
+	map[int64]string{
+		int64(sideloadUnknownFilesStrict):      "strict",
+		int64(sideloadUnknownFilesWarnAndSkip): "warn-and-skip",
+		int64(sideloadUnknownFilesQuarantine):  "quarantine",
+	},
+)
+
+// sideloadWriteLimit caps the aggregate rate at which the sideloaded storages
+// of all replicas on a store write to disk. These writes are also subject to
+// kv.bulk_io_write.max_rate, which is shared with other bulk io operations.
+var sideloadWriteLimit = settings.RegisterByteSizeSetting(
+	"kv.raft_log.sideloading.max_write_rate",
+	"the rate limit (bytes/sec) for writes of sideloaded Raft payloads to disk, across all ranges of a store",
+	1<<40,
+)
+
+// sideloadMaxFilesPerRange limits the number of files in the sideloaded
+// storage of a range, which avoids straining the filesystem with very large
+// numbers of small files. See diskSideloadStorage.enforceMaxFiles.
+var sideloadMaxFilesPerRange = settings.RegisterNonNegativeIntSetting(
+	"kv.raft_log.sideloading.max_files_per_range",
+	"the maximum number of sideloaded files per range, enforced by removing files of truncated Raft log entries or else keeping payloads inline (0 to disable)",
+	0,
+)
+
+// sideloadDeferredDeletion makes the removal of sideloaded files, for example
+// by TruncateTo, move them aside instead of deleting them, which leaves the
+// actual deletion to the store's sweeper (see sweepSideloadPendingDeletions).
+var sideloadDeferredDeletion = settings.RegisterBoolSetting(
+	"kv.raft_log.sideloading.deferred_deletion.enabled",
+	"if enabled, removed sideloaded files are deleted in the background instead of by the operation removing them",
+	false,
+)
+
+// sideloadEagerDirCreation makes newDiskSideloadStorage create the sideloaded
+// directory right away, rather than on the first write to the storage. This
+// takes the directory creation off the path of the first sideloaded proposal.
+// The directory is still removed when truncation empties it.
+var sideloadEagerDirCreation = settings.RegisterBoolSetting(
+	"kv.raft.sideload_eager_dir.enabled",
+	"if enabled, the directory for sideloaded Raft payloads is created when a replica is initialized instead of on first use",
+	false,
+)
+
+// sideloadPendingDeleteSuffix is appended to the names of sideloaded files
+// whose deletion has been deferred. Such files are not considered part of the
+// storage anymore.
+const sideloadPendingDeleteSuffix = ".pending-delete"
+
 type diskSideloadStorage struct {
-	st         *cluster.Settings
-	limiter    *rate.Limiter
+	st        *cluster.Settings
+	rangeID   roachpb.RangeID
+	replicaID roachpb.ReplicaID
+	limiter   *rate.Limiter
+	// sideloadLimiter is shared by all disk sideloaded storages on a store and
+	// caps their aggregate write rate (see sideloadWriteLimit). Writes are
+	// subject to it in addition to limiter.
+	sideloadLimiter *rate.Limiter
+	// cache is shared by all disk sideloaded storages on a store and holds
+	// payloads read by Get. It may be nil.
+	cache      *sideloadCache
 	dir        string
 	dirCreated bool
 	eng        engine.Engine
+	// namer determines the subdirectories of dir into which files are
+	// written. Files are read from dir itself as well, whatever the namer.
+	namer sideloadFileNamer
+
+	// truncatedIndex is the highest index passed to TruncateTo. Files below it
+	// don't belong to entries in the Raft log and can always be removed, even
+	// if TruncateTo failed to do so.
+	truncatedIndex uint64
+
+	// files indexes the files in dir, so that they don't have to be listed for
+	// every operation. It is loaded lazily. See sideloadFileIndex.
+	files sideloadFileIndex
+
+	// metrics is shared by all disk sideloaded storages on a store. It may be
+	// nil. residentBytes is the size of the files in the index as last
+	// reported to it.
+	metrics       *sideloadMetrics
+	residentBytes int64
 }
 
 func deprecatedSideloadedPath(
@@ -63,6 +168,14 @@ func sideloadedPath(baseDir string, rangeID roachpb.RangeID) string {
 	)
 }
 
+// sideloadQuarantinePath returns the directory into which unknown files found in
+// the given sideloaded directory are moved under the quarantine policy. For
+// example, files in baseDir/sideloading/r1XXXX/r1828 are moved to
+// baseDir/sideloading/quarantine/r1828.
+func sideloadQuarantinePath(dir string) string {
+	return filepath.Join(filepath.Dir(filepath.Dir(dir)), "quarantine", filepath.Base(dir))
+}
+
 func exists(path string) (bool, error) {
 	_, err := os.Stat(path)
 	if err == nil {
@@ -74,6 +187,37 @@ func exists(path string) (bool, error) {
 	return false, err
 }
 
+// globSideloadDir is like filepath.Glob for the given pattern in the given
+// directory, but reads the directory in batches and stops with the context's
+// error if it is canceled in between. Like filepath.Glob, it ignores I/O
+// errors, so that a missing directory has no matches.
+func globSideloadDir(ctx context.Context, dir, pattern string) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, nil
+	}
+	defer d.Close()
+	var matches []string
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		names, err := d.Readdirnames(128)
+		for _, name := range names {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				matches = append(matches, filepath.Join(dir, name))
+			}
+		}
+		if err != nil {
+			sort.Strings(matches)
+			return matches, nil
+		}
+	}
+}
+
 // moveSideloadedData handles renames of sideloaded directories that precede
 // VersionSideloadedStorageNoReplicaID. Such directories depend on the replicaID
 // which can change, in which case this method needs to be called to move the
@@ -125,6 +269,8 @@ func newDiskSideloadStorage(
 	replicaID roachpb.ReplicaID,
 	baseDir string,
 	limiter *rate.Limiter,
+	sideloadLimiter *rate.Limiter,
+	cache *sideloadCache,
 	eng engine.Engine,
 ) (*diskSideloadStorage, error) {
 	path := deprecatedSideloadedPath(baseDir, rangeID, replicaID)
@@ -160,10 +306,25 @@ func newDiskSideloadStorage(
 	}
 
 	ss := &diskSideloadStorage{
-		dir:     path,
-		eng:     eng,
-		st:      st,
-		limiter: limiter,
+		dir:             path,
+		eng:             eng,
+		st:              st,
+		limiter:         limiter,
+		sideloadLimiter: sideloadLimiter,
+		cache:           cache,
+		rangeID:         rangeID,
+		replicaID:       replicaID,
+		namer:           flatSideloadFileNamer{},
+	}
+	// Binaries which don't know about the sharded layout would not find the
+	// files placed in subdirectories.
+	if st.Version.IsActive(cluster.VersionShardedSideloadedStorage) {
+		ss.namer = shardedSideloadFileNamer{}
+	}
+	if sideloadEagerDirCreation.Get(&st.SV) {
+		if err := ss.createDir(); err != nil {
+			return nil, errors.Wrap(err, "creating sideloaded directory")
+		}
 	}
 	return ss, nil
 }
@@ -179,36 +340,383 @@ func (ss *diskSideloadStorage) Dir() string {
 	return ss.dir
 }
 
+// Identity implements SideloadStorage.
+func (ss *diskSideloadStorage) Identity() (roachpb.RangeID, roachpb.ReplicaID) {
+	return ss.rangeID, ss.replicaID
+}
+
 // Put implements SideloadStorage.
 func (ss *diskSideloadStorage) Put(ctx context.Context, index, term uint64, contents []byte) error {
-	filename := ss.filename(ctx, index, term)
+	defer ss.updateResidentBytes()
+	if err := ss.enforceMaxFiles(ctx, index, term); err != nil {
+		return err
+	}
+	ss.cache.invalidate(ss.rangeID, index, term)
+	filename := ss.newFilename(index, term)
+	data := contents
+	if sideloadCompressionEnabled.Get(&ss.st.SV) {
+		data = compressSideloadPayload(contents)
+	}
 	// There's a chance the whole path is missing (for example after Clear()),
 	// in which case handle that transparently.
 	for {
 		// Use 0644 since that's what RocksDB uses:
 		// https://github.com/facebook/rocksdb/blob/56656e12d67d8a63f1e4c4214da9feeec2bd442b/env/env_posix.cc#L171
-		if err := writeFileSyncing(ctx, filename, contents, ss.eng, 0644, ss.st, ss.limiter); err == nil {
-			return nil
+		if err := writeFileSyncing(
+			ctx, filename, data, ss.eng, 0644, ss.st, ss.limiter, ss.sideloadLimiter,
+		); err == nil {
+			if ss.files.loaded {
+				size, err := ss.fileSize(filename)
+				if err != nil {
+					ss.invalidateFileIndex()
+					return err
+				}
+				ss.files.put(slKey{index: index, term: term}, size)
+			}
+			ss.metrics.written(int64(len(contents)))
+			if err := ss.removeFlatCopy(index, term); err != nil {
+				ss.invalidateFileIndex()
+				return err
+			}
+			return ss.putChecksum(ctx, index, term, contents)
 		} else if !os.IsNotExist(err) {
+			// The file may or may not have been (partially) written.
+			ss.invalidateFileIndex()
 			return err
 		}
-		// createDir() ensures ss.dir exists but will not create any subdirectories
-		// within ss.dir because filename() does not make subdirectories in ss.dir.
-		if err := ss.createDir(); err != nil {
+		// createShardDir() ensures that ss.dir and the subdirectory of it that
+		// the file goes into exist.
+		if err := ss.createShardDir(index); err != nil {
 			return err
 		}
 		continue
 	}
 }
 
-// Get implements SideloadStorage.
+// PutMany implements SideloadStorage. Unlike Put, which syncs each file as it
+// writes it, the files are written unsynced and synced together at the end,
+// which is cheaper for batches of files. If an error occurs, the files created
+// by the batch are removed again. Files which existed before are left in
+// place, though they may have been overwritten.
+func (ss *diskSideloadStorage) PutMany(
+	ctx context.Context, entries []storagebase.SideloadEntry,
+) (retErr error) {
+	// created holds the entries whose files were created by the batch,
+	// possibly only partially, and open holds the files which have yet to be
+	// synced.
+	var created []storagebase.SideloadEntry
+	var open []engine.DBFile
+	defer ss.updateResidentBytes()
+	defer func() {
+		for _, f := range open {
+			_ = f.Close()
+		}
+		if retErr == nil {
+			return
+		}
+		for _, e := range created {
+			for _, filename := range []string{
+				ss.newFilename(e.Index, e.Term),
+				ss.checksumFilename(ss.shardDir(e.Index), e.Index, e.Term),
+			} {
+				if err := ss.eng.DeleteFile(filename); err != nil && !os.IsNotExist(err) {
+					log.Warningf(ctx, "unable to remove sideloaded file %s of failed batch: %s", filename, err)
+				}
+			}
+		}
+		ss.invalidateFileIndex()
+	}()
+
+	compress := sideloadCompressionEnabled.Get(&ss.st.SV)
+	for _, e := range entries {
+		if err := ss.enforceMaxFiles(ctx, e.Index, e.Term); err != nil {
+			return err
+		}
+		ss.cache.invalidate(ss.rangeID, e.Index, e.Term)
+		filename := ss.newFilename(e.Index, e.Term)
+		data := e.Contents
+		if compress {
+			data = compressSideloadPayload(e.Contents)
+		}
+		if existed, err := exists(filename); err != nil {
+			return err
+		} else if !existed {
+			created = append(created, e)
+		}
+		f, err := writeFileUnsynced(ctx, filename, data, ss.eng, ss.limiter, ss.sideloadLimiter)
+		if os.IsNotExist(err) {
+			// The directory is missing, as after Clear(), or the entry is the
+			// first one of its subdirectory.
+			if err := ss.createShardDir(e.Index); err != nil {
+				return err
+			}
+			f, err = writeFileUnsynced(ctx, filename, data, ss.eng, ss.limiter, ss.sideloadLimiter)
+		}
+		if err != nil {
+			return err
+		}
+		open = append(open, f)
+		// The file index is kept up to date as the files are written, so that
+		// enforceMaxFiles accounts for the files written earlier in the batch.
+		if ss.files.loaded {
+			size, err := ss.fileSize(filename)
+			if err != nil {
+				return err
+			}
+			ss.files.put(slKey{index: e.Index, term: e.Term}, size)
+		}
+	}
+
+	for len(open) > 0 {
+		f := open[0]
+		open = open[1:]
+		err := f.Sync()
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		ss.metrics.written(int64(len(e.Contents)))
+	}
+	for _, e := range entries {
+		if err := ss.removeFlatCopy(e.Index, e.Term); err != nil {
+			return err
+		}
+		if err := ss.putChecksum(ctx, e.Index, e.Term, e.Contents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putChecksum writes the checksum file for the payload at the given index and
+// term if kv.raft_log.sideloading.checksum is enabled, and removes any
+// checksum file left over from a previous payload otherwise.
+func (ss *diskSideloadStorage) putChecksum(
+	ctx context.Context, index, term uint64, contents []byte,
+) error {
+	filename := ss.checksumFilename(ss.shardDir(index), index, term)
+	algorithm := sideloadChecksumAlgorithm(sideloadChecksumSetting.Get(&ss.st.SV))
+	if algorithm == sideloadChecksumNone {
+		return ss.removeChecksum(filename)
+	}
+	return writeFileSyncing(
+		ctx, filename, encodeSideloadChecksum(algorithm, contents), ss.eng, 0644, ss.st, ss.limiter,
+	)
+}
+
+// removeChecksum removes the given checksum file, if it exists.
+func (ss *diskSideloadStorage) removeChecksum(filename string) error {
+	if ok, err := exists(filename); err != nil || !ok {
+		return err
+	}
+	if err := ss.eng.DeleteFile(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// checksumFilename returns the name of the checksum file for the payload at
+// the given index and term, which is placed in the given directory along with
+// the payload.
+func (ss *diskSideloadStorage) checksumFilename(dir string, index, term uint64) string {
+	return filepath.Join(dir, sideloadChecksumFilename(index, term))
+}
+
+// enforceMaxFiles makes room for a file at the given index and term if the
+// storage already holds as many files as allowed by sideloadMaxFilesPerRange.
+// Files of entries which have been truncated from the Raft log are removed,
+// lowest index first; files of entries which may still be in the log are never
+// removed. If not enough files can be removed, a sideloadStorageFullError is
+// returned. The files are looked up in the file index, so the directory is
+// only listed if the index isn't loaded.
+func (ss *diskSideloadStorage) enforceMaxFiles(ctx context.Context, index, term uint64) error {
+	maxFiles := sideloadMaxFilesPerRange.Get(&ss.st.SV)
+	if maxFiles == 0 {
+		return nil
+	}
+	files, err := ss.fileIndex(ctx)
+	if err != nil {
+		return err
+	}
+	if _, ok := files.search(slKey{index: index, term: term}); ok {
+		// Overwriting a file doesn't add to the number of files.
+		return nil
+	}
+	for int64(len(files.entries)) >= maxFiles {
+		k := files.entries[0].slKey
+		if k.index >= ss.truncatedIndex {
+			return &sideloadStorageFullError{index: index, term: term, maxFiles: maxFiles}
+		}
+		log.Eventf(ctx, "removing sideloaded file of truncated entry at index=%d term=%d", k.index, k.term)
+		// Purge removes the file from the index.
+		if _, err := ss.Purge(ctx, k.index, k.term); err != nil && err != errSideloadedFileNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutIfAbsent implements SideloadStorage.
+func (ss *diskSideloadStorage) PutIfAbsent(
+	ctx context.Context, index, term uint64, contents []byte,
+) (bool, error) {
+	existing, err := ss.Get(ctx, index, term)
+	if err == nil {
+		if !bytes.Equal(existing, contents) {
+			return false, errSideloadExists
+		}
+		return false, nil
+	} else if errors.Cause(err) != errSideloadedFileNotFound {
+		return false, err
+	}
+	if err := ss.Put(ctx, index, term, contents); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PutMonotonic implements SideloadStorage.
+func (ss *diskSideloadStorage) PutMonotonic(
+	ctx context.Context, index, term uint64, contents []byte,
+) error {
+	files, err := ss.fileIndex(ctx)
+	if err != nil {
+		return err
+	}
+	// Look for the entry with the highest term at the index.
+	if i, _ := files.search(slKey{index: index + 1}); i > 0 {
+		if existing := files.entries[i-1]; existing.index == index && existing.term > term {
+			return &sideloadTermRegressionError{index: index, term: term, existingTerm: existing.term}
+		}
+	}
+	return ss.Put(ctx, index, term, contents)
+}
+
+// Get implements SideloadStorage. Payloads are served from the cache shared by
+// the storages of the store, if enabled (see sideloadCacheSize), and added to
+// it when read from disk.
 func (ss *diskSideloadStorage) Get(ctx context.Context, index, term uint64) ([]byte, error) {
+	if b, ok := ss.cache.get(ss.rangeID, index, term); ok {
+		return b, nil
+	}
+	dir := ss.payloadDir(index, term)
+	b, err := ss.eng.ReadFile(filepath.Join(dir, sideloadFilename(index, term)))
+	if os.IsNotExist(err) {
+		return nil, ss.notFoundError(index, term)
+	} else if err != nil {
+		return nil, err
+	}
+	// Files are decompressed regardless of the current setting, as it may
+	// have changed since they were written.
+	if b, err = decompressSideloadPayload(index, term, b); err != nil {
+		return nil, err
+	}
+	// Payloads are verified whenever a checksum file exists, regardless of
+	// the current setting, as it may have changed since they were written.
+	sum, err := ss.eng.ReadFile(ss.checksumFilename(dir, index, term))
+	if os.IsNotExist(err) {
+		ss.cache.put(ss.rangeID, index, term, b)
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := verifySideloadChecksum(index, term, b, sum); err != nil {
+		return nil, err
+	}
+	ss.cache.put(ss.rangeID, index, term, b)
+	return b, nil
+}
+
+// HasEntry implements SideloadStorage.
+func (ss *diskSideloadStorage) HasEntry(ctx context.Context, index, term uint64) (bool, error) {
+	if _, err := os.Stat(ss.filename(ctx, index, term)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Stat implements SideloadStorage. The size is that of the payload, which
+// differs from that of the file if the file is compressed.
+func (ss *diskSideloadStorage) Stat(
+	ctx context.Context, index, term uint64,
+) (storagebase.SideloadFileInfo, error) {
 	filename := ss.filename(ctx, index, term)
-	b, err := ss.eng.ReadFile(filename)
+	info, err := os.Stat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return storagebase.SideloadFileInfo{}, errSideloadedFileNotFound
+		}
+		return storagebase.SideloadFileInfo{}, err
+	}
+	size, err := ss.fileSize(filename)
+	if err != nil {
+		return storagebase.SideloadFileInfo{}, err
+	}
+	return storagebase.SideloadFileInfo{Size: size, ModTime: info.ModTime()}, nil
+}
+
+// notFoundError returns the error for a file at the given index and term which
+// Get didn't find on disk. If the index of files still lists it, the file
+// existed but was removed behind the storage's back, which is reported as an
+// *errSideloadRemovedConcurrently. The index is then out of date and thus
+// discarded. Files removed through the storage itself are also removed from
+// the index, and so are reported as errSideloadedFileNotFound.
+func (ss *diskSideloadStorage) notFoundError(index, term uint64) error {
+	if !ss.files.loaded {
+		return errSideloadedFileNotFound
+	}
+	if _, ok := ss.files.search(slKey{index: index, term: term}); !ok {
+		return errSideloadedFileNotFound
+	}
+	ss.invalidateFileIndex()
+	return &errSideloadRemovedConcurrently{index: index, term: term}
+}
+
+// GetRange implements SideloadStorage. The SSTable is read through its block
+// index, so that only the data blocks overlapping the range are read from
+// disk. Unlike Get, it doesn't verify the payload against its checksum file,
+// which covers the whole payload. Compressed files can't be read partially,
+// and are read in full through Get instead.
+func (ss *diskSideloadStorage) GetRange(
+	ctx context.Context, index, term uint64, start, end roachpb.Key,
+) ([]byte, error) {
+	filename := ss.filename(ctx, index, term)
+	compressed, _, err := readSideloadCompressionHeader(filename)
 	if os.IsNotExist(err) {
 		return nil, errSideloadedFileNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var iter engine.SimpleIterator
+	if compressed {
+		b, err := ss.Get(ctx, index, term)
+		if err != nil {
+			return nil, err
+		}
+		iter, err = engine.NewMemSSTIterator(b, false /* verify */)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// TODO(tschottdorf): like fileSize, this should go through the env, as
+		// it won't be able to read the file if encryption is on.
+		//
+		// See #31913.
+		iter, err = engine.NewSSTIterator(filename)
+		if os.IsNotExist(err) {
+			return nil, errSideloadedFileNotFound
+		} else if err != nil {
+			return nil, err
+		}
 	}
-	return b, err
+	return sideloadedSSTableRange(iter, start, end)
 }
 
 // Filename implements SideloadStorage.
@@ -216,13 +724,34 @@ func (ss *diskSideloadStorage) Filename(ctx context.Context, index, term uint64)
 	return ss.filename(ctx, index, term), nil
 }
 
+// filename returns the name of the file holding the payload at the given index
+// and term, which is found in the flat layout if it was written that way.
 func (ss *diskSideloadStorage) filename(ctx context.Context, index, term uint64) string {
-	return filepath.Join(ss.dir, fmt.Sprintf("i%d.t%d", index, term))
+	return filepath.Join(ss.payloadDir(index, term), sideloadFilename(index, term))
+}
+
+// newFilename returns the name of the file into which the payload at the given
+// index and term is written.
+func (ss *diskSideloadStorage) newFilename(index, term uint64) string {
+	return filepath.Join(ss.shardDir(index), sideloadFilename(index, term))
 }
 
 // Purge implements SideloadStorage.
 func (ss *diskSideloadStorage) Purge(ctx context.Context, index, term uint64) (int64, error) {
-	return ss.purgeFile(ctx, ss.filename(ctx, index, term))
+	defer ss.updateResidentBytes()
+	ss.cache.invalidate(ss.rangeID, index, term)
+	dir := ss.payloadDir(index, term)
+	size, err := ss.purgeFile(ctx, filepath.Join(dir, sideloadFilename(index, term)))
+	if err == nil || err == errSideloadedFileNotFound {
+		ss.files.remove(slKey{index: index, term: term})
+	} else {
+		ss.invalidateFileIndex()
+		return size, err
+	}
+	if err := ss.removeChecksum(ss.checksumFilename(dir, index, term)); err != nil {
+		return size, err
+	}
+	return size, err
 }
 
 func (ss *diskSideloadStorage) fileSize(filename string) (int64, error) {
@@ -238,6 +767,19 @@ func (ss *diskSideloadStorage) fileSize(filename string) (int64, error) {
 		}
 		return 0, err
 	}
+	// The size of a compressed file's payload is accounted for, as that's
+	// what was added to the size of the Raft log when it was sideloaded. If
+	// the header is corrupt, the size of the file is the best guess.
+	compressed, payloadLen, err := readSideloadCompressionHeader(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, errSideloadedFileNotFound
+		}
+		return 0, err
+	}
+	if compressed && payloadLen >= 0 {
+		return payloadLen, nil
+	}
 	return info.Size(), nil
 }
 
@@ -246,6 +788,15 @@ func (ss *diskSideloadStorage) purgeFile(ctx context.Context, filename string) (
 	if err != nil {
 		return 0, err
 	}
+	if sideloadDeferredDeletion.Get(&ss.st.SV) {
+		if err := ss.moveFile(ctx, filename, filename+sideloadPendingDeleteSuffix); err != nil {
+			if os.IsNotExist(err) {
+				return 0, errSideloadedFileNotFound
+			}
+			return 0, err
+		}
+		return size, nil
+	}
 	if err := ss.eng.DeleteFile(filename); err != nil {
 		if os.IsNotExist(err) {
 			return 0, errSideloadedFileNotFound
@@ -256,9 +807,24 @@ func (ss *diskSideloadStorage) purgeFile(ctx context.Context, filename string) (
 }
 
 // Clear implements SideloadStorage.
-func (ss *diskSideloadStorage) Clear(_ context.Context) error {
-	err := ss.eng.DeleteDirAndFiles(ss.dir)
+func (ss *diskSideloadStorage) Clear(ctx context.Context) error {
+	defer ss.updateResidentBytes()
+	ss.cache.invalidateRange(ss.rangeID)
+	// DeleteDirAndFiles doesn't descend into subdirectories, so these are
+	// deleted first.
+	dirs, err := ss.shardDirs(ctx)
+	for i := 0; err == nil && i < len(dirs); i++ {
+		err = ss.eng.DeleteDirAndFiles(dirs[i])
+	}
+	if err == nil {
+		err = ss.eng.DeleteDirAndFiles(ss.dir)
+	}
 	ss.dirCreated = ss.dirCreated && err != nil
+	if err == nil {
+		ss.files = sideloadFileIndex{loaded: true}
+	} else {
+		ss.invalidateFileIndex()
+	}
 	return err
 }
 
@@ -266,31 +832,76 @@ func (ss *diskSideloadStorage) Clear(_ context.Context) error {
 func (ss *diskSideloadStorage) TruncateTo(
 	ctx context.Context, firstIndex uint64,
 ) (bytesFreed, bytesRetained int64, _ error) {
-	deletedAll := true
-	if err := ss.forEach(ctx, func(index uint64, filename string) error {
-		if index >= firstIndex {
-			size, err := ss.fileSize(filename)
-			if err != nil {
-				return err
-			}
-			bytesRetained += size
-			deletedAll = false
-			return nil
+	if firstIndex > ss.truncatedIndex {
+		ss.truncatedIndex = firstIndex
+	}
+	// Purge invalidates the cached payloads it removes, but payloads may also
+	// have been removed behind the storage's back.
+	ss.cache.invalidateBelow(ss.rangeID, firstIndex)
+	defer ss.updateResidentBytes()
+	files, err := ss.fileIndex(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	// Subdirectories emptied by the truncation are removed (see
+	// sideloadFileNamer).
+	var shards []string
+	defer func() { ss.removeEmptyShardDirs(shards) }()
+	// Purging removes the keys from the index, so iterate over a copy.
+	for _, k := range files.keys() {
+		if k.index >= firstIndex {
+			break
 		}
-		fileSize, err := ss.purgeFile(ctx, filename)
-		if err != nil {
-			return err
+		// Truncating a large number of files can take a while. Files removed
+		// before the context is canceled stay removed.
+		if err := ctx.Err(); err != nil {
+			return bytesFreed, 0, err
+		}
+		size, err := ss.Purge(ctx, k.index, k.term)
+		if err != nil && err != errSideloadedFileNotFound {
+			return bytesFreed, 0, errors.Wrap(err, ss.filename(ctx, k.index, k.term))
+		}
+		bytesFreed += size
+		ss.metrics.truncated(size)
+		if shard := ss.shardDir(k.index); len(shards) == 0 || shards[len(shards)-1] != shard {
+			shards = append(shards, shard)
 		}
-		bytesFreed += fileSize
-		return nil
-	}); err != nil {
-		return 0, 0, err
 	}
+	bytesRetained = files.bytes
 
-	if deletedAll {
+	if len(files.entries) == 0 {
+		// Checksum files are removed along with their payloads, but may have
+		// been left behind by a crash in between.
+		orphans, err := ss.globAll(ctx, "c*.t*")
+		if err != nil {
+			return bytesFreed, 0, err
+		}
+		for _, orphan := range orphans {
+			if err := ss.removeChecksum(orphan); err != nil {
+				return bytesFreed, 0, err
+			}
+		}
+		// Files pending deletion keep the directory from being removed. The
+		// sweeper removes it along with them.
+		pending, err := ss.globAll(ctx, "*"+sideloadPendingDeleteSuffix)
+		if err != nil {
+			return bytesFreed, 0, err
+		}
+		if len(pending) > 0 {
+			return bytesFreed, 0, nil
+		}
+		if shards, err = ss.shardDirs(ctx); err != nil {
+			return bytesFreed, 0, err
+		}
+		ss.removeEmptyShardDirs(shards)
 		// The directory may not exist, or it may exist and have been empty.
 		// Not worth trying to figure out which one, just try to delete.
-		err := os.Remove(ss.dir)
+		err = os.Remove(ss.dir)
+		if err == nil || os.IsNotExist(err) {
+			ss.dirCreated = false
+		} else {
+			err = ss.handleUnknownFiles(ctx, err)
+		}
 		if !os.IsNotExist(err) {
 			return bytesFreed, 0, errors.Wrapf(err, "while purging %q", ss.dir)
 		}
@@ -298,16 +909,229 @@ func (ss *diskSideloadStorage) TruncateTo(
 	return bytesFreed, bytesRetained, nil
 }
 
+// handleUnknownFiles is called when the sideloaded directory could not be
+// removed after truncating all sideloaded files from it, presumably because it
+// contains files that weren't written by the sideloaded storage. The files are
+// handled according to the configured sideloadUnknownFilesPolicy. The returned
+// error is the passed-in error for the strict policy, or the result of
+// retrying the removal otherwise.
+func (ss *diskSideloadStorage) handleUnknownFiles(ctx context.Context, removeErr error) error {
+	policy := sideloadUnknownFilesPolicy(sideloadUnknownFilesPolicySetting.Get(&ss.st.SV))
+	if policy == sideloadUnknownFilesStrict {
+		return removeErr
+	}
+	infos, err := ioutil.ReadDir(ss.dir)
+	if err != nil {
+		return err
+	}
+	switch policy {
+	case sideloadUnknownFilesWarnAndSkip:
+		names := make([]string, 0, len(infos))
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		log.Warningf(ctx, "leaving unknown files in sideloaded directory %s: %v", ss.dir, names)
+		return nil
+	case sideloadUnknownFilesQuarantine:
+		quarantineDir := sideloadQuarantinePath(ss.dir)
+		if err := os.MkdirAll(quarantineDir, 0755); err != nil {
+			return errors.Wrap(err, "creating quarantine directory")
+		}
+		for _, info := range infos {
+			from := filepath.Join(ss.dir, info.Name())
+			to := filepath.Join(quarantineDir, info.Name())
+			log.Warningf(ctx, "moving unknown file %s in sideloaded directory to %s", from, to)
+			if err := os.Rename(from, to); err != nil {
+				return errors.Wrap(err, "while quarantining unknown file")
+			}
+		}
+		if err := os.Remove(ss.dir); err != nil {
+			return err
+		}
+		ss.dirCreated = false
+		return nil
+	default:
+		return errors.Errorf("unknown policy %d for unknown sideloaded files", policy)
+	}
+}
+
+// quarantine moves the directory of the storage, along with all files in it,
+// into the quarantine area (see sideloadQuarantinePath), which preserves them
+// for investigation. The storage is empty afterwards. It returns the directory
+// the files were moved to, or an empty string if there were none.
+func (ss *diskSideloadStorage) quarantine(ctx context.Context) (string, error) {
+	ex, err := exists(ss.dir)
+	if err != nil || !ex {
+		return "", err
+	}
+	to := fmt.Sprintf("%s.corrupt-%d", sideloadQuarantinePath(ss.dir), timeutil.Now().UnixNano())
+	ss.cache.invalidateRange(ss.rangeID)
+	// Directories are visited before the files and subdirectories in them, so
+	// the latter are removed first.
+	var dirs []string
+	if err := filepath.Walk(ss.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(ss.dir, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, path)
+			return os.MkdirAll(filepath.Join(to, rel), 0755)
+		}
+		return ss.moveFile(ctx, path, filepath.Join(to, rel))
+	}); err != nil {
+		ss.invalidateFileIndex()
+		return "", errors.Wrap(err, "while quarantining sideloaded directory")
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := ss.eng.DeleteDirAndFiles(dirs[i]); err != nil {
+			ss.invalidateFileIndex()
+			return "", errors.Wrap(err, "while quarantining sideloaded directory")
+		}
+	}
+	ss.dirCreated = false
+	ss.files = sideloadFileIndex{loaded: true}
+	return to, nil
+}
+
+// moveFile moves the file from one path to the other through the engine, by
+// hard-linking it and removing the original. If the engine can't link the
+// file, it is copied instead.
+func (ss *diskSideloadStorage) moveFile(ctx context.Context, from, to string) error {
+	if err := ss.eng.LinkFile(from, to); err != nil {
+		b, err := ss.eng.ReadFile(from)
+		if err != nil {
+			return err
+		}
+		if err := writeFileSyncing(ctx, to, b, ss.eng, 0644, ss.st); err != nil {
+			return err
+		}
+	}
+	return ss.eng.DeleteFile(from)
+}
+
+// ForEach implements SideloadStorage. The sizes are those recorded in the
+// index of the files, which stats each file when it is loaded.
+func (ss *diskSideloadStorage) ForEach(
+	ctx context.Context, visit func(index, term uint64, size int64) error,
+) error {
+	files, err := ss.fileIndex(ctx)
+	if err != nil {
+		return err
+	}
+	for _, e := range files.entries {
+		if err := visit(e.index, e.term, e.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsEmpty implements SideloadStorage. If the index of the files hasn't been
+// loaded, the directory is read only until the first payload is found, which
+// is cheaper than loading the index.
+func (ss *diskSideloadStorage) IsEmpty(_ context.Context) (bool, error) {
+	if ss.files.loaded {
+		return len(ss.files.entries) == 0, nil
+	}
+	return ss.isEmptyDir(ss.dir)
+}
+
+// isEmptyDir returns whether the given directory holds no payload files,
+// descending into the subdirectories created by the namer.
+func (ss *diskSideloadStorage) isEmptyDir(path string) (bool, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	defer dir.Close()
+	for {
+		names, err := dir.Readdirnames(128)
+		for _, name := range names {
+			if strings.HasSuffix(name, sideloadPendingDeleteSuffix) {
+				continue
+			}
+			if _, _, err := parseSideloadFilename(name); err == nil {
+				return false, nil
+			}
+			if path == ss.dir && ss.namer.isShard(name) {
+				if empty, err := ss.isEmptyDir(filepath.Join(path, name)); err != nil || !empty {
+					return empty, err
+				}
+			}
+		}
+		if err == io.EOF {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+}
+
+// State implements SideloadStorage. The directory is only stat'ed if it isn't
+// known to have been created by this storage, which it may have been in a
+// previous incarnation of the replica.
+func (ss *diskSideloadStorage) State() storagebase.SideloadDirState {
+	if !ss.dirCreated {
+		if ex, err := exists(ss.dir); err == nil && !ex {
+			return storagebase.SideloadDirNotCreated
+		}
+	}
+	if empty, err := ss.IsEmpty(context.Background()); err == nil && empty {
+		return storagebase.SideloadDirEmpty
+	}
+	return storagebase.SideloadDirNonEmpty
+}
+
+// BytesUsed implements SideloadStorage. It sums up the sizes of all files in
+// the directory, including those which aren't payloads, such as checksum
+// files and files pending deletion, since they take up disk space all the
+// same. A directory which doesn't exist uses no bytes.
+func (ss *diskSideloadStorage) BytesUsed(_ context.Context) (int64, error) {
+	var total int64
+	if err := filepath.Walk(ss.dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// sortedKeys returns the keys of all stored payloads in the order in which
+// ForEach visits them.
+func (ss *diskSideloadStorage) sortedKeys(ctx context.Context) ([]slKey, error) {
+	files, err := ss.fileIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return files.keys(), nil
+}
+
 func (ss *diskSideloadStorage) forEach(
 	ctx context.Context, visit func(index uint64, filename string) error,
 ) error {
-	matches, err := filepath.Glob(filepath.Join(ss.dir, "i*.t*"))
+	matches, err := ss.globAll(ctx, "i*.t*")
 	if err != nil {
 		return err
 	}
 	for _, match := range matches {
 		base := filepath.Base(match)
-		if len(base) < 1 || base[0] != 'i' {
+		if len(base) < 1 || base[0] != 'i' || strings.HasSuffix(base, sideloadPendingDeleteSuffix) {
 			continue
 		}
 		base = base[1:]
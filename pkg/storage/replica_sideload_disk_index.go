@@ -0,0 +1,201 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// sideloadFileIndexEntry describes a file in a diskSideloadStorage.
+type sideloadFileIndexEntry struct {
+	slKey
+	size int64
+}
+
+// sideloadFileIndex is an in-memory index of the files held by a
+// diskSideloadStorage. It allows answering questions about the stored files,
+// such as which ones a truncation removes and how many bytes remain, without
+// listing the directory.
+//
+// The filesystem is the source of truth: the index is loaded from it on first
+// use (and thus after a restart), and then maintained incrementally by the
+// mutations of the storage. Whenever the outcome of a mutation is uncertain,
+// the index is discarded and loaded anew on next use.
+type sideloadFileIndex struct {
+	loaded bool
+	// entries is sorted by index and then term.
+	entries []sideloadFileIndexEntry
+	// bytes is the total size of the files in entries.
+	bytes int64
+}
+
+// search returns the position of the given key in entries, and whether an
+// entry for it exists at that position.
+func (idx *sideloadFileIndex) search(k slKey) (int, bool) {
+	i := sort.Search(len(idx.entries), func(i int) bool {
+		e := idx.entries[i]
+		return e.index > k.index || (e.index == k.index && e.term >= k.term)
+	})
+	return i, i < len(idx.entries) && idx.entries[i].slKey == k
+}
+
+// put adds a file of the given size to the index, replacing any previous
+// entry for the same key.
+func (idx *sideloadFileIndex) put(k slKey, size int64) {
+	i, ok := idx.search(k)
+	if ok {
+		idx.bytes += size - idx.entries[i].size
+		idx.entries[i].size = size
+		return
+	}
+	idx.entries = append(idx.entries, sideloadFileIndexEntry{})
+	copy(idx.entries[i+1:], idx.entries[i:])
+	idx.entries[i] = sideloadFileIndexEntry{slKey: k, size: size}
+	idx.bytes += size
+}
+
+// remove removes the file with the given key from the index, if present.
+func (idx *sideloadFileIndex) remove(k slKey) {
+	i, ok := idx.search(k)
+	if !ok {
+		return
+	}
+	idx.bytes -= idx.entries[i].size
+	idx.entries = append(idx.entries[:i], idx.entries[i+1:]...)
+}
+
+// reset replaces the contents of the index with the given entries, which
+// need not be sorted.
+func (idx *sideloadFileIndex) reset(entries []sideloadFileIndexEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].index != entries[j].index {
+			return entries[i].index < entries[j].index
+		}
+		return entries[i].term < entries[j].term
+	})
+	*idx = sideloadFileIndex{loaded: true, entries: entries}
+	for _, e := range entries {
+		idx.bytes += e.size
+	}
+}
+
+// keys returns the keys of the indexed files, in increasing order of index and
+// then term.
+func (idx *sideloadFileIndex) keys() []slKey {
+	keys := make([]slKey, 0, len(idx.entries))
+	for _, e := range idx.entries {
+		keys = append(keys, e.slKey)
+	}
+	return keys
+}
+
+// fileIndex returns the index of the files in the storage, loading it from the
+// directory if necessary.
+func (ss *diskSideloadStorage) fileIndex(ctx context.Context) (*sideloadFileIndex, error) {
+	if !ss.files.loaded {
+		entries, err := ss.listFiles(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ss.files.reset(entries)
+	}
+	return &ss.files, nil
+}
+
+// updateResidentBytes reports the size of the files in the index to the
+// metrics, if the index is loaded. Otherwise, the size last reported stands
+// until the index is loaded again.
+func (ss *diskSideloadStorage) updateResidentBytes() {
+	if ss.files.loaded {
+		ss.metrics.updateResident(&ss.residentBytes, ss.files.bytes)
+	}
+}
+
+// invalidateFileIndex discards the index of the files in the storage, which
+// is loaded from the directory again on next use.
+func (ss *diskSideloadStorage) invalidateFileIndex() {
+	ss.files = sideloadFileIndex{}
+}
+
+// listFiles lists the files in the directory of the storage. A payload found
+// both in the flat layout and in a subdirectory (see sideloadFileNamer), which
+// happens if a crash prevented Put from removing the former, is listed once,
+// as Get reads the latter.
+func (ss *diskSideloadStorage) listFiles(ctx context.Context) ([]sideloadFileIndexEntry, error) {
+	var entries []sideloadFileIndexEntry
+	positions := make(map[slKey]int)
+	if err := ss.forEach(ctx, func(_ uint64, filename string) error {
+		index, term, err := parseSideloadFilename(filepath.Base(filename))
+		if err != nil {
+			return err
+		}
+		size, err := ss.fileSize(filename)
+		if err != nil {
+			return err
+		}
+		k := slKey{index: index, term: term}
+		// forEach visits the flat layout first.
+		if i, ok := positions[k]; ok {
+			entries[i].size = size
+			return nil
+		}
+		positions[k] = len(entries)
+		entries = append(entries, sideloadFileIndexEntry{slKey: k, size: size})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// reconcileFileIndex compares the index of the files in the storage against
+// the files actually present in its directory, and replaces the index with the
+// latter. It returns a description of the differences, which is empty if the
+// two agreed or the index hadn't been loaded yet.
+func (ss *diskSideloadStorage) reconcileFileIndex(ctx context.Context) (string, error) {
+	entries, err := ss.listFiles(ctx)
+	if err != nil {
+		return "", err
+	}
+	var fresh sideloadFileIndex
+	fresh.reset(entries)
+
+	var diffs []string
+	if ss.files.loaded {
+		sizes := make(map[slKey]int64, len(ss.files.entries))
+		for _, e := range ss.files.entries {
+			sizes[e.slKey] = e.size
+		}
+		for _, e := range fresh.entries {
+			size, ok := sizes[e.slKey]
+			delete(sizes, e.slKey)
+			if !ok {
+				diffs = append(diffs, fmt.Sprintf("unindexed file %s", sideloadFilename(e.index, e.term)))
+			} else if size != e.size {
+				diffs = append(diffs, fmt.Sprintf("file %s has size %d, indexed as %d",
+					sideloadFilename(e.index, e.term), e.size, size))
+			}
+		}
+		for _, e := range ss.files.entries {
+			if _, ok := sizes[e.slKey]; ok {
+				diffs = append(diffs, fmt.Sprintf("missing file %s", sideloadFilename(e.index, e.term)))
+			}
+		}
+	}
+	ss.files = fresh
+	return strings.Join(diffs, "; "), nil
+}
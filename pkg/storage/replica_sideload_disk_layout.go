@@ -0,0 +1,182 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sideloadFileNamer determines where in its directory a diskSideloadStorage
+// places the files of a payload, that is the payload file itself (see
+// sideloadFilename) and its checksum file. It doesn't affect the names of
+// these files, only the subdirectory they're placed in.
+//
+// Files written in the flat layout, that is in the directory of the storage
+// itself, are always read, regardless of the namer. This allows a storage to
+// switch from the flat layout to a sharded one without rewriting its files.
+type sideloadFileNamer interface {
+	// shard returns the name of the subdirectory holding the files of the
+	// payload at the given index, or "" if they're held by the directory of
+	// the storage itself.
+	shard(index uint64) string
+	// isShard returns whether the given entry of the storage's directory is
+	// a subdirectory returned by shard.
+	isShard(name string) bool
+}
+
+// flatSideloadFileNamer places all files in the directory of the storage.
+type flatSideloadFileNamer struct{}
+
+var _ sideloadFileNamer = flatSideloadFileNamer{}
+
+func (flatSideloadFileNamer) shard(uint64) string {
+	return ""
+}
+
+func (flatSideloadFileNamer) isShard(string) bool {
+	return false
+}
+
+// sideloadShardSize is the number of consecutive indexes whose files
+// shardedSideloadFileNamer places in the same subdirectory.
+const sideloadShardSize = 1000
+
+// shardedSideloadFileNamer places the files of each sideloadShardSize
+// consecutive indexes in a subdirectory of their own, which keeps ranges with
+// very long logs from accumulating huge numbers of files in one directory.
+//
+// For example, the payload at index 12345 and term 6 ends up in
+// dir/i12XXX/i12345.t6. The names of the subdirectories can't be mistaken for
+// those of payload or checksum files, nor for files pending deletion.
+type shardedSideloadFileNamer struct{}
+
+var _ sideloadFileNamer = shardedSideloadFileNamer{}
+
+func (shardedSideloadFileNamer) shard(index uint64) string {
+	return fmt.Sprintf("i%dXXX", index/sideloadShardSize)
+}
+
+func (shardedSideloadFileNamer) isShard(name string) bool {
+	if !strings.HasPrefix(name, "i") || !strings.HasSuffix(name, "XXX") {
+		return false
+	}
+	_, err := strconv.ParseUint(name[1:len(name)-len("XXX")], 10, 64)
+	return err == nil
+}
+
+// shardDir returns the directory into which the files of the payload at the
+// given index are written.
+func (ss *diskSideloadStorage) shardDir(index uint64) string {
+	return filepath.Join(ss.dir, ss.namer.shard(index))
+}
+
+// payloadDir returns the directory holding the files of the payload at the
+// given index and term. This is the directory returned by shardDir, unless the
+// payload was written in the flat layout. If the payload doesn't exist, it is
+// the directory returned by shardDir as well.
+func (ss *diskSideloadStorage) payloadDir(index, term uint64) string {
+	dir := ss.shardDir(index)
+	if dir == ss.dir {
+		return dir
+	}
+	if ex, err := exists(filepath.Join(dir, sideloadFilename(index, term))); err != nil || ex {
+		return dir
+	}
+	if ex, err := exists(filepath.Join(ss.dir, sideloadFilename(index, term))); err == nil && ex {
+		return ss.dir
+	}
+	return dir
+}
+
+// createShardDir creates the directory into which the files of the payload at
+// the given index are written, along with the directory of the storage.
+func (ss *diskSideloadStorage) createShardDir(index uint64) error {
+	if err := ss.createDir(); err != nil {
+		return err
+	}
+	return os.MkdirAll(ss.shardDir(index), 0755)
+}
+
+// removeFlatCopy removes the files of the payload at the given index and term
+// from the directory of the storage, if the namer places them elsewhere. This
+// is called after writing the payload, so that a copy written in the flat
+// layout doesn't shadow it.
+func (ss *diskSideloadStorage) removeFlatCopy(index, term uint64) error {
+	if ss.shardDir(index) == ss.dir {
+		return nil
+	}
+	filename := filepath.Join(ss.dir, sideloadFilename(index, term))
+	if err := ss.eng.DeleteFile(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ss.removeChecksum(ss.checksumFilename(ss.dir, index, term))
+}
+
+// shardDirs returns the subdirectories of the storage's directory created by
+// its namer, in sorted order.
+func (ss *diskSideloadStorage) shardDirs(ctx context.Context) ([]string, error) {
+	matches, err := globSideloadDir(ctx, ss.dir, "*")
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, match := range matches {
+		if !ss.namer.isShard(filepath.Base(match)) {
+			continue
+		}
+		if info, err := os.Stat(match); err != nil || !info.IsDir() {
+			continue
+		}
+		dirs = append(dirs, match)
+	}
+	return dirs, nil
+}
+
+// globAll is like globSideloadDir for the directory of the storage, but also
+// returns the matches in the subdirectories created by its namer. The matches
+// in the directory itself come first.
+func (ss *diskSideloadStorage) globAll(ctx context.Context, pattern string) ([]string, error) {
+	matches, err := globSideloadDir(ctx, ss.dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := ss.shardDirs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		shardMatches, err := globSideloadDir(ctx, dir, pattern)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, shardMatches...)
+	}
+	return matches, nil
+}
+
+// removeEmptyShardDirs removes those of the given subdirectories of the
+// storage's directory that are empty.
+func (ss *diskSideloadStorage) removeEmptyShardDirs(dirs []string) {
+	for _, dir := range dirs {
+		if dir == ss.dir {
+			continue
+		}
+		// This fails if the directory still holds files, which is fine.
+		_ = os.Remove(dir)
+	}
+}
@@ -13,6 +13,7 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"path/filepath"
@@ -20,6 +21,8 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/storagebase"
+	"golang.org/x/time/rate"
 )
 
 type slKey struct {
@@ -27,14 +30,21 @@ type slKey struct {
 }
 
 type inMemSideloadStorage struct {
-	m      map[slKey][]byte
-	prefix string
+	m         map[slKey][]byte
+	prefix    string
+	rangeID   roachpb.RangeID
+	replicaID roachpb.ReplicaID
+	// limiter, if set, throttles Put and Get like the limiter of the disk
+	// storage throttles its writes.
+	limiter *rate.Limiter
 }
 
 func mustNewInMemSideloadStorage(
-	rangeID roachpb.RangeID, replicaID roachpb.ReplicaID, baseDir string,
+	rangeID roachpb.RangeID, replicaID roachpb.ReplicaID, baseDir string, limiter *rate.Limiter,
 ) SideloadStorage {
-	ss, err := newInMemSideloadStorage(cluster.MakeTestingClusterSettings(), rangeID, replicaID, baseDir, nil)
+	ss, err := newInMemSideloadStorage(
+		cluster.MakeTestingClusterSettings(), rangeID, replicaID, baseDir, limiter, nil,
+	)
 	if err != nil {
 		panic(err)
 	}
@@ -46,14 +56,35 @@ func newInMemSideloadStorage(
 	rangeID roachpb.RangeID,
 	replicaID roachpb.ReplicaID,
 	baseDir string,
+	limiter *rate.Limiter,
 	eng engine.Engine,
 ) (SideloadStorage, error) {
 	return &inMemSideloadStorage{
-		prefix: filepath.Join(baseDir, fmt.Sprintf("%d.%d", rangeID, replicaID)),
-		m:      make(map[slKey][]byte),
+		prefix:    filepath.Join(baseDir, fmt.Sprintf("%d.%d", rangeID, replicaID)),
+		m:         make(map[slKey][]byte),
+		rangeID:   rangeID,
+		replicaID: replicaID,
+		limiter:   limiter,
 	}, nil
 }
 
+// wait waits for the limiter, if any, to admit the given number of bytes. The
+// bytes are admitted in chunks no larger than the burst of the limiter, as the
+// disk storage does when writing files.
+func (ss *inMemSideloadStorage) wait(ctx context.Context, size int) {
+	if ss.limiter == nil || ss.limiter.Limit() == rate.Inf || ss.limiter.Burst() <= 0 {
+		return
+	}
+	for size > 0 {
+		n := size
+		if burst := ss.limiter.Burst(); n > burst {
+			n = burst
+		}
+		limitBulkIOWrite(ctx, ss.limiter, n)
+		size -= n
+	}
+}
+
 func (ss *inMemSideloadStorage) key(index, term uint64) slKey {
 	return slKey{index: index, term: term}
 }
@@ -64,23 +95,95 @@ func (ss *inMemSideloadStorage) Dir() string {
 	panic("unsupported")
 }
 
-func (ss *inMemSideloadStorage) Put(_ context.Context, index, term uint64, contents []byte) error {
+func (ss *inMemSideloadStorage) Identity() (roachpb.RangeID, roachpb.ReplicaID) {
+	return ss.rangeID, ss.replicaID
+}
+
+func (ss *inMemSideloadStorage) Put(ctx context.Context, index, term uint64, contents []byte) error {
+	ss.wait(ctx, len(contents))
 	key := ss.key(index, term)
 	ss.m[key] = contents
 	return nil
 }
 
-func (ss *inMemSideloadStorage) Get(_ context.Context, index, term uint64) ([]byte, error) {
+func (ss *inMemSideloadStorage) PutMany(
+	ctx context.Context, entries []storagebase.SideloadEntry,
+) error {
+	for _, e := range entries {
+		if err := ss.Put(ctx, e.Index, e.Term, e.Contents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ss *inMemSideloadStorage) PutIfAbsent(
+	_ context.Context, index, term uint64, contents []byte,
+) (bool, error) {
+	key := ss.key(index, term)
+	if existing, ok := ss.m[key]; ok {
+		if !bytes.Equal(existing, contents) {
+			return false, errSideloadExists
+		}
+		return false, nil
+	}
+	ss.m[key] = contents
+	return true, nil
+}
+
+func (ss *inMemSideloadStorage) PutMonotonic(
+	ctx context.Context, index, term uint64, contents []byte,
+) error {
+	for k := range ss.m {
+		if k.index == index && k.term > term {
+			return &sideloadTermRegressionError{index: index, term: term, existingTerm: k.term}
+		}
+	}
+	return ss.Put(ctx, index, term, contents)
+}
+
+func (ss *inMemSideloadStorage) Get(ctx context.Context, index, term uint64) ([]byte, error) {
 	key := ss.key(index, term)
 	data, ok := ss.m[key]
 	if !ok {
 		return nil, errSideloadedFileNotFound
 	}
+	ss.wait(ctx, len(data))
 	return data, nil
 }
 
+func (ss *inMemSideloadStorage) HasEntry(_ context.Context, index, term uint64) (bool, error) {
+	_, ok := ss.m[ss.key(index, term)]
+	return ok, nil
+}
+
+// Stat implements SideloadStorage. Modification times aren't tracked.
+func (ss *inMemSideloadStorage) Stat(
+	_ context.Context, index, term uint64,
+) (storagebase.SideloadFileInfo, error) {
+	data, ok := ss.m[ss.key(index, term)]
+	if !ok {
+		return storagebase.SideloadFileInfo{}, errSideloadedFileNotFound
+	}
+	return storagebase.SideloadFileInfo{Size: int64(len(data))}, nil
+}
+
+func (ss *inMemSideloadStorage) GetRange(
+	ctx context.Context, index, term uint64, start, end roachpb.Key,
+) ([]byte, error) {
+	data, err := ss.Get(ctx, index, term)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := engine.NewMemSSTIterator(data, false /* verify */)
+	if err != nil {
+		return nil, err
+	}
+	return sideloadedSSTableRange(iter, start, end)
+}
+
 func (ss *inMemSideloadStorage) Filename(_ context.Context, index, term uint64) (string, error) {
-	return filepath.Join(ss.prefix, fmt.Sprintf("i%d.t%d", index, term)), nil
+	return filepath.Join(ss.prefix, sideloadFilename(index, term)), nil
 }
 
 func (ss *inMemSideloadStorage) Purge(_ context.Context, index, term uint64) (int64, error) {
@@ -112,3 +215,47 @@ func (ss *inMemSideloadStorage) TruncateTo(
 	}
 	return freed, retained, nil
 }
+
+func (ss *inMemSideloadStorage) ForEach(
+	_ context.Context, visit func(index, term uint64, size int64) error,
+) error {
+	for _, k := range ss.sortedKeys() {
+		if err := visit(k.index, k.term, int64(len(ss.m[k]))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ss *inMemSideloadStorage) IsEmpty(_ context.Context) (bool, error) {
+	return len(ss.m) == 0, nil
+}
+
+// State implements SideloadStorage. The in-memory storage has no location
+// to create, so it is never reported as not created.
+func (ss *inMemSideloadStorage) State() storagebase.SideloadDirState {
+	if len(ss.m) == 0 {
+		return storagebase.SideloadDirEmpty
+	}
+	return storagebase.SideloadDirNonEmpty
+}
+
+func (ss *inMemSideloadStorage) BytesUsed(_ context.Context) (int64, error) {
+	var total int64
+	for _, v := range ss.m {
+		total += int64(len(v))
+	}
+	return total, nil
+}
+
+// sortedKeys returns the keys of all stored payloads in the order in which
+// ForEach visits them. Map iteration order is random, so they are sorted
+// explicitly.
+func (ss *inMemSideloadStorage) sortedKeys() []slKey {
+	keys := make([]slKey, 0, len(ss.m))
+	for k := range ss.m {
+		keys = append(keys, k)
+	}
+	sortSideloadKeys(keys)
+	return keys
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/storagepb"
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/raft/raftpb"
+)
+
+// ReplaySideloadedIntoEngine ingests the SSTables of the AddSSTable commands
+// in the given committed Raft log entries of a replica into the given engine,
+// in increasing order of index. This reconstructs the data written by these
+// commands, for recovering from the loss of an engine whose Raft log and
+// sideloaded storage survived.
+//
+// The payloads of sideloaded entries are read from the given sideloaded
+// storage, while entries which carry their payload inline are used as is.
+// Entries which don't hold an AddSSTable command are skipped. Only the
+// SSTables are replayed: the effects of any other commands, as well as those
+// of the AddSSTable commands on the replica's state (such as its MVCC stats),
+// are not.
+func ReplaySideloadedIntoEngine(
+	ctx context.Context, ss SideloadStorage, entries []raftpb.Entry, eng engine.Engine,
+) error {
+	sorted := append([]raftpb.Entry(nil), entries...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Index < sorted[j].Index })
+
+	for _, ent := range sorted {
+		if ent.Type != raftpb.EntryNormal || len(ent.Data) == 0 {
+			continue
+		}
+		_, data := DecodeRaftCommand(ent.Data)
+		var command storagepb.RaftCommand
+		if err := protoutil.Unmarshal(data, &command); err != nil {
+			return errors.Wrapf(err, "decoding command at index %d term %d", ent.Index, ent.Term)
+		}
+		sst := command.ReplicatedEvalResult.AddSSTable
+		if sst == nil {
+			continue
+		}
+		payload := sst.Data
+		if len(payload) == 0 && sniffSideloadedRaftCommand(ent.Data) {
+			var err error
+			if payload, err = ss.Get(ctx, ent.Index, ent.Term); err != nil {
+				return errors.Wrapf(err, "loading sideloaded data at index %d term %d", ent.Index, ent.Term)
+			}
+		}
+		if sst.CRC32 != 0 {
+			if checksum := util.CRC32(payload); checksum != sst.CRC32 {
+				return &sideloadChecksumMismatchError{
+					index: ent.Index, term: ent.Term, commandCRC: true, expected: sst.CRC32, actual: checksum,
+				}
+			}
+		}
+		if err := ingestReplayedSSTable(ctx, eng, ent.Index, ent.Term, payload); err != nil {
+			return errors.Wrapf(err, "ingesting SSTable at index %d term %d", ent.Index, ent.Term)
+		}
+	}
+	return nil
+}
+
+// ingestReplayedSSTable writes a copy of the given SSTable into the auxiliary
+// directory of the engine and ingests it, allowing the engine to modify or
+// move the copy.
+func ingestReplayedSSTable(
+	ctx context.Context, eng engine.Engine, index, term uint64, data []byte,
+) error {
+	const skipSeqNo, modify = false, true
+
+	path := filepath.Join(
+		eng.GetAuxiliaryDir(), "sideload-replay", fmt.Sprintf("i%d.t%d.sst", index, term),
+	)
+	if inmem, ok := eng.(engine.InMem); ok {
+		if err := inmem.WriteFile(path, data); err != nil {
+			return err
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		f, err := writeFileUnsynced(ctx, path, data, eng)
+		if err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	if err := eng.IngestExternalFiles(ctx, []string{path}, skipSeqNo, modify); err != nil {
+		return err
+	}
+	log.Eventf(ctx, "replayed SSTable at index %d, term %d", index, term)
+	return nil
+}
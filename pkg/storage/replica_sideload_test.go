@@ -16,6 +16,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"math/rand"
 	"os"
@@ -25,23 +26,32 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
 	"github.com/cockroachdb/cockroach/pkg/storage/raftentry"
+	"github.com/cockroachdb/cockroach/pkg/storage/sideloadtest"
 	"github.com/cockroachdb/cockroach/pkg/storage/stateloader"
 	"github.com/cockroachdb/cockroach/pkg/storage/storagebase"
 	"github.com/cockroachdb/cockroach/pkg/storage/storagepb"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 	"github.com/kr/pretty"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
@@ -84,19 +94,117 @@ func mkEnt(
 	return ent
 }
 
+// newTestDiskSideloadStorage returns an unthrottled disk sideloaded storage
+// without a cache for replica 2 of range 1, which keeps its files in dir.
+func newTestDiskSideloadStorage(
+	t *testing.T, st *cluster.Settings, eng engine.Engine, dir string,
+) *diskSideloadStorage {
+	t.Helper()
+	ss, err := newDiskSideloadStorage(
+		st, 1, 2, dir, rate.NewLimiter(rate.Inf, math.MaxInt64), rate.NewLimiter(rate.Inf, math.MaxInt64), nil, eng,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ss
+}
+
 func TestSideloadingSideloadedStorage(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	t.Run("Mem", func(t *testing.T) {
-		testSideloadingSideloadedStorage(t, newInMemSideloadStorage)
+		maker := func(
+			s *cluster.Settings, rangeID roachpb.RangeID, rep roachpb.ReplicaID, name string, eng engine.Engine,
+		) (SideloadStorage, error) {
+			return newInMemSideloadStorage(s, rangeID, rep, name, nil, eng)
+		}
+		testSideloadingSideloadedStorage(t, maker)
 	})
 	t.Run("Disk", func(t *testing.T) {
 		maker := func(
 			s *cluster.Settings, rangeID roachpb.RangeID, rep roachpb.ReplicaID, name string, eng engine.Engine,
 		) (SideloadStorage, error) {
-			return newDiskSideloadStorage(s, rangeID, rep, name, rate.NewLimiter(rate.Inf, math.MaxInt64), eng)
+			return newDiskSideloadStorage(
+				s, rangeID, rep, name, rate.NewLimiter(rate.Inf, math.MaxInt64), rate.NewLimiter(rate.Inf, math.MaxInt64), nil, eng,
+			)
+		}
+		testSideloadingSideloadedStorage(t, maker)
+	})
+	t.Run("DiskCached", func(t *testing.T) {
+		maker := func(
+			s *cluster.Settings, rangeID roachpb.RangeID, rep roachpb.ReplicaID, name string, eng engine.Engine,
+		) (SideloadStorage, error) {
+			sideloadCacheSize.Override(&s.SV, 1<<20)
+			cache := newSideloadCache(s, metric.NewCounter(metric.Metadata{}), metric.NewCounter(metric.Metadata{}))
+			return newDiskSideloadStorage(
+				s, rangeID, rep, name, rate.NewLimiter(rate.Inf, math.MaxInt64), rate.NewLimiter(rate.Inf, math.MaxInt64), cache, eng,
+			)
 		}
 		testSideloadingSideloadedStorage(t, maker)
 	})
+	t.Run("MemThrottled", func(t *testing.T) {
+		testSideloadingThrottled(t, func(
+			st *cluster.Settings, dir string, limiter *rate.Limiter,
+		) (SideloadStorage, error) {
+			return newInMemSideloadStorage(st, 1, 2, dir, limiter, nil)
+		})
+	})
+	t.Run("DiskThrottled", func(t *testing.T) {
+		cleanup, cache, eng := newRocksDB(t)
+		defer cleanup()
+		defer cache.Release()
+		defer eng.Close()
+		testSideloadingThrottled(t, func(
+			st *cluster.Settings, dir string, limiter *rate.Limiter,
+		) (SideloadStorage, error) {
+			return newDiskSideloadStorage(
+				st, 1, 2, dir, limiter, rate.NewLimiter(rate.Inf, math.MaxInt64), nil, eng,
+			)
+		})
+	})
+}
+
+// testSideloadingThrottled verifies that the writes of the sideloaded storage
+// created by maker are throttled by the supplied limiter.
+func testSideloadingThrottled(
+	t *testing.T,
+	maker func(*cluster.Settings, string, *rate.Limiter) (SideloadStorage, error),
+) {
+	ctx := context.Background()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	const (
+		chunkSize   = 16 << 10 // 16KiB
+		rateLimit   = 1 << 20  // 1MiB/s
+		payloadSize = 256 << 10
+	)
+	st := cluster.MakeTestingClusterSettings()
+	// The disk storage writes (and thus rate limits) the payloads in chunks no
+	// larger than the burst of the limiter.
+	sstWriteSyncRate.Override(&st.SV, chunkSize)
+	ss, err := maker(st, dir, rate.NewLimiter(rateLimit, chunkSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := bytes.Repeat([]byte("x"), payloadSize)
+	start := timeutil.Now()
+	if err := ss.Put(ctx, 1, 1, payload); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := timeutil.Since(start)
+	// Apart from the initial burst, all bytes have to be admitted by the
+	// limiter.
+	minDuration := time.Duration(float64(payloadSize-chunkSize) / rateLimit * float64(time.Second))
+	if elapsed < minDuration {
+		t.Fatalf("expected writing %d bytes to take at least %s, but took %s",
+			payloadSize, minDuration, elapsed)
+	}
+	if data, err := ss.Get(ctx, 1, 1); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data, payload) {
+		t.Fatal("unexpected payload")
+	}
 }
 
 func testSideloadingSideloadedStorage(
@@ -151,6 +259,9 @@ func testSideloadingSideloadedStorage(
 	} else if exp := file(1); !bytes.Equal(c, exp) {
 		t.Fatalf("got %q, wanted %q", c, exp)
 	}
+	if ok, err := ss.HasEntry(ctx, 1, highTerm); err != nil || !ok {
+		t.Fatalf("expected entry to exist, got (%t, %v)", ok, err)
+	}
 
 	// Overwrites the occupied slot.
 	if err := ss.Put(ctx, 1, highTerm, file(12345)); err != nil {
@@ -202,6 +313,15 @@ func testSideloadingSideloadedStorage(
 				return err
 			},
 		},
+		{
+			err: nil,
+			fun: func() error {
+				if ok, err := ss.HasEntry(ctx, 123, 456); err != nil || ok {
+					return fmt.Errorf("expected no entry, got (%t, %v)", ok, err)
+				}
+				return nil
+			},
+		},
 	} {
 		if err := test.fun(); err != test.err {
 			t.Fatalf("%d: expected %v, got %v", n, test.err, err)
@@ -266,12 +386,18 @@ func testSideloadingSideloadedStorage(
 				if _, err := ss.Get(ctx, i, term); err != nil {
 					t.Fatalf("%d.%d: %s", n, i, err)
 				}
+				if ok, err := ss.HasEntry(ctx, i, term); err != nil || !ok {
+					t.Fatalf("%d.%d: expected entry to exist, got (%t, %v)", n, i, ok, err)
+				}
 			}
 			// Indexes below are gone.
 			for _, i := range payloads[:n] {
 				if _, err := ss.Get(ctx, i, term); err != errSideloadedFileNotFound {
 					t.Fatalf("%d.%d: %v", n, i, err)
 				}
+				if ok, err := ss.HasEntry(ctx, i, term); err != nil || ok {
+					t.Fatalf("%d.%d: expected no entry, got (%t, %v)", n, i, ok, err)
+				}
 			}
 		}
 	}
@@ -388,707 +514,5247 @@ func testSideloadingSideloadedStorage(
 	}
 }
 
-func TestSideloadedStorageReplicaIDMigration(t *testing.T) {
+// testSideloadStorageImpls runs the given function against a fresh instance of
+// each SideloadStorage implementation.
+func testSideloadStorageImpls(t *testing.T, f func(t *testing.T, ss SideloadStorage)) {
+	for _, name := range []string{"Mem", "Disk", "Cloud"} {
+		t.Run(name, func(t *testing.T) {
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			cleanup, cache, eng := newRocksDB(t)
+			defer cleanup()
+			defer cache.Release()
+			defer eng.Close()
+
+			st := cluster.MakeTestingClusterSettings()
+			var ss SideloadStorage
+			var err error
+			switch name {
+			case "Mem":
+				ss, err = newInMemSideloadStorage(st, 1, 2, dir, nil, eng)
+			case "Disk":
+				ss = newTestDiskSideloadStorage(t, st, eng, dir)
+			case "Cloud":
+				ss = newCloudSideloadStorage(st, 1, 1, 2, dir, newMemSideloadBlobStore())
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			f(t, ss)
+		})
+	}
+}
+
+// memSideloadBlobStore is an in-memory SideloadBlobStore.
+type memSideloadBlobStore struct {
+	syncutil.Mutex
+	objects map[string][]byte
+}
+
+func newMemSideloadBlobStore() *memSideloadBlobStore {
+	return &memSideloadBlobStore{objects: map[string][]byte{}}
+}
+
+func (s *memSideloadBlobStore) ReadFile(_ context.Context, name string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	b, ok := s.objects[name]
+	if !ok {
+		return nil, &os.PathError{Op: "read", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), b...), nil
+}
+
+func (s *memSideloadBlobStore) WriteFile(_ context.Context, name string, content []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.objects[name] = append([]byte(nil), content...)
+	return nil
+}
+
+func (s *memSideloadBlobStore) Delete(_ context.Context, name string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *memSideloadBlobStore) names() []string {
+	s.Lock()
+	defer s.Unlock()
+	var names []string
+	for name := range s.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestSideloadingSharedWriteLimiter verifies that the aggregate write rate of
+// several disk sideloaded storages is bounded by the limiter they share.
+func TestSideloadingSharedWriteLimiter(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
+	ctx := context.Background()
 	dir, cleanup := testutils.TempDir(t)
 	defer cleanup()
+	cleanup, cache, eng := newRocksDB(t)
+	defer cleanup()
+	defer cache.Release()
+	defer eng.Close()
 
-	ctx := context.Background()
-	preV := cluster.VersionByKey(cluster.VersionSideloadedStorageNoReplicaID - 1)
-	stPre := cluster.MakeTestingClusterSettingsWithVersion(preV, preV)
+	const (
+		chunkSize   = 16 << 10 // 16KiB
+		rateLimit   = 1 << 20  // 1MiB/s
+		numStorages = 3
+		payloadSize = 256 << 10 // 256KiB
+	)
+	st := cluster.MakeTestingClusterSettings()
+	// Write (and thus rate limit) the payloads in chunks no larger than the
+	// burst of the shared limiter.
+	sstWriteSyncRate.Override(&st.SV, chunkSize)
+	shared := rate.NewLimiter(rateLimit, chunkSize)
 
-	postV := cluster.VersionByKey(cluster.VersionSideloadedStorageNoReplicaID)
-	stPost := cluster.MakeTestingClusterSettingsWithVersion(postV, postV)
+	var storages []*diskSideloadStorage
+	for i := 0; i < numStorages; i++ {
+		ss, err := newDiskSideloadStorage(
+			st, roachpb.RangeID(i+1), 1, dir, rate.NewLimiter(rate.Inf, math.MaxInt64), shared, nil, eng,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		storages = append(storages, ss)
+	}
 
-	const rangeID = roachpb.RangeID(1)
+	payload := bytes.Repeat([]byte("x"), payloadSize)
+	start := timeutil.Now()
+	var wg sync.WaitGroup
+	errCh := make(chan error, numStorages)
+	for _, ss := range storages {
+		wg.Add(1)
+		go func(ss *diskSideloadStorage) {
+			defer wg.Done()
+			errCh <- ss.Put(ctx, 1, 1, payload)
+		}(ss)
+	}
+	wg.Wait()
+	elapsed := timeutil.Since(start)
+	close(errCh)
+	for err := range errCh {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Apart from the initial burst, all bytes have to be admitted by the shared
+	// limiter, no matter how they are distributed across the storages.
+	minDuration := time.Duration(float64(numStorages*payloadSize-chunkSize) / rateLimit * float64(time.Second))
+	if elapsed < minDuration {
+		t.Fatalf("expected writing %d bytes to take at least %s, but took %s",
+			numStorages*payloadSize, minDuration, elapsed)
+	}
+}
+
+// TestSideloadingMaxFilesPerRange verifies that the disk sideloaded storage
+// keeps the number of files below the configured maximum by removing only files
+// of truncated entries, that writes fail when no such files are left, and that
+// the payloads of appended entries are then kept inline.
+func TestSideloadingMaxFilesPerRange(t *testing.T) {
+	defer leaktest.AfterTest(t)()
 
+	ctx := context.Background()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
 	cleanup, cache, eng := newRocksDB(t)
 	defer cleanup()
 	defer cache.Release()
 	defer eng.Close()
-	limiter := rate.NewLimiter(rate.Inf, 1<<9)
 
-	var ss SideloadStorage
-	create := func(st *cluster.Settings, replicaID roachpb.ReplicaID) *diskSideloadStorage {
+	st := cluster.MakeTestingClusterSettings()
+	sideloadMaxFilesPerRange.Override(&st.SV, 4)
+	ss := newTestDiskSideloadStorage(t, st, eng, dir)
+
+	const term = 1
+	put := func(index uint64) error {
+		return ss.Put(ctx, index, term, []byte(fmt.Sprintf("payload-%d", index)))
+	}
+	assertIndexes := func(exp ...uint64) {
 		t.Helper()
-		if err := moveSideloadedData(ss, dir, rangeID, replicaID); err != nil {
+		var indexes []uint64
+		if err := ss.ForEach(ctx, func(index, _ uint64, _ int64) error {
+			indexes = append(indexes, index)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(indexes, exp) {
+			t.Fatalf("expected files at indexes %v, got %v", exp, indexes)
+		}
+	}
+
+	for index := uint64(1); index <= 3; index++ {
+		if err := put(index); err != nil {
 			t.Fatal(err)
 		}
-		ss, err := newDiskSideloadStorage(st, rangeID, replicaID, dir, limiter, eng)
+	}
+	if _, _, err := ss.TruncateTo(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate files of truncated entries which TruncateTo failed to remove.
+	for index := uint64(1); index <= 2; index++ {
+		filename, err := ss.Filename(ctx, index, term)
 		if err != nil {
 			t.Fatal(err)
 		}
-		return ss
+		if err := ioutil.WriteFile(filename, []byte("leftover"), 0644); err != nil {
+			t.Fatal(err)
+		}
 	}
-
-	ss = create(stPre, 120)
-	foo := []byte("foo")
-	if err := ss.Put(ctx, 1, 10, foo); err != nil {
+	// The files were written behind the storage's back, so make it pick them up.
+	if _, err := ss.reconcileFileIndex(ctx); err != nil {
 		t.Fatal(err)
 	}
+	assertIndexes(1, 2, 3)
 
-	// Jog moveSideloadedData (via create) prior to the migration.
-	for _, replicaID := range []roachpb.ReplicaID{123, 124} {
-		ss = create(stPre, replicaID)
-		v, err := ss.Get(ctx, 1, 10)
-		if err != nil {
+	// The limit isn't exceeded yet.
+	if err := put(4); err != nil {
+		t.Fatal(err)
+	}
+	assertIndexes(1, 2, 3, 4)
+	// Files of truncated entries are removed to make room, oldest first.
+	if err := put(5); err != nil {
+		t.Fatal(err)
+	}
+	assertIndexes(2, 3, 4, 5)
+	if err := put(6); err != nil {
+		t.Fatal(err)
+	}
+	assertIndexes(3, 4, 5, 6)
+	// No files of truncated entries are left, so the write fails.
+	if err := put(7); !testutils.IsError(err, "storage holds the maximum of 4 files") {
+		t.Fatalf("expected error, got %v", err)
+	}
+	assertIndexes(3, 4, 5, 6)
+	// Overwriting a file is still possible.
+	if err := put(6); err != nil {
+		t.Fatal(err)
+	}
+	// Once the log is truncated further, new files can be written again.
+	if _, _, err := ss.TruncateTo(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+	assertIndexes(5, 6)
+	for _, index := range []uint64{7, 8} {
+		if err := put(index); err != nil {
 			t.Fatal(err)
 		}
-		assert.Equal(t, foo, v)
 	}
+	assertIndexes(5, 6, 7, 8)
 
-	// Migrate.
-	for _, replicaID := range []roachpb.ReplicaID{125, 126} {
-		ss = create(stPost, replicaID)
-		v, err := ss.Get(ctx, 1, 10)
+	// Appending entries to a full storage keeps their payloads inline, whether
+	// they are written individually or as a batch.
+	addSST := storagepb.ReplicatedEvalResult_AddSSTable{Data: []byte("sst")}
+	for _, preEnts := range [][]raftpb.Entry{
+		{mkEnt(raftVersionSideloaded, 9, term, &addSST)},
+		{
+			mkEnt(raftVersionSideloaded, 9, term, &addSST),
+			mkEnt(raftVersionStandard, 10, term, nil),
+			mkEnt(raftVersionSideloaded, 11, term, &addSST),
+		},
+	} {
+		postEnts, size, err := maybeSideloadEntriesImpl(ctx, st, preEnts, ss, nil /* policy */)
 		if err != nil {
 			t.Fatal(err)
 		}
-		assert.Equal(t, foo, v)
+		if !reflect.DeepEqual(postEnts, preEnts) {
+			t.Fatalf("expected entries to be kept inline: %s", pretty.Diff(postEnts, preEnts))
+		}
+		if size != 0 {
+			t.Fatalf("expected no sideloaded bytes, but found %d", size)
+		}
+		assertIndexes(5, 6, 7, 8)
 	}
-
-	// Check that we really did migrate.
-	prevDir := ss.Dir()
-	ss = create(stPost, 129)
-	assert.Equal(t, prevDir, ss.Dir())
 }
 
-func TestRaftSSTableSideloadingInline(t *testing.T) {
+// TestSideloadingFileIndex verifies that the index of the files in the disk
+// sideloaded storage stays consistent with the directory across mutations, is
+// loaded lazily by a new storage, and is reconciled with the directory when
+// it's modified behind the storage's back.
+func TestSideloadingFileIndex(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
-	v1, v2 := raftVersionStandard, raftVersionSideloaded
-	rangeID := roachpb.RangeID(1)
+	ctx := context.Background()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+	cleanup, cache, eng := newRocksDB(t)
+	defer cleanup()
+	defer cache.Release()
+	defer eng.Close()
 
-	type testCase struct {
-		// Entry passed into maybeInlineSideloadedRaftCommand and the entry
-		// after having (perhaps) been modified.
-		thin, fat raftpb.Entry
-		// Populate the raft entry cache and sideload storage before running the test.
-		setup func(*raftentry.Cache, SideloadStorage)
-		// If nonempty, the error expected from maybeInlineSideloadedRaftCommand.
-		expErr string
-		// If nonempty, a regex that the recorded trace span must match.
-		expTrace string
+	st := cluster.MakeTestingClusterSettings()
+	newStorage := func() *diskSideloadStorage {
+		return newTestDiskSideloadStorage(t, st, eng, dir)
 	}
+	ss := newStorage()
 
-	sstFat := storagepb.ReplicatedEvalResult_AddSSTable{
-		Data:  []byte("foo"),
-		CRC32: 0, // not checked
-	}
-	sstThin := storagepb.ReplicatedEvalResult_AddSSTable{
-		CRC32: 0, // not checked
+	assertConsistent := func(expKeys ...slKey) {
+		t.Helper()
+		files, err := ss.fileIndex(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := files.keys(); !reflect.DeepEqual(keys, append([]slKey{}, expKeys...)) {
+			t.Fatalf("expected indexed keys %v, got %v", expKeys, keys)
+		}
+		var expBytes int64
+		for _, k := range expKeys {
+			expBytes += int64(len(sideloadFilename(k.index, k.term)))
+		}
+		if files.bytes != expBytes {
+			t.Fatalf("expected %d indexed bytes, got %d", expBytes, files.bytes)
+		}
+		if diff, err := ss.reconcileFileIndex(ctx); err != nil {
+			t.Fatal(err)
+		} else if diff != "" {
+			t.Fatalf("index is inconsistent with directory: %s", diff)
+		}
 	}
-
-	putOnDisk := func(ec *raftentry.Cache, ss SideloadStorage) {
-		if err := ss.Put(context.Background(), 5, 6, sstFat.Data); err != nil {
+	// Each payload is its file name, so that sizes are easy to predict.
+	put := func(index, term uint64) {
+		t.Helper()
+		if err := ss.Put(ctx, index, term, []byte(sideloadFilename(index, term))); err != nil {
 			t.Fatal(err)
 		}
 	}
 
-	testCases := map[string]testCase{
-		// Plain old v1 Raft command without payload. Don't touch.
-		"v1-no-payload": {thin: mkEnt(v1, 5, 6, &sstThin), fat: mkEnt(v1, 5, 6, &sstThin)},
-		// With payload, but command is v1. Don't touch. Note that the
-		// first of the two shouldn't happen in practice or we have a
-		// huge problem once we try to apply this entry.
-		"v1-slim-with-payload": {thin: mkEnt(v1, 5, 6, &sstThin), fat: mkEnt(v1, 5, 6, &sstThin)},
-		"v1-with-payload":      {thin: mkEnt(v1, 5, 6, &sstFat), fat: mkEnt(v1, 5, 6, &sstFat)},
-		// v2 with payload, but payload is AWOL. This would be fatal in practice.
-		"v2-with-payload-missing-file": {
-			thin: mkEnt(v2, 5, 6, &sstThin), fat: mkEnt(v2, 5, 6, &sstThin),
-			expErr: "not found",
-		},
-		// v2 with payload that's actually there. The request we'll see in
-		// practice.
-		"v2-with-payload-with-file-no-cache": {
-			thin: mkEnt(v2, 5, 6, &sstThin), fat: mkEnt(v2, 5, 6, &sstFat),
-			setup: putOnDisk, expTrace: "inlined entry not cached",
-		},
-		"v2-with-payload-with-file-with-cache": {
-			thin: mkEnt(v2, 5, 6, &sstThin), fat: mkEnt(v2, 5, 6, &sstFat),
-			setup: func(ec *raftentry.Cache, ss SideloadStorage) {
-				putOnDisk(ec, ss)
-				ec.Add(rangeID, []raftpb.Entry{mkEnt(v2, 5, 6, &sstFat)}, true)
-			}, expTrace: "using cache hit",
-		},
-		"v2-fat-without-file": {
-			thin: mkEnt(v2, 5, 6, &sstFat), fat: mkEnt(v2, 5, 6, &sstFat),
-			setup:    func(ec *raftentry.Cache, ss SideloadStorage) {},
-			expTrace: "already inlined",
-		},
+	assertConsistent()
+	for _, k := range []slKey{{10, 1}, {9, 1}, {11, 2}, {11, 1}, {12, 2}} {
+		put(k.index, k.term)
+	}
+	assertConsistent(slKey{9, 1}, slKey{10, 1}, slKey{11, 1}, slKey{11, 2}, slKey{12, 2})
+	// Overwriting a file replaces its entry.
+	put(10, 1)
+	assertConsistent(slKey{9, 1}, slKey{10, 1}, slKey{11, 1}, slKey{11, 2}, slKey{12, 2})
+	if err := ss.PutMonotonic(ctx, 11, 1, []byte("x")); !testutils.IsError(err, "term 2 is already present") {
+		t.Fatalf("expected term regression error, got %v", err)
 	}
 
-	runOne := func(k string, test testCase) {
-		ctx, collect, cancel := tracing.ContextWithRecordingSpan(context.Background(), "test-recording")
-		defer cancel()
+	if _, err := ss.Purge(ctx, 11, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Purge(ctx, 11, 1); err != errSideloadedFileNotFound {
+		t.Fatalf("expected %v, got %v", errSideloadedFileNotFound, err)
+	}
+	assertConsistent(slKey{9, 1}, slKey{10, 1}, slKey{11, 2}, slKey{12, 2})
 
-		ec := raftentry.NewCache(1024) // large enough
-		ss := mustNewInMemSideloadStorage(rangeID, roachpb.ReplicaID(1), ".")
-		if test.setup != nil {
-			test.setup(ec, ss)
-		}
+	freed, retained, err := ss.TruncateTo(ctx, 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expFreed, expRetained := int64(len("i9.t1")+len("i10.t1")), int64(len("i11.t2")+len("i12.t2"))
+	if freed != expFreed || retained != expRetained {
+		t.Fatalf("expected (%d, %d) bytes freed and retained, got (%d, %d)", expFreed, expRetained, freed, retained)
+	}
+	assertConsistent(slKey{11, 2}, slKey{12, 2})
 
-		thinCopy := *(protoutil.Clone(&test.thin).(*raftpb.Entry))
-		newEnt, err := maybeInlineSideloadedRaftCommand(ctx, rangeID, thinCopy, ss, ec)
-		if err != nil {
-			if test.expErr == "" || !testutils.IsError(err, test.expErr) {
-				t.Fatalf("%s: %s", k, err)
-			}
-		} else if test.expErr != "" {
-			t.Fatalf("%s: success, but expected error: %s", k, test.expErr)
-		} else if err := entryEq(thinCopy, test.thin); err != nil {
-			t.Fatalf("%s: mutated the original entry: %s", k, pretty.Diff(thinCopy, test.thin))
+	// A new storage for the same directory, as after a restart, loads the index
+	// on first use.
+	ss = newStorage()
+	if ss.files.loaded {
+		t.Fatal("expected index to be loaded lazily")
+	}
+	assertConsistent(slKey{11, 2}, slKey{12, 2})
+
+	// Modifications behind the storage's back are detected and reconciled.
+	if err := ioutil.WriteFile(ss.filename(ctx, 13, 2), []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(ss.filename(ctx, 11, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if diff, err := ss.reconcileFileIndex(ctx); err != nil {
+		t.Fatal(err)
+	} else if exp := "unindexed file i13.t2; missing file i11.t2"; diff != exp {
+		t.Fatalf("expected differences %q, got %q", exp, diff)
+	}
+	if keys, err := ss.sortedKeys(ctx); err != nil {
+		t.Fatal(err)
+	} else if exp := []slKey{{12, 2}, {13, 2}}; !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("expected keys %v, got %v", exp, keys)
+	}
+
+	if err := ss.Clear(ctx); err != nil {
+		t.Fatal(err)
+	}
+	assertConsistent()
+}
+
+func TestSideloadingSideloadedStorageIdentity(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	testSideloadStorageImpls(t, func(t *testing.T, ss SideloadStorage) {
+		// testSideloadStorageImpls creates storages for r1 and replica 2.
+		if rangeID, replicaID := ss.Identity(); rangeID != 1 || replicaID != 2 {
+			t.Fatalf("expected identity (1, 2), got (%d, %d)", rangeID, replicaID)
 		}
+	})
+}
 
-		if newEnt == nil {
-			newEnt = &thinCopy
+// SideloadStorage and its mirror in sideloadtest must remain in sync.
+var _ SideloadStorage = (*sideloadtest.FaultySideloadStorage)(nil)
+var _ sideloadtest.SideloadStorage = SideloadStorage(nil)
+
+func TestSideloadingFaultyStorage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	testSideloadStorageImpls(t, func(t *testing.T, wrapped SideloadStorage) {
+		ctx := context.Background()
+		ss := sideloadtest.NewFaultySideloadStorage(wrapped)
+		payload := []byte("foo")
+
+		// An injected Put failure is returned for as many calls as configured,
+		// without writing to the wrapped storage.
+		errInjected := errors.New("injected")
+		ss.Inject(sideloadtest.MethodPut, sideloadtest.Fault{Err: errInjected, Count: 2})
+		for i := 0; i < 2; i++ {
+			if err := ss.Put(ctx, 1, 1, payload); err != errInjected {
+				t.Fatalf("%d: expected injected error, got %v", i, err)
+			}
 		}
-		if err := entryEq(*newEnt, test.fat); err != nil {
-			t.Fatalf("%s: %s", k, err)
+		if _, err := wrapped.Get(ctx, 1, 1); err != errSideloadedFileNotFound {
+			t.Fatalf("expected %v, got %v", errSideloadedFileNotFound, err)
+		}
+		if err := ss.Put(ctx, 1, 1, payload); err != nil {
+			t.Fatal(err)
+		}
+		if n := ss.Calls(sideloadtest.MethodPut); n != 3 {
+			t.Fatalf("expected 3 calls to Put, got %d", n)
 		}
 
-		if dump := tracing.FormatRecordedSpans(collect()); test.expTrace != "" {
-			if ok, err := regexp.MatchString(test.expTrace, dump); err != nil {
-				t.Fatalf("%s: %s", k, err)
-			} else if !ok {
-				t.Fatalf("%s: expected trace matching:\n%s\n\nbut got\n%s", k, test.expTrace, dump)
+		// Errors of the wrapped storage are passed through.
+		if _, err := ss.Get(ctx, 2, 1); err != errSideloadedFileNotFound {
+			t.Fatalf("expected %v, got %v", errSideloadedFileNotFound, err)
+		}
+
+		// An injected Get failure applies until it is cleared.
+		ss.Inject(sideloadtest.MethodGet, sideloadtest.Fault{Err: errInjected})
+		for i := 0; i < 3; i++ {
+			if _, err := ss.Get(ctx, 1, 1); err != errInjected {
+				t.Fatalf("%d: expected injected error, got %v", i, err)
 			}
 		}
-	}
+		ss.ClearFaults(sideloadtest.MethodGet)
+		if b, err := ss.Get(ctx, 1, 1); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(b, payload) {
+			t.Fatalf("expected %q, got %q", payload, b)
+		}
 
-	keys := make([]string, 0, len(testCases))
-	for k := range testCases {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-	for _, k := range keys {
-		runOne(k, testCases[k])
-	}
+		// Partial reads return a prefix of the payload.
+		ss.Inject(sideloadtest.MethodGet, sideloadtest.Fault{PartialRead: true, ReadLen: 1, Count: 1})
+		if b, err := ss.Get(ctx, 1, 1); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(b, payload[:1]) {
+			t.Fatalf("expected %q, got %q", payload[:1], b)
+		}
+
+		// A delayed call is aborted when its context is canceled.
+		ss.Inject(sideloadtest.MethodGet, sideloadtest.Fault{Delay: time.Hour})
+		cancelCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := ss.Get(cancelCtx, 1, 1); err != context.Canceled {
+			t.Fatalf("expected %v, got %v", context.Canceled, err)
+		}
+	})
 }
 
-func TestRaftSSTableSideloadingSideload(t *testing.T) {
+func TestSideloadingUnknownFilesPolicy(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
-	addSST := storagepb.ReplicatedEvalResult_AddSSTable{
-		Data: []byte("foo"), CRC32: 0, // not checked
-	}
-
-	addSSTStripped := addSST
-	addSSTStripped.Data = nil
-
-	entV1Reg := mkEnt(raftVersionStandard, 10, 99, nil)
-	entV1SST := mkEnt(raftVersionStandard, 11, 99, &addSST)
-	entV2Reg := mkEnt(raftVersionSideloaded, 12, 99, nil)
-	entV2SST := mkEnt(raftVersionSideloaded, 13, 99, &addSST)
-	entV2SSTStripped := mkEnt(raftVersionSideloaded, 13, 99, &addSSTStripped)
+	for _, policy := range []sideloadUnknownFilesPolicy{
+		sideloadUnknownFilesStrict,
+		sideloadUnknownFilesWarnAndSkip,
+		sideloadUnknownFilesQuarantine,
+	} {
+		t.Run(fmt.Sprintf("policy=%d", policy), func(t *testing.T) {
+			ctx := context.Background()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
 
-	type tc struct {
-		name              string
-		preEnts, postEnts []raftpb.Entry
-		ss                []string
-		size              int64
-	}
+			cleanup, cache, eng := newRocksDB(t)
+			defer cleanup()
+			defer cache.Release()
+			defer eng.Close()
 
-	// Intentionally ignore the fact that real calls would always have an
-	// unbroken run of `entry.Index`.
-	testCases := []tc{
-		{
-			name:     "empty",
-			preEnts:  nil,
-			postEnts: nil,
-			ss:       nil,
-			size:     0,
-		},
-		{
-			name:     "v1",
-			preEnts:  []raftpb.Entry{entV1Reg, entV1SST},
-			postEnts: []raftpb.Entry{entV1Reg, entV1SST},
-			size:     0,
-		},
-		{
-			name:     "v2",
-			preEnts:  []raftpb.Entry{entV2SST, entV2Reg},
-			postEnts: []raftpb.Entry{entV2SSTStripped, entV2Reg},
-			ss:       []string{"i13t99"},
-			size:     int64(len(addSST.Data)),
-		},
-		{
-			name:     "mixed",
-			preEnts:  []raftpb.Entry{entV1Reg, entV1SST, entV2Reg, entV2SST},
-			postEnts: []raftpb.Entry{entV1Reg, entV1SST, entV2Reg, entV2SSTStripped},
-			ss:       []string{"i13t99"},
-			size:     int64(len(addSST.Data)),
-		},
-	}
+			st := cluster.MakeTestingClusterSettings()
+			sideloadUnknownFilesPolicySetting.Override(&st.SV, int64(policy))
+			ss := newTestDiskSideloadStorage(t, st, eng, dir)
+			if err := ss.Put(ctx, 1, 1, []byte("foo")); err != nil {
+				t.Fatal(err)
+			}
+			strayFile := filepath.Join(ss.dir, "stray.xx")
+			if err := ioutil.WriteFile(strayFile, []byte("stray"), 0644); err != nil {
+				t.Fatal(err)
+			}
 
-	for _, test := range testCases {
-		t.Run(test.name, func(t *testing.T) {
-			ctx := context.Background()
-			sideloaded := mustNewInMemSideloadStorage(roachpb.RangeID(3), roachpb.ReplicaID(17), ".")
-			postEnts, size, err := maybeSideloadEntriesImpl(ctx, test.preEnts, sideloaded)
-			if err != nil {
+			freed, retained, err := ss.TruncateTo(ctx, math.MaxUint64)
+			if policy == sideloadUnknownFilesStrict {
+				if !testutils.IsError(err, "directory not empty") {
+					t.Fatalf("expected error due to stray file, got %v", err)
+				}
+			} else if err != nil {
 				t.Fatal(err)
+			} else if freed != 3 || retained != 0 {
+				t.Fatalf("expected (3, 0) bytes freed and retained, got (%d, %d)", freed, retained)
 			}
-			if len(addSST.Data) == 0 {
-				t.Fatal("invocation mutated original AddSSTable struct in memory")
+			if _, err := ss.Get(ctx, 1, 1); err != errSideloadedFileNotFound {
+				t.Fatalf("expected sideloaded file to be removed, got %v", err)
 			}
-			if !reflect.DeepEqual(postEnts, test.postEnts) {
-				t.Fatalf("result differs from expected: %s", pretty.Diff(postEnts, test.postEnts))
+
+			quarantined := filepath.Join(sideloadQuarantinePath(ss.dir), "stray.xx")
+			strayExists, err := exists(strayFile)
+			if err != nil {
+				t.Fatal(err)
 			}
-			if test.size != size {
-				t.Fatalf("expected %d sideloadedSize, but found %d", test.size, size)
+			quarantinedExists, err := exists(quarantined)
+			if err != nil {
+				t.Fatal(err)
 			}
-			var actKeys []string
-			for k := range sideloaded.(*inMemSideloadStorage).m {
-				actKeys = append(actKeys, fmt.Sprintf("i%dt%d", k.index, k.term))
+			dirExists, err := exists(ss.dir)
+			if err != nil {
+				t.Fatal(err)
 			}
-			sort.Strings(actKeys)
-			if !reflect.DeepEqual(actKeys, test.ss) {
-				t.Fatalf("expected %v, got %v", test.ss, actKeys)
+			if policy == sideloadUnknownFilesQuarantine {
+				if strayExists || !quarantinedExists || dirExists {
+					t.Fatalf("expected stray file to be quarantined and directory to be removed")
+				}
+			} else if !strayExists || quarantinedExists || !dirExists {
+				t.Fatalf("expected stray file and directory to be left in place")
 			}
 		})
 	}
 }
 
-func makeInMemSideloaded(repl *Replica) {
-	repl.raftMu.Lock()
-	repl.raftMu.sideloaded = mustNewInMemSideloadStorage(repl.RangeID, 0, repl.store.engine.GetAuxiliaryDir())
-	repl.raftMu.Unlock()
-}
-
-// TestRaftSSTableSideloadingProposal runs a straightforward application of an `AddSSTable` command.
-func TestRaftSSTableSideloadingProposal(t *testing.T) {
+// TestSideloadingChecksum verifies that payloads are round-tripped through
+// the disk sideloaded storage with kv.raft_log.sideloading.checksum enabled,
+// and that corrupted payloads are detected when read.
+func TestSideloadingChecksum(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
-	testutils.RunTrueAndFalse(t, "engineInMem", func(t *testing.T, engineInMem bool) {
-		testutils.RunTrueAndFalse(t, "mockSideloaded", func(t *testing.T, mockSideloaded bool) {
-			if engineInMem && !mockSideloaded {
-				t.Skip("https://github.com/cockroachdb/cockroach/issues/31913")
-			}
-			testRaftSSTableSideloadingProposal(t, engineInMem, mockSideloaded)
-		})
-	})
+	ctx := context.Background()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	cleanup, cache, eng := newRocksDB(t)
+	defer cleanup()
+	defer cache.Release()
+	defer eng.Close()
+
+	st := cluster.MakeTestingClusterSettings()
+	sideloadChecksumSetting.Override(&st.SV, int64(sideloadChecksumSHA256))
+	ss := newTestDiskSideloadStorage(t, st, eng, dir)
+
+	payload := []byte("some sideloaded payload")
+	if err := ss.Put(ctx, 1, 1, payload); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ss.Get(ctx, 1, 1); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(b, payload) {
+		t.Fatalf("expected %q, got %q", payload, b)
+	}
+	// The checksum file doesn't show up as a payload.
+	if keys, err := ss.sortedKeys(ctx); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 1 {
+		t.Fatalf("expected a single payload, got %v", keys)
+	}
+
+	// Corrupt the payload without changing its size. It is still verified
+	// after disabling the checksum, since its checksum file remains.
+	sideloadChecksumSetting.Override(&st.SV, int64(sideloadChecksumNone))
+	corrupted := append([]byte(nil), payload...)
+	corrupted[3] ^= 0x01
+	if err := ioutil.WriteFile(ss.filename(ctx, 1, 1), corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Get(ctx, 1, 1); !testutils.IsError(err, "does not match its sha256 checksum") {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+
+	// Overwriting the payload with the checksum disabled drops the stale
+	// checksum file.
+	if err := ss.Put(ctx, 1, 1, corrupted); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ss.Get(ctx, 1, 1); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(b, corrupted) {
+		t.Fatalf("expected %q, got %q", corrupted, b)
+	}
+
+	// Truncating the payloads removes the checksum files along with them, so
+	// that the directory can be removed.
+	sideloadChecksumSetting.Override(&st.SV, int64(sideloadChecksumSHA256))
+	if err := ss.Put(ctx, 2, 1, payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ss.TruncateTo(ctx, math.MaxUint64); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := exists(ss.dir); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatalf("expected %s to be removed", ss.dir)
+	}
 }
 
-// TestRaftSSTableSideloadingProposal runs a straightforward application of an `AddSSTable` command.
-func testRaftSSTableSideloadingProposal(t *testing.T, engineInMem, mockSideloaded bool) {
+// TestSideloadingCompression verifies that payloads are round-tripped through
+// the disk sideloaded storage with kv.raft_log.sideloading.compression.enabled
+// both set and unset, that directories holding both compressed and
+// uncompressed files are read correctly, and that files with a corrupt header
+// are detected when read.
+func TestSideloadingCompression(t *testing.T) {
 	defer leaktest.AfterTest(t)()
-	defer SetMockAddSSTable()()
 
+	ctx := context.Background()
 	dir, cleanup := testutils.TempDir(t)
 	defer cleanup()
-	stopper := stop.NewStopper()
-	tc := testContext{}
-	if !engineInMem {
-		cfg := engine.RocksDBConfig{
-			Dir:      dir,
-			Settings: cluster.MakeTestingClusterSettings(),
+
+	cleanup, cache, eng := newRocksDB(t)
+	defer cleanup()
+	defer cache.Release()
+	defer eng.Close()
+
+	st := cluster.MakeTestingClusterSettings()
+	ss := newTestDiskSideloadStorage(t, st, eng, dir)
+
+	payload, _ := MakeSSTable("a", strings.Repeat("compressible", 1000), hlc.Timestamp{WallTime: 1})
+	for i, compress := range []bool{true, false} {
+		index := uint64(i + 1)
+		sideloadCompressionEnabled.Override(&st.SV, compress)
+		if err := ss.Put(ctx, index, 1, payload); err != nil {
+			t.Fatal(err)
 		}
-		var err error
-		cache := engine.NewRocksDBCache(1 << 20)
-		defer cache.Release()
-		tc.engine, err = engine.NewRocksDB(cfg, cache)
+		onDisk, err := ioutil.ReadFile(ss.filename(ctx, index, 1))
 		if err != nil {
 			t.Fatal(err)
 		}
-		stopper.AddCloser(tc.engine)
+		if compress != isCompressedSideloadPayload(onDisk) {
+			t.Fatalf("compression %t: file is compressed: %t", compress, !compress)
+		}
+		if compress && len(onDisk) >= len(payload) {
+			t.Fatalf("expected compressed file to be smaller than %d bytes, got %d", len(payload), len(onDisk))
+		}
 	}
-	defer stopper.Stop(context.TODO())
-	tc.Start(t, stopper)
-
-	ctx, collect, cancel := tracing.ContextWithRecordingSpan(context.Background(), "test-recording")
-	defer cancel()
-
-	const (
-		key       = "foo"
-		entrySize = 128
-	)
-	val := strings.Repeat("x", entrySize)
 
-	if mockSideloaded {
-		makeInMemSideloaded(tc.repl)
+	// Both files are readable regardless of the setting.
+	for _, compress := range []bool{true, false} {
+		sideloadCompressionEnabled.Override(&st.SV, compress)
+		for _, index := range []uint64{1, 2} {
+			if b, err := ss.Get(ctx, index, 1); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(b, payload) {
+				t.Fatalf("index %d: payload doesn't round-trip", index)
+			}
+			if b, err := ss.GetRange(ctx, index, 1, roachpb.Key("a"), roachpb.Key("b")); err != nil {
+				t.Fatal(err)
+			} else if b == nil {
+				t.Fatalf("index %d: expected a non-empty range", index)
+			}
+		}
 	}
 
-	ts := hlc.Timestamp{Logical: 1}
+	// Corrupt the header of a compressed file.
+	for _, tc := range []struct {
+		contents []byte
+		expErr   string
+	}{
+		{append(append([]byte(nil), sideloadCompressionMagic...), 99), "has unknown version 99"},
+		{append(append([]byte(nil), sideloadCompressionMagic...), sideloadCompressionVersion, 0xff), "decompressing"},
+	} {
+		if err := ioutil.WriteFile(ss.filename(ctx, 3, 1), tc.contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ss.Get(ctx, 3, 1); !testutils.IsError(err, tc.expErr) {
+			t.Fatalf("expected %q, got %v", tc.expErr, err)
+		}
+	}
 
-	if err := ProposeAddSSTable(ctx, key, val, ts, tc.store); err != nil {
+	// Truncation accounts for the uncompressed size of the payloads, which is
+	// what they contribute to the size of the Raft log, and removes the
+	// corrupt file along with the others.
+	freed, _, err := ss.TruncateTo(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := int64(2 * len(payload)); freed != exp {
+		t.Fatalf("expected %d bytes freed, got %d", exp, freed)
+	}
+	if _, _, err := ss.TruncateTo(ctx, math.MaxUint64); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := exists(ss.dir); err != nil {
 		t.Fatal(err)
+	} else if ok {
+		t.Fatalf("expected %s to be removed", ss.dir)
 	}
+}
 
-	{
-		var ba roachpb.BatchRequest
-		get := getArgs(roachpb.Key(key))
-		ba.Add(&get)
-		ba.Header.RangeID = tc.repl.RangeID
+// TestSideloadingSideloadedStorageGetRange verifies that GetRange returns an
+// SSTable holding exactly the entries of the stored SSTable in the requested
+// key range.
+func TestSideloadingSideloadedStorageGetRange(t *testing.T) {
+	defer leaktest.AfterTest(t)()
 
-		br, pErr := tc.store.Send(ctx, ba)
-		if pErr != nil {
-			t.Fatal(pErr)
+	for _, tc := range []struct {
+		name  string
+		maker func(*cluster.Settings, roachpb.RangeID, roachpb.ReplicaID, string, engine.Engine) (SideloadStorage, error)
+	}{
+		{"Mem", func(
+			s *cluster.Settings, rangeID roachpb.RangeID, rep roachpb.ReplicaID, name string, eng engine.Engine,
+		) (SideloadStorage, error) {
+			return newInMemSideloadStorage(s, rangeID, rep, name, nil, eng)
+		}},
+		{"Disk", func(
+			s *cluster.Settings, rangeID roachpb.RangeID, rep roachpb.ReplicaID, name string, eng engine.Engine,
+		) (SideloadStorage, error) {
+			return newDiskSideloadStorage(
+				s, rangeID, rep, name, rate.NewLimiter(rate.Inf, math.MaxInt64), rate.NewLimiter(rate.Inf, math.MaxInt64), nil, eng,
+			)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir, cleanup := testutils.TempDir(t)
+			defer cleanup()
+
+			cleanup, cache, eng := newRocksDB(t)
+			defer cleanup()
+			defer cache.Release()
+			defer eng.Close()
+
+			ss, err := tc.maker(cluster.MakeTestingClusterSettings(), 1, 2, dir, eng)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sst, err := engine.MakeRocksDBSstFileWriter()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sst.Close()
+			for _, k := range []string{"a", "b", "c", "d", "e"} {
+				kv := engine.MVCCKeyValue{
+					Key:   engine.MVCCKey{Key: roachpb.Key(k), Timestamp: hlc.Timestamp{WallTime: 1}},
+					Value: []byte(strings.Repeat(k, 100)),
+				}
+				if err := sst.Add(kv); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data, err := sst.Finish()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ss.Put(ctx, 1, 1, data); err != nil {
+				t.Fatal(err)
+			}
+
+			readKeys := func(start, end string) []string {
+				t.Helper()
+				b, err := ss.GetRange(ctx, 1, 1, roachpb.Key(start), roachpb.Key(end))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if b == nil {
+					return nil
+				}
+				iter, err := engine.NewMemSSTIterator(b, false /* verify */)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer iter.Close()
+				var keys []string
+				for iter.Seek(engine.MVCCKey{}); ; iter.Next() {
+					if ok, err := iter.Valid(); err != nil {
+						t.Fatal(err)
+					} else if !ok {
+						break
+					}
+					k := string(iter.UnsafeKey().Key)
+					if v := strings.Repeat(k, 100); string(iter.UnsafeValue()) != v {
+						t.Fatalf("unexpected value for key %s: %q", k, iter.UnsafeValue())
+					}
+					keys = append(keys, k)
+				}
+				return keys
+			}
+
+			if keys := readKeys("b", "d"); !reflect.DeepEqual(keys, []string{"b", "c"}) {
+				t.Fatalf("expected keys [b c], got %v", keys)
+			}
+			if keys := readKeys("", "z"); !reflect.DeepEqual(keys, []string{"a", "b", "c", "d", "e"}) {
+				t.Fatalf("expected all keys, got %v", keys)
+			}
+			if keys := readKeys("f", "z"); keys != nil {
+				t.Fatalf("expected no keys, got %v", keys)
+			}
+			if _, err := ss.GetRange(ctx, 2, 1, roachpb.Key("a"), roachpb.Key("z")); err != errSideloadedFileNotFound {
+				t.Fatalf("expected errSideloadedFileNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+// TestSideloadingDeferredDeletion verifies that with deferred deletion
+// enabled, truncating the disk sideloaded storage only marks the files for
+// deletion, and that the sweeper then removes them along with the directory.
+func TestSideloadingDeferredDeletion(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	cleanup, cache, eng := newRocksDB(t)
+	defer cleanup()
+	defer cache.Release()
+	defer eng.Close()
+
+	st := cluster.MakeTestingClusterSettings()
+	sideloadDeferredDeletion.Override(&st.SV, true)
+	ss := newTestDiskSideloadStorage(t, st, eng, dir)
+	for i := uint64(1); i <= 3; i++ {
+		if err := ss.Put(ctx, i, 1, []byte("payload")); err != nil {
+			t.Fatal(err)
 		}
-		v := br.Responses[0].GetInner().(*roachpb.GetResponse).Value
-		if v == nil {
-			t.Fatal("expected to read a value")
+	}
+
+	freed, retained, err := ss.TruncateTo(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freed != 14 || retained != 7 {
+		t.Fatalf("expected (14, 7) bytes freed and retained, got (%d, %d)", freed, retained)
+	}
+	// The truncated files are pending deletion, and thus absent.
+	for i := uint64(1); i <= 2; i++ {
+		if _, err := ss.Get(ctx, i, 1); err != errSideloadedFileNotFound {
+			t.Fatalf("expected file at index %d to be absent, got %v", i, err)
 		}
-		if valBytes, err := v.GetBytes(); err != nil {
+		pending := ss.filename(ctx, i, 1) + sideloadPendingDeleteSuffix
+		if ok, err := exists(pending); err != nil {
 			t.Fatal(err)
-		} else if !bytes.Equal(valBytes, []byte(val)) {
-			t.Fatalf("expected to read '%s', but found '%s'", val, valBytes)
+		} else if !ok {
+			t.Fatalf("expected %s to exist", pending)
 		}
 	}
+	if keys, err := ss.sortedKeys(ctx); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(keys, []slKey{{index: 3, term: 1}}) {
+		t.Fatalf("expected only the untruncated file to be listed, got %v", keys)
+	}
+	// Reloading the file index from disk ignores the pending files as well.
+	if diff, err := ss.reconcileFileIndex(ctx); err != nil {
+		t.Fatal(err)
+	} else if diff != "" {
+		t.Fatalf("unexpected file index discrepancy: %s", diff)
+	}
 
-	func() {
-		tc.repl.raftMu.Lock()
-		defer tc.repl.raftMu.Unlock()
-		if ss, ok := tc.repl.raftMu.sideloaded.(*inMemSideloadStorage); ok && len(ss.m) < 1 {
-			t.Fatal("sideloaded storage is empty")
+	// Truncating the last file leaves the directory to the sweeper.
+	if _, _, err := ss.TruncateTo(ctx, math.MaxUint64); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := sweepSideloadPendingDeletions(ctx, eng, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Fatalf("expected 3 files to be removed, got %d", removed)
+	}
+	if ok, err := exists(ss.dir); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatalf("expected %s to be removed", ss.dir)
+	}
+}
+
+func TestSideloadingEagerDirCreation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	testutils.RunTrueAndFalse(t, "eager", func(t *testing.T, eager bool) {
+		dir, cleanup := testutils.TempDir(t)
+		defer cleanup()
+
+		cleanup, cache, eng := newRocksDB(t)
+		defer cleanup()
+		defer cache.Release()
+		defer eng.Close()
+
+		st := cluster.MakeTestingClusterSettings()
+		sideloadEagerDirCreation.Override(&st.SV, eager)
+		ss := newTestDiskSideloadStorage(t, st, eng, dir)
+		assertDir := func(expected bool) {
+			t.Helper()
+			if ss.dirCreated != expected {
+				t.Fatalf("expected dirCreated=%t, got %t", expected, ss.dirCreated)
+			}
+			if ok, err := exists(ss.dir); err != nil {
+				t.Fatal(err)
+			} else if ok != expected {
+				t.Fatalf("expected directory existence to be %t, got %t", expected, ok)
+			}
 		}
 
-		if err := testutils.MatchInOrder(tracing.FormatRecordedSpans(collect()), "sideloadable proposal detected", "ingested SSTable"); err != nil {
+		// The directory is only created by the first write if creation is lazy.
+		assertDir(eager)
+		if err := ss.Put(ctx, 1, 1, []byte("payload")); err != nil {
 			t.Fatal(err)
 		}
+		assertDir(true)
 
-		if n := tc.store.metrics.AddSSTableProposals.Count(); n == 0 {
-			t.Fatalf("expected metric to show at least one AddSSTable proposal, but got %d", n)
+		// Truncation removes the directory either way once it is empty.
+		if _, _, err := ss.TruncateTo(ctx, 2); err != nil {
+			t.Fatal(err)
 		}
-
-		if n := tc.store.metrics.AddSSTableApplications.Count(); n == 0 {
-			t.Fatalf("expected metric to show at least one AddSSTable application, but got %d", n)
+		if ok, err := exists(ss.dir); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			t.Fatalf("expected %s to be removed", ss.dir)
 		}
-		// We usually don't see copies because we hardlink and ingest the original SST. However, this
-		// depends on luck and the file system, so don't try to assert it. We should, however, see
-		// no more than one.
-		expMaxCopies := int64(1)
-		if engineInMem {
-			// We don't count in-memory env SST writes as copies.
-			expMaxCopies = 0
+	})
+}
+
+func TestSideloadingSideloadedStorageState(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	testSideloadStorageImpls(t, func(t *testing.T, ss SideloadStorage) {
+		ctx := context.Background()
+		// Only the disk storage has a directory which may not exist.
+		absent := storagebase.SideloadDirEmpty
+		if _, ok := ss.(*diskSideloadStorage); ok {
+			absent = storagebase.SideloadDirNotCreated
 		}
-		if n := tc.store.metrics.AddSSTableApplicationCopies.Count(); n > expMaxCopies {
-			t.Fatalf("expected metric to show <= %d AddSSTable copies, but got %d", expMaxCopies, n)
+		assertState := func(expected storagebase.SideloadDirState) {
+			t.Helper()
+			if state := ss.State(); state != expected {
+				t.Fatalf("expected state %s, got %s", expected, state)
+			}
 		}
-	}()
-
-	// Force a log truncation followed by verification of the tracked raft log size. This exercises a
-	// former bug in which the raft log size took the sideloaded payload into account when adding
-	// to the log, but not when truncating.
 
-	// Write enough keys to the range to make sure that a truncation will happen.
-	for i := 0; i < RaftLogQueueStaleThreshold+1; i++ {
-		key := roachpb.Key(fmt.Sprintf("key%02d", i))
-		args := putArgs(key, []byte(fmt.Sprintf("value%02d", i)))
-		if _, err := client.SendWrapped(context.Background(), tc.store.TestSender(), &args); err != nil {
+		assertState(absent)
+		if err := ss.Put(ctx, 1, 1, []byte("foo")); err != nil {
 			t.Fatal(err)
 		}
-	}
+		assertState(storagebase.SideloadDirNonEmpty)
+		if err := ss.Put(ctx, 2, 1, []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		// Partial truncation leaves the storage in place.
+		if _, _, err := ss.TruncateTo(ctx, 2); err != nil {
+			t.Fatal(err)
+		}
+		assertState(storagebase.SideloadDirNonEmpty)
+		// Full truncation removes the directory again.
+		if _, _, err := ss.TruncateTo(ctx, 3); err != nil {
+			t.Fatal(err)
+		}
+		assertState(absent)
 
-	if _, err := tc.store.raftLogQueue.testingAdd(ctx, tc.repl, 99.99 /* priority */); err != nil {
-		t.Fatal(err)
-	}
-	tc.store.MustForceRaftLogScanAndProcess()
-	// SST is definitely truncated now, so recomputing the Raft log keys should match up with
-	// the tracked size.
-	verifyLogSizeInSync(t, tc.repl)
+		if err := ss.Put(ctx, 3, 1, []byte("baz")); err != nil {
+			t.Fatal(err)
+		}
+		assertState(storagebase.SideloadDirNonEmpty)
+		if err := ss.Clear(ctx); err != nil {
+			t.Fatal(err)
+		}
+		assertState(absent)
+	})
 }
 
-type mockSender struct {
-	logEntries [][]byte
-	done       bool
+// cancelAfterContext is a context which reports itself canceled once its Err
+// method has been called the given number of times.
+type cancelAfterContext struct {
+	context.Context
+	calls int
 }
 
-func (mr *mockSender) Send(req *SnapshotRequest) error {
-	if req.LogEntries != nil {
-		if mr.logEntries != nil {
-			return errors.New("already have log entries")
-		}
-		mr.logEntries = req.LogEntries
+func (c *cancelAfterContext) Err() error {
+	if c.calls <= 0 {
+		return context.Canceled
 	}
+	c.calls--
 	return nil
 }
 
-func (mr *mockSender) Recv() (*SnapshotResponse, error) {
-	if mr.done {
-		return nil, io.EOF
+func TestSideloadingTruncateToCanceled(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	cleanup, cache, eng := newRocksDB(t)
+	defer cleanup()
+	defer cache.Release()
+	defer eng.Close()
+
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	ss := newTestDiskSideloadStorage(t, st, eng, dir)
+	const numFiles = 10
+	for i := uint64(1); i <= numFiles; i++ {
+		if err := ss.Put(ctx, i, 1, []byte("payload")); err != nil {
+			t.Fatal(err)
+		}
 	}
-	status := SnapshotResponse_ACCEPTED
-	if len(mr.logEntries) > 0 {
-		status = SnapshotResponse_APPLIED
-		mr.done = true
+	count := func() int {
+		t.Helper()
+		var n int
+		if err := ss.ForEach(ctx, func(_, _ uint64, _ int64) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n
 	}
-	return &SnapshotResponse{Status: status}, nil
-}
 
-func newRocksDB(t *testing.T) (func(), engine.RocksDBCache, *engine.RocksDB) {
-	dir, cleanup := testutils.TempDir(t)
-	cache := engine.NewRocksDBCache(1 << 20)
-	eng, err := engine.NewRocksDB(engine.RocksDBConfig{
-		Dir:       dir,
-		MustExist: false,
-	}, cache)
-	if err != nil {
+	// Nothing is removed if the context is canceled up front.
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, _, err := ss.TruncateTo(canceledCtx, math.MaxUint64); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if n := count(); n != numFiles {
+		t.Fatalf("expected %d files, got %d", numFiles, n)
+	}
+
+	// A context canceled midway leaves the files removed until then removed.
+	freed, _, err := ss.TruncateTo(&cancelAfterContext{Context: ctx, calls: 3}, math.MaxUint64)
+	if err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if n := count(); n == 0 || n == numFiles {
+		t.Fatalf("expected a partial truncation, but %d of %d files remain", n, numFiles)
+	} else if expFreed := int64((numFiles - n) * len("payload")); freed != expFreed {
+		t.Fatalf("expected %d bytes freed, got %d", expFreed, freed)
+	}
+
+	// Truncation can be completed later.
+	if _, _, err := ss.TruncateTo(ctx, math.MaxUint64); err != nil {
 		t.Fatal(err)
 	}
-	return cleanup, cache, eng
+	if n := count(); n != 0 {
+		t.Fatalf("expected no files, got %d", n)
+	}
+	if ex, err := exists(ss.dir); err != nil {
+		t.Fatal(err)
+	} else if ex {
+		t.Fatalf("expected %s to be removed", ss.dir)
+	}
 }
 
-// This test verifies that when a snapshot is sent, sideloaded proposals are
-// inlined.
-func TestRaftSSTableSideloadingSnapshot(t *testing.T) {
+// TestSideloadingTruncationCanceledRaftLogSize verifies that the Raft log size
+// of a replica accounts for the sideloaded files removed by a log truncation
+// which was canceled midway.
+func TestSideloadingTruncationCanceledRaftLogSize(t *testing.T) {
 	defer leaktest.AfterTest(t)()
-	defer SetMockAddSSTable()()
 
-	ctx := context.Background()
 	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
 
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
 	cleanup, cache, eng := newRocksDB(t)
-	tc.engine = eng
 	defer cleanup()
 	defer cache.Release()
 	defer eng.Close()
 
-	stopper := stop.NewStopper()
-	defer stopper.Stop(ctx)
-	tc.Start(t, stopper)
-
-	var ba roachpb.BatchRequest
-	ba.RangeID = tc.repl.RangeID
-
-	// Disable log truncation as we want to be sure that we get to create
-	// snapshots that have our sideloaded proposal in them.
-	tc.store.SetRaftLogQueueActive(false)
-
-	// Put a sideloaded proposal on the Range.
-	key, val := "don't", "care"
-	origSSTData, _ := MakeSSTable(key, val, hlc.Timestamp{}.Add(0, 1))
-	{
-
-		var addReq roachpb.AddSSTableRequest
-		addReq.Data = origSSTData
-		addReq.Key = roachpb.Key(key)
-		addReq.EndKey = addReq.Key.Next()
-		ba.Add(&addReq)
-
-		_, pErr := tc.store.Send(ctx, ba)
-		if pErr != nil {
-			t.Fatal(pErr)
+	ctx := context.Background()
+	ss, err := newDiskSideloadStorage(
+		tc.store.cfg.Settings, tc.repl.RangeID, 2, dir,
+		rate.NewLimiter(rate.Inf, math.MaxInt64), rate.NewLimiter(rate.Inf, math.MaxInt64), nil, eng,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const numFiles = 10
+	for i := uint64(1); i <= numFiles; i++ {
+		if err := ss.Put(ctx, i, 1, []byte("payload")); err != nil {
+			t.Fatal(err)
 		}
 	}
 
-	// Run a happy case snapshot. Check that it properly inlines the payload in
-	// the contained log entries.
-	inlinedEntry := func() raftpb.Entry {
-		os, err := tc.repl.GetSnapshot(ctx, "testing-will-succeed")
-		if err != nil {
+	count := func() int {
+		t.Helper()
+		var n int
+		if err := ss.ForEach(ctx, func(_, _ uint64, _ int64) error {
+			n++
+			return nil
+		}); err != nil {
 			t.Fatal(err)
 		}
-		defer os.Close()
+		return n
+	}
+	if n := count(); n != numFiles {
+		t.Fatalf("expected %d files, got %d", numFiles, n)
+	}
 
-		mockSender := &mockSender{}
-		if err := sendSnapshot(
-			ctx,
-			&tc.store.cfg.RaftConfig,
-			tc.store.cfg.Settings,
+	const logSize, logDelta = 1000, -100
+	tc.repl.raftMu.Lock()
+	defer tc.repl.raftMu.Unlock()
+	defer func(orig SideloadStorage) { tc.repl.raftMu.sideloaded = orig }(tc.repl.raftMu.sideloaded)
+	tc.repl.raftMu.sideloaded = ss
+	tc.repl.mu.Lock()
+	tc.repl.mu.raftLogSize = logSize
+	tc.repl.mu.Unlock()
+
+	tc.repl.handleReplicatedEvalResult(
+		&cancelAfterContext{Context: ctx, calls: 3},
+		storagepb.ReplicatedEvalResult{
+			State: &storagepb.ReplicaState{
+				TruncatedState: &roachpb.RaftTruncatedState{Index: numFiles, Term: 1},
+			},
+			RaftLogDelta: logDelta,
+		},
+		0, /* raftAppliedIndex */
+		0, /* leaseAppliedIndex */
+	)
+
+	remaining := count()
+	if remaining == 0 || remaining == numFiles {
+		t.Fatalf("expected a partial truncation, but %d of %d files remain", remaining, numFiles)
+	}
+	expSize := int64(logSize + logDelta - (numFiles-remaining)*len("payload"))
+	tc.repl.mu.Lock()
+	defer tc.repl.mu.Unlock()
+	if size := tc.repl.mu.raftLogSize; size != expSize {
+		t.Fatalf("expected a Raft log size of %d, got %d", expSize, size)
+	}
+}
+
+// TestSideloadingShardedLayout verifies that the disk sideloaded storage places
+// files in subdirectories according to shardedSideloadFileNamer, while files
+// written in the flat layout remain readable and are truncated and cleared
+// along with the others.
+func TestSideloadingShardedLayout(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	cleanup, cache, eng := newRocksDB(t)
+	defer cleanup()
+	defer cache.Release()
+	defer eng.Close()
+
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	sideloadChecksumSetting.Override(&st.SV, int64(sideloadChecksumSHA256))
+	ss := newTestDiskSideloadStorage(t, st, eng, dir)
+	if _, ok := ss.namer.(shardedSideloadFileNamer); !ok {
+		t.Fatalf("expected the sharded layout to be used, got %T", ss.namer)
+	}
+	namer := shardedSideloadFileNamer{}
+	for _, tc := range []struct {
+		index uint64
+		shard string
+	}{
+		{0, "i0XXX"}, {999, "i0XXX"}, {1000, "i1XXX"}, {12345, "i12XXX"},
+	} {
+		if shard := namer.shard(tc.index); shard != tc.shard {
+			t.Fatalf("index %d: expected shard %s, got %s", tc.index, tc.shard, shard)
+		} else if !namer.isShard(shard) {
+			t.Fatalf("expected %s to be recognized as a shard", shard)
+		}
+	}
+	for _, name := range []string{
+		"i12", "iXXX", "i1.t1XXX", sideloadFilename(1000, 1), sideloadChecksumFilename(1000, 1),
+		sideloadFilename(1000, 1) + sideloadPendingDeleteSuffix,
+	} {
+		if namer.isShard(name) {
+			t.Fatalf("expected %s not to be recognized as a shard", name)
+		}
+	}
+
+	payload := func(index uint64) []byte {
+		return []byte(sideloadFilename(index, 1))
+	}
+	// Write some payloads in the flat layout.
+	ss.namer = flatSideloadFileNamer{}
+	for _, index := range []uint64{1, 999, 1000} {
+		if err := ss.Put(ctx, index, 1, payload(index)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(ss.dir, sideloadFilename(index, 1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// After switching to the sharded layout, new payloads go into
+	// subdirectories, while the old ones can still be read.
+	ss.namer = namer
+	ss.invalidateFileIndex()
+	for _, index := range []uint64{2500, 3000} {
+		if err := ss.Put(ctx, index, 1, payload(index)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(ss.dir, namer.shard(index), sideloadFilename(index, 1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Overwriting a payload written in the flat layout moves it.
+	if err := ss.Put(ctx, 1000, 1, payload(1000)); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{sideloadFilename(1000, 1), sideloadChecksumFilename(1000, 1)} {
+		if ex, err := exists(filepath.Join(ss.dir, name)); err != nil {
+			t.Fatal(err)
+		} else if ex {
+			t.Fatalf("expected %s in the flat layout to be removed", name)
+		}
+	}
+
+	expKeys := []slKey{{1, 1}, {999, 1}, {1000, 1}, {2500, 1}, {3000, 1}}
+	for _, k := range expKeys {
+		if b, err := ss.Get(ctx, k.index, k.term); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(b, payload(k.index)) {
+			t.Fatalf("index %d: expected %q, got %q", k.index, payload(k.index), b)
+		}
+	}
+	if keys, err := ss.sortedKeys(ctx); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(keys, expKeys) {
+		t.Fatalf("expected %v, got %v", expKeys, keys)
+	}
+	if diff, err := ss.reconcileFileIndex(ctx); err != nil {
+		t.Fatal(err)
+	} else if diff != "" {
+		t.Fatalf("unexpected file index discrepancy: %s", diff)
+	}
+
+	// Truncation removes payloads in either layout, as well as the
+	// subdirectories it empties.
+	if _, _, err := ss.TruncateTo(ctx, 2600); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := ss.sortedKeys(ctx); err != nil {
+		t.Fatal(err)
+	} else if exp := []slKey{{3000, 1}}; !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("expected %v, got %v", exp, keys)
+	}
+	for _, name := range []string{
+		sideloadFilename(1, 1), sideloadFilename(999, 1), namer.shard(1000), namer.shard(2500),
+	} {
+		if ex, err := exists(filepath.Join(ss.dir, name)); err != nil {
+			t.Fatal(err)
+		} else if ex {
+			t.Fatalf("expected %s to be removed", name)
+		}
+	}
+	ss.invalidateFileIndex()
+	if empty, err := ss.IsEmpty(ctx); err != nil {
+		t.Fatal(err)
+	} else if empty {
+		t.Fatal("expected the payload in a subdirectory to be found")
+	}
+
+	// Clearing removes the subdirectories along with the directory.
+	if err := ss.Clear(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ex, err := exists(ss.dir); err != nil {
+		t.Fatal(err)
+	} else if ex {
+		t.Fatalf("expected %s to be removed", ss.dir)
+	}
+}
+
+// TestSideloadingCache verifies that the disk sideloaded storage serves payloads
+// from the sideloadCache once they have been read, and that the cache never
+// returns payloads which were overwritten or removed.
+func TestSideloadingCache(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	cleanup, cache, eng := newRocksDB(t)
+	defer cleanup()
+	defer cache.Release()
+	defer eng.Close()
+
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	sideloadCacheSize.Override(&st.SV, 100)
+	hits := metric.NewCounter(metric.Metadata{})
+	misses := metric.NewCounter(metric.Metadata{})
+	sc := newSideloadCache(st, hits, misses)
+	ss, err := newDiskSideloadStorage(
+		st, 1, 2, dir, rate.NewLimiter(rate.Inf, math.MaxInt64), rate.NewLimiter(rate.Inf, math.MaxInt64), sc, eng,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second storage for another range, which shares the cache.
+	other, err := newDiskSideloadStorage(
+		st, 2, 2, dir, rate.NewLimiter(rate.Inf, math.MaxInt64), rate.NewLimiter(rate.Inf, math.MaxInt64), sc, eng,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(ss SideloadStorage, index uint64, exp string, expHits, expMisses int64) {
+		t.Helper()
+		if b, err := ss.Get(ctx, index, 1); err != nil {
+			t.Fatal(err)
+		} else if string(b) != exp {
+			t.Fatalf("index %d: expected %q, got %q", index, exp, b)
+		}
+		if h, m := hits.Count(), misses.Count(); h != expHits || m != expMisses {
+			t.Fatalf("expected %d hits and %d misses, got %d and %d", expHits, expMisses, h, m)
+		}
+	}
+	put := func(ss SideloadStorage, index uint64, contents string) {
+		t.Helper()
+		if err := ss.Put(ctx, index, 1, []byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put(ss, 1, "foo")
+	put(other, 1, "other")
+	get(ss, 1, "foo", 0, 1)
+	get(ss, 1, "foo", 1, 1)
+	get(other, 1, "other", 1, 2)
+	get(other, 1, "other", 2, 2)
+
+	// Overwriting a payload invalidates it.
+	put(ss, 1, "bar")
+	get(ss, 1, "bar", 2, 3)
+	get(ss, 1, "bar", 3, 3)
+
+	// So does purging it.
+	if _, err := ss.Purge(ctx, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Get(ctx, 1, 1); err != errSideloadedFileNotFound {
+		t.Fatalf("expected %v, got %v", errSideloadedFileNotFound, err)
+	}
+
+	// Truncation invalidates the payloads below the truncation index, even
+	// if they were removed behind the storage's back.
+	for index := uint64(2); index <= 4; index++ {
+		put(ss, index, fmt.Sprintf("v%d", index))
+		get(ss, index, fmt.Sprintf("v%d", index), 3, 4+int64(index)-1)
+	}
+	if err := os.Remove(ss.filename(ctx, 2, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ss.TruncateTo(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+	for index := uint64(2); index <= 3; index++ {
+		if _, err := ss.Get(ctx, index, 1); err != errSideloadedFileNotFound {
+			t.Fatalf("index %d: expected %v, got %v", index, errSideloadedFileNotFound, err)
+		}
+	}
+	get(ss, 4, "v4", 4, 9)
+
+	// Payloads which don't fit into the cache aren't cached.
+	large := strings.Repeat("x", 101)
+	put(ss, 5, large)
+	get(ss, 5, large, 4, 10)
+	get(ss, 5, large, 4, 11)
+	// Adding payloads evicts the least recently used ones to stay within the
+	// size of the cache.
+	medium := strings.Repeat("y", 95)
+	put(ss, 6, medium)
+	get(ss, 6, medium, 4, 12) // evicts r2's payload
+	get(ss, 4, "v4", 5, 12)
+	get(other, 1, "other", 5, 13) // evicts the payload at index 6
+	get(ss, 6, medium, 5, 14)     // evicts the payload at index 4
+
+	// Clearing the storage invalidates all of its payloads, but not those of
+	// other ranges.
+	if err := ss.Clear(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Get(ctx, 6, 1); err != errSideloadedFileNotFound {
+		t.Fatalf("expected %v, got %v", errSideloadedFileNotFound, err)
+	}
+	get(other, 1, "other", 6, 15)
+
+	// Callers can modify the payloads they get without affecting the cache.
+	if b, err := other.Get(ctx, 1, 1); err != nil {
+		t.Fatal(err)
+	} else {
+		copy(b, "xxxxx")
+	}
+	get(other, 1, "other", 8, 15)
+
+	// Disabling the cache drops the cached payloads.
+	sideloadCacheSize.Override(&st.SV, 0)
+	get(other, 1, "other", 8, 15)
+	sc.mu.Lock()
+	n, size := sc.mu.cache.Len(), sc.mu.bytes
+	sc.mu.Unlock()
+	if n != 0 || size != 0 {
+		t.Fatalf("expected an empty cache, found %d payloads of %d bytes", n, size)
+	}
+}
+
+func TestSideloadingSideloadedStoragePutIfAbsent(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	testSideloadStorageImpls(t, func(t *testing.T, ss SideloadStorage) {
+		ctx := context.Background()
+		foo, bar := []byte("foo"), []byte("bar")
+
+		// Put overwrites the occupied slot by default.
+		if err := ss.Put(ctx, 1, 1, foo); err != nil {
+			t.Fatal(err)
+		}
+		if err := ss.Put(ctx, 1, 1, bar); err != nil {
+			t.Fatal(err)
+		}
+		if c, err := ss.Get(ctx, 1, 1); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(c, bar) {
+			t.Fatalf("got %q, wanted %q", c, bar)
+		}
+
+		// PutIfAbsent into an empty slot succeeds.
+		if ok, err := ss.PutIfAbsent(ctx, 2, 1, foo); err != nil || !ok {
+			t.Fatalf("expected successful write, got (%t, %v)", ok, err)
+		}
+		if c, err := ss.Get(ctx, 2, 1); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(c, foo) {
+			t.Fatalf("got %q, wanted %q", c, foo)
+		}
+
+		// Writing the same payload again is a noop.
+		if ok, err := ss.PutIfAbsent(ctx, 2, 1, foo); err != nil || ok {
+			t.Fatalf("expected noop, got (%t, %v)", ok, err)
+		}
+
+		// Writing a different payload fails and leaves the original in place.
+		if ok, err := ss.PutIfAbsent(ctx, 2, 1, bar); err != errSideloadExists || ok {
+			t.Fatalf("expected %v, got (%t, %v)", errSideloadExists, ok, err)
+		}
+		if c, err := ss.Get(ctx, 2, 1); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(c, foo) {
+			t.Fatalf("got %q, wanted %q", c, foo)
+		}
+
+		// The same index at a different term is a different slot.
+		if ok, err := ss.PutIfAbsent(ctx, 2, 2, bar); err != nil || !ok {
+			t.Fatalf("expected successful write, got (%t, %v)", ok, err)
+		}
+	})
+}
+
+func TestSideloadingSideloadedStoragePutMany(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	testSideloadStorageImpls(t, func(t *testing.T, ss SideloadStorage) {
+		ctx := context.Background()
+		if err := ss.Put(ctx, 5, 1, []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+		var entries []storagebase.SideloadEntry
+		for _, k := range []slKey{{5, 1}, {6, 1}, {7, 2}} {
+			entries = append(entries, storagebase.SideloadEntry{
+				Index: k.index, Term: k.term, Contents: []byte(sideloadFilename(k.index, k.term)),
+			})
+		}
+		if err := ss.PutMany(ctx, entries); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if c, err := ss.Get(ctx, e.Index, e.Term); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(c, e.Contents) {
+				t.Fatalf("got %q, wanted %q", c, e.Contents)
+			}
+		}
+		if used, err := ss.BytesUsed(ctx); err != nil {
+			t.Fatal(err)
+		} else if exp := int64(3 * len("i5.t1")); used != exp {
+			t.Fatalf("expected %d bytes used, got %d", exp, used)
+		}
+
+		disk, ok := ss.(*diskSideloadStorage)
+		if !ok {
+			return
+		}
+		// A batch which fails partway through leaves none of the files it
+		// created behind, but keeps those which existed before.
+		sideloadMaxFilesPerRange.Override(&disk.st.SV, 4)
+		if err := ss.PutMany(ctx, []storagebase.SideloadEntry{
+			{Index: 7, Term: 2, Contents: []byte("i7.t2")},
+			{Index: 8, Term: 2, Contents: []byte("i8.t2")},
+			{Index: 9, Term: 2, Contents: []byte("i9.t2")},
+		}); !testutils.IsError(err, "storage holds the maximum of 4 files") {
+			t.Fatalf("expected error due to the maximum number of files, got %v", err)
+		}
+		var keys []slKey
+		if err := ss.ForEach(ctx, func(index, term uint64, _ int64) error {
+			keys = append(keys, slKey{index: index, term: term})
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if exp := []slKey{{5, 1}, {6, 1}, {7, 2}}; !reflect.DeepEqual(keys, exp) {
+			t.Fatalf("expected %v, got %v", exp, keys)
+		}
+		if c, err := ss.Get(ctx, 7, 2); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(c, []byte("i7.t2")) {
+			t.Fatalf("got %q, wanted %q", c, "i7.t2")
+		}
+	})
+}
+
+func TestSideloadingSideloadedStoragePutMonotonic(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	testSideloadStorageImpls(t, func(t *testing.T, ss SideloadStorage) {
+		ctx := context.Background()
+
+		// Increasing terms at the same index are accepted.
+		for term := uint64(1); term <= 3; term++ {
+			if err := ss.PutMonotonic(ctx, 5, term, []byte(fmt.Sprintf("t%d", term))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// So is rewriting at the highest term.
+		if err := ss.PutMonotonic(ctx, 5, 3, []byte("t3")); err != nil {
+			t.Fatal(err)
+		}
+		// Other indexes are unaffected by the terms at index 5.
+		if err := ss.PutMonotonic(ctx, 50, 1, []byte("other")); err != nil {
+			t.Fatal(err)
+		}
+
+		// A lower term is rejected with a typed error and not written.
+		err := ss.PutMonotonic(ctx, 5, 2, []byte("regressed"))
+		if rErr, ok := err.(*sideloadTermRegressionError); !ok {
+			t.Fatalf("expected term regression error, got %v", err)
+		} else if rErr.existingTerm != 3 {
+			t.Fatalf("expected existing term 3, got %d", rErr.existingTerm)
+		}
+		if c, err := ss.Get(ctx, 5, 2); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(c, []byte("t2")) {
+			t.Fatalf("got %q, wanted %q", c, "t2")
+		}
+
+		// An explicit Put still overwrites.
+		if err := ss.Put(ctx, 5, 2, []byte("regressed")); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestSideloadingSideloadedStorageArchive(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	testSideloadStorageImpls(t, func(t *testing.T, ss SideloadStorage) {
+		ctx := context.Background()
+		payloads := map[slKey][]byte{}
+		for _, k := range []slKey{{9, 2}, {3, 1}, {10, 3}, {3, 2}, {5, 1}} {
+			payloads[k] = []byte(fmt.Sprintf("content-%d-%d", k.index, k.term))
+			if err := ss.Put(ctx, k.index, k.term, payloads[k]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := writeSideloadArchive(ctx, &buf, ss); err != nil {
+			t.Fatal(err)
+		}
+
+		// Archiving again yields the exact same bytes.
+		var again bytes.Buffer
+		if err := writeSideloadArchive(ctx, &again, ss); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), again.Bytes()) {
+			t.Fatal("archive is not deterministic")
+		}
+
+		// Restore into a fresh storage and check that it ends up with the same
+		// payloads and archives identically.
+		restored := mustNewInMemSideloadStorage(1, 2, ".", nil)
+		if err := restoreSideloadArchive(ctx, bytes.NewReader(buf.Bytes()), restored); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(restored.(*inMemSideloadStorage).m); n != len(payloads) {
+			t.Fatalf("expected %d restored payloads, got %d", len(payloads), n)
+		}
+		for k, exp := range payloads {
+			if c, err := restored.Get(ctx, k.index, k.term); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(c, exp) {
+				t.Fatalf("%v: got %q, wanted %q", k, c, exp)
+			}
+		}
+		var restoredBuf bytes.Buffer
+		if err := writeSideloadArchive(ctx, &restoredBuf, restored); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), restoredBuf.Bytes()) {
+			t.Fatal("archive of restored storage differs from original archive")
+		}
+
+		// Finally, round-trip through the original storage.
+		if err := ss.Clear(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := restoreSideloadArchive(ctx, bytes.NewReader(buf.Bytes()), ss); err != nil {
+			t.Fatal(err)
+		}
+		for k, exp := range payloads {
+			if c, err := ss.Get(ctx, k.index, k.term); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(c, exp) {
+				t.Fatalf("%v: got %q, wanted %q", k, c, exp)
+			}
+		}
+	})
+}
+
+func TestSideloadingSideloadedStorageForEach(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	testSideloadStorageImpls(t, func(t *testing.T, ss SideloadStorage) {
+		ctx := context.Background()
+		// Index 10 sorts before index 9 lexicographically. The payloads are
+		// named after their files, which gives them different sizes.
+		for _, k := range []slKey{{9, 2}, {10, 3}, {3, 2}, {100, 1}, {3, 1}, {10, 1}} {
+			if err := ss.Put(ctx, k.index, k.term, []byte(sideloadFilename(k.index, k.term))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var visited []slKey
+		if err := ss.ForEach(ctx, func(index, term uint64, size int64) error {
+			if exp := int64(len(sideloadFilename(index, term))); size != exp {
+				t.Errorf("%d.%d: expected size %d, got %d", index, term, exp, size)
+			}
+			visited = append(visited, slKey{index: index, term: term})
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		exp := []slKey{{3, 1}, {3, 2}, {9, 2}, {10, 1}, {10, 3}, {100, 1}}
+		if !reflect.DeepEqual(visited, exp) {
+			t.Fatalf("expected %v, got %v", exp, visited)
+		}
+
+		// Errors returned from visit stop the iteration.
+		visited = nil
+		errBoom := errors.New("boom")
+		if err := ss.ForEach(ctx, func(index, term uint64, _ int64) error {
+			visited = append(visited, slKey{index: index, term: term})
+			if len(visited) == 2 {
+				return errBoom
+			}
+			return nil
+		}); err != errBoom {
+			t.Fatalf("expected %v, got %v", errBoom, err)
+		}
+		if !reflect.DeepEqual(visited, exp[:2]) {
+			t.Fatalf("expected %v, got %v", exp[:2], visited)
+		}
+	})
+}
+
+func TestSideloadingSideloadedStoragePurgeStaleTerms(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	testSideloadStorageImpls(t, func(t *testing.T, ss SideloadStorage) {
+		ctx := context.Background()
+		for _, k := range []slKey{{5, 1}, {5, 2}, {6, 2}, {7, 1}, {7, 3}, {8, 1}, {8, 2}} {
+			if err := ss.Put(ctx, k.index, k.term, []byte(sideloadFilename(k.index, k.term))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Index 8 has no known authoritative term, so all of its files are kept.
+		authoritative := map[uint64]uint64{5: 2, 6: 2, 7: 3}
+		freed, err := purgeStaleSideloadedTerms(ctx, ss, func(index uint64) uint64 {
+			return authoritative[index]
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := int64(len("i5.t1") + len("i7.t1")); freed != exp {
+			t.Fatalf("expected %d bytes to be freed, got %d", exp, freed)
+		}
+
+		var remaining []slKey
+		if err := ss.ForEach(ctx, func(index, term uint64, _ int64) error {
+			remaining = append(remaining, slKey{index: index, term: term})
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		exp := []slKey{{5, 2}, {6, 2}, {7, 3}, {8, 1}, {8, 2}}
+		if !reflect.DeepEqual(remaining, exp) {
+			t.Fatalf("expected remaining files %v, got %v", exp, remaining)
+		}
+	})
+}
+
+func TestSideloadingSideloadedStorageIsEmpty(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	testSideloadStorageImpls(t, func(t *testing.T, ss SideloadStorage) {
+		ctx := context.Background()
+		assertEmpty := func(exp bool) {
+			t.Helper()
+			if empty, err := ss.IsEmpty(ctx); err != nil {
+				t.Fatal(err)
+			} else if empty != exp {
+				t.Fatalf("expected empty=%t, got %t", exp, empty)
+			}
+			// The disk storage answers from its index of files if loaded, and
+			// reads the directory otherwise. Check the latter, too.
+			if disk, ok := ss.(*diskSideloadStorage); ok {
+				disk.invalidateFileIndex()
+				if empty, err := ss.IsEmpty(ctx); err != nil {
+					t.Fatal(err)
+				} else if empty != exp {
+					t.Fatalf("expected empty=%t after invalidating the file index, got %t", exp, empty)
+				}
+			}
+		}
+
+		assertEmpty(true)
+		for _, index := range []uint64{5, 6} {
+			if err := ss.Put(ctx, index, 1, []byte("foo")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		assertEmpty(false)
+
+		if _, _, err := ss.TruncateTo(ctx, 6); err != nil {
+			t.Fatal(err)
+		}
+		assertEmpty(false)
+		if _, _, err := ss.TruncateTo(ctx, 7); err != nil {
+			t.Fatal(err)
+		}
+		assertEmpty(true)
+
+		if err := ss.Put(ctx, 7, 1, []byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		assertEmpty(false)
+		if err := ss.Clear(ctx); err != nil {
+			t.Fatal(err)
+		}
+		assertEmpty(true)
+	})
+}
+
+// TestSideloadingGetRacingClear races Get against a Clear of the same
+// directory, and verifies that Get either returns the payload or reports it as
+// removed concurrently, but never as absent, since it knew about the file.
+func TestSideloadingGetRacingClear(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+	cleanup, cache, eng := newRocksDB(t)
+	defer cleanup()
+	defer cache.Release()
+	defer eng.Close()
+
+	st := cluster.MakeTestingClusterSettings()
+	newStorage := func() *diskSideloadStorage {
+		return newTestDiskSideloadStorage(t, st, eng, dir)
+	}
+	// The storages aren't thread safe, so the Clear and the Get run on
+	// different storages backed by the same directory.
+	clearer := newStorage()
+	payload := []byte("foo")
+
+	const index, term = 5, 1
+	for i := 0; i < 20; i++ {
+		if err := clearer.Put(ctx, index, term, payload); err != nil {
+			t.Fatal(err)
+		}
+		getter := newStorage()
+		if _, err := getter.fileIndex(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- clearer.Clear(ctx)
+		}()
+		b, err := getter.Get(ctx, index, term)
+		if err == nil {
+			if !bytes.Equal(b, payload) {
+				t.Fatalf("%d: expected payload %q, got %q", i, payload, b)
+			}
+		} else if _, ok := err.(*errSideloadRemovedConcurrently); !ok {
+			t.Fatalf("%d: expected payload or concurrent removal, got %v", i, err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Once the Clear has finished, the file is reported as removed
+	// concurrently. Its cause is the absence of the file.
+	if err := clearer.Put(ctx, index, term, payload); err != nil {
+		t.Fatal(err)
+	}
+	getter := newStorage()
+	if _, err := getter.fileIndex(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := clearer.Clear(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_, err := getter.Get(ctx, index, term)
+	if _, ok := err.(*errSideloadRemovedConcurrently); !ok {
+		t.Fatalf("expected concurrent removal, got %v", err)
+	}
+	if errors.Cause(err) != errSideloadedFileNotFound {
+		t.Fatalf("expected cause %v, got %v", errSideloadedFileNotFound, errors.Cause(err))
+	}
+	// The index of the getter was discarded, and the file is now known to be
+	// absent, as is a file which never existed.
+	for _, k := range []slKey{{index: index, term: term}, {index: index + 1, term: term}} {
+		if _, err := getter.Get(ctx, k.index, k.term); err != errSideloadedFileNotFound {
+			t.Fatalf("%+v: expected %v, got %v", k, errSideloadedFileNotFound, err)
+		}
+	}
+}
+
+func TestSideloadingSideloadedStorageBytesUsed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	testSideloadStorageImpls(t, func(t *testing.T, ss SideloadStorage) {
+		ctx := context.Background()
+		assertBytesUsed := func(exp int64) {
+			t.Helper()
+			if used, err := ss.BytesUsed(ctx); err != nil {
+				t.Fatal(err)
+			} else if used != exp {
+				t.Fatalf("expected %d bytes used, got %d", exp, used)
+			}
+		}
+
+		// The directory of the disk storage doesn't exist yet.
+		assertBytesUsed(0)
+		if err := ss.Put(ctx, 5, 1, []byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		if err := ss.Put(ctx, 6, 1, []byte("barbaz")); err != nil {
+			t.Fatal(err)
+		}
+		assertBytesUsed(9)
+		// Overwriting a payload replaces its size.
+		if err := ss.Put(ctx, 6, 1, []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		assertBytesUsed(6)
+
+		if _, _, err := ss.TruncateTo(ctx, 6); err != nil {
+			t.Fatal(err)
+		}
+		assertBytesUsed(3)
+		if err := ss.Clear(ctx); err != nil {
+			t.Fatal(err)
+		}
+		assertBytesUsed(0)
+	})
+}
+
+func TestSideloadingSideloadedStorageStat(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	testSideloadStorageImpls(t, func(t *testing.T, ss SideloadStorage) {
+		ctx := context.Background()
+		if _, err := ss.Stat(ctx, 5, 1); err != errSideloadedFileNotFound {
+			t.Fatalf("expected %v, got %v", errSideloadedFileNotFound, err)
+		}
+		if err := ss.Put(ctx, 5, 1, []byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		info, err := ss.Stat(ctx, 5, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != 3 {
+			t.Fatalf("expected a size of 3, got %d", info.Size)
+		}
+		// Only the disk storage tracks modification times.
+		if _, isDisk := ss.(*diskSideloadStorage); isDisk == info.ModTime.IsZero() {
+			t.Fatalf("unexpected modification time %s", info.ModTime)
+		}
+		// A payload at another term isn't found.
+		if _, err := ss.Stat(ctx, 5, 2); err != errSideloadedFileNotFound {
+			t.Fatalf("expected %v, got %v", errSideloadedFileNotFound, err)
+		}
+	})
+}
+
+// TestSideloadingCloudStorage verifies that the cloud sideloaded storage
+// keeps its payloads and its manifest in the object store, and that
+// newSideloadStorage only starts using it when an object store is configured
+// and available, but then keeps using it.
+func TestSideloadingCloudStorage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+	cleanup, cache, eng := newRocksDB(t)
+	defer cleanup()
+	defer cache.Release()
+	defer eng.Close()
+
+	st := cluster.MakeTestingClusterSettings()
+	store := newMemSideloadBlobStore()
+	ss := newCloudSideloadStorage(st, 1, 1, 2, dir, store)
+	for _, index := range []uint64{5, 6, 7} {
+		if err := ss.Put(ctx, index, 1, []byte(sideloadFilename(index, 1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Appending payloads writes the manifest.
+	exp := []string{
+		"sideloading/s1/r1/MANIFEST",
+		"sideloading/s1/r1/i5.t1", "sideloading/s1/r1/i6.t1", "sideloading/s1/r1/i7.t1",
+	}
+	if names := store.names(); !reflect.DeepEqual(names, exp) {
+		t.Fatalf("expected objects %v, got %v", exp, names)
+	}
+
+	// A fresh storage finds all payloads without reading them, while the
+	// storages of another range, or of the same range on another store, don't
+	// see them.
+	fresh := newCloudSideloadStorage(st, 1, 1, 3, dir, store)
+	if bytesUsed, err := fresh.BytesUsed(ctx); err != nil {
+		t.Fatal(err)
+	} else if bytesUsed != 15 {
+		t.Fatalf("expected 15 bytes used, got %d", bytesUsed)
+	}
+	if b, err := fresh.Get(ctx, 6, 1); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(b, []byte("i6.t1")) {
+		t.Fatalf("expected %q, got %q", "i6.t1", b)
+	}
+	// An object which the manifest doesn't reference, such as one left behind
+	// by a crash before the manifest was written, isn't a payload.
+	if err := store.WriteFile(ctx, "sideloading/s1/r1/i8.t1", []byte("i8.t1")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := newCloudSideloadStorage(st, 1, 1, 3, dir, store).HasEntry(ctx, 8, 1); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("expected the unreferenced object not to be a payload")
+	}
+	if err := store.Delete(ctx, "sideloading/s1/r1/i8.t1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, other := range []*cloudSideloadStorage{
+		newCloudSideloadStorage(st, 1, 2, 2, dir, store),
+		newCloudSideloadStorage(st, 2, 1, 2, dir, store),
+	} {
+		if ok, err := other.HasEntry(ctx, 6, 1); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			t.Fatalf("expected storage with prefix %s not to have the payload", other.prefix)
+		}
+	}
+
+	// Truncation writes the manifest, deletes the objects and returns the
+	// freed bytes.
+	if freed, retained, err := ss.TruncateTo(ctx, 7); err != nil {
+		t.Fatal(err)
+	} else if freed != 10 || retained != 5 {
+		t.Fatalf("expected to free 10 and retain 5 bytes, got %d and %d", freed, retained)
+	}
+	exp = []string{"sideloading/s1/r1/MANIFEST", "sideloading/s1/r1/i7.t1"}
+	if names := store.names(); !reflect.DeepEqual(names, exp) {
+		t.Fatalf("expected objects %v, got %v", exp, names)
+	}
+	if _, err := ss.Get(ctx, 5, 1); err != errSideloadedFileNotFound {
+		t.Fatalf("expected %v, got %v", errSideloadedFileNotFound, err)
+	}
+	// A fresh storage picks up the payloads from the manifest.
+	if empty, err := newCloudSideloadStorage(st, 1, 1, 3, dir, store).IsEmpty(ctx); err != nil {
+		t.Fatal(err)
+	} else if empty {
+		t.Fatal("expected storage to list the payload in the manifest")
+	}
+
+	// An object which vanishes behind the storage's back is reported as
+	// removed concurrently, whose cause is the absence of the payload.
+	if err := store.Delete(ctx, "sideloading/s1/r1/i7.t1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Get(ctx, 7, 1); errors.Cause(err) != errSideloadedFileNotFound {
+		t.Fatalf("expected cause %v, got %v", errSideloadedFileNotFound, err)
+	}
+
+	// newSideloadStorage uses the local disk unless an external URI is set and
+	// an object store can be created for it.
+	tryNewStorage := func(rangeID roachpb.RangeID) (SideloadStorage, error) {
+		return newSideloadStorage(
+			ctx, st, 1 /* storeID */, rangeID, 2, dir,
+			rate.NewLimiter(rate.Inf, math.MaxInt64), rate.NewLimiter(rate.Inf, math.MaxInt64), nil, nil, eng,
+		)
+	}
+	newStorage := func(rangeID roachpb.RangeID) SideloadStorage {
+		t.Helper()
+		ss, err := tryNewStorage(rangeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ss
+	}
+	defer RegisterSideloadBlobStoreFactory(nil)
+	RegisterSideloadBlobStoreFactory(func(
+		_ context.Context, uri string, _ *cluster.Settings,
+	) (SideloadBlobStore, error) {
+		if uri != "mem://" {
+			return nil, errors.Errorf("unsupported URI %q", uri)
+		}
+		return store, nil
+	})
+	if _, ok := newStorage(10).(*diskSideloadStorage); !ok {
+		t.Fatal("expected disk storage without an external URI")
+	}
+	u := st.MakeUpdater()
+	if err := u.Set("kv.raft_log.sideloading.external_uri", "nodelocal://", "s"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := newStorage(10).(*diskSideloadStorage); !ok {
+		t.Fatal("expected disk storage when the object store can't be created")
+	}
+	if err := u.Set("kv.raft_log.sideloading.external_uri", "mem://", "s"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := newStorage(10).(*cloudSideloadStorage); !ok {
+		t.Fatal("expected cloud storage")
+	}
+	// A replica with payloads on the local disk keeps using them.
+	disk, err := newDiskSideloadStorage(
+		st, 11, 2, dir, rate.NewLimiter(rate.Inf, math.MaxInt64), rate.NewLimiter(rate.Inf, math.MaxInt64), nil, eng,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.Put(ctx, 1, 1, []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := newStorage(11).(*diskSideloadStorage); !ok {
+		t.Fatal("expected disk storage for a replica with local payloads")
+	}
+
+	// A replica which uses the object store keeps using it after the setting
+	// is cleared, and fails to create its storage if the object store isn't
+	// available, instead of falling back to the local disk.
+	if err := u.Set("kv.raft_log.sideloading.external_uri", "", "s"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := newStorage(10).(*cloudSideloadStorage); !ok {
+		t.Fatal("expected cloud storage after clearing the external URI")
+	}
+	if err := u.Set("kv.raft_log.sideloading.external_uri", "mem://", "s"); err != nil {
+		t.Fatal(err)
+	}
+	RegisterSideloadBlobStoreFactory(nil)
+	if _, err := tryNewStorage(10); !testutils.IsError(err, "but none is available") {
+		t.Fatalf("expected error, got %v", err)
+	}
+	if _, ok := newStorage(12).(*diskSideloadStorage); !ok {
+		t.Fatal("expected disk storage without a registered object store")
+	}
+	// Destroying the replica removes the record, after which a new replica
+	// picks its storage anew.
+	if err := removeSideloadExternalMarker(eng, dir, 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := newStorage(10).(*diskSideloadStorage); !ok {
+		t.Fatal("expected disk storage after removing the record of the object store")
+	}
+}
+
+// blockingSideloadBlobStore is a SideloadBlobStore whose writes block until
+// their context is done.
+type blockingSideloadBlobStore struct {
+	*memSideloadBlobStore
+}
+
+func (s blockingSideloadBlobStore) WriteFile(ctx context.Context, _ string, _ []byte) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// TestSideloadingCloudStorageTimeout verifies that writes to an unresponsive
+// object store time out, are counted, and return an error which keeps the
+// payloads inline.
+func TestSideloadingCloudStorageTimeout(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	st := cluster.MakeTestingClusterSettings()
+	sideloadExternalTimeout.Override(&st.SV, time.Millisecond)
+	ss := newCloudSideloadStorage(st, 1, 1, 2, dir, blockingSideloadBlobStore{newMemSideloadBlobStore()})
+	m := newStoreMetrics(time.Minute)
+	ss.metrics = newSideloadMetrics(m)
+
+	checkErr := func(err error) {
+		t.Helper()
+		if _, ok := errors.Cause(err).(*sideloadExternalStoreError); !ok {
+			t.Fatalf("expected external store error, got %v", err)
+		}
+		if !keepSideloadedPayloadsInline(err) {
+			t.Fatalf("expected payloads to be kept inline on %v", err)
+		}
+	}
+	checkErr(ss.Put(ctx, 5, 1, []byte("foo")))
+	checkErr(ss.PutMany(ctx, []storagebase.SideloadEntry{{Index: 6, Term: 1, Contents: []byte("bar")}}))
+	if n := m.SideloadExternalErrors.Count(); n != 2 {
+		t.Fatalf("expected 2 failed operations, got %d", n)
+	}
+	if ok, err := ss.HasEntry(ctx, 5, 1); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("expected the failed payload not to be stored")
+	}
+}
+
+// failingSideloadBlobStore is a SideloadBlobStore which fails to read the
+// objects named in failRead and to delete those named in failDelete.
+type failingSideloadBlobStore struct {
+	*memSideloadBlobStore
+	failRead, failDelete map[string]bool
+}
+
+var errFailingSideloadBlobStore = errors.New("object store unavailable")
+
+func (s *failingSideloadBlobStore) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	if s.failRead[name] {
+		return nil, errFailingSideloadBlobStore
+	}
+	return s.memSideloadBlobStore.ReadFile(ctx, name)
+}
+
+func (s *failingSideloadBlobStore) Delete(ctx context.Context, name string) error {
+	if s.failDelete[name] {
+		return errFailingSideloadBlobStore
+	}
+	return s.memSideloadBlobStore.Delete(ctx, name)
+}
+
+// TestSideloadingCloudStorageManifestReadFailure verifies that appends to a
+// cloud sideloaded storage whose manifest can't be read return an error which
+// keeps the payloads inline, rather than one which fails the append.
+func TestSideloadingCloudStorageManifestReadFailure(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	st := cluster.MakeTestingClusterSettings()
+	store := &failingSideloadBlobStore{
+		memSideloadBlobStore: newMemSideloadBlobStore(),
+		failRead:             map[string]bool{"sideloading/s1/r1/MANIFEST": true},
+	}
+	ss := newCloudSideloadStorage(st, 1, 1, 2, dir, store)
+
+	checkErr := func(err error) {
+		t.Helper()
+		if _, ok := errors.Cause(err).(*sideloadExternalStoreError); !ok {
+			t.Fatalf("expected external store error, got %v", err)
+		}
+		if !keepSideloadedPayloadsInline(err) {
+			t.Fatalf("expected payloads to be kept inline on %v", err)
+		}
+	}
+	checkErr(ss.Put(ctx, 5, 1, []byte("foo")))
+	checkErr(ss.PutMany(ctx, []storagebase.SideloadEntry{{Index: 6, Term: 1, Contents: []byte("bar")}}))
+	checkErr(ss.PutMonotonic(ctx, 7, 1, []byte("baz")))
+	if names := store.names(); len(names) != 0 {
+		t.Fatalf("expected no objects, got %v", names)
+	}
+
+	// Once the manifest can be read again, payloads are stored.
+	store.failRead = nil
+	if err := ss.Put(ctx, 5, 1, []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := ss.HasEntry(ctx, 5, 1); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected the payload to be stored")
+	}
+}
+
+// TestSideloadingCloudStorageTruncateDeleteFailure verifies that a truncation
+// which fails to delete an object returns the bytes it freed, and keeps the
+// payloads it didn't delete in the manifest, so that a later truncation
+// deletes them.
+func TestSideloadingCloudStorageTruncateDeleteFailure(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	st := cluster.MakeTestingClusterSettings()
+	store := &failingSideloadBlobStore{
+		memSideloadBlobStore: newMemSideloadBlobStore(),
+		failDelete:           map[string]bool{"sideloading/s1/r1/i6.t1": true},
+	}
+	ss := newCloudSideloadStorage(st, 1, 1, 2, dir, store)
+	for _, index := range []uint64{5, 6, 7} {
+		if err := ss.Put(ctx, index, 1, []byte(sideloadFilename(index, 1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if freed, retained, err := ss.TruncateTo(ctx, 8); errors.Cause(err) != errFailingSideloadBlobStore {
+		t.Fatalf("expected %v, got %v", errFailingSideloadBlobStore, err)
+	} else if freed != 5 || retained != 10 {
+		t.Fatalf("expected to free 5 and retain 10 bytes, got %d and %d", freed, retained)
+	}
+	// A fresh storage still lists the payloads which weren't deleted.
+	fresh := newCloudSideloadStorage(st, 1, 1, 2, dir, store)
+	for index, exp := range map[uint64]bool{5: false, 6: true, 7: true} {
+		if ok, err := fresh.HasEntry(ctx, index, 1); err != nil {
+			t.Fatal(err)
+		} else if ok != exp {
+			t.Fatalf("expected payload at index %d to be listed: %t, got %t", index, exp, ok)
+		}
+	}
+
+	store.failDelete = nil
+	if freed, retained, err := fresh.TruncateTo(ctx, 8); err != nil {
+		t.Fatal(err)
+	} else if freed != 10 || retained != 0 {
+		t.Fatalf("expected to free 10 and retain 0 bytes, got %d and %d", freed, retained)
+	}
+	if exp, names := []string{"sideloading/s1/r1/MANIFEST"}, store.names(); !reflect.DeepEqual(names, exp) {
+		t.Fatalf("expected objects %v, got %v", exp, names)
+	}
+}
+
+func TestSideloadedStorageReplicaIDMigration(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	preV := cluster.VersionByKey(cluster.VersionSideloadedStorageNoReplicaID - 1)
+	stPre := cluster.MakeTestingClusterSettingsWithVersion(preV, preV)
+
+	postV := cluster.VersionByKey(cluster.VersionSideloadedStorageNoReplicaID)
+	stPost := cluster.MakeTestingClusterSettingsWithVersion(postV, postV)
+
+	const rangeID = roachpb.RangeID(1)
+
+	cleanup, cache, eng := newRocksDB(t)
+	defer cleanup()
+	defer cache.Release()
+	defer eng.Close()
+	limiter := rate.NewLimiter(rate.Inf, 1<<9)
+
+	var ss SideloadStorage
+	create := func(st *cluster.Settings, replicaID roachpb.ReplicaID) *diskSideloadStorage {
+		t.Helper()
+		if err := moveSideloadedData(ss, dir, rangeID, replicaID); err != nil {
+			t.Fatal(err)
+		}
+		ss, err := newDiskSideloadStorage(st, rangeID, replicaID, dir, limiter, limiter, nil, eng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ss
+	}
+
+	ss = create(stPre, 120)
+	foo := []byte("foo")
+	if err := ss.Put(ctx, 1, 10, foo); err != nil {
+		t.Fatal(err)
+	}
+
+	// Jog moveSideloadedData (via create) prior to the migration.
+	for _, replicaID := range []roachpb.ReplicaID{123, 124} {
+		ss = create(stPre, replicaID)
+		v, err := ss.Get(ctx, 1, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, foo, v)
+	}
+
+	// Migrate.
+	for _, replicaID := range []roachpb.ReplicaID{125, 126} {
+		ss = create(stPost, replicaID)
+		v, err := ss.Get(ctx, 1, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, foo, v)
+	}
+
+	// Check that we really did migrate.
+	prevDir := ss.Dir()
+	ss = create(stPost, 129)
+	assert.Equal(t, prevDir, ss.Dir())
+}
+
+func TestRaftSSTableSideloadingInline(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	v1, v2 := raftVersionStandard, raftVersionSideloaded
+	rangeID := roachpb.RangeID(1)
+
+	type testCase struct {
+		// Entry passed into maybeInlineSideloadedRaftCommand and the entry
+		// after having (perhaps) been modified.
+		thin, fat raftpb.Entry
+		// Populate the raft entry cache and sideload storage before running the test.
+		setup func(*raftentry.Cache, SideloadStorage)
+		// If nonempty, the error expected from maybeInlineSideloadedRaftCommand.
+		expErr string
+		// If nonempty, a regex that the recorded trace span must match.
+		expTrace string
+		// If set, the payload isn't verified against the CRC32 of the command.
+		disableCRC bool
+	}
+
+	sstFat := storagepb.ReplicatedEvalResult_AddSSTable{
+		Data:  []byte("foo"),
+		CRC32: 0, // not checked
+	}
+	sstThin := storagepb.ReplicatedEvalResult_AddSSTable{
+		CRC32: 0, // not checked
+	}
+	sstFatCRC := storagepb.ReplicatedEvalResult_AddSSTable{
+		Data:  []byte("foo"),
+		CRC32: util.CRC32([]byte("foo")),
+	}
+	sstThinCRC := storagepb.ReplicatedEvalResult_AddSSTable{
+		CRC32: sstFatCRC.CRC32,
+	}
+	// The CRC32 of a payload other than the stored one.
+	sstFatBadCRC := storagepb.ReplicatedEvalResult_AddSSTable{
+		Data:  []byte("foo"),
+		CRC32: util.CRC32([]byte("bar")),
+	}
+	sstThinBadCRC := storagepb.ReplicatedEvalResult_AddSSTable{
+		CRC32: sstFatBadCRC.CRC32,
+	}
+
+	putOnDisk := func(ec *raftentry.Cache, ss SideloadStorage) {
+		if err := ss.Put(context.Background(), 5, 6, sstFat.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := map[string]testCase{
+		// Plain old v1 Raft command without payload. Don't touch.
+		"v1-no-payload": {thin: mkEnt(v1, 5, 6, &sstThin), fat: mkEnt(v1, 5, 6, &sstThin)},
+		// With payload, but command is v1. Don't touch. Note that the
+		// first of the two shouldn't happen in practice or we have a
+		// huge problem once we try to apply this entry.
+		"v1-slim-with-payload": {thin: mkEnt(v1, 5, 6, &sstThin), fat: mkEnt(v1, 5, 6, &sstThin)},
+		"v1-with-payload":      {thin: mkEnt(v1, 5, 6, &sstFat), fat: mkEnt(v1, 5, 6, &sstFat)},
+		// v2 with payload, but payload is AWOL. This would be fatal in practice.
+		"v2-with-payload-missing-file": {
+			thin: mkEnt(v2, 5, 6, &sstThin), fat: mkEnt(v2, 5, 6, &sstThin),
+			expErr: "not found",
+		},
+		// v2 with payload that's actually there. The request we'll see in
+		// practice.
+		"v2-with-payload-with-file-no-cache": {
+			thin: mkEnt(v2, 5, 6, &sstThin), fat: mkEnt(v2, 5, 6, &sstFat),
+			setup: putOnDisk, expTrace: "inlined entry not cached",
+		},
+		"v2-with-payload-with-file-with-cache": {
+			thin: mkEnt(v2, 5, 6, &sstThin), fat: mkEnt(v2, 5, 6, &sstFat),
+			setup: func(ec *raftentry.Cache, ss SideloadStorage) {
+				putOnDisk(ec, ss)
+				ec.Add(rangeID, []raftpb.Entry{mkEnt(v2, 5, 6, &sstFat)}, true)
+			}, expTrace: "using cache hit",
+		},
+		// v2 with a payload matching the CRC32 of the command.
+		"v2-with-payload-with-file-crc-match": {
+			thin: mkEnt(v2, 5, 6, &sstThinCRC), fat: mkEnt(v2, 5, 6, &sstFatCRC),
+			setup: putOnDisk,
+		},
+		// v2 with a payload which doesn't match the CRC32 of the command, as
+		// after the corruption of the file.
+		"v2-with-payload-with-file-crc-mismatch": {
+			thin: mkEnt(v2, 5, 6, &sstThinBadCRC), fat: mkEnt(v2, 5, 6, &sstThinBadCRC),
+			setup:  putOnDisk,
+			expErr: "does not match the checksum of its command",
+		},
+		"v2-with-payload-with-file-crc-mismatch-unverified": {
+			thin: mkEnt(v2, 5, 6, &sstThinBadCRC), fat: mkEnt(v2, 5, 6, &sstFatBadCRC),
+			setup: putOnDisk, disableCRC: true,
+		},
+		"v2-fat-without-file": {
+			thin: mkEnt(v2, 5, 6, &sstFat), fat: mkEnt(v2, 5, 6, &sstFat),
+			setup:    func(ec *raftentry.Cache, ss SideloadStorage) {},
+			expTrace: "already inlined",
+		},
+	}
+
+	runOne := func(k string, test testCase) {
+		ctx, collect, cancel := tracing.ContextWithRecordingSpan(context.Background(), "test-recording")
+		defer cancel()
+
+		ec := raftentry.NewCache(1024) // large enough
+		ss := mustNewInMemSideloadStorage(rangeID, roachpb.ReplicaID(1), ".", nil)
+		if test.setup != nil {
+			test.setup(ec, ss)
+		}
+
+		var st *cluster.Settings
+		if test.disableCRC {
+			st = cluster.MakeTestingClusterSettings()
+			sideloadCRCVerificationEnabled.Override(&st.SV, false)
+		}
+
+		thinCopy := *(protoutil.Clone(&test.thin).(*raftpb.Entry))
+		newEnt, err := maybeInlineSideloadedRaftCommand(ctx, st, rangeID, thinCopy, ss, ec)
+		if err != nil {
+			if test.expErr == "" || !testutils.IsError(err, test.expErr) {
+				t.Fatalf("%s: %s", k, err)
+			}
+		} else if test.expErr != "" {
+			t.Fatalf("%s: success, but expected error: %s", k, test.expErr)
+		} else if err := entryEq(thinCopy, test.thin); err != nil {
+			t.Fatalf("%s: mutated the original entry: %s", k, pretty.Diff(thinCopy, test.thin))
+		}
+
+		if newEnt == nil {
+			newEnt = &thinCopy
+		}
+		if err := entryEq(*newEnt, test.fat); err != nil {
+			t.Fatalf("%s: %s", k, err)
+		}
+
+		if dump := tracing.FormatRecordedSpans(collect()); test.expTrace != "" {
+			if ok, err := regexp.MatchString(test.expTrace, dump); err != nil {
+				t.Fatalf("%s: %s", k, err)
+			} else if !ok {
+				t.Fatalf("%s: expected trace matching:\n%s\n\nbut got\n%s", k, test.expTrace, dump)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(testCases))
+	for k := range testCases {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		runOne(k, testCases[k])
+	}
+}
+
+// TestRaftSSTableSideloadingInlineCRCSampling verifies that large sideloaded
+// payloads are verified at the configured sample rate when they are inlined,
+// while small ones are always verified.
+func TestRaftSSTableSideloadingInlineCRCSampling(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	rangeID := roachpb.RangeID(1)
+	st := cluster.MakeTestingClusterSettings()
+	sideloadCRCVerificationAlwaysBelow.Override(&st.SV, 10)
+	sideloadCRCVerificationSampleRate.Override(&st.SV, 4)
+
+	// The stored payloads don't match the CRC32 of their commands, so every
+	// verification fails.
+	small, large := []byte("foo"), bytes.Repeat([]byte("x"), 100)
+	ss := mustNewInMemSideloadStorage(rangeID, roachpb.ReplicaID(1), ".", nil)
+	for index, payload := range map[uint64][]byte{5: small, 6: large} {
+		if err := ss.Put(ctx, index, 6, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sstThinBadCRC := storagepb.ReplicatedEvalResult_AddSSTable{CRC32: util.CRC32([]byte("bar"))}
+
+	countVerified := func(index uint64, n int) int {
+		t.Helper()
+		var verified int
+		for i := 0; i < n; i++ {
+			_, err := maybeInlineSideloadedRaftCommand(
+				ctx, st, rangeID, mkEnt(raftVersionSideloaded, index, 6, &sstThinBadCRC), ss, raftentry.NewCache(1024),
+			)
+			if _, ok := err.(*sideloadChecksumMismatchError); ok {
+				verified++
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return verified
+	}
+
+	if verified := countVerified(5, 20); verified != 20 {
+		t.Fatalf("expected all 20 small payloads to be verified, got %d", verified)
+	}
+	if verified := countVerified(6, 100); verified != 25 {
+		t.Fatalf("expected 25 of 100 large payloads to be verified, got %d", verified)
+	}
+	sideloadCRCVerificationSampleRate.Override(&st.SV, 1)
+	if verified := countVerified(6, 20); verified != 20 {
+		t.Fatalf("expected all 20 large payloads to be verified, got %d", verified)
+	}
+	// Disabling verification takes precedence over the size.
+	sideloadCRCVerificationEnabled.Override(&st.SV, false)
+	if verified := countVerified(5, 20); verified != 0 {
+		t.Fatalf("expected no payloads to be verified, got %d", verified)
+	}
+}
+
+func TestExpectedSideloadedFiles(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	v1, v2 := raftVersionStandard, raftVersionSideloaded
+	sstFat := storagepb.ReplicatedEvalResult_AddSSTable{Data: []byte("foo")}
+	sstThin := storagepb.ReplicatedEvalResult_AddSSTable{}
+	entries := []raftpb.Entry{
+		// An empty entry, as appended by a new leader.
+		{Index: 1, Term: 1},
+		// A regular command.
+		mkEnt(v1, 2, 1, nil),
+		// A v1 AddSSTable command, which keeps its payload inline.
+		mkEnt(v1, 3, 1, &sstFat),
+		// A sideloaded AddSSTable command.
+		mkEnt(v2, 4, 1, &sstThin),
+		// A sideloaded AddSSTable command which hasn't been sideloaded yet.
+		mkEnt(v2, 5, 2, &sstFat),
+		mkEnt(v1, 6, 2, nil),
+		mkEnt(v2, 7, 3, &sstThin),
+	}
+
+	keys, err := ExpectedSideloadedFiles(context.Background(), entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []SideloadKey{{Index: 4, Term: 1}, {Index: 7, Term: 3}}; !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("expected %v, got %v", exp, keys)
+	}
+
+	// A sideloaded command without an AddSSTable is corrupt.
+	if _, err := ExpectedSideloadedFiles(
+		context.Background(), []raftpb.Entry{mkEnt(v2, 8, 3, nil)},
+	); !testutils.IsError(err, "sideloaded entry at index 8 term 3 has no AddSSTable") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRaftSSTableSideloadingSideload(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	addSST := storagepb.ReplicatedEvalResult_AddSSTable{
+		Data: []byte("foo"), CRC32: 0, // not checked
+	}
+
+	addSSTStripped := addSST
+	addSSTStripped.Data = nil
+
+	entV1Reg := mkEnt(raftVersionStandard, 10, 99, nil)
+	entV1SST := mkEnt(raftVersionStandard, 11, 99, &addSST)
+	entV2Reg := mkEnt(raftVersionSideloaded, 12, 99, nil)
+	entV2SST := mkEnt(raftVersionSideloaded, 13, 99, &addSST)
+	entV2SSTStripped := mkEnt(raftVersionSideloaded, 13, 99, &addSSTStripped)
+	entV2SST2 := mkEnt(raftVersionSideloaded, 14, 99, &addSST)
+	entV2SST2Stripped := mkEnt(raftVersionSideloaded, 14, 99, &addSSTStripped)
+
+	type tc struct {
+		name              string
+		preEnts, postEnts []raftpb.Entry
+		ss                []string
+		size              int64
+	}
+
+	// Intentionally ignore the fact that real calls would always have an
+	// unbroken run of `entry.Index`.
+	testCases := []tc{
+		{
+			name:     "empty",
+			preEnts:  nil,
+			postEnts: nil,
+			ss:       nil,
+			size:     0,
+		},
+		{
+			name:     "v1",
+			preEnts:  []raftpb.Entry{entV1Reg, entV1SST},
+			postEnts: []raftpb.Entry{entV1Reg, entV1SST},
+			size:     0,
+		},
+		{
+			name:     "v2",
+			preEnts:  []raftpb.Entry{entV2SST, entV2Reg},
+			postEnts: []raftpb.Entry{entV2SSTStripped, entV2Reg},
+			ss:       []string{"i13t99"},
+			size:     int64(len(addSST.Data)),
+		},
+		{
+			name:     "mixed",
+			preEnts:  []raftpb.Entry{entV1Reg, entV1SST, entV2Reg, entV2SST},
+			postEnts: []raftpb.Entry{entV1Reg, entV1SST, entV2Reg, entV2SSTStripped},
+			ss:       []string{"i13t99"},
+			size:     int64(len(addSST.Data)),
+		},
+		{
+			name:     "v2-many",
+			preEnts:  []raftpb.Entry{entV2SST, entV2Reg, entV2SST2},
+			postEnts: []raftpb.Entry{entV2SSTStripped, entV2Reg, entV2SST2Stripped},
+			ss:       []string{"i13t99", "i14t99"},
+			size:     2 * int64(len(addSST.Data)),
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			sideloaded := mustNewInMemSideloadStorage(roachpb.RangeID(3), roachpb.ReplicaID(17), ".", nil)
+			st := cluster.MakeTestingClusterSettings()
+			postEnts, size, err := maybeSideloadEntriesImpl(ctx, st, test.preEnts, sideloaded, nil /* policy */)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(addSST.Data) == 0 {
+				t.Fatal("invocation mutated original AddSSTable struct in memory")
+			}
+			if !reflect.DeepEqual(postEnts, test.postEnts) {
+				t.Fatalf("result differs from expected: %s", pretty.Diff(postEnts, test.postEnts))
+			}
+			if test.size != size {
+				t.Fatalf("expected %d sideloadedSize, but found %d", test.size, size)
+			}
+			var actKeys []string
+			for k := range sideloaded.(*inMemSideloadStorage).m {
+				actKeys = append(actKeys, fmt.Sprintf("i%dt%d", k.index, k.term))
+			}
+			sort.Strings(actKeys)
+			if !reflect.DeepEqual(actKeys, test.ss) {
+				t.Fatalf("expected %v, got %v", test.ss, actKeys)
+			}
+		})
+	}
+}
+
+// TestRaftSSTableSideloadingRemovalPending verifies that, if enabled through
+// kv.raft_log.sideloading.skip_removal_pending.enabled, a replica pending
+// removal keeps the payloads of the entries it appends inline, and that such
+// entries remain usable.
+func TestRaftSSTableSideloadingRemovalPending(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	tc.Start(t, stopper)
+
+	addSST := storagepb.ReplicatedEvalResult_AddSSTable{Data: []byte("foo"), CRC32: util.CRC32([]byte("foo"))}
+	ents := []raftpb.Entry{mkEnt(raftVersionSideloaded, 1000, 5, &addSST)}
+	setRemovalPending := func(pending bool) {
+		tc.repl.mu.Lock()
+		defer tc.repl.mu.Unlock()
+		if pending {
+			tc.repl.mu.destroyStatus.Set(
+				roachpb.NewRangeNotFoundError(tc.repl.RangeID, tc.store.StoreID()), destroyReasonRemovalPending)
+		} else {
+			tc.repl.mu.destroyStatus.Reset()
+		}
+	}
+	sideload := func() ([]raftpb.Entry, int64) {
+		t.Helper()
+		tc.repl.raftMu.Lock()
+		defer tc.repl.raftMu.Unlock()
+		thin, size, err := tc.repl.maybeSideloadEntriesRaftMuLocked(ctx, ents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return thin, size
+	}
+	assertHasFile := func(exp bool) {
+		t.Helper()
+		tc.repl.raftMu.Lock()
+		defer tc.repl.raftMu.Unlock()
+		if ok, err := tc.repl.raftMu.sideloaded.HasEntry(ctx, 1000, 5); err != nil {
+			t.Fatal(err)
+		} else if ok != exp {
+			t.Fatalf("expected sideloaded file to exist: %t, got %t", exp, ok)
+		}
+	}
+
+	if sideloadSkipRemovalPending.Get(&tc.store.cfg.Settings.SV) {
+		t.Fatal("expected the option to be disabled by default")
+	}
+	sideloadSkipRemovalPending.Override(&tc.store.cfg.Settings.SV, true)
+	setRemovalPending(true)
+	thin, size := sideload()
+	if size != 0 {
+		t.Fatalf("expected nothing to be sideloaded, got %d bytes", size)
+	}
+	if err := entryEq(thin[0], ents[0]); err != nil {
+		t.Fatal(err)
+	}
+	assertHasFile(false)
+	// The inline entry can be applied without a sideloaded file.
+	if fat, err := maybeInlineSideloadedRaftCommand(
+		ctx, tc.store.cfg.Settings, tc.repl.RangeID, thin[0], tc.repl.raftMu.sideloaded, raftentry.NewCache(1024),
+	); err != nil {
+		t.Fatal(err)
+	} else if err := entryEq(*fat, ents[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the option, or once the replica is no longer pending removal,
+	// the payload is sideloaded.
+	sideloadSkipRemovalPending.Override(&tc.store.cfg.Settings.SV, false)
+	if _, size := sideload(); size != int64(len(addSST.Data)) {
+		t.Fatalf("expected %d bytes to be sideloaded, got %d", len(addSST.Data), size)
+	}
+	assertHasFile(true)
+	sideloadSkipRemovalPending.Override(&tc.store.cfg.Settings.SV, true)
+	setRemovalPending(false)
+	if _, size := sideload(); size != int64(len(addSST.Data)) {
+		t.Fatalf("expected %d bytes to be sideloaded, got %d", len(addSST.Data), size)
+	}
+}
+
+// TestRaftSideloadingAdditionalField verifies that a registered sideloadable
+// field other than AddSSTable is stripped when sideloading and restored when
+// inlining, alongside AddSSTable payloads, and that a command carrying both
+// fields only sideloads the field registered first. The payloads of the field
+// are verified and repaired against the checksum it reports.
+func TestRaftSideloadingAdditionalField(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The write batch stands in for a future large-payload field.
+	wb := storagepb.WriteBatch{Data: []byte("batch")}
+	wbChecksum := util.CRC32(wb.Data)
+	defer func(fields []sideloadableField) { sideloadableFields = fields }(sideloadableFields)
+	sideloadableFields = append(sideloadableFields[:len(sideloadableFields):len(sideloadableFields)],
+		sideloadableField{
+			name: "WriteBatch",
+			get: func(cmd *storagepb.RaftCommand) ([]byte, bool) {
+				if wb := cmd.WriteBatch; wb != nil {
+					return wb.Data, true
+				}
+				return nil, false
+			},
+			set: func(cmd *storagepb.RaftCommand, payload []byte) {
+				cmd.WriteBatch.Data = payload
+			},
+			checksum: func(*storagepb.RaftCommand) uint32 {
+				return wbChecksum
+			},
+		})
+
+	mkCmdEnt := func(
+		index uint64, as *storagepb.ReplicatedEvalResult_AddSSTable, wb *storagepb.WriteBatch,
+	) raftpb.Entry {
+		var cmd storagepb.RaftCommand
+		cmd.ReplicatedEvalResult.AddSSTable = as
+		cmd.WriteBatch = wb
+		b, err := protoutil.Marshal(&cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmdIDKey := strings.Repeat("x", raftCommandIDLen)
+		return raftpb.Entry{
+			Index: index,
+			Term:  99,
+			Data:  encodeRaftCommand(raftVersionSideloaded, storagebase.CmdIDKey(cmdIDKey), b),
+		}
+	}
+
+	addSST := storagepb.ReplicatedEvalResult_AddSSTable{Data: []byte("sst")}
+	addSSTStripped := addSST
+	addSSTStripped.Data = nil
+	wbStripped := wb
+	wbStripped.Data = nil
+
+	preEnts := []raftpb.Entry{
+		mkCmdEnt(10, &addSST, nil),
+		mkCmdEnt(11, nil, &wb),
+		mkCmdEnt(12, &addSST, &wb),
+	}
+	expPostEnts := []raftpb.Entry{
+		mkCmdEnt(10, &addSSTStripped, nil),
+		mkCmdEnt(11, nil, &wbStripped),
+		mkCmdEnt(12, &addSSTStripped, &wb),
+	}
+
+	ctx := context.Background()
+	const rangeID = 3
+	st := cluster.MakeTestingClusterSettings()
+	sideloaded := mustNewInMemSideloadStorage(rangeID, roachpb.ReplicaID(17), ".", nil)
+	postEnts, size, err := maybeSideloadEntriesImpl(ctx, st, preEnts, sideloaded, nil /* policy */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range postEnts {
+		if err := entryEq(postEnts[i], expPostEnts[i]); err != nil {
+			t.Fatalf("entry at index %d: %s", postEnts[i].Index, err)
+		}
+	}
+	if exp := int64(2*len(addSST.Data) + len(wb.Data)); size != exp {
+		t.Fatalf("expected %d sideloaded bytes, but found %d", exp, size)
+	}
+	for _, tc := range []struct {
+		index   uint64
+		payload []byte
+	}{{10, addSST.Data}, {11, wb.Data}, {12, addSST.Data}} {
+		payload, err := sideloaded.Get(ctx, tc.index, 99)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload, tc.payload) {
+			t.Fatalf("expected payload %q at index %d, got %q", tc.payload, tc.index, payload)
+		}
+	}
+
+	keys, err := ExpectedSideloadedFiles(ctx, postEnts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expKeys := []SideloadKey{{Index: 10, Term: 99}, {Index: 11, Term: 99}, {Index: 12, Term: 99}}
+	if !reflect.DeepEqual(keys, expKeys) {
+		t.Fatalf("expected %v, got %v", expKeys, keys)
+	}
+
+	for i, thin := range postEnts {
+		fat, err := maybeInlineSideloadedRaftCommand(
+			ctx, st, rangeID, thin, sideloaded, raftentry.NewCache(1024),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fat == nil {
+			t.Fatalf("expected entry at index %d to be inlined", thin.Index)
+		}
+		if err := entryEq(*fat, preEnts[i]); err != nil {
+			t.Fatalf("entry at index %d: %s", thin.Index, err)
+		}
+	}
+
+	// A corrupt payload of the field fails verification against its checksum.
+	if err := sideloaded.Put(ctx, 11, 99, []byte("corrupt")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := maybeInlineSideloadedRaftCommand(
+		ctx, st, rangeID, postEnts[1], sideloaded, raftentry.NewCache(1024),
+	); err == nil {
+		t.Fatal("expected a checksum mismatch")
+	} else if _, ok := err.(*sideloadChecksumMismatchError); !ok {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+
+	// A missing payload of the field is repaired from the fat entry.
+	if _, err := sideloaded.Purge(ctx, 11, 99); err != nil {
+		t.Fatal(err)
+	}
+	maybeRepairSideloadedFile(ctx, preEnts[1], sideloaded)
+	if payload, err := sideloaded.Get(ctx, 11, 99); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(payload, wb.Data) {
+		t.Fatalf("expected payload %q, got %q", wb.Data, payload)
+	}
+}
+
+// TestRaftSSTableSideloadingDisabled verifies that when sideloading is disabled
+// via the cluster setting, new AddSSTable entries keep their payloads inline,
+// while entries that were sideloaded previously can still be inlined.
+func TestRaftSSTableSideloadingDisabled(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	sideloadingEnabled.Override(&st.SV, false)
+
+	addSST := storagepb.ReplicatedEvalResult_AddSSTable{
+		Data: []byte("foo"), CRC32: 0, // not checked
+	}
+	addSSTStripped := addSST
+	addSSTStripped.Data = nil
+
+	const rangeID = 3
+	sideloaded := mustNewInMemSideloadStorage(rangeID, roachpb.ReplicaID(17), ".", nil)
+
+	preEnts := []raftpb.Entry{
+		mkEnt(raftVersionStandard, 10, 99, &addSST),
+		mkEnt(raftVersionSideloaded, 11, 99, &addSST),
+	}
+	postEnts, size, err := maybeSideloadEntriesImpl(ctx, st, preEnts, sideloaded, nil /* policy */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(postEnts, preEnts) {
+		t.Fatalf("expected entries to remain inline: %s", pretty.Diff(postEnts, preEnts))
+	}
+	if size != 0 {
+		t.Fatalf("expected no sideloaded bytes, but found %d", size)
+	}
+	if n := len(sideloaded.(*inMemSideloadStorage).m); n != 0 {
+		t.Fatalf("expected empty sideloaded storage, found %d entries", n)
+	}
+
+	// An entry that was sideloaded before the setting was changed is still
+	// inlined correctly.
+	if err := sideloaded.Put(ctx, 12, 99, addSST.Data); err != nil {
+		t.Fatal(err)
+	}
+	thin := mkEnt(raftVersionSideloaded, 12, 99, &addSSTStripped)
+	fat, err := maybeInlineSideloadedRaftCommand(
+		ctx, st, rangeID, thin, sideloaded, raftentry.NewCache(1024),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fat == nil {
+		t.Fatal("expected entry to be inlined")
+	}
+	if err := entryEq(*fat, mkEnt(raftVersionSideloaded, 12, 99, &addSST)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRaftSSTableSideloadingReadRepair verifies that repairSideloaded restores
+// a missing sideloaded file of an untruncated entry from the Raft entry cache,
+// that inlining an entry served from the cache doesn't write to the sideloaded
+// storage, and that files of truncated entries aren't restored.
+func TestRaftSSTableSideloadingReadRepair(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	ctx := context.Background()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	tc.Start(t, stopper)
+	tc.store.SetRaftLogQueueActive(false)
+
+	if err := ProposeAddSSTable(ctx, "a", "value", hlc.Timestamp{Logical: 1}, tc.store); err != nil {
+		t.Fatal(err)
+	}
+	index, err := tc.repl.GetLastIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.repl.mu.RLock()
+	term, err := tc.repl.raftTermRLocked(index)
+	tc.repl.mu.RUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lose := func() {
+		t.Helper()
+		tc.repl.raftMu.Lock()
+		defer tc.repl.raftMu.Unlock()
+		if _, err := tc.repl.raftMu.sideloaded.Purge(ctx, index, term); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertHasFile := func(exp bool) {
+		t.Helper()
+		tc.repl.raftMu.Lock()
+		defer tc.repl.raftMu.Unlock()
+		if ok, err := tc.repl.raftMu.sideloaded.HasEntry(ctx, index, term); err != nil {
+			t.Fatal(err)
+		} else if ok != exp {
+			t.Fatalf("expected sideloaded file to exist: %t, got %t", exp, ok)
+		}
+	}
+	assertRepaired := func(exp int) {
+		t.Helper()
+		if n, err := tc.repl.repairSideloaded(ctx); err != nil {
+			t.Fatal(err)
+		} else if n != exp {
+			t.Fatalf("expected %d files to be restored, got %d", exp, n)
+		}
+	}
+
+	// Reading the entry from the cache leaves the missing file alone.
+	lose()
+	tc.repl.mu.Lock()
+	_, err = tc.repl.raftEntriesLocked(index, index+1, math.MaxUint64)
+	tc.repl.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertHasFile(false)
+
+	assertRepaired(1)
+	assertHasFile(true)
+	assertRepaired(0)
+
+	// Files of truncated entries are never restored.
+	lose()
+	tc.repl.mu.Lock()
+	truncState := tc.repl.mu.state.TruncatedState
+	tc.repl.mu.state.TruncatedState = &roachpb.RaftTruncatedState{Index: index, Term: term}
+	tc.repl.mu.Unlock()
+	assertRepaired(0)
+	assertHasFile(false)
+	tc.repl.mu.Lock()
+	tc.repl.mu.state.TruncatedState = truncState
+	tc.repl.mu.Unlock()
+}
+
+// TestRaftSSTableSideloadingPlacementPolicy verifies that a placement policy
+// controls which payloads are sideloaded, and that entries are inlined
+// correctly regardless of their placement.
+func TestRaftSSTableSideloadingPlacementPolicy(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	const rangeID = 3
+	sideloaded := mustNewInMemSideloadStorage(rangeID, roachpb.ReplicaID(17), ".", nil)
+
+	small := storagepb.ReplicatedEvalResult_AddSSTable{Data: []byte("foo")}
+	large := storagepb.ReplicatedEvalResult_AddSSTable{Data: []byte("foobarbaz")}
+	largeStripped := large
+	largeStripped.Data = nil
+
+	// Only sideload payloads of at least 5 bytes.
+	var seen []uint64
+	policy := func(info SideloadPlacementInfo) bool {
+		seen = append(seen, info.Index)
+		if len(info.Command.ReplicatedEvalResult.AddSSTable.Data) != info.Size {
+			t.Errorf("index %d: size %d doesn't match payload", info.Index, info.Size)
+		}
+		return info.Size >= 5
+	}
+
+	preEnts := []raftpb.Entry{
+		mkEnt(raftVersionSideloaded, 10, 99, &small),
+		mkEnt(raftVersionSideloaded, 11, 99, &large),
+	}
+	postEnts, size, err := maybeSideloadEntriesImpl(ctx, st, preEnts, sideloaded, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(seen, []uint64{10, 11}) {
+		t.Fatalf("expected policy to be consulted for indexes 10 and 11, got %v", seen)
+	}
+	expEnts := []raftpb.Entry{
+		mkEnt(raftVersionSideloaded, 10, 99, &small),
+		mkEnt(raftVersionSideloaded, 11, 99, &largeStripped),
+	}
+	if !reflect.DeepEqual(postEnts, expEnts) {
+		t.Fatalf("result differs from expected: %s", pretty.Diff(postEnts, expEnts))
+	}
+	if e := int64(len(large.Data)); size != e {
+		t.Fatalf("expected %d sideloaded bytes, but found %d", e, size)
+	}
+	var actKeys []string
+	for k := range sideloaded.(*inMemSideloadStorage).m {
+		actKeys = append(actKeys, fmt.Sprintf("i%dt%d", k.index, k.term))
+	}
+	if exp := []string{"i11t99"}; !reflect.DeepEqual(actKeys, exp) {
+		t.Fatalf("expected %v, got %v", exp, actKeys)
+	}
+
+	// Both entries are inlined correctly, without help from the entry cache.
+	for i, ent := range postEnts {
+		fat, err := maybeInlineSideloadedRaftCommand(
+			ctx, st, rangeID, ent, sideloaded, raftentry.NewCache(1024),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := entryEq(*fat, preEnts[i]); err != nil {
+			t.Fatalf("index %d: %s", ent.Index, err)
+		}
+	}
+}
+
+func makeInMemSideloaded(repl *Replica) {
+	repl.raftMu.Lock()
+	repl.raftMu.sideloaded = mustNewInMemSideloadStorage(repl.RangeID, 0, repl.store.engine.GetAuxiliaryDir(), nil)
+	repl.raftMu.Unlock()
+}
+
+// TestRaftSSTableSideloadingProposal runs a straightforward application of an `AddSSTable` command.
+func TestRaftSSTableSideloadingProposal(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	testutils.RunTrueAndFalse(t, "engineInMem", func(t *testing.T, engineInMem bool) {
+		testutils.RunTrueAndFalse(t, "mockSideloaded", func(t *testing.T, mockSideloaded bool) {
+			if engineInMem && !mockSideloaded {
+				t.Skip("https://github.com/cockroachdb/cockroach/issues/31913")
+			}
+			testRaftSSTableSideloadingProposal(t, engineInMem, mockSideloaded)
+		})
+	})
+}
+
+// TestRaftSSTableSideloadingProposal runs a straightforward application of an `AddSSTable` command.
+func testRaftSSTableSideloadingProposal(t *testing.T, engineInMem, mockSideloaded bool) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+	stopper := stop.NewStopper()
+	tc := testContext{}
+	if !engineInMem {
+		cfg := engine.RocksDBConfig{
+			Dir:      dir,
+			Settings: cluster.MakeTestingClusterSettings(),
+		}
+		var err error
+		cache := engine.NewRocksDBCache(1 << 20)
+		defer cache.Release()
+		tc.engine, err = engine.NewRocksDB(cfg, cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stopper.AddCloser(tc.engine)
+	}
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+
+	ctx, collect, cancel := tracing.ContextWithRecordingSpan(context.Background(), "test-recording")
+	defer cancel()
+
+	const (
+		key       = "foo"
+		entrySize = 128
+	)
+	val := strings.Repeat("x", entrySize)
+
+	if mockSideloaded {
+		makeInMemSideloaded(tc.repl)
+	}
+
+	ts := hlc.Timestamp{Logical: 1}
+
+	if err := ProposeAddSSTable(ctx, key, val, ts, tc.store); err != nil {
+		t.Fatal(err)
+	}
+
+	{
+		var ba roachpb.BatchRequest
+		get := getArgs(roachpb.Key(key))
+		ba.Add(&get)
+		ba.Header.RangeID = tc.repl.RangeID
+
+		br, pErr := tc.store.Send(ctx, ba)
+		if pErr != nil {
+			t.Fatal(pErr)
+		}
+		v := br.Responses[0].GetInner().(*roachpb.GetResponse).Value
+		if v == nil {
+			t.Fatal("expected to read a value")
+		}
+		if valBytes, err := v.GetBytes(); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(valBytes, []byte(val)) {
+			t.Fatalf("expected to read '%s', but found '%s'", val, valBytes)
+		}
+	}
+
+	func() {
+		tc.repl.raftMu.Lock()
+		defer tc.repl.raftMu.Unlock()
+		if ss, ok := tc.repl.raftMu.sideloaded.(*inMemSideloadStorage); ok && len(ss.m) < 1 {
+			t.Fatal("sideloaded storage is empty")
+		}
+
+		if err := testutils.MatchInOrder(tracing.FormatRecordedSpans(collect()), "sideloadable proposal detected", "ingested SSTable"); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := tc.store.metrics.AddSSTableProposals.Count(); n == 0 {
+			t.Fatalf("expected metric to show at least one AddSSTable proposal, but got %d", n)
+		}
+
+		if n := tc.store.metrics.AddSSTableApplications.Count(); n == 0 {
+			t.Fatalf("expected metric to show at least one AddSSTable application, but got %d", n)
+		}
+		// We usually don't see copies because we hardlink and ingest the original SST. However, this
+		// depends on luck and the file system, so don't try to assert it. We should, however, see
+		// no more than one.
+		expMaxCopies := int64(1)
+		if engineInMem {
+			// We don't count in-memory env SST writes as copies.
+			expMaxCopies = 0
+		}
+		if n := tc.store.metrics.AddSSTableApplicationCopies.Count(); n > expMaxCopies {
+			t.Fatalf("expected metric to show <= %d AddSSTable copies, but got %d", expMaxCopies, n)
+		}
+		// The in-memory sideloaded storage doesn't update the metrics.
+		if n := tc.store.metrics.SideloadBytesWritten.Count(); !mockSideloaded && n == 0 {
+			t.Fatalf("expected metric to show sideloaded bytes written, but got %d", n)
+		}
+	}()
+
+	// Force a log truncation followed by verification of the tracked raft log size. This exercises a
+	// former bug in which the raft log size took the sideloaded payload into account when adding
+	// to the log, but not when truncating.
+
+	// Write enough keys to the range to make sure that a truncation will happen.
+	for i := 0; i < RaftLogQueueStaleThreshold+1; i++ {
+		key := roachpb.Key(fmt.Sprintf("key%02d", i))
+		args := putArgs(key, []byte(fmt.Sprintf("value%02d", i)))
+		if _, err := client.SendWrapped(context.Background(), tc.store.TestSender(), &args); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := tc.store.raftLogQueue.testingAdd(ctx, tc.repl, 99.99 /* priority */); err != nil {
+		t.Fatal(err)
+	}
+	tc.store.MustForceRaftLogScanAndProcess()
+	// SST is definitely truncated now, so recomputing the Raft log keys should match up with
+	// the tracked size.
+	verifyLogSizeInSync(t, tc.repl)
+	if !mockSideloaded {
+		if n := tc.store.metrics.SideloadBytesTruncated.Count(); n == 0 {
+			t.Fatalf("expected metric to show sideloaded bytes truncated, but got %d", n)
+		}
+		if n := tc.store.metrics.SideloadBytesResident.Value(); n != 0 {
+			t.Fatalf("expected metric to show no resident sideloaded bytes, but got %d", n)
+		}
+	}
+}
+
+// TestAddSSTableInMemCopies verifies that the SSTables ingested by an
+// in-memory engine count as copies in AddSSTableApplicationCopies only if
+// kv.bulk_ingest.count_in_memory_copies.enabled is set.
+func TestAddSSTableInMemCopies(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	testutils.RunTrueAndFalse(t, "countCopies", func(t *testing.T, countCopies bool) {
+		stopper := stop.NewStopper()
+		defer stopper.Stop(context.TODO())
+		tc := testContext{}
+		tc.Start(t, stopper)
+		addSSTableCountInMemCopies.Override(&tc.store.ClusterSettings().SV, countCopies)
+		makeInMemSideloaded(tc.repl)
+
+		ctx := context.Background()
+		if err := ProposeAddSSTable(ctx, "foo", "bar", hlc.Timestamp{Logical: 1}, tc.store); err != nil {
+			t.Fatal(err)
+		}
+		if n := tc.store.metrics.AddSSTableApplications.Count(); n != 1 {
+			t.Fatalf("expected metric to show one AddSSTable application, but got %d", n)
+		}
+		expCopies := int64(0)
+		if countCopies {
+			expCopies = 1
+		}
+		if n := tc.store.metrics.AddSSTableApplicationCopies.Count(); n != expCopies {
+			t.Fatalf("expected metric to show %d AddSSTable copies, but got %d", expCopies, n)
+		}
+	})
+}
+
+type mockSender struct {
+	headerSent bool
+	logEntries [][]byte
+	done       bool
+}
+
+func (mr *mockSender) Send(req *SnapshotRequest) error {
+	if req.Header != nil {
+		mr.headerSent = true
+	}
+	// The log entries may be sent in several batches, whose memory is reused
+	// once Send returns.
+	for _, ent := range req.LogEntries {
+		mr.logEntries = append(mr.logEntries, append([]byte(nil), ent...))
+	}
+	return nil
+}
+
+func (mr *mockSender) Recv() (*SnapshotResponse, error) {
+	if mr.done {
+		return nil, io.EOF
+	}
+	status := SnapshotResponse_ACCEPTED
+	if len(mr.logEntries) > 0 {
+		status = SnapshotResponse_APPLIED
+		mr.done = true
+	}
+	return &SnapshotResponse{Status: status}, nil
+}
+
+func newRocksDB(t *testing.T) (func(), engine.RocksDBCache, *engine.RocksDB) {
+	dir, cleanup := testutils.TempDir(t)
+	cache := engine.NewRocksDBCache(1 << 20)
+	eng, err := engine.NewRocksDB(engine.RocksDBConfig{
+		Dir:       dir,
+		MustExist: false,
+	}, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cleanup, cache, eng
+}
+
+// This test verifies that when a snapshot is sent, sideloaded proposals are
+// inlined.
+func TestRaftSSTableSideloadingSnapshot(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	ctx := context.Background()
+	tc := testContext{}
+
+	cleanup, cache, eng := newRocksDB(t)
+	tc.engine = eng
+	defer cleanup()
+	defer cache.Release()
+	defer eng.Close()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	tc.Start(t, stopper)
+
+	var ba roachpb.BatchRequest
+	ba.RangeID = tc.repl.RangeID
+
+	// Disable log truncation as we want to be sure that we get to create
+	// snapshots that have our sideloaded proposal in them.
+	tc.store.SetRaftLogQueueActive(false)
+
+	// Put a sideloaded proposal on the Range.
+	key, val := "don't", "care"
+	origSSTData, _ := MakeSSTable(key, val, hlc.Timestamp{}.Add(0, 1))
+	{
+
+		var addReq roachpb.AddSSTableRequest
+		addReq.Data = origSSTData
+		addReq.Key = roachpb.Key(key)
+		addReq.EndKey = addReq.Key.Next()
+		ba.Add(&addReq)
+
+		_, pErr := tc.store.Send(ctx, ba)
+		if pErr != nil {
+			t.Fatal(pErr)
+		}
+	}
+
+	// Run a happy case snapshot. Check that it properly inlines the payload in
+	// the contained log entries.
+	inlinedEntry := func() raftpb.Entry {
+		os, err := tc.repl.GetSnapshot(ctx, "testing-will-succeed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Close()
+
+		mockSender := &mockSender{}
+		if err := sendSnapshot(
+			ctx,
+			&tc.store.cfg.RaftConfig,
+			tc.store.cfg.Settings,
+			mockSender,
+			&fakeStorePool{},
+			SnapshotRequest_Header{State: os.State, Priority: SnapshotRequest_RECOVERY},
+			os,
+			tc.repl.store.Engine().NewBatch,
+			func() {},
+		); err != nil {
+			t.Fatal(err)
+		}
+
+		var ent raftpb.Entry
+		var cmd storagepb.RaftCommand
+		var finalEnt raftpb.Entry
+		for _, entryBytes := range mockSender.logEntries {
+			if err := protoutil.Unmarshal(entryBytes, &ent); err != nil {
+				t.Fatal(err)
+			}
+			if sniffSideloadedRaftCommand(ent.Data) {
+				_, cmdBytes := DecodeRaftCommand(ent.Data)
+				if err := protoutil.Unmarshal(cmdBytes, &cmd); err != nil {
+					t.Fatal(err)
+				}
+				if as := cmd.ReplicatedEvalResult.AddSSTable; as == nil {
+					t.Fatalf("no AddSSTable found in sideloaded command %+v", cmd)
+				} else if len(as.Data) == 0 {
+					t.Fatalf("empty payload in sideloaded command: %+v", cmd)
+				}
+				finalEnt = ent
+			}
+		}
+		if finalEnt.Index == 0 {
+			t.Fatal("no sideloaded command found")
+		}
+		return finalEnt
+	}()
+
+	sideloadedIndex := inlinedEntry.Index
+
+	// This happens to be a good point in time to check the `entries()` method
+	// which has special handling to accommodate `term()`: when an empty
+	// sideload storage is passed in, `entries()` should not inline, and in turn
+	// also not populate the entries cache (since its contents must always be
+	// fully inlined).
+	func() {
+		tc.repl.raftMu.Lock()
+		defer tc.repl.raftMu.Unlock()
+		tc.repl.mu.Lock()
+		defer tc.repl.mu.Unlock()
+		for _, withSS := range []bool{false, true} {
+			tc.store.raftEntryCache.Clear(tc.repl.RangeID, sideloadedIndex+1)
+
+			var ss SideloadStorage
+			if withSS {
+				ss = tc.repl.raftMu.sideloaded
+			}
+			rsl := stateloader.Make(tc.repl.RangeID)
+			entries, err := entries(
+				ctx, tc.store.ClusterSettings(), rsl, tc.store.Engine(), tc.repl.RangeID, tc.store.raftEntryCache,
+				ss, sideloadedIndex, sideloadedIndex+1, 1<<20,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("no or too many entries returned from cache: %+v", entries)
+			}
+			ents, _, _, _ := tc.store.raftEntryCache.Scan(nil, tc.repl.RangeID, sideloadedIndex, sideloadedIndex+1, 1<<20)
+			if withSS {
+				// We passed the sideload storage, so we expect to get our
+				// inlined index back from the cache.
+				if len(ents) != 1 {
+					t.Fatalf("no or too many entries returned from cache: %+v", ents)
+				}
+				if err := entryEq(inlinedEntry, ents[0]); err != nil {
+					t.Fatalf("withSS=%t: %s", withSS, err)
+				}
+			} else {
+				// Without sideload storage, expect the cache to remain
+				// unpopulated and the entry returned from entries() to not have
+				// been inlined.
+				if len(ents) != 0 {
+					t.Fatalf("expected no cached entries, but got %+v", ents)
+				}
+				if expErr, err := `ReplicatedEvalResult.AddSSTable.Data: \[\]uint8\[\d+\] != \[\]uint8\[0\]`,
+					entryEq(inlinedEntry, entries[0]); !testutils.IsError(
+					err,
+					expErr,
+				) {
+					t.Fatalf("expected specific mismatch on `Data` field, but got %v\nwanted: %s", err, expErr)
+				}
+			}
+		}
+	}()
+
+	// Now run a snapshot that will fail since it doesn't find one of its on-disk
+	// payloads. This can happen if the Raft log queue runs between the time the
+	// (engine) snapshot is taken and the log entries are actually read from the
+	// (engine) snapshot. We didn't run this before because we wanted the file
+	// to stay in sideloaded storage for the previous test.
+	func() {
+		failingOS, err := tc.repl.GetSnapshot(ctx, "testing-will-fail")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer failingOS.Close()
+
+		// Remove the actual file.
+		tc.repl.raftMu.Lock()
+		if err := tc.repl.raftMu.sideloaded.Clear(ctx); err != nil {
+			tc.repl.raftMu.Unlock()
+			t.Fatal(err)
+		}
+		tc.repl.raftMu.Unlock()
+		// Additionally we need to clear out the entry from the cache because
+		// that would still save the day.
+		tc.store.raftEntryCache.Clear(tc.repl.RangeID, sideloadedIndex+1)
+
+		mockSender := &mockSender{}
+		err = sendSnapshot(
+			ctx,
+			&tc.store.cfg.RaftConfig,
+			tc.store.cfg.Settings,
 			mockSender,
 			&fakeStorePool{},
-			SnapshotRequest_Header{State: os.State, Priority: SnapshotRequest_RECOVERY},
-			os,
+			SnapshotRequest_Header{State: failingOS.State, Priority: SnapshotRequest_RECOVERY},
+			failingOS,
 			tc.repl.store.Engine().NewBatch,
 			func() {},
+		)
+		if _, ok := errors.Cause(err).(*errMustRetrySnapshotDueToTruncation); !ok {
+			t.Fatal(err)
+		}
+	}()
+}
+
+// TestRaftSSTableSideloadingCanSnapshotInline verifies that CanSnapshotInline
+// reports sideloaded entries whose payloads have gone missing.
+func TestRaftSSTableSideloadingCanSnapshotInline(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	ctx := context.Background()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	tc.Start(t, stopper)
+	makeInMemSideloaded(tc.repl)
+	tc.store.SetRaftLogQueueActive(false)
+
+	key, val := "don't", "care"
+	sstData, _ := MakeSSTable(key, val, hlc.Timestamp{}.Add(0, 1))
+	var ba roachpb.BatchRequest
+	ba.RangeID = tc.repl.RangeID
+	var addReq roachpb.AddSSTableRequest
+	addReq.Data = sstData
+	addReq.Key = roachpb.Key(key)
+	addReq.EndKey = addReq.Key.Next()
+	ba.Add(&addReq)
+	if _, pErr := tc.store.Send(ctx, ba); pErr != nil {
+		t.Fatal(pErr)
+	}
+
+	lastIndex, err := tc.repl.GetLastIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstIndex, err := tc.repl.GetFirstIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, missing, err := tc.repl.CanSnapshotInline(ctx, firstIndex, lastIndex+1); err != nil {
+		t.Fatal(err)
+	} else if !ok || len(missing) != 0 {
+		t.Fatalf("expected all entries to be inlinable, but found missing %v", missing)
+	}
+
+	// Remove the payload and evict it from the entry cache.
+	tc.repl.raftMu.Lock()
+	var keys []slKey
+	for k := range tc.repl.raftMu.sideloaded.(*inMemSideloadStorage).m {
+		keys = append(keys, k)
+	}
+	if err := tc.repl.raftMu.sideloaded.Clear(ctx); err != nil {
+		tc.repl.raftMu.Unlock()
+		t.Fatal(err)
+	}
+	tc.repl.raftMu.Unlock()
+	tc.store.raftEntryCache.Clear(tc.repl.RangeID, lastIndex+1)
+
+	if len(keys) != 1 {
+		t.Fatalf("expected a single sideloaded payload, found %v", keys)
+	}
+	expMissing := []SideloadKey{{Index: keys[0].index, Term: keys[0].term}}
+	if ok, missing, err := tc.repl.CanSnapshotInline(ctx, firstIndex, lastIndex+1); err != nil {
+		t.Fatal(err)
+	} else if ok || !reflect.DeepEqual(missing, expMissing) {
+		t.Fatalf("expected missing %v, got (%t, %v)", expMissing, ok, missing)
+	}
+}
+
+// TestRaftSSTableSideloadingIndexesForSnapshot verifies that
+// SideloadedIndexesForSnapshot computes the entries that a snapshot sender
+// needs to inline, and which of them it would fail to inline.
+func TestRaftSSTableSideloadingIndexesForSnapshot(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	ctx := context.Background()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	tc.Start(t, stopper)
+	makeInMemSideloaded(tc.repl)
+	tc.store.SetRaftLogQueueActive(false)
+
+	for i, key := range []string{"a", "b"} {
+		sstData, _ := MakeSSTable(key, "val", hlc.Timestamp{}.Add(0, int32(i+1)))
+		var ba roachpb.BatchRequest
+		ba.RangeID = tc.repl.RangeID
+		var addReq roachpb.AddSSTableRequest
+		addReq.Data = sstData
+		addReq.Key = roachpb.Key(key)
+		addReq.EndKey = addReq.Key.Next()
+		ba.Add(&addReq)
+		if _, pErr := tc.store.Send(ctx, ba); pErr != nil {
+			t.Fatal(pErr)
+		}
+	}
+
+	snap, err := tc.repl.GetSnapshot(ctx, "testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	header := SnapshotRequest_Header{State: snap.State}
+	indexesForSnapshot := func() (keys, missing []SideloadKey) {
+		t.Helper()
+		tc.repl.raftMu.Lock()
+		defer tc.repl.raftMu.Unlock()
+		keys, missing, err := SideloadedIndexesForSnapshot(
+			ctx, snap.EngineSnap, header, tc.repl.raftMu.sideloaded, nil, /* entryCache */
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys, missing
+	}
+	keys, missing := indexesForSnapshot()
+
+	// The sender inlines exactly the payloads in the sideloaded storage.
+	var expKeys []SideloadKey
+	tc.repl.raftMu.Lock()
+	for k := range tc.repl.raftMu.sideloaded.(*inMemSideloadStorage).m {
+		expKeys = append(expKeys, SideloadKey{Index: k.index, Term: k.term})
+	}
+	tc.repl.raftMu.Unlock()
+	sort.Slice(expKeys, func(i, j int) bool { return expKeys[i].Index < expKeys[j].Index })
+
+	if len(expKeys) != 2 {
+		t.Fatalf("expected two sideloaded payloads, found %v", expKeys)
+	}
+	if !reflect.DeepEqual(keys, expKeys) || len(missing) != 0 {
+		t.Fatalf("expected %v and none missing, got %v and %v missing", expKeys, keys, missing)
+	}
+
+	// A payload removed from the sideloaded storage is still needed, but
+	// missing.
+	tc.repl.raftMu.Lock()
+	_, err = tc.repl.raftMu.sideloaded.Purge(ctx, expKeys[0].Index, expKeys[0].Term)
+	tc.repl.raftMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, missing = indexesForSnapshot()
+	if expMissing := expKeys[:1]; !reflect.DeepEqual(keys, expKeys) || !reflect.DeepEqual(missing, expMissing) {
+		t.Fatalf("expected %v and %v missing, got %v and %v missing", expKeys, expMissing, keys, missing)
+	}
+}
+
+func TestReplicaSideloadedIndexBounds(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	tc.Start(t, stopper)
+	makeInMemSideloaded(tc.repl)
+
+	assertBounds := func(expOldest, expNewest uint64, expOK bool) {
+		t.Helper()
+		oldest, newest, ok, err := tc.repl.SideloadedIndexBounds(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if oldest != expOldest || newest != expNewest || ok != expOK {
+			t.Fatalf("expected bounds (%d, %d, %t), got (%d, %d, %t)",
+				expOldest, expNewest, expOK, oldest, newest, ok)
+		}
+	}
+
+	assertBounds(0, 0, false)
+
+	tc.repl.raftMu.Lock()
+	for _, k := range []slKey{{12, 2}, {9, 1}, {100, 3}, {10, 1}, {9, 2}} {
+		if err := tc.repl.raftMu.sideloaded.Put(ctx, k.index, k.term, []byte("foo")); err != nil {
+			tc.repl.raftMu.Unlock()
+			t.Fatal(err)
+		}
+	}
+	tc.repl.raftMu.Unlock()
+	assertBounds(9, 100, true)
+
+	tc.repl.raftMu.Lock()
+	_, _, err := tc.repl.raftMu.sideloaded.TruncateTo(ctx, 11)
+	tc.repl.raftMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertBounds(12, 100, true)
+}
+
+// TestReplicaSideloadTruncationLag verifies that the payloads below the index
+// to which the Raft log can be truncated are reported as pending reclamation.
+func TestReplicaSideloadTruncationLag(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	tc.Start(t, stopper)
+	tc.store.SetRaftLogQueueActive(false)
+	makeInMemSideloaded(tc.repl)
+
+	assertLag := func(expOldest uint64, expFiles int) {
+		t.Helper()
+		oldest, committed, files, err := tc.repl.SideloadTruncationLag(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expCommitted := tc.repl.RaftStatus().Commit; committed != expCommitted {
+			t.Fatalf("expected committed index %d, got %d", expCommitted, committed)
+		}
+		if oldest != expOldest || files != expFiles {
+			t.Fatalf("expected oldest index %d and %d files, got %d and %d",
+				expOldest, expFiles, oldest, files)
+		}
+	}
+
+	assertLag(0, 0)
+
+	// Seed a backlog of two payloads which truncation would reclaim, followed
+	// by two which are still needed.
+	safeIndex, err := tc.repl.MinSafeTruncationIndex(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if safeIndex < 3 {
+		t.Fatalf("expected a safe truncation index of at least 3, got %d", safeIndex)
+	}
+	// A snapshot in flight keeps the index from advancing as the log grows.
+	tc.repl.mu.Lock()
+	tc.repl.addSnapshotLogTruncationConstraintLocked(ctx, uuid.MakeV4(), safeIndex)
+	tc.repl.mu.Unlock()
+	tc.repl.raftMu.Lock()
+	for _, index := range []uint64{safeIndex - 2, safeIndex - 1, safeIndex, safeIndex + 5} {
+		if err := tc.repl.raftMu.sideloaded.Put(ctx, index, 1, []byte("foo")); err != nil {
+			tc.repl.raftMu.Unlock()
+			t.Fatal(err)
+		}
+	}
+	tc.repl.raftMu.Unlock()
+	assertLag(safeIndex-2, 2)
+
+	// Once the backlog is reclaimed, nothing is pending.
+	tc.repl.raftMu.Lock()
+	_, _, err = tc.repl.raftMu.sideloaded.TruncateTo(ctx, safeIndex)
+	tc.repl.raftMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertLag(safeIndex, 0)
+}
+
+// TestStoreQuarantineSideloaded verifies that a corrupt sideloaded storage is
+// moved into the quarantine area, that the replica is marked as needing a
+// snapshot, also across restarts, and that the Raft log queue recovers it by
+// truncating the affected entries.
+func TestStoreQuarantineSideloaded(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	tc.Start(t, stopper)
+
+	dir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+	st := tc.store.ClusterSettings()
+	sideloadChecksumSetting.Override(&st.SV, int64(sideloadChecksumSHA256))
+	ss, err := newDiskSideloadStorage(
+		st, tc.repl.RangeID, 1, dir,
+		rate.NewLimiter(rate.Inf, math.MaxInt64), rate.NewLimiter(rate.Inf, math.MaxInt64), nil, tc.engine,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.repl.raftMu.Lock()
+	tc.repl.raftMu.sideloaded = ss
+	tc.repl.raftMu.Unlock()
+
+	payload := []byte("some sideloaded payload")
+	for index := uint64(1); index <= 2; index++ {
+		if err := ss.Put(ctx, index, 1, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupted := append([]byte(nil), payload...)
+	corrupted[3] ^= 0x01
+	if err := ioutil.WriteFile(ss.filename(ctx, 2, 1), corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Get(ctx, 2, 1); !testutils.IsError(err, "does not match its sha256 checksum") {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if tc.repl.NeedsSnapshot() {
+		t.Fatal("expected replica not to need a snapshot before quarantining")
+	}
+
+	quarantined := func() []string {
+		t.Helper()
+		matches, err := filepath.Glob(sideloadQuarantinePath(ss.Dir()) + ".corrupt-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return matches
+	}
+	for i := 0; i < 2; i++ {
+		if err := tc.store.QuarantineSideloaded(ctx, tc.repl.RangeID); err != nil {
+			t.Fatal(err)
+		}
+		// Quarantining again has no effect.
+		if matches := quarantined(); len(matches) != 1 {
+			t.Fatalf("%d: expected a single quarantined directory, got %v", i, matches)
+		}
+	}
+
+	// The corrupt file was moved, along with the others.
+	if ex, err := exists(ss.Dir()); err != nil {
+		t.Fatal(err)
+	} else if ex {
+		t.Fatalf("expected sideloaded directory %s to be moved", ss.Dir())
+	}
+	moved := filepath.Join(quarantined()[0], ss.namer.shard(2))
+	if b, err := ioutil.ReadFile(filepath.Join(moved, sideloadFilename(2, 1))); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(b, corrupted) {
+		t.Fatalf("expected quarantined payload %q, got %q", corrupted, b)
+	}
+	if _, err := os.Stat(filepath.Join(moved, sideloadFilename(1, 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The storage starts out empty, and the replica waits for a snapshot.
+	tc.repl.raftMu.Lock()
+	empty, err := tc.repl.raftMu.sideloaded.IsEmpty(ctx)
+	tc.repl.raftMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	} else if !empty {
+		t.Fatal("expected sideloaded storage to be empty after quarantining")
+	}
+	if !tc.repl.NeedsSnapshot() {
+		t.Fatal("expected replica to need a snapshot after quarantining")
+	}
+
+	// The quarantine is persisted, and restored when the replica is loaded.
+	tc.repl.raftMu.Lock()
+	tc.repl.mu.Lock()
+	quarantinedIndex := tc.repl.mu.quarantinedIndex
+	tc.repl.mu.quarantinedIndex = 0
+	err = tc.repl.loadSideloadQuarantineRaftMuLockedMuLocked()
+	restoredIndex := tc.repl.mu.quarantinedIndex
+	tc.repl.mu.Unlock()
+	tc.repl.raftMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	} else if restoredIndex != quarantinedIndex {
+		t.Fatalf("expected quarantined index %d to be restored, got %d", quarantinedIndex, restoredIndex)
+	}
+
+	// The Raft log queue truncates the entries whose payloads were lost, after
+	// which the replica has recovered and the quarantine is cleared.
+	tc.store.SetRaftLogQueueActive(true)
+	testutils.SucceedsSoon(t, func() error {
+		tc.store.MustForceRaftLogScanAndProcess()
+		if tc.repl.NeedsSnapshot() {
+			return errors.New("replica still needs a snapshot")
+		}
+		return nil
+	})
+	if index, err := tc.repl.GetFirstIndex(); err != nil {
+		t.Fatal(err)
+	} else if index <= quarantinedIndex {
+		t.Fatalf("expected log to be truncated beyond index %d, first index is %d", quarantinedIndex, index)
+	}
+	tc.store.MustForceRaftLogScanAndProcess()
+	marker := sideloadQuarantineMarkerPath(tc.engine.GetAuxiliaryDir(), tc.repl.RangeID)
+	if ex, err := exists(marker); err != nil {
+		t.Fatal(err)
+	} else if ex {
+		t.Fatalf("expected quarantine marker %s to be removed", marker)
+	}
+}
+
+func TestRaftSSTableSideloadingTruncation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc.Start(t, stopper)
+	makeInMemSideloaded(tc.repl)
+	ctx := context.Background()
+
+	const count = 10
+
+	var indexes []uint64
+	addLastIndex := func() {
+		lastIndex, err := tc.repl.GetLastIndex()
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexes = append(indexes, lastIndex)
+	}
+	for i := 0; i < count; i++ {
+		addLastIndex()
+		key := fmt.Sprintf("key-%d", i)
+		val := fmt.Sprintf("val-%d", i)
+		if err := ProposeAddSSTable(ctx, key, val, tc.Clock().Now(), tc.store); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+	}
+	// Append an extra entry which, if we truncate it, should definitely also
+	// remove any leftover files (ok, unless the last one is reproposed but
+	// that's *very* unlikely to happen for the last one)
+	addLastIndex()
+
+	fmtSideloaded := func() []string {
+		var r []string
+		tc.repl.raftMu.Lock()
+		defer tc.repl.raftMu.Unlock()
+		if err := tc.repl.raftMu.sideloaded.ForEach(ctx, func(index, term uint64, _ int64) error {
+			r = append(r, sideloadFilename(index, term))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	// Check that when we truncate, the number of on-disk files changes in ways
+	// we expect. Intentionally not too strict due to the possibility of
+	// reproposals, etc; it could be made stricter, but this should give enough
+	// confidence already that we're calling `PurgeTo` correctly, and for the
+	// remainder unit testing on each impl's PurgeTo is more useful.
+	for i := range indexes {
+		const rangeID = 1
+		newFirstIndex := indexes[i] + 1
+		truncateArgs := truncateLogArgs(newFirstIndex, rangeID)
+		log.Eventf(ctx, "truncating to index < %d", newFirstIndex)
+		if _, pErr := client.SendWrappedWith(ctx, tc.Sender(), roachpb.Header{RangeID: rangeID}, &truncateArgs); pErr != nil {
+			t.Fatal(pErr)
+		}
+		sideloadStrings := fmtSideloaded()
+		if minFiles := count - i; len(sideloadStrings) < minFiles {
+			t.Fatalf("after truncation at %d (i=%d), expected at least %d files left, but have:\n%v",
+				indexes[i], i, minFiles, sideloadStrings)
+		}
+	}
+
+	if sideloadStrings := fmtSideloaded(); len(sideloadStrings) != 0 {
+		t.Fatalf("expected all files to be cleaned up, but found %v", sideloadStrings)
+	}
+
+}
+
+// TestRaftSSTableSideloadingRebalance verifies that the sideloaded storage of
+// a replica can be moved to a different engine, after which existing payloads
+// can still be inlined and new ones are written to the new location.
+func TestRaftSSTableSideloadingRebalance(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	ctx := context.Background()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	tc.Start(t, stopper)
+	tc.store.SetRaftLogQueueActive(false)
+
+	addSSTable := func(key string) {
+		t.Helper()
+		sstData, _ := MakeSSTable(key, "care", hlc.Timestamp{}.Add(0, 1))
+		var ba roachpb.BatchRequest
+		ba.RangeID = tc.repl.RangeID
+		var addReq roachpb.AddSSTableRequest
+		addReq.Data = sstData
+		addReq.Key = roachpb.Key(key)
+		addReq.EndKey = addReq.Key.Next()
+		ba.Add(&addReq)
+		if _, pErr := tc.store.Send(ctx, ba); pErr != nil {
+			t.Fatal(pErr)
+		}
+	}
+	sideloadedFiles := func(dir string) []string {
+		t.Helper()
+		var names []string
+		if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !info.IsDir() {
+				names = append(names, strings.TrimPrefix(path, dir))
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+	sideloadedDir := func() string {
+		tc.repl.raftMu.Lock()
+		defer tc.repl.raftMu.Unlock()
+		return tc.repl.raftMu.sideloaded.Dir()
+	}
+
+	addSSTable("a")
+	srcDir := sideloadedDir()
+	srcFiles := sideloadedFiles(srcDir)
+	if len(srcFiles) != 1 {
+		t.Fatalf("expected a single sideloaded file, found %v", srcFiles)
+	}
+
+	target := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer target.Close()
+	// The target engine has to be known to the store, which otherwise couldn't
+	// open the relocated storage again.
+	if err := tc.store.RebalanceSideloaded(
+		ctx, tc.repl.RangeID, target,
+	); !testutils.IsError(err, "none of the sideload engines") {
+		t.Fatalf("expected error for unknown engine, got %v", err)
+	}
+	if dir := sideloadedDir(); dir != srcDir {
+		t.Fatalf("expected sideloaded storage to remain in %s, found %s", srcDir, dir)
+	}
+	tc.store.cfg.SideloadEngines = []engine.Engine{target}
+	if err := tc.store.RebalanceSideloaded(ctx, tc.repl.RangeID, target); err != nil {
+		t.Fatal(err)
+	}
+	// The new location is persisted for when the replica is initialized again.
+	if baseDir, eng, err := tc.store.sideloadLocation(tc.repl.RangeID); err != nil {
+		t.Fatal(err)
+	} else if baseDir != target.GetAuxiliaryDir() || eng != target {
+		t.Fatalf("expected persisted location %s, got %s", target.GetAuxiliaryDir(), baseDir)
+	}
+	// It is written to a temporary file first, which is renamed into place.
+	relocationPath := sideloadRelocationPath(tc.store.engine.GetAuxiliaryDir(), tc.repl.RangeID)
+	if ok, err := exists(relocationPath + ".tmp"); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("expected the temporary file of the persisted location to be renamed")
+	}
+
+	dstDir := sideloadedDir()
+	if !strings.HasPrefix(dstDir, target.GetAuxiliaryDir()) {
+		t.Fatalf("expected sideloaded storage to be located in %s, but found %s",
+			target.GetAuxiliaryDir(), dstDir)
+	}
+	if files := sideloadedFiles(srcDir); len(files) != 0 {
+		t.Fatalf("expected %s to be empty, found %v", srcDir, files)
+	}
+	if files := sideloadedFiles(dstDir); !reflect.DeepEqual(files, srcFiles) {
+		t.Fatalf("expected %v in %s, found %v", srcFiles, dstDir, files)
+	}
+
+	// The relocated payload can still be inlined from the new location.
+	lastIndex, err := tc.repl.GetLastIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstIndex, err := tc.repl.GetFirstIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.store.raftEntryCache.Clear(tc.repl.RangeID, lastIndex+1)
+	if ok, missing, err := tc.repl.CanSnapshotInline(ctx, firstIndex, lastIndex+1); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatalf("expected all entries to be inlinable, but found missing %v", missing)
+	}
+
+	// New payloads are written to the new location.
+	addSSTable("b")
+	if files := sideloadedFiles(dstDir); len(files) != 2 {
+		t.Fatalf("expected two sideloaded files in %s, found %v", dstDir, files)
+	}
+	if files := sideloadedFiles(srcDir); len(files) != 0 {
+		t.Fatalf("expected %s to be empty, found %v", srcDir, files)
+	}
+}
+
+// TestMoveSideloadStorage verifies that moving a sideloaded storage leaves the
+// source intact if copying fails, and can be completed by retrying.
+func TestMoveSideloadStorage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	testSideloadStorageImpls(t, func(t *testing.T, src SideloadStorage) {
+		ctx := context.Background()
+		payloads := map[slKey][]byte{
+			{index: 1, term: 1}: []byte("a"),
+			{index: 2, term: 1}: []byte("b"),
+			{index: 3, term: 2}: []byte("c"),
+		}
+		for k, payload := range payloads {
+			if err := src.Put(ctx, k.index, k.term, payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dst := sideloadtest.NewFaultySideloadStorage(mustNewInMemSideloadStorage(1, 2, ".", nil))
+		// A previous, interrupted move copied one of the payloads already.
+		if err := dst.Put(ctx, 1, 1, []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+
+		errInjected := errors.New("injected")
+		dst.Inject(sideloadtest.MethodPut, sideloadtest.Fault{Err: errInjected, Count: 1})
+		if err := moveSideloadStorage(ctx, src, dst); errors.Cause(err) != errInjected {
+			t.Fatalf("expected injected error, got %v", err)
+		}
+		for k, payload := range payloads {
+			if data, err := src.Get(ctx, k.index, k.term); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(data, payload) {
+				t.Fatalf("%v: expected %q in source, got %q", k, payload, data)
+			}
+		}
+
+		if err := moveSideloadStorage(ctx, src, dst); err != nil {
+			t.Fatal(err)
+		}
+		for k, payload := range payloads {
+			if data, err := dst.Get(ctx, k.index, k.term); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(data, payload) {
+				t.Fatalf("%v: expected %q in destination, got %q", k, payload, data)
+			}
+		}
+		if empty, err := src.IsEmpty(ctx); err != nil {
+			t.Fatal(err)
+		} else if !empty {
+			t.Fatal("expected source to be empty")
+		}
+
+		// Moving an empty storage is a no-op.
+		if err := moveSideloadStorage(ctx, src, dst); err != nil {
+			t.Fatal(err)
+		}
+		if n := dst.Calls(sideloadtest.MethodPut); n != 5 {
+			t.Fatalf("expected 5 calls to Put, got %d", n)
+		}
+	})
+}
+
+// TestRaftLogSizeBreakdown verifies that the Raft log size breakdown of a
+// replica with sideloaded entries accounts for both the entries and the
+// sideloaded payloads.
+func TestRaftLogSizeBreakdown(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc := testContext{}
+	tc.Start(t, stopper)
+	tc.store.SetRaftLogQueueActive(false)
+
+	ctx := context.Background()
+	const (
+		key       = "foo"
+		entrySize = 128
+	)
+	val := strings.Repeat("x", entrySize)
+	if err := ProposeAddSSTable(ctx, key, val, hlc.Timestamp{Logical: 1}, tc.store); err != nil {
+		t.Fatal(err)
+	}
+
+	breakdown, err := tc.repl.RaftLogSizeBreakdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if breakdown.EntriesBytes <= 0 {
+		t.Fatalf("expected nonzero size of log entries: %+v", breakdown)
+	}
+	if breakdown.SideloadedBytes <= 0 {
+		t.Fatalf("expected nonzero size of sideloaded payloads: %+v", breakdown)
+	}
+	if sum := breakdown.EntriesBytes + breakdown.SideloadedBytes; sum != breakdown.Recomputed {
+		t.Fatalf("components sum up to %d, but recomputed size is %d", sum, breakdown.Recomputed)
+	}
+
+	tc.repl.raftMu.Lock()
+	expSize, err := ComputeRaftLogSize(ctx, tc.repl.RangeID, tc.engine, tc.repl.SideloadedRaftMuLocked())
+	tc.repl.raftMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expSize != breakdown.Recomputed {
+		t.Fatalf("expected recomputed size %d, got %d", expSize, breakdown.Recomputed)
+	}
+}
+
+// TestStoreRaftStorageSummary verifies that RaftStorageSummary aggregates the
+// Raft log sizes of the replicas of a store, lists the replicas with the
+// largest logs first, and skips replicas which are being removed.
+func TestStoreRaftStorageSummary(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	ctx := context.Background()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	cfg := TestStoreConfig(nil /* clock */)
+	store := createTestStoreWithConfig(t, stopper, testStoreOpts{}, &cfg)
+	store.SetRaftLogQueueActive(false)
+
+	for _, key := range []string{"b", "d"} {
+		args := &roachpb.AdminSplitRequest{
+			RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)},
+			SplitKey:      roachpb.Key(key),
+		}
+		if _, pErr := client.SendWrapped(ctx, store.TestSender(), args); pErr != nil {
+			t.Fatal(pErr)
+		}
+	}
+	// Sideload payloads of varying sizes into the ranges starting at b and d.
+	for i, tc := range []struct {
+		key  string
+		size int
+	}{
+		{"c", 1 << 14},
+		{"c", 1 << 14},
+		{"e", 1 << 16},
+	} {
+		val := strings.Repeat("x", tc.size)
+		if err := ProposeAddSSTable(ctx, tc.key, val, hlc.Timestamp{Logical: int32(i + 1)}, store); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	summary, err := store.RaftStorageSummary(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected RaftStorageSummary
+	var n int
+	newStoreReplicaVisitor(store).Visit(func(r *Replica) bool {
+		breakdown, err := r.RaftLogSizeBreakdown(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected.TotalLogBytes += breakdown.Recomputed
+		expected.TotalSideloadedBytes += breakdown.SideloadedBytes
+		n++
+		return true
+	})
+	if summary.TotalLogBytes != expected.TotalLogBytes ||
+		summary.TotalSideloadedBytes != expected.TotalSideloadedBytes {
+		t.Fatalf("expected totals %+v, got %+v", expected, summary)
+	}
+	if len(summary.TopRangesByLogBytes) != n {
+		t.Fatalf("expected %d ranges, got %+v", n, summary.TopRangesByLogBytes)
+	}
+	top := summary.TopRangesByLogBytes
+	for i := 1; i < len(top); i++ {
+		if top[i-1].LogBytes < top[i].LogBytes {
+			t.Fatalf("ranges not ordered by decreasing log size: %+v", top)
+		}
+	}
+	replE := store.LookupReplica(roachpb.RKey("e"))
+	replC := store.LookupReplica(roachpb.RKey("c"))
+	if top[0].RangeID != replE.RangeID || top[1].RangeID != replC.RangeID {
+		t.Fatalf("expected r%d and r%d to have the largest logs, got %+v",
+			replE.RangeID, replC.RangeID, top)
+	}
+	if top[0].SideloadedBytes <= top[1].SideloadedBytes || top[1].SideloadedBytes <= 0 {
+		t.Fatalf("unexpected sideloaded sizes: %+v", top)
+	}
+
+	// A replica pending removal is skipped.
+	replE.mu.Lock()
+	replE.mu.destroyStatus.Set(errors.New("removal pending"), destroyReasonRemovalPending)
+	replE.mu.Unlock()
+	defer func() {
+		replE.mu.Lock()
+		replE.mu.destroyStatus.Reset()
+		replE.mu.Unlock()
+	}()
+	skipped, err := store.RaftStorageSummary(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := summary.TotalLogBytes - top[0].LogBytes; skipped.TotalLogBytes != exp {
+		t.Fatalf("expected total of %d bytes without r%d, got %d", exp, replE.RangeID, skipped.TotalLogBytes)
+	}
+	for _, stat := range skipped.TopRangesByLogBytes {
+		if stat.RangeID == replE.RangeID {
+			t.Fatalf("expected r%d to be skipped, got %+v", replE.RangeID, skipped.TopRangesByLogBytes)
+		}
+	}
+}
+
+// TestStoreSideloadAccountingDrift verifies that SideloadAccountingDrift
+// reports the replicas whose tracked Raft log size drifted, ordered by the
+// magnitude of the drift.
+func TestStoreSideloadAccountingDrift(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	ctx := context.Background()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	cfg := TestStoreConfig(nil /* clock */)
+	store := createTestStoreWithConfig(t, stopper, testStoreOpts{}, &cfg)
+	store.SetRaftLogQueueActive(false)
+
+	for _, key := range []string{"b", "d", "f"} {
+		args := &roachpb.AdminSplitRequest{
+			RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)},
+			SplitKey:      roachpb.Key(key),
+		}
+		if _, pErr := client.SendWrapped(ctx, store.TestSender(), args); pErr != nil {
+			t.Fatal(pErr)
+		}
+	}
+	for i, key := range []string{"c", "e", "g"} {
+		if err := ProposeAddSSTable(ctx, key, "val", hlc.Timestamp{Logical: int32(i + 1)}, store); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Start out with accurate tracked sizes, and then let the replicas at c
+	// and e drift in opposite directions.
+	deltas := map[string]int64{"c": 100, "e": -1000, "g": 0}
+	replicas := make(map[string]*Replica, len(deltas))
+	for key, delta := range deltas {
+		repl := store.LookupReplica(roachpb.RKey(key))
+		replicas[key] = repl
+		if _, _, err := repl.ReconcileRaftLogSize(ctx); err != nil {
+			t.Fatal(err)
+		}
+		repl.mu.Lock()
+		repl.mu.raftLogSize += delta
+		repl.mu.Unlock()
+	}
+
+	drifts, err := store.SideloadAccountingDrift(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []RangeDrift
+	for _, d := range drifts {
+		for key, repl := range replicas {
+			if d.RangeID != repl.RangeID {
+				continue
+			}
+			if d.Drift != deltas[key] || d.Tracked-d.Recomputed != d.Drift {
+				t.Fatalf("expected r%d to have drifted by %d, got %+v", repl.RangeID, deltas[key], d)
+			}
+			found = append(found, d)
+		}
+	}
+	if len(found) != 2 || found[0].RangeID != replicas["e"].RangeID ||
+		found[1].RangeID != replicas["c"].RangeID {
+		t.Fatalf("expected r%d and r%d to be reported in this order, got %+v",
+			replicas["e"].RangeID, replicas["c"].RangeID, drifts)
+	}
+
+	// A replica pending removal is skipped.
+	replE := replicas["e"]
+	replE.mu.Lock()
+	replE.mu.destroyStatus.Set(errors.New("removal pending"), destroyReasonRemovalPending)
+	replE.mu.Unlock()
+	defer func() {
+		replE.mu.Lock()
+		replE.mu.destroyStatus.Reset()
+		replE.mu.Unlock()
+	}()
+	drifts, err = store.SideloadAccountingDrift(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range drifts {
+		if d.RangeID == replE.RangeID {
+			t.Fatalf("expected r%d to be skipped, got %+v", replE.RangeID, drifts)
+		}
+	}
+}
+
+// TestAssertRaftLogSizeInSync verifies that AssertRaftLogSizeInSync passes on a
+// healthy replica and describes the discrepancy once the tracked size drifts.
+func TestAssertRaftLogSizeInSync(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc := testContext{}
+	tc.Start(t, stopper)
+	tc.store.SetRaftLogQueueActive(false)
+
+	ctx := context.Background()
+	if err := ProposeAddSSTable(ctx, "foo", "bar", hlc.Timestamp{Logical: 1}, tc.store); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.repl.AssertRaftLogSizeInSync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	const drift = 17
+	tc.repl.mu.Lock()
+	tc.repl.mu.raftLogSize += drift
+	trusted := tc.repl.mu.raftLogSizeTrusted
+	tc.repl.mu.Unlock()
+
+	err := tc.repl.AssertRaftLogSizeInSync(ctx)
+	mismatch, ok := err.(*RaftLogSizeMismatchError)
+	if !ok {
+		t.Fatalf("expected a *RaftLogSizeMismatchError, got %v", err)
+	}
+	if mismatch.RangeID != tc.repl.RangeID || mismatch.Tracked-mismatch.Recomputed != drift ||
+		mismatch.EntriesBytes <= 0 || mismatch.SideloadedBytes <= 0 {
+		t.Fatalf("unexpected mismatch: %+v", mismatch)
+	}
+	exp := fmt.Sprintf(
+		"r%d: tracked raft log size %d \\(trusted: %t\\) is off by %d bytes from the recomputed size %d",
+		tc.repl.RangeID, mismatch.Tracked, trusted, drift, mismatch.Recomputed,
+	)
+	if !testutils.IsError(err, exp) {
+		t.Fatalf("expected error matching %q, got %q", exp, err)
+	}
+}
+
+// TestReconcileRaftLogSize verifies that ReconcileRaftLogSize corrects a small
+// drift of the tracked Raft log size, but refuses to correct a large one.
+func TestReconcileRaftLogSize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc := testContext{}
+	tc.Start(t, stopper)
+	tc.store.SetRaftLogQueueActive(false)
+	const maxDelta = 1 << 10
+	raftLogSizeReconcileMaxDelta.Override(&tc.store.cfg.Settings.SV, maxDelta)
+
+	ctx := context.Background()
+	if err := ProposeAddSSTable(ctx, "foo", "bar", hlc.Timestamp{Logical: 1}, tc.store); err != nil {
+		t.Fatal(err)
+	}
+	// Start out with an accurate, trusted size.
+	if _, _, err := tc.repl.ReconcileRaftLogSize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if corrected, delta, err := tc.repl.ReconcileRaftLogSize(ctx); err != nil || corrected || delta != 0 {
+		t.Fatalf("expected nothing to correct, got (%t, %d, %v)", corrected, delta, err)
+	}
+
+	drift := func(d int64) {
+		tc.repl.mu.Lock()
+		tc.repl.mu.raftLogSize += d
+		tc.repl.mu.Unlock()
+	}
+	tracked := func() int64 {
+		tc.repl.mu.Lock()
+		defer tc.repl.mu.Unlock()
+		return tc.repl.mu.raftLogSize
+	}
+	expSize := tracked()
+
+	// A small drift is corrected.
+	drift(17)
+	if corrected, delta, err := tc.repl.ReconcileRaftLogSize(ctx); err != nil || !corrected || delta != -17 {
+		t.Fatalf("expected a correction by -17 bytes, got (%t, %d, %v)", corrected, delta, err)
+	}
+	if size := tracked(); size != expSize {
+		t.Fatalf("expected tracked size %d, got %d", expSize, size)
+	}
+
+	// A large drift is left alone.
+	drift(-2 * maxDelta)
+	corrected, delta, err := tc.repl.ReconcileRaftLogSize(ctx)
+	if _, ok := err.(*RaftLogSizeMismatchError); !ok || corrected || delta != 2*maxDelta {
+		t.Fatalf("expected a mismatch error, got (%t, %d, %v)", corrected, delta, err)
+	}
+	if size := tracked(); size != expSize-2*maxDelta {
+		t.Fatalf("expected tracked size %d to be left alone, got %d", expSize-2*maxDelta, size)
+	}
+
+	// Unless the tracked size isn't trusted anyway.
+	tc.repl.mu.Lock()
+	tc.repl.mu.raftLogSizeTrusted = false
+	tc.repl.mu.Unlock()
+	if corrected, delta, err := tc.repl.ReconcileRaftLogSize(ctx); err != nil || !corrected || delta != 2*maxDelta {
+		t.Fatalf("expected a correction by %d bytes, got (%t, %d, %v)", 2*maxDelta, corrected, delta, err)
+	}
+	if size := tracked(); size != expSize {
+		t.Fatalf("expected tracked size %d, got %d", expSize, size)
+	}
+}
+
+// TestRaftSSTableSideloadingCompactionTrigger verifies that a compaction of a
+// range's span is suggested once the range has applied enough AddSSTable
+// commands.
+func TestRaftSSTableSideloadingCompactionTrigger(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc := testContext{}
+	tc.Start(t, stopper)
+
+	const threshold = 3
+	st := tc.store.cfg.Settings
+	sideloadCompactionTriggerEnabled.Override(&st.SV, true)
+	sideloadCompactionTriggerThreshold.Override(&st.SV, threshold)
+	// The compactions suggested for each ingested SSTable are tested
+	// separately.
+	sideloadIngestCompactionHintEnabled.Override(&st.SV, false)
+
+	suggestedSpans := func() []roachpb.Span {
+		return suggestedCompactionSpans(t, tc.engine)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < threshold; i++ {
+		if spans := suggestedSpans(); len(spans) != 0 {
+			t.Fatalf("unexpected suggested compactions after %d AddSSTable commands: %v", i, spans)
+		}
+		key := fmt.Sprintf("key%d", i)
+		if err := ProposeAddSSTable(ctx, key, "value", hlc.Timestamp{Logical: 1}, tc.store); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	desc := tc.repl.Desc()
+	expSpans := []roachpb.Span{{Key: roachpb.Key(desc.StartKey), EndKey: roachpb.Key(desc.EndKey)}}
+	if spans := suggestedSpans(); !reflect.DeepEqual(spans, expSpans) {
+		t.Fatalf("expected suggested compactions %v, got %v", expSpans, spans)
+	}
+}
+
+// suggestedCompactionSpans returns the spans of the compactions suggested in
+// the given engine.
+func suggestedCompactionSpans(t *testing.T, eng engine.Reader) []roachpb.Span {
+	t.Helper()
+	var spans []roachpb.Span
+	if err := eng.Iterate(
+		engine.MVCCKey{Key: keys.LocalStoreSuggestedCompactionsMin},
+		engine.MVCCKey{Key: keys.LocalStoreSuggestedCompactionsMax},
+		func(kv engine.MVCCKeyValue) (bool, error) {
+			start, end, err := keys.DecodeStoreSuggestedCompactionKey(kv.Key.Key)
+			if err != nil {
+				return true, err
+			}
+			spans = append(spans, roachpb.Span{Key: start, EndKey: end})
+			return false, nil
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+	return spans
+}
+
+// TestRaftSSTableSideloadingIngestCompactionHint verifies that a compaction of
+// the key span of an applied AddSSTable command is suggested, unless disabled.
+func TestRaftSSTableSideloadingIngestCompactionHint(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc := testContext{}
+	tc.Start(t, stopper)
+
+	ctx := context.Background()
+	st := tc.store.cfg.Settings
+	sideloadIngestCompactionHintEnabled.Override(&st.SV, false)
+	if err := ProposeAddSSTable(ctx, "a", "value", hlc.Timestamp{Logical: 1}, tc.store); err != nil {
+		t.Fatal(err)
+	}
+	if spans := suggestedCompactionSpans(t, tc.engine); len(spans) != 0 {
+		t.Fatalf("unexpected suggested compactions: %v", spans)
+	}
+
+	sideloadIngestCompactionHintEnabled.Override(&st.SV, true)
+	if err := ProposeAddSSTable(ctx, "b", "value", hlc.Timestamp{Logical: 1}, tc.store); err != nil {
+		t.Fatal(err)
+	}
+	expSpans := []roachpb.Span{{Key: roachpb.Key("b"), EndKey: roachpb.Key("b").Next()}}
+	if spans := suggestedCompactionSpans(t, tc.engine); !reflect.DeepEqual(spans, expSpans) {
+		t.Fatalf("expected suggested compactions %v, got %v", expSpans, spans)
+	}
+}
+
+// TestRaftSSTableSideloadingIngestRate verifies that the ingestion of applied
+// AddSSTable commands is paced according to kv.bulk_io_write.ingest_rate.
+func TestRaftSSTableSideloadingIngestRate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc := testContext{}
+	tc.Start(t, stopper)
+
+	const ingestRate = 20 // per second
+	const numSSTs = 5
+	addSSTableIngestRate.Override(&tc.store.cfg.Settings.SV, ingestRate)
+
+	ctx := context.Background()
+	begin := timeutil.Now()
+	for i := 0; i < numSSTs; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := ProposeAddSSTable(ctx, key, "value", hlc.Timestamp{Logical: 1}, tc.store); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first ingestion uses up the burst of the limiter, and each of the
+	// remaining ones has to wait for the next token.
+	minDuration := time.Duration(numSSTs-1) * time.Second / ingestRate
+	if d := timeutil.Since(begin); d < minDuration {
+		t.Fatalf("expected %d ingestions to take at least %s, took %s", numSSTs, minDuration, d)
+	}
+	if n := tc.store.metrics.AddSSTableApplications.Count(); n != numSSTs {
+		t.Fatalf("expected %d AddSSTable applications, got %d", numSSTs, n)
+	}
+}
+
+// TestRaftSSTableSideloadingCommittedEntry verifies that the payload of a
+// committed AddSSTable entry which was kept inline can be moved into the
+// sideloaded storage, and that inlining the rewritten entry reconstructs the
+// original one.
+func TestRaftSSTableSideloadingCommittedEntry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc := testContext{manualClock: hlc.NewManualClock(123)}
+	cfg := TestStoreConfig(hlc.NewClock(tc.manualClock.UnixNano, time.Nanosecond))
+	// Keep all payloads inline, in the sideloaded encoding.
+	cfg.SideloadPlacementPolicy = func(SideloadPlacementInfo) bool { return false }
+	tc.StartWithStoreConfig(t, stopper, cfg)
+	tc.store.SetRaftLogQueueActive(false)
+
+	ctx := context.Background()
+	propose := func(key string) uint64 {
+		if err := ProposeAddSSTable(ctx, key, "value", hlc.Timestamp{Logical: 1}, tc.store); err != nil {
+			t.Fatal(err)
+		}
+		lastIndex, err := tc.repl.GetLastIndex()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lastIndex
+	}
+	loadEntry := func(index uint64) raftpb.Entry {
+		var ent raftpb.Entry
+		if ok, err := engine.MVCCGetProto(
+			ctx, tc.engine, keys.RaftLogKey(tc.repl.RangeID, index), hlc.Timestamp{}, &ent,
+			engine.MVCCGetOptions{},
+		); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("no entry at index %d", index)
+		}
+		return ent
+	}
+	decode := func(ent raftpb.Entry) storagepb.RaftCommand {
+		_, data := DecodeRaftCommand(ent.Data)
+		var cmd storagepb.RaftCommand
+		if err := protoutil.Unmarshal(data, &cmd); err != nil {
+			t.Fatal(err)
+		}
+		return cmd
+	}
+
+	sideloadedIndex := propose("a")
+	sideloadingEnabled.Override(&tc.store.cfg.Settings.SV, false)
+	standardIndex := propose("b")
+
+	before, err := tc.repl.RaftLogSizeBreakdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.SideloadedBytes != 0 {
+		t.Fatalf("expected no sideloaded payloads, got %+v", before)
+	}
+
+	for _, index := range []uint64{sideloadedIndex, standardIndex} {
+		orig := loadEntry(index)
+		if cmd := decode(orig); cmd.ReplicatedEvalResult.AddSSTable == nil ||
+			len(cmd.ReplicatedEvalResult.AddSSTable.Data) == 0 {
+			t.Fatalf("index %d: expected inline AddSSTable, got %+v", index, cmd)
+		}
+
+		if err := tc.repl.SideloadCommittedEntry(ctx, index); err != nil {
+			t.Fatal(err)
+		}
+		thin := loadEntry(index)
+		if !sniffSideloadedRaftCommand(thin.Data) {
+			t.Fatalf("index %d: expected sideloaded encoding", index)
+		}
+		if cmd := decode(thin); len(cmd.ReplicatedEvalResult.AddSSTable.Data) != 0 {
+			t.Fatalf("index %d: expected payload to be stripped", index)
+		}
+
+		tc.repl.raftMu.Lock()
+		fat, err := maybeInlineSideloadedRaftCommand(
+			ctx, nil /* st */, tc.repl.RangeID, thin, tc.repl.SideloadedRaftMuLocked(), raftentry.NewCache(1024),
+		)
+		tc.repl.raftMu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index == sideloadedIndex {
+			if err := entryEq(*fat, orig); err != nil {
+				t.Fatalf("index %d: %s", index, err)
+			}
+		} else if fat.Index != orig.Index || fat.Term != orig.Term {
+			t.Fatalf("index %d: expected index %d and term %d, got %d and %d",
+				index, orig.Index, orig.Term, fat.Index, fat.Term)
+		} else if cmd, origCmd := decode(*fat), decode(orig); !reflect.DeepEqual(cmd, origCmd) {
+			t.Fatalf("index %d: command differs from original: %s", index, pretty.Diff(cmd, origCmd))
+		}
+
+		// Sideloading the entry again fails.
+		if err := tc.repl.SideloadCommittedEntry(ctx, index); !testutils.IsError(err, "already sideloaded") {
+			t.Fatalf("index %d: expected error, got %v", index, err)
+		}
+	}
+
+	after, err := tc.repl.RaftLogSizeBreakdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.SideloadedBytes == 0 {
+		t.Fatalf("expected sideloaded payloads, got %+v", after)
+	}
+	if a, e := after.Tracked-before.Tracked, after.Recomputed-before.Recomputed; a != e {
+		t.Fatalf("tracked raft log size changed by %d, but recomputed one by %d", a, e)
+	}
+
+	// Entries which aren't part of the committed log can't be sideloaded.
+	lastIndex, err := tc.repl.GetLastIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.repl.SideloadCommittedEntry(ctx, lastIndex+1); !testutils.IsError(err, "outside of the committed Raft log") {
+		t.Fatalf("expected error, got %v", err)
+	}
+}
+
+// TestRaftSSTableSideloadingMigrateInline verifies that
+// MigrateInlineAddSSTablesToSideloaded sideloads the payloads of all committed
+// AddSSTable entries which were kept inline, preserving their index, term and
+// payload, and leaves other entries alone.
+func TestRaftSSTableSideloadingMigrateInline(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc := testContext{manualClock: hlc.NewManualClock(123)}
+	cfg := TestStoreConfig(hlc.NewClock(tc.manualClock.UnixNano, time.Nanosecond))
+	// Keep all payloads inline, in the sideloaded encoding.
+	cfg.SideloadPlacementPolicy = func(SideloadPlacementInfo) bool { return false }
+	tc.StartWithStoreConfig(t, stopper, cfg)
+	tc.store.SetRaftLogQueueActive(false)
+
+	ctx := context.Background()
+	loadEntry := func(index uint64) raftpb.Entry {
+		var ent raftpb.Entry
+		if ok, err := engine.MVCCGetProto(
+			ctx, tc.engine, keys.RaftLogKey(tc.repl.RangeID, index), hlc.Timestamp{}, &ent,
+			engine.MVCCGetOptions{},
 		); err != nil {
 			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("no entry at index %d", index)
+		}
+		return ent
+	}
+	addSSTable := func(ent raftpb.Entry) *storagepb.ReplicatedEvalResult_AddSSTable {
+		_, data := DecodeRaftCommand(ent.Data)
+		var cmd storagepb.RaftCommand
+		if err := protoutil.Unmarshal(data, &cmd); err != nil {
+			t.Fatal(err)
+		}
+		return cmd.ReplicatedEvalResult.AddSSTable
+	}
+
+	var indexes []uint64
+	for _, key := range []string{"a", "b", "c"} {
+		if key == "c" {
+			// The last payload is kept inline in the standard encoding.
+			sideloadingEnabled.Override(&tc.store.cfg.Settings.SV, false)
+		}
+		if err := ProposeAddSSTable(ctx, key, "value", hlc.Timestamp{Logical: 1}, tc.store); err != nil {
+			t.Fatal(err)
+		}
+		lastIndex, err := tc.repl.GetLastIndex()
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexes = append(indexes, lastIndex)
+	}
+	pArgs := putArgs(roachpb.Key("d"), []byte("value"))
+	if _, pErr := tc.SendWrapped(&pArgs); pErr != nil {
+		t.Fatal(pErr)
+	}
+	putIndex, err := tc.repl.GetLastIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	origPut := loadEntry(putIndex)
+	var orig []raftpb.Entry
+	for _, index := range indexes {
+		orig = append(orig, loadEntry(index))
+	}
+
+	before, err := tc.repl.RaftLogSizeBreakdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated, err := tc.repl.MigrateInlineAddSSTablesToSideloaded(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != len(indexes) {
+		t.Fatalf("expected %d migrated entries, got %d", len(indexes), migrated)
+	}
+
+	for i, index := range indexes {
+		thin := loadEntry(index)
+		if !sniffSideloadedRaftCommand(thin.Data) {
+			t.Fatalf("index %d: expected sideloaded encoding", index)
+		}
+		if sst := addSSTable(thin); len(sst.Data) != 0 {
+			t.Fatalf("index %d: expected payload to be stripped", index)
+		}
+		tc.repl.raftMu.Lock()
+		fat, err := maybeInlineSideloadedRaftCommand(
+			ctx, nil /* st */, tc.repl.RangeID, thin, tc.repl.SideloadedRaftMuLocked(), raftentry.NewCache(1024),
+		)
+		tc.repl.raftMu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fat.Index != orig[i].Index || fat.Term != orig[i].Term {
+			t.Fatalf("index %d: expected index %d and term %d, got %d and %d",
+				index, orig[i].Index, orig[i].Term, fat.Index, fat.Term)
 		}
+		if sst, origSST := addSSTable(*fat), addSSTable(orig[i]); sst.CRC32 != origSST.CRC32 ||
+			!bytes.Equal(sst.Data, origSST.Data) {
+			t.Fatalf("index %d: payload differs from original", index)
+		}
+	}
+	if err := entryEq(loadEntry(putIndex), origPut); err != nil {
+		t.Fatalf("unrelated entry was modified: %s", err)
+	}
+
+	after, err := tc.repl.RaftLogSizeBreakdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, e := after.Tracked-before.Tracked, after.Recomputed-before.Recomputed; a != e {
+		t.Fatalf("tracked raft log size changed by %d, but recomputed one by %d", a, e)
+	}
+
+	// There's nothing left to migrate.
+	if migrated, err := tc.repl.MigrateInlineAddSSTablesToSideloaded(ctx); err != nil {
+		t.Fatal(err)
+	} else if migrated != 0 {
+		t.Fatalf("expected no migrated entries, got %d", migrated)
+	}
+}
+
+// TestRaftSSTableSideloadingMigrateInlineFailure verifies that a failed
+// MigrateInlineAddSSTablesToSideloaded removes the sideloaded files it wrote
+// for the entries which it didn't rewrite.
+func TestRaftSSTableSideloadingMigrateInlineFailure(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+	tc := testContext{manualClock: hlc.NewManualClock(123)}
+	cfg := TestStoreConfig(hlc.NewClock(tc.manualClock.UnixNano, time.Nanosecond))
+	// Keep all payloads inline.
+	cfg.SideloadPlacementPolicy = func(SideloadPlacementInfo) bool { return false }
+	tc.StartWithStoreConfig(t, stopper, cfg)
+	tc.store.SetRaftLogQueueActive(false)
+
+	ctx := context.Background()
+	if err := ProposeAddSSTable(ctx, "a", "value", hlc.Timestamp{Logical: 1}, tc.store); err != nil {
+		t.Fatal(err)
+	}
+	sstIndex, err := tc.repl.GetLastIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sstTerm, err := tc.repl.GetTerm(sstIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pArgs := putArgs(roachpb.Key("b"), []byte("value"))
+	if _, pErr := tc.SendWrapped(&pArgs); pErr != nil {
+		t.Fatal(pErr)
+	}
+	putIndex, err := tc.repl.GetLastIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The scan fails on the entry following the AddSSTable, once its payload
+	// has been written.
+	putKey := keys.RaftLogKey(tc.repl.RangeID, putIndex)
+	var origPut raftpb.Entry
+	if ok, err := engine.MVCCGetProto(
+		ctx, tc.engine, putKey, hlc.Timestamp{}, &origPut, engine.MVCCGetOptions{},
+	); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatalf("no entry at index %d", putIndex)
+	}
+	var corrupt roachpb.Value
+	corrupt.SetInt(1)
+	if err := engine.MVCCPut(ctx, tc.engine, nil, putKey, hlc.Timestamp{}, corrupt, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tc.repl.MigrateInlineAddSSTablesToSideloaded(ctx); err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+	tc.repl.raftMu.Lock()
+	ok, err := tc.repl.SideloadedRaftMuLocked().HasEntry(ctx, sstIndex, sstTerm)
+	tc.repl.raftMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("expected the sideloaded file of the failed migration to be removed")
+	}
+
+	if err := engine.MVCCPutProto(
+		ctx, tc.engine, nil, putKey, hlc.Timestamp{}, nil, &origPut,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if migrated, err := tc.repl.MigrateInlineAddSSTablesToSideloaded(ctx); err != nil {
+		t.Fatal(err)
+	} else if migrated != 1 {
+		t.Fatalf("expected 1 migrated entry, got %d", migrated)
+	}
+}
+
+// TestReplaySideloadedIntoEngine verifies that the SSTables of AddSSTable
+// commands can be replayed from a Raft log and sideloaded storage into a fresh
+// engine.
+func TestReplaySideloadedIntoEngine(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	ss := mustNewInMemSideloadStorage(1, 2, ".", nil)
+	ts := hlc.Timestamp{WallTime: 1}
 
-		var ent raftpb.Entry
-		var cmd storagepb.RaftCommand
-		var finalEnt raftpb.Entry
-		for _, entryBytes := range mockSender.logEntries {
-			if err := protoutil.Unmarshal(entryBytes, &ent); err != nil {
+	var entries []raftpb.Entry
+	var expected []engine.MVCCKeyValue
+	addSST := func(index uint64, key, value string, sideloaded bool) {
+		sst, kv := MakeSSTable(key, value, ts)
+		as := &storagepb.ReplicatedEvalResult_AddSSTable{CRC32: util.CRC32(sst)}
+		if sideloaded {
+			if err := ss.Put(ctx, index, 1, sst); err != nil {
 				t.Fatal(err)
 			}
-			if sniffSideloadedRaftCommand(ent.Data) {
-				_, cmdBytes := DecodeRaftCommand(ent.Data)
-				if err := protoutil.Unmarshal(cmdBytes, &cmd); err != nil {
-					t.Fatal(err)
-				}
-				if as := cmd.ReplicatedEvalResult.AddSSTable; as == nil {
-					t.Fatalf("no AddSSTable found in sideloaded command %+v", cmd)
-				} else if len(as.Data) == 0 {
-					t.Fatalf("empty payload in sideloaded command: %+v", cmd)
-				}
-				finalEnt = ent
-			}
+		} else {
+			as.Data = sst
 		}
-		if finalEnt.Index == 0 {
-			t.Fatal("no sideloaded command found")
+		entries = append(entries, mkEnt(raftVersionSideloaded, index, 1, as))
+		expected = append(expected, kv)
+	}
+	addSST(1, "a", "1", true /* sideloaded */)
+	addSST(2, "b", "2", true /* sideloaded */)
+	// The payload of this entry is inline. It overwrites the value written by
+	// the previous entry, which requires the entries to be replayed in order.
+	addSST(3, "b", "3", false /* sideloaded */)
+	addSST(4, "c", "4", true /* sideloaded */)
+	// Entries without an AddSSTable are skipped.
+	entries = append(entries, mkEnt(raftVersionStandard, 5, 1, nil), raftpb.Entry{Index: 6, Term: 1})
+	// The entries are replayed in index order regardless of the order in which
+	// they are passed.
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	cleanup, cache, eng := newRocksDB(t)
+	defer cleanup()
+	defer cache.Release()
+	defer eng.Close()
+
+	if err := ReplaySideloadedIntoEngine(ctx, ss, entries, eng); err != nil {
+		t.Fatal(err)
+	}
+	// Only the last value written to "b" is expected.
+	expected = append(expected[:1], expected[2:]...)
+	for _, kv := range expected {
+		if value, err := eng.Get(kv.Key); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(value, kv.Value) {
+			t.Fatalf("%s: expected %q, got %q", kv.Key, kv.Value, value)
 		}
-		return finalEnt
-	}()
+	}
 
-	sideloadedIndex := inlinedEntry.Index
+	// A missing sideloaded payload fails the replay.
+	if _, err := ss.Purge(ctx, 4, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReplaySideloadedIntoEngine(
+		ctx, ss, entries, eng,
+	); errors.Cause(err) != errSideloadedFileNotFound {
+		t.Fatalf("expected %v, got %v", errSideloadedFileNotFound, err)
+	}
+}
 
-	// This happens to be a good point in time to check the `entries()` method
-	// which has special handling to accommodate `term()`: when an empty
-	// sideload storage is passed in, `entries()` should not inline, and in turn
-	// also not populate the entries cache (since its contents must always be
-	// fully inlined).
-	func() {
-		tc.repl.raftMu.Lock()
-		defer tc.repl.raftMu.Unlock()
-		tc.repl.mu.Lock()
-		defer tc.repl.mu.Unlock()
-		for _, withSS := range []bool{false, true} {
-			tc.store.raftEntryCache.Clear(tc.repl.RangeID, sideloadedIndex+1)
+// TestReplicaRecentAddSSTables verifies that the AddSSTable commands in the
+// Raft log are listed along with the spans and sizes of their SSTables, both
+// for sideloaded and inline entries.
+func TestReplicaRecentAddSSTables(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
 
-			var ss SideloadStorage
-			if withSS {
-				ss = tc.repl.raftMu.sideloaded
-			}
-			rsl := stateloader.Make(tc.repl.RangeID)
-			entries, err := entries(
-				ctx, rsl, tc.store.Engine(), tc.repl.RangeID, tc.store.raftEntryCache,
-				ss, sideloadedIndex, sideloadedIndex+1, 1<<20,
-			)
-			if err != nil {
-				t.Fatal(err)
-			}
-			if len(entries) != 1 {
-				t.Fatalf("no or too many entries returned from cache: %+v", entries)
-			}
-			ents, _, _, _ := tc.store.raftEntryCache.Scan(nil, tc.repl.RangeID, sideloadedIndex, sideloadedIndex+1, 1<<20)
-			if withSS {
-				// We passed the sideload storage, so we expect to get our
-				// inlined index back from the cache.
-				if len(ents) != 1 {
-					t.Fatalf("no or too many entries returned from cache: %+v", ents)
-				}
-				if err := entryEq(inlinedEntry, ents[0]); err != nil {
-					t.Fatalf("withSS=%t: %s", withSS, err)
-				}
-			} else {
-				// Without sideload storage, expect the cache to remain
-				// unpopulated and the entry returned from entries() to not have
-				// been inlined.
-				if len(ents) != 0 {
-					t.Fatalf("expected no cached entries, but got %+v", ents)
-				}
-				if expErr, err := `ReplicatedEvalResult.AddSSTable.Data: \[\]uint8\[\d+\] != \[\]uint8\[0\]`,
-					entryEq(inlinedEntry, entries[0]); !testutils.IsError(
-					err,
-					expErr,
-				) {
-					t.Fatalf("expected specific mismatch on `Data` field, but got %v\nwanted: %s", err, expErr)
-				}
-			}
-		}
-	}()
+	ctx := context.Background()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	tc := testContext{}
+	tc.Start(t, stopper)
+	tc.store.SetRaftLogQueueActive(false)
 
-	// Now run a snapshot that will fail since it doesn't find one of its on-disk
-	// payloads. This can happen if the Raft log queue runs between the time the
-	// (engine) snapshot is taken and the log entries are actually read from the
-	// (engine) snapshot. We didn't run this before because we wanted the file
-	// to stay in sideloaded storage for the previous test.
-	func() {
-		failingOS, err := tc.repl.GetSnapshot(ctx, "testing-will-fail")
+	ts := hlc.Timestamp{Logical: 1}
+	var expected []AddSSTableInfo
+	propose := func(key string) {
+		if err := ProposeAddSSTable(ctx, key, "value", ts, tc.store); err != nil {
+			t.Fatal(err)
+		}
+		lastIndex, err := tc.repl.GetLastIndex()
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer failingOS.Close()
-
-		// Remove the actual file.
-		tc.repl.raftMu.Lock()
-		if err := tc.repl.raftMu.sideloaded.Clear(ctx); err != nil {
-			tc.repl.raftMu.Unlock()
+		term, err := tc.repl.GetTerm(lastIndex)
+		if err != nil {
 			t.Fatal(err)
 		}
-		tc.repl.raftMu.Unlock()
-		// Additionally we need to clear out the entry from the cache because
-		// that would still save the day.
-		tc.store.raftEntryCache.Clear(tc.repl.RangeID, sideloadedIndex+1)
+		data, _ := MakeSSTable(key, "value", ts)
+		expected = append(expected, AddSSTableInfo{
+			Index:   lastIndex,
+			Term:    term,
+			KeySpan: roachpb.Span{Key: roachpb.Key(key), EndKey: roachpb.Key(key).Next()},
+			Bytes:   int64(len(data)),
+		})
+	}
+	propose("a")
+	propose("b")
+	// The last payload is kept inline in the standard encoding.
+	sideloadingEnabled.Override(&tc.store.cfg.Settings.SV, false)
+	propose("c")
+	// Unrelated commands are skipped.
+	pArgs := putArgs(roachpb.Key("d"), []byte("value"))
+	if _, pErr := tc.SendWrapped(&pArgs); pErr != nil {
+		t.Fatal(pErr)
+	}
+	// Make sure the sideloaded payloads are read from the sideloaded storage.
+	tc.store.raftEntryCache.Drop(tc.repl.RangeID)
 
-		mockSender := &mockSender{}
-		err = sendSnapshot(
-			ctx,
-			&tc.store.cfg.RaftConfig,
-			tc.store.cfg.Settings,
-			mockSender,
-			&fakeStorePool{},
-			SnapshotRequest_Header{State: failingOS.State, Priority: SnapshotRequest_RECOVERY},
-			failingOS,
-			tc.repl.store.Engine().NewBatch,
-			func() {},
-		)
-		if _, ok := errors.Cause(err).(*errMustRetrySnapshotDueToTruncation); !ok {
+	for _, limit := range []int{10, 2} {
+		infos, err := tc.repl.RecentAddSSTables(ctx, limit)
+		if err != nil {
 			t.Fatal(err)
 		}
-	}()
+		exp := expected
+		if len(exp) > limit {
+			exp = exp[len(exp)-limit:]
+		}
+		if !reflect.DeepEqual(infos, exp) {
+			t.Fatalf("limit %d: expected %+v, got %+v", limit, exp, infos)
+		}
+	}
+	if _, err := tc.repl.RecentAddSSTables(ctx, 0); !testutils.IsError(err, "limit must be positive") {
+		t.Fatalf("expected error, got %v", err)
+	}
 }
 
-func TestRaftSSTableSideloadingTruncation(t *testing.T) {
+// TestReplicaVerifyAddSSTable verifies that Replica.VerifyAddSSTable detects
+// corrupt and missing payloads without repairing them.
+func TestReplicaVerifyAddSSTable(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	defer SetMockAddSSTable()()
 
-	tc := testContext{}
+	ctx := context.Background()
 	stopper := stop.NewStopper()
-	defer stopper.Stop(context.TODO())
+	defer stopper.Stop(ctx)
+	tc := testContext{}
 	tc.Start(t, stopper)
-	makeInMemSideloaded(tc.repl)
-	ctx := context.Background()
-
-	const count = 10
+	tc.store.SetRaftLogQueueActive(false)
 
-	var indexes []uint64
-	addLastIndex := func() {
-		lastIndex, err := tc.repl.GetLastIndex()
+	ts := hlc.Timestamp{Logical: 1}
+	propose := func(key string) (index, term uint64) {
+		if err := ProposeAddSSTable(ctx, key, "value", ts, tc.store); err != nil {
+			t.Fatal(err)
+		}
+		index, err := tc.repl.GetLastIndex()
 		if err != nil {
 			t.Fatal(err)
 		}
-		indexes = append(indexes, lastIndex)
+		term, err = tc.repl.GetTerm(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return index, term
 	}
-	for i := 0; i < count; i++ {
-		addLastIndex()
-		key := fmt.Sprintf("key-%d", i)
-		val := fmt.Sprintf("val-%d", i)
-		if err := ProposeAddSSTable(ctx, key, val, tc.Clock().Now(), tc.store); err != nil {
-			t.Fatalf("%d: %s", i, err)
+	verify := func(index uint64, expStatus VerifyStatus, expSideloaded bool) {
+		t.Helper()
+		res, err := tc.repl.VerifyAddSSTable(ctx, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Status != expStatus || res.Sideloaded != expSideloaded {
+			t.Fatalf("index %d: expected status %s (sideloaded: %t), got %+v",
+				index, expStatus, expSideloaded, res)
 		}
 	}
-	// Append an extra entry which, if we truncate it, should definitely also
-	// remove any leftover files (ok, unless the last one is reproposed but
-	// that's *very* unlikely to happen for the last one)
-	addLastIndex()
+	data, _ := MakeSSTable("a", "value", ts)
+	ss := tc.repl.raftMu.sideloaded
 
-	fmtSideloaded := func() []string {
-		var r []string
-		tc.repl.raftMu.Lock()
-		defer tc.repl.raftMu.Unlock()
-		for k := range tc.repl.raftMu.sideloaded.(*inMemSideloadStorage).m {
-			r = append(r, fmt.Sprintf("%v", k))
-		}
-		sort.Strings(r)
-		return r
+	okIndex, _ := propose("a")
+	corruptIndex, corruptTerm := propose("b")
+	missingIndex, missingTerm := propose("c")
+	sideloadingEnabled.Override(&tc.store.cfg.Settings.SV, false)
+	inlineIndex, _ := propose("d")
+	pArgs := putArgs(roachpb.Key("e"), []byte("value"))
+	if _, pErr := tc.SendWrapped(&pArgs); pErr != nil {
+		t.Fatal(pErr)
+	}
+	putIndex, err := tc.repl.GetLastIndex()
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	// Check that when we truncate, the number of on-disk files changes in ways
-	// we expect. Intentionally not too strict due to the possibility of
-	// reproposals, etc; it could be made stricter, but this should give enough
-	// confidence already that we're calling `PurgeTo` correctly, and for the
-	// remainder unit testing on each impl's PurgeTo is more useful.
-	for i := range indexes {
-		const rangeID = 1
-		newFirstIndex := indexes[i] + 1
-		truncateArgs := truncateLogArgs(newFirstIndex, rangeID)
-		log.Eventf(ctx, "truncating to index < %d", newFirstIndex)
-		if _, pErr := client.SendWrappedWith(ctx, tc.Sender(), roachpb.Header{RangeID: rangeID}, &truncateArgs); pErr != nil {
-			t.Fatal(pErr)
-		}
-		sideloadStrings := fmtSideloaded()
-		if minFiles := count - i; len(sideloadStrings) < minFiles {
-			t.Fatalf("after truncation at %d (i=%d), expected at least %d files left, but have:\n%v",
-				indexes[i], i, minFiles, sideloadStrings)
-		}
+	// Replace a payload by one that doesn't match its command, and remove
+	// another.
+	if _, err := ss.Purge(ctx, corruptIndex, corruptTerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Put(ctx, corruptIndex, corruptTerm, data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Purge(ctx, missingIndex, missingTerm); err != nil {
+		t.Fatal(err)
 	}
 
-	if sideloadStrings := fmtSideloaded(); len(sideloadStrings) != 0 {
-		t.Fatalf("expected all files to be cleaned up, but found %v", sideloadStrings)
+	verify(okIndex, VerifyOK, true /* sideloaded */)
+	verify(corruptIndex, VerifyCRCMismatch, true /* sideloaded */)
+	verify(missingIndex, VerifyMissing, true /* sideloaded */)
+	verify(inlineIndex, VerifyOK, false /* sideloaded */)
+
+	// The missing payload isn't restored, even though the entry is still
+	// cached.
+	if _, err := ss.Get(ctx, missingIndex, missingTerm); errors.Cause(err) != errSideloadedFileNotFound {
+		t.Fatalf("expected the payload to remain missing, got %v", err)
+	}
+
+	if _, err := tc.repl.VerifyAddSSTable(ctx, putIndex); !testutils.IsError(err, "is not an AddSSTable command") {
+		t.Fatalf("expected error, got %v", err)
+	}
+	if _, err := tc.repl.VerifyAddSSTable(ctx, putIndex+1); !testutils.IsError(err, "is not in the applied part") {
+		t.Fatalf("expected error, got %v", err)
+	}
+}
+
+// TestRaftSSTableSideloadingSnapshotMissingFilePolicy verifies how each
+// snapshotMissingSideloadedPolicy handles a sideloaded payload which is
+// removed before a snapshot containing it is sent.
+func TestRaftSSTableSideloadingSnapshotMissingFilePolicy(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	for _, tc := range []struct {
+		policy snapshotMissingSideloadedPolicy
+		expErr string
+	}{
+		{policy: snapshotMissingSideloadedRetry, expErr: "log truncation during snapshot removed sideloaded SSTable"},
+		{policy: snapshotMissingSideloadedAbort, expErr: "the recipient needs a snapshot from another replica"},
+	} {
+		t.Run(fmt.Sprintf("policy=%d", tc.policy), func(t *testing.T) {
+			testRaftSSTableSideloadingSnapshotMissingFilePolicy(t, tc.policy, tc.expErr)
+		})
+	}
+}
+
+func testRaftSSTableSideloadingSnapshotMissingFilePolicy(
+	t *testing.T, policy snapshotMissingSideloadedPolicy, expErr string,
+) {
+	ctx := context.Background()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	tc.Start(t, stopper)
+	tc.store.SetRaftLogQueueActive(false)
+	snapshotMissingSideloadedPolicySetting.Override(&tc.store.cfg.Settings.SV, int64(policy))
+
+	if err := ProposeAddSSTable(ctx, "key", "value", hlc.Timestamp{Logical: 1}, tc.store); err != nil {
+		t.Fatal(err)
+	}
+	index, err := tc.repl.GetLastIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	term, err := tc.repl.GetTerm(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os, err := tc.repl.GetSnapshot(ctx, "testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Close()
+
+	// The entry is removed from the Raft entry cache along with its payload,
+	// as the cache would otherwise make up for the missing payload.
+	tc.repl.raftMu.Lock()
+	_, err = tc.repl.raftMu.sideloaded.Purge(ctx, index, term)
+	tc.repl.raftMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
 	}
+	tc.store.raftEntryCache.Drop(tc.repl.RangeID)
 
+	var sender mockSender
+	err = sendSnapshot(
+		ctx,
+		&tc.store.cfg.RaftConfig,
+		tc.store.cfg.Settings,
+		&sender,
+		&fakeStorePool{},
+		SnapshotRequest_Header{State: os.State, Priority: SnapshotRequest_RECOVERY},
+		os,
+		tc.repl.store.Engine().NewBatch,
+		func() {},
+	)
+	if !testutils.IsError(err, expErr) {
+		t.Fatalf("expected error %q, got %v", expErr, err)
+	}
+	// Aborting snapshots are aborted before the recipient is contacted.
+	if exp := policy != snapshotMissingSideloadedAbort; sender.headerSent != exp {
+		t.Fatalf("expected header to be sent: %t, got %t", exp, sender.headerSent)
+	}
 }
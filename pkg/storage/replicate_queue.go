@@ -131,6 +131,7 @@ type replicateQueue struct {
 	allocator         Allocator
 	updateChan        chan time.Time
 	lastLeaseTransfer atomic.Value // read and written by scanner & queue goroutines
+	activity          *replicateActivityLog
 }
 
 // newReplicateQueue returns a new instance of replicateQueue.
@@ -139,6 +140,7 @@ func newReplicateQueue(store *Store, g *gossip.Gossip, allocator Allocator) *rep
 		metrics:    makeReplicateQueueMetrics(),
 		allocator:  allocator,
 		updateChan: make(chan time.Time, 1),
+		activity:   newReplicateActivityLog(),
 	}
 	store.metrics.registry.AddMetricStruct(&rq.metrics)
 	rq.baseQueue = newBaseQueue(
@@ -262,10 +264,12 @@ func (rq *replicateQueue) process(
 				// case we don't want to wait another scanner cycle before reconsidering
 				// the range.
 				log.Info(ctx, err)
+				rq.activity.record(timeutil.Now(), replicateOutcomeSnapshotFailure)
 				break
 			}
 
 			if err != nil {
+				rq.recordFailure(err)
 				return err
 			}
 
@@ -283,9 +287,31 @@ func (rq *replicateQueue) process(
 		}
 	}
 
+	rq.activity.record(timeutil.Now(), replicateOutcomeOtherFailure)
 	return errors.Errorf("failed to replicate after %d retries", retryOpts.MaxRetries)
 }
 
+// recordFailure records a processing failure in the recent activity of the
+// queue. Benign errors aren't failures.
+func (rq *replicateQueue) recordFailure(err error) {
+	if isBenign(err) {
+		return
+	}
+	outcome := replicateOutcomeOtherFailure
+	if _, ok := isPurgatoryError(err); ok {
+		outcome = replicateOutcomePurgatoryFailure
+	}
+	rq.activity.record(timeutil.Now(), outcome)
+}
+
+// RecentActivity summarizes the changes made, and the failures encountered,
+// by the replicate queue within the given window. Only a bounded number of
+// recent outcomes is remembered, which the Truncated field of the summary
+// indicates to have been insufficient to cover the window.
+func (rq *replicateQueue) RecentActivity(window time.Duration) ReplicateActivitySummary {
+	return rq.activity.summarize(timeutil.Now(), window)
+}
+
 func (rq *replicateQueue) processOneChange(
 	ctx context.Context, repl *Replica, canTransferLease func() bool, dryRun bool,
 ) (requeue bool, _ error) {
@@ -652,6 +678,7 @@ func (rq *replicateQueue) transferLease(
 		return errors.Wrapf(err, "%s: unable to transfer lease to s%d", repl, target.StoreID)
 	}
 	rq.lastLeaseTransfer.Store(timeutil.Now())
+	rq.activity.record(timeutil.Now(), replicateOutcomeTransferLease)
 	rq.allocator.storePool.updateLocalStoresAfterLeaseTransfer(
 		repl.store.StoreID(), target.StoreID, rangeQPS)
 	return nil
@@ -675,6 +702,11 @@ func (rq *replicateQueue) addReplica(
 	}
 	rangeInfo := rangeInfoForRepl(repl, desc)
 	rq.allocator.storePool.updateLocalStoreAfterRebalance(target.StoreID, rangeInfo, roachpb.ADD_REPLICA)
+	outcome := replicateOutcomeAdd
+	if reason == storagepb.ReasonRebalance {
+		outcome = replicateOutcomeRebalance
+	}
+	rq.activity.record(timeutil.Now(), outcome)
 	return nil
 }
 
@@ -695,9 +727,23 @@ func (rq *replicateQueue) removeReplica(
 	}
 	rangeInfo := rangeInfoForRepl(repl, desc)
 	rq.allocator.storePool.updateLocalStoreAfterRebalance(target.StoreID, rangeInfo, roachpb.REMOVE_REPLICA)
+	outcome := replicateOutcomeRemove
+	if reason == storagepb.ReasonStoreDead {
+		outcome = replicateOutcomeRemoveDead
+	}
+	rq.activity.record(timeutil.Now(), outcome)
 	return nil
 }
 
+// DrainAndWait processes all replicas currently in the replicate queue, as
+// well as those in its purgatory, and returns once the queue has no more work
+// that can make progress. Replicas which remain stuck in purgatory are not
+// waited on; their range IDs are returned instead. See
+// Store.DrainReplicateQueue.
+func (rq *replicateQueue) DrainAndWait(ctx context.Context) ([]roachpb.RangeID, error) {
+	return rq.drainAndWait(ctx, rq.store.stopper)
+}
+
 func (rq *replicateQueue) canTransferLease() bool {
 	if lastLeaseTransfer := rq.lastLeaseTransfer.Load(); lastLeaseTransfer != nil {
 		return timeutil.Since(lastLeaseTransfer.(time.Time)) > minLeaseTransferInterval
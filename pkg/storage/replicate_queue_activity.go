@@ -0,0 +1,147 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package storage
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/envutil"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// replicateActivityMaxEntries is the number of recent outcomes the replicate
+// queue remembers for RecentActivity.
+var replicateActivityMaxEntries = envutil.EnvOrDefaultInt("COCKROACH_REPLICATE_QUEUE_ACTIVITY", 1024)
+
+// replicateOutcome is the outcome of a change made, or attempted, by the
+// replicate queue.
+type replicateOutcome int8
+
+const (
+	replicateOutcomeAdd replicateOutcome = iota
+	replicateOutcomeRemove
+	replicateOutcomeRemoveDead
+	replicateOutcomeRebalance
+	replicateOutcomeTransferLease
+	// replicateOutcomePurgatoryFailure is a failure which sent the replica to
+	// purgatory.
+	replicateOutcomePurgatoryFailure
+	// replicateOutcomeSnapshotFailure is a failed preemptive snapshot, after
+	// which the change is retried.
+	replicateOutcomeSnapshotFailure
+	replicateOutcomeOtherFailure
+)
+
+// ReplicateActivitySummary counts the outcomes of the processing done by the
+// replicate queue within a window of time. Changes are counted once they
+// have succeeded.
+type ReplicateActivitySummary struct {
+	Window time.Duration
+	// Adds counts the replicas added to under-replicated ranges.
+	Adds int
+	// Removes counts the replicas removed from over-replicated ranges or
+	// decommissioning stores.
+	Removes int
+	// DeadRemovals counts the replicas removed from dead stores.
+	DeadRemovals int
+	// Rebalances counts the replicas added to rebalance ranges.
+	Rebalances     int
+	LeaseTransfers int
+	// PurgatoryFailures counts the failures which sent replicas to purgatory,
+	// such as the lack of a valid allocation target or of a quorum of live
+	// replicas.
+	PurgatoryFailures int
+	// SnapshotFailures counts the failed preemptive snapshots, which are
+	// retried.
+	SnapshotFailures int
+	// OtherFailures counts all other failures.
+	OtherFailures int
+	// Truncated is set if outcomes within the window were discarded because
+	// the queue only remembers a bounded number of them.
+	Truncated bool
+}
+
+type replicateActivityEntry struct {
+	at      time.Time
+	outcome replicateOutcome
+}
+
+// replicateActivityLog remembers the most recent outcomes of the replicate
+// queue in a circular buffer.
+type replicateActivityLog struct {
+	syncutil.Mutex
+	index   int
+	entries []replicateActivityEntry // A circular buffer with index.
+}
+
+func newReplicateActivityLog() *replicateActivityLog {
+	return &replicateActivityLog{
+		entries: make([]replicateActivityEntry, 0, replicateActivityMaxEntries),
+	}
+}
+
+func (l *replicateActivityLog) record(now time.Time, outcome replicateOutcome) {
+	l.Lock()
+	defer l.Unlock()
+
+	// Not through the first pass through the buffer.
+	if l.index == len(l.entries) {
+		l.entries = append(l.entries, replicateActivityEntry{at: now, outcome: outcome})
+	} else {
+		l.entries[l.index] = replicateActivityEntry{at: now, outcome: outcome}
+	}
+	l.index++
+	if l.index >= replicateActivityMaxEntries {
+		l.index = 0
+	}
+}
+
+// summarize counts the outcomes recorded within the given window before now.
+func (l *replicateActivityLog) summarize(
+	now time.Time, window time.Duration,
+) ReplicateActivitySummary {
+	s := ReplicateActivitySummary{Window: window}
+	cutoff := now.Add(-window)
+
+	l.Lock()
+	defer l.Unlock()
+	for _, e := range l.entries {
+		if e.at.Before(cutoff) {
+			continue
+		}
+		switch e.outcome {
+		case replicateOutcomeAdd:
+			s.Adds++
+		case replicateOutcomeRemove:
+			s.Removes++
+		case replicateOutcomeRemoveDead:
+			s.DeadRemovals++
+		case replicateOutcomeRebalance:
+			s.Rebalances++
+		case replicateOutcomeTransferLease:
+			s.LeaseTransfers++
+		case replicateOutcomePurgatoryFailure:
+			s.PurgatoryFailures++
+		case replicateOutcomeSnapshotFailure:
+			s.SnapshotFailures++
+		case replicateOutcomeOtherFailure:
+			s.OtherFailures++
+		}
+	}
+	// Once the buffer is full, the entry at index is the oldest one. If it
+	// falls within the window, older ones may have, too.
+	if len(l.entries) == replicateActivityMaxEntries && !l.entries[l.index].at.Before(cutoff) {
+		s.Truncated = true
+	}
+	return s
+}
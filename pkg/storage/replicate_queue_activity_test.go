@@ -0,0 +1,94 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/pkg/errors"
+)
+
+func TestReplicateQueueRecentActivity(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rq := &replicateQueue{activity: newReplicateActivityLog()}
+	now := timeutil.Now()
+	// Outcomes older than the window aren't counted.
+	rq.activity.record(now.Add(-2*time.Hour), replicateOutcomeAdd)
+	rq.activity.record(now.Add(-2*time.Hour), replicateOutcomeOtherFailure)
+	for _, outcome := range []replicateOutcome{
+		replicateOutcomeAdd,
+		replicateOutcomeAdd,
+		replicateOutcomeRemove,
+		replicateOutcomeRemoveDead,
+		replicateOutcomeRebalance,
+		replicateOutcomeRebalance,
+		replicateOutcomeRebalance,
+		replicateOutcomeTransferLease,
+		replicateOutcomeSnapshotFailure,
+	} {
+		rq.activity.record(now, outcome)
+	}
+	rq.recordFailure(newQuorumError("range requires a replication change, but lacks a quorum"))
+	rq.recordFailure(errors.Wrap(&allocatorError{}, "avoid up-replicating to fragile quorum"))
+	rq.recordFailure(&benignError{errors.New("not raft leader while range needs removal")})
+	rq.recordFailure(errors.New("boom"))
+
+	exp := ReplicateActivitySummary{
+		Window:            time.Hour,
+		Adds:              2,
+		Removes:           1,
+		DeadRemovals:      1,
+		Rebalances:        3,
+		LeaseTransfers:    1,
+		PurgatoryFailures: 2,
+		SnapshotFailures:  1,
+		OtherFailures:     1,
+	}
+	if s := rq.RecentActivity(time.Hour); s != exp {
+		t.Fatalf("expected %+v, got %+v", exp, s)
+	}
+	if s := rq.activity.summarize(now.Add(3*time.Hour), time.Hour); s != (ReplicateActivitySummary{
+		Window: time.Hour,
+	}) {
+		t.Fatalf("expected no activity, got %+v", s)
+	}
+}
+
+func TestReplicateQueueRecentActivityTruncated(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	defer func(prev int) { replicateActivityMaxEntries = prev }(replicateActivityMaxEntries)
+	replicateActivityMaxEntries = 4
+
+	l := newReplicateActivityLog()
+	now := timeutil.Now()
+	for i := 0; i < 6; i++ {
+		l.record(now.Add(time.Duration(i)*time.Minute), replicateOutcomeAdd)
+	}
+	// Only the four most recent outcomes are remembered, the oldest of which
+	// was recorded at minute 2.
+	end := now.Add(5 * time.Minute)
+	if s := l.summarize(end, 10*time.Minute); s.Adds != 4 || !s.Truncated {
+		t.Fatalf("expected 4 adds in a truncated summary, got %+v", s)
+	}
+	if s := l.summarize(end, 3*time.Minute); s.Adds != 4 || !s.Truncated {
+		t.Fatalf("expected 4 adds in a truncated summary, got %+v", s)
+	}
+	if s := l.summarize(end, 150*time.Second); s.Adds != 3 || s.Truncated {
+		t.Fatalf("expected 3 adds in a complete summary, got %+v", s)
+	}
+}
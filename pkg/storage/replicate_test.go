@@ -38,13 +38,17 @@ func TestEagerReplication(t *testing.T) {
 	defer stopper.Stop(ctx)
 	store := createTestStoreWithConfig(t, stopper, storeCfg)
 
-	// After bootstrap, all of the system ranges should be present in replicate
-	// queue purgatory (because we only have a single store in the test and thus
-	// replication cannot succeed).
-	purgatoryStartCount := store.ReplicateQueuePurgatoryLength()
+	// After bootstrap, all of the system ranges should be stuck in replicate
+	// queue purgatory (because we only have a single store in the test and
+	// thus replication cannot succeed).
+	stuck, err := store.DrainReplicateQueue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	purgatoryStartCount := len(stuck)
 
 	t.Logf("purgatory start count is %d", purgatoryStartCount)
-	// Perform a split and check that there's one more range in the purgatory.
+	// Perform a split and check that the new range is stuck as well.
 
 	key := roachpb.Key("a")
 	args := adminSplitArgs(key)
@@ -52,16 +56,87 @@ func TestEagerReplication(t *testing.T) {
 	if pErr != nil {
 		t.Fatal(pErr)
 	}
+	rangeID := store.LookupReplica(roachpb.RKey(key)).RangeID
 
 	// The addition of replicas to the replicateQueue after a split
-	// occurs happens after the update of the descriptors in meta2
+	// occurs asynchronously, after the update of the descriptors in meta2,
 	// leaving a tiny window of time in which the newly split replica
-	// will not have been added to purgatory. Thus we loop.
+	// will not have been queued. Thus we loop.
 	testutils.SucceedsSoon(t, func() error {
-		expected := purgatoryStartCount + 1
-		if n := store.ReplicateQueuePurgatoryLength(); expected != n {
+		stuck, err := store.DrainReplicateQueue(ctx)
+		if err != nil {
+			return err
+		}
+		if expected, n := purgatoryStartCount+1, len(stuck); expected != n {
 			return errors.Errorf("expected %d replicas in purgatory, but found %d", expected, n)
 		}
+		if !containsRangeID(stuck, rangeID) {
+			return errors.Errorf("expected r%d in purgatory, but found %v", rangeID, stuck)
+		}
+		return nil
+	})
+}
+
+// TestStoreDrainReplicateQueue verifies that DrainReplicateQueue processes the
+// ranges in the replicate queue and returns the ones which are stuck, without
+// waiting for them.
+func TestStoreDrainReplicateQueue(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	storeCfg := storage.TestStoreConfig(nil /* clock */)
+	storeCfg.TestingKnobs.DisableScanner = true
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	store := createTestStoreWithConfig(t, stopper, storeCfg)
+
+	// Each split enqueues the new range, which can't be up-replicated on a
+	// single store.
+	var rangeIDs []roachpb.RangeID
+	for _, k := range []string{"a", "b", "c", "d"} {
+		key := roachpb.Key(k)
+		if _, pErr := client.SendWrapped(ctx, store.TestSender(), adminSplitArgs(key)); pErr != nil {
+			t.Fatal(pErr)
+		}
+		rangeIDs = append(rangeIDs, store.LookupReplica(roachpb.RKey(key)).RangeID)
+	}
+
+	testutils.SucceedsSoon(t, func() error {
+		stuck, err := store.DrainReplicateQueue(ctx)
+		if err != nil {
+			return err
+		}
+		for _, rangeID := range rangeIDs {
+			if !containsRangeID(stuck, rangeID) {
+				return errors.Errorf("expected r%d in purgatory, but found %v", rangeID, stuck)
+			}
+		}
 		return nil
 	})
+
+	// Draining again retries the stuck ranges once instead of waiting for them,
+	// and leaves them in purgatory.
+	stuck, err := store.DrainReplicateQueue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := store.ReplicateQueuePurgatoryLength(); n != len(stuck) {
+		t.Fatalf("expected %d replicas in purgatory, but found %d", len(stuck), n)
+	}
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := store.DrainReplicateQueue(cancelCtx); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func containsRangeID(rangeIDs []roachpb.RangeID, rangeID roachpb.RangeID) bool {
+	for _, id := range rangeIDs {
+		if id == rangeID {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,391 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+// Package sideloadtest provides a fault injecting wrapper around the storage
+// used for sideloaded Raft payloads, for use in tests only.
+//
+// The package does not import the storage package, so that the storage package
+// can use it in its own tests. Instead, it mirrors storage.SideloadStorage in
+// its SideloadStorage interface; the storage package asserts that both
+// interfaces stay in sync.
+package sideloadtest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/storagebase"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// SideloadStorage mirrors storage.SideloadStorage.
+type SideloadStorage interface {
+	Dir() string
+	Identity() (roachpb.RangeID, roachpb.ReplicaID)
+	Put(_ context.Context, index, term uint64, contents []byte) error
+	PutMany(_ context.Context, entries []storagebase.SideloadEntry) error
+	PutIfAbsent(_ context.Context, index, term uint64, contents []byte) (bool, error)
+	PutMonotonic(_ context.Context, index, term uint64, contents []byte) error
+	Get(_ context.Context, index, term uint64) ([]byte, error)
+	HasEntry(_ context.Context, index, term uint64) (bool, error)
+	Stat(_ context.Context, index, term uint64) (storagebase.SideloadFileInfo, error)
+	GetRange(_ context.Context, index, term uint64, start, end roachpb.Key) ([]byte, error)
+	Purge(_ context.Context, index, term uint64) (int64, error)
+	Clear(context.Context) error
+	TruncateTo(_ context.Context, index uint64) (freed, retained int64, _ error)
+	Filename(_ context.Context, index, term uint64) (string, error)
+	ForEach(_ context.Context, visit func(index, term uint64, size int64) error) error
+	IsEmpty(context.Context) (bool, error)
+	State() storagebase.SideloadDirState
+	BytesUsed(context.Context) (int64, error)
+}
+
+// Method identifies a method of SideloadStorage into which faults can be
+// injected. Dir and Identity never fail and can't be faulted.
+type Method int
+
+// The methods of SideloadStorage into which faults can be injected.
+const (
+	MethodPut Method = iota
+	MethodPutIfAbsent
+	MethodPutMonotonic
+	MethodGet
+	MethodPurge
+	MethodClear
+	MethodTruncateTo
+	MethodFilename
+	MethodForEach
+	MethodGetRange
+	MethodIsEmpty
+	MethodBytesUsed
+	MethodHasEntry
+	MethodPutMany
+	MethodStat
+)
+
+func (m Method) String() string {
+	switch m {
+	case MethodPut:
+		return "Put"
+	case MethodPutIfAbsent:
+		return "PutIfAbsent"
+	case MethodPutMonotonic:
+		return "PutMonotonic"
+	case MethodGet:
+		return "Get"
+	case MethodPurge:
+		return "Purge"
+	case MethodClear:
+		return "Clear"
+	case MethodTruncateTo:
+		return "TruncateTo"
+	case MethodFilename:
+		return "Filename"
+	case MethodForEach:
+		return "ForEach"
+	case MethodGetRange:
+		return "GetRange"
+	case MethodIsEmpty:
+		return "IsEmpty"
+	case MethodBytesUsed:
+		return "BytesUsed"
+	case MethodHasEntry:
+		return "HasEntry"
+	case MethodPutMany:
+		return "PutMany"
+	case MethodStat:
+		return "Stat"
+	}
+	return fmt.Sprintf("Method(%d)", int(m))
+}
+
+// Fault describes a failure injected into calls of a Method.
+type Fault struct {
+	// Delay, if nonzero, is waited out before the call proceeds. The wait is
+	// aborted, returning the context's error, if the context is canceled.
+	Delay time.Duration
+	// Err, if set, is returned from the call instead of invoking the wrapped
+	// storage.
+	Err error
+	// PartialRead, if set, makes Get return only the first ReadLen bytes of
+	// the payload (or all of it, if it is shorter). It only applies to Get.
+	PartialRead bool
+	ReadLen     int
+	// Count, if positive, is the number of calls the fault applies to, after
+	// which it is removed. Otherwise, the fault applies to all calls until it
+	// is cleared.
+	Count int
+}
+
+// FaultySideloadStorage is a SideloadStorage which delegates to a wrapped
+// SideloadStorage, but injects the faults configured for each method. All
+// results of the wrapped storage, including errors, are passed through
+// unchanged unless a fault says otherwise. It is safe to configure faults
+// concurrently with calls into the storage.
+type FaultySideloadStorage struct {
+	wrapped SideloadStorage
+
+	mu struct {
+		syncutil.Mutex
+		faults map[Method]Fault
+		calls  map[Method]int
+	}
+}
+
+var _ SideloadStorage = (*FaultySideloadStorage)(nil)
+
+// NewFaultySideloadStorage returns a FaultySideloadStorage wrapping the given
+// storage, initially without any faults.
+func NewFaultySideloadStorage(wrapped SideloadStorage) *FaultySideloadStorage {
+	ss := &FaultySideloadStorage{wrapped: wrapped}
+	ss.mu.faults = map[Method]Fault{}
+	ss.mu.calls = map[Method]int{}
+	return ss
+}
+
+// Wrapped returns the wrapped storage.
+func (ss *FaultySideloadStorage) Wrapped() SideloadStorage {
+	return ss.wrapped
+}
+
+// Inject configures the fault for the given method, replacing any fault
+// configured for it previously.
+func (ss *FaultySideloadStorage) Inject(m Method, f Fault) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.mu.faults[m] = f
+}
+
+// ClearFaults removes the faults configured for the given methods, or for all
+// methods if none are given.
+func (ss *FaultySideloadStorage) ClearFaults(methods ...Method) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if len(methods) == 0 {
+		ss.mu.faults = map[Method]Fault{}
+		return
+	}
+	for _, m := range methods {
+		delete(ss.mu.faults, m)
+	}
+}
+
+// Calls returns the number of calls of the given method so far, including
+// those which were failed by an injected fault.
+func (ss *FaultySideloadStorage) Calls(m Method) int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.mu.calls[m]
+}
+
+// fault records a call of the given method and returns the fault which
+// applies to it, if any.
+func (ss *FaultySideloadStorage) fault(m Method) (Fault, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.mu.calls[m]++
+	f, ok := ss.mu.faults[m]
+	if !ok {
+		return Fault{}, false
+	}
+	if f.Count > 0 {
+		if f.Count == 1 {
+			delete(ss.mu.faults, m)
+		} else {
+			next := f
+			next.Count--
+			ss.mu.faults[m] = next
+		}
+	}
+	return f, true
+}
+
+// before is called at the start of each faultable method. It waits out the
+// fault's delay and returns the error the call should fail with, if any, as
+// well as the fault itself so that callers can apply method-specific faults.
+func (ss *FaultySideloadStorage) before(ctx context.Context, m Method) (Fault, error) {
+	f, ok := ss.fault(m)
+	if !ok {
+		return Fault{}, nil
+	}
+	if f.Delay > 0 {
+		select {
+		case <-time.After(f.Delay):
+		case <-ctx.Done():
+			return f, ctx.Err()
+		}
+	}
+	return f, f.Err
+}
+
+// Dir implements SideloadStorage.
+func (ss *FaultySideloadStorage) Dir() string {
+	return ss.wrapped.Dir()
+}
+
+// Identity implements SideloadStorage.
+func (ss *FaultySideloadStorage) Identity() (roachpb.RangeID, roachpb.ReplicaID) {
+	return ss.wrapped.Identity()
+}
+
+// Put implements SideloadStorage.
+func (ss *FaultySideloadStorage) Put(
+	ctx context.Context, index, term uint64, contents []byte,
+) error {
+	if _, err := ss.before(ctx, MethodPut); err != nil {
+		return err
+	}
+	return ss.wrapped.Put(ctx, index, term, contents)
+}
+
+// PutMany implements SideloadStorage.
+func (ss *FaultySideloadStorage) PutMany(
+	ctx context.Context, entries []storagebase.SideloadEntry,
+) error {
+	if _, err := ss.before(ctx, MethodPutMany); err != nil {
+		return err
+	}
+	return ss.wrapped.PutMany(ctx, entries)
+}
+
+// PutIfAbsent implements SideloadStorage.
+func (ss *FaultySideloadStorage) PutIfAbsent(
+	ctx context.Context, index, term uint64, contents []byte,
+) (bool, error) {
+	if _, err := ss.before(ctx, MethodPutIfAbsent); err != nil {
+		return false, err
+	}
+	return ss.wrapped.PutIfAbsent(ctx, index, term, contents)
+}
+
+// PutMonotonic implements SideloadStorage.
+func (ss *FaultySideloadStorage) PutMonotonic(
+	ctx context.Context, index, term uint64, contents []byte,
+) error {
+	if _, err := ss.before(ctx, MethodPutMonotonic); err != nil {
+		return err
+	}
+	return ss.wrapped.PutMonotonic(ctx, index, term, contents)
+}
+
+// Get implements SideloadStorage.
+func (ss *FaultySideloadStorage) Get(ctx context.Context, index, term uint64) ([]byte, error) {
+	f, err := ss.before(ctx, MethodGet)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ss.wrapped.Get(ctx, index, term)
+	if err != nil {
+		return nil, err
+	}
+	if f.PartialRead && f.ReadLen < len(b) {
+		b = b[:f.ReadLen]
+	}
+	return b, nil
+}
+
+// HasEntry implements SideloadStorage.
+func (ss *FaultySideloadStorage) HasEntry(ctx context.Context, index, term uint64) (bool, error) {
+	if _, err := ss.before(ctx, MethodHasEntry); err != nil {
+		return false, err
+	}
+	return ss.wrapped.HasEntry(ctx, index, term)
+}
+
+// Stat implements SideloadStorage.
+func (ss *FaultySideloadStorage) Stat(
+	ctx context.Context, index, term uint64,
+) (storagebase.SideloadFileInfo, error) {
+	if _, err := ss.before(ctx, MethodStat); err != nil {
+		return storagebase.SideloadFileInfo{}, err
+	}
+	return ss.wrapped.Stat(ctx, index, term)
+}
+
+// GetRange implements SideloadStorage.
+func (ss *FaultySideloadStorage) GetRange(
+	ctx context.Context, index, term uint64, start, end roachpb.Key,
+) ([]byte, error) {
+	if _, err := ss.before(ctx, MethodGetRange); err != nil {
+		return nil, err
+	}
+	return ss.wrapped.GetRange(ctx, index, term, start, end)
+}
+
+// Purge implements SideloadStorage.
+func (ss *FaultySideloadStorage) Purge(ctx context.Context, index, term uint64) (int64, error) {
+	if _, err := ss.before(ctx, MethodPurge); err != nil {
+		return 0, err
+	}
+	return ss.wrapped.Purge(ctx, index, term)
+}
+
+// Clear implements SideloadStorage.
+func (ss *FaultySideloadStorage) Clear(ctx context.Context) error {
+	if _, err := ss.before(ctx, MethodClear); err != nil {
+		return err
+	}
+	return ss.wrapped.Clear(ctx)
+}
+
+// TruncateTo implements SideloadStorage.
+func (ss *FaultySideloadStorage) TruncateTo(
+	ctx context.Context, index uint64,
+) (freed, retained int64, _ error) {
+	if _, err := ss.before(ctx, MethodTruncateTo); err != nil {
+		return 0, 0, err
+	}
+	return ss.wrapped.TruncateTo(ctx, index)
+}
+
+// Filename implements SideloadStorage.
+func (ss *FaultySideloadStorage) Filename(
+	ctx context.Context, index, term uint64,
+) (string, error) {
+	if _, err := ss.before(ctx, MethodFilename); err != nil {
+		return "", err
+	}
+	return ss.wrapped.Filename(ctx, index, term)
+}
+
+// ForEach implements SideloadStorage.
+func (ss *FaultySideloadStorage) ForEach(
+	ctx context.Context, visit func(index, term uint64, size int64) error,
+) error {
+	if _, err := ss.before(ctx, MethodForEach); err != nil {
+		return err
+	}
+	return ss.wrapped.ForEach(ctx, visit)
+}
+
+// IsEmpty implements SideloadStorage.
+func (ss *FaultySideloadStorage) IsEmpty(ctx context.Context) (bool, error) {
+	if _, err := ss.before(ctx, MethodIsEmpty); err != nil {
+		return false, err
+	}
+	return ss.wrapped.IsEmpty(ctx)
+}
+
+// State implements SideloadStorage. Like Dir, it can't be faulted.
+func (ss *FaultySideloadStorage) State() storagebase.SideloadDirState {
+	return ss.wrapped.State()
+}
+
+// BytesUsed implements SideloadStorage.
+func (ss *FaultySideloadStorage) BytesUsed(ctx context.Context) (int64, error) {
+	if _, err := ss.before(ctx, MethodBytesUsed); err != nil {
+		return 0, err
+	}
+	return ss.wrapped.BytesUsed(ctx)
+}
@@ -70,6 +70,51 @@ type ApplyFilterArgs struct {
 	StoreID roachpb.StoreID
 }
 
+// SideloadEntry is a payload to be written to the sideloaded storage of a
+// replica, along with the index and term of the Raft log entry it belongs to.
+type SideloadEntry struct {
+	Index, Term uint64
+	Contents    []byte
+}
+
+// SideloadFileInfo describes a payload held by the sideloaded storage of a
+// replica, as returned by its Stat method.
+type SideloadFileInfo struct {
+	// Size is the size of the payload, as accounted for in the size of the
+	// Raft log.
+	Size int64
+	// ModTime is the time at which the payload was last written, or the zero
+	// time if the storage doesn't track it.
+	ModTime time.Time
+}
+
+// SideloadDirState describes where in its lifecycle the location backing the
+// sideloaded storage of a replica is.
+type SideloadDirState int
+
+const (
+	// SideloadDirNotCreated means that the location doesn't exist, either
+	// because nothing was written to the storage yet or because it was removed
+	// after the storage was emptied.
+	SideloadDirNotCreated SideloadDirState = iota
+	// SideloadDirEmpty means that the location exists but holds no payloads.
+	SideloadDirEmpty
+	// SideloadDirNonEmpty means that the location holds payloads.
+	SideloadDirNonEmpty
+)
+
+func (s SideloadDirState) String() string {
+	switch s {
+	case SideloadDirNotCreated:
+		return "not-created"
+	case SideloadDirEmpty:
+		return "empty"
+	case SideloadDirNonEmpty:
+		return "non-empty"
+	}
+	return fmt.Sprintf("SideloadDirState(%d)", int(s))
+}
+
 // InRaftCmd returns true if the filter is running in the context of a Raft
 // command (it could be running outside of one, for example for a read).
 func (f *FilterArgs) InRaftCmd() bool {
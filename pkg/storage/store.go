@@ -17,6 +17,8 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"os"
+	"path/filepath"
 	"runtime"
 	"sort"
 	"strings"
@@ -131,6 +133,14 @@ var addSSTableRequestMaxRate = settings.RegisterNonNegativeFloatSetting(
 
 const addSSTableRequestBurst = 32
 
+// addSSTableIngestRate is the maximum number of SSTables per second that the
+// application of AddSSTable commands ingests into the engine of a store.
+var addSSTableIngestRate = settings.RegisterNonNegativeFloatSetting(
+	"kv.bulk_io_write.ingest_rate",
+	"maximum number of SSTables per second ingested by AddSSTable commands applied on a single store",
+	float64(rate.Inf),
+)
+
 // addSSTableRequestLimit limits concurrent AddSSTable requests.
 var addSSTableRequestLimit = settings.RegisterPositiveIntSetting(
 	"kv.bulk_io_write.concurrent_addsstable_requests",
@@ -411,6 +421,22 @@ type Store struct {
 	limiters           batcheval.Limiters
 	txnWaitMetrics     *txnwait.Metrics
 
+	// sideloadWriteLimiter is shared by the sideloaded storages of all
+	// replicas and limits their aggregate write rate.
+	sideloadWriteLimiter *rate.Limiter
+	// sideloadCache caches the payloads read by the sideloaded storages of
+	// all replicas.
+	sideloadCache *sideloadCache
+	// sideloadMetrics are updated by the sideloaded storages of all replicas.
+	sideloadMetrics *sideloadMetrics
+	// splitReplication holds the ranges whose replication after a split is
+	// deferred (see enqueueReplicationAfterSplit).
+	splitReplication deferredSplitReplication
+
+	// ingestLimiter paces the ingestion of SSTables by applied AddSSTable
+	// commands across all replicas (see addSSTableIngestRate).
+	ingestLimiter *rate.Limiter
+
 	// gossipRangeCountdown and leaseRangeCountdown are countdowns of
 	// changes to range and leaseholder counts, after which the store
 	// descriptor will be re-gossiped earlier than the normal periodic
@@ -641,6 +667,17 @@ type StoreConfig struct {
 	// maintenance queue to dispatch individual maintenance tasks.
 	TimeSeriesDataStore TimeSeriesDataStore
 
+	// SideloadPlacementPolicy, if set, decides which AddSSTable payloads are
+	// sideloaded and which are kept inline in the Raft log. Optional; by
+	// default, all payloads are sideloaded.
+	SideloadPlacementPolicy SideloadPlacementPolicy
+
+	// SideloadEngines are the engines, besides the store's own, to whose
+	// auxiliary directories RebalanceSideloaded may relocate the sideloaded
+	// storages of replicas. A relocated storage can only be opened again, for
+	// example after a restart, if its engine is listed. Optional.
+	SideloadEngines []engine.Engine
+
 	// CoalescedHeartbeatsInterval is the interval for which heartbeat messages
 	// are queued and then sent as a single coalesced heartbeat; it is a
 	// fraction of the RaftTickInterval so that heartbeats don't get delayed by
@@ -800,6 +837,7 @@ func NewStore(
 			return 0, false
 		})
 	}
+	s.allocator.applyTestingKnobs(&cfg.TestingKnobs)
 	s.replRankings = newReplicaRankings()
 
 	s.draining.Store(false)
@@ -853,6 +891,14 @@ func NewStore(
 	bulkIOWriteLimit.SetOnChange(&cfg.Settings.SV, func() {
 		s.limiters.BulkIOWriteRate.SetLimit(rate.Limit(bulkIOWriteLimit.Get(&cfg.Settings.SV)))
 	})
+	s.sideloadWriteLimiter = rate.NewLimiter(rate.Limit(sideloadWriteLimit.Get(&cfg.Settings.SV)), bulkIOWriteBurst)
+	sideloadWriteLimit.SetOnChange(&cfg.Settings.SV, func() {
+		s.sideloadWriteLimiter.SetLimit(rate.Limit(sideloadWriteLimit.Get(&cfg.Settings.SV)))
+	})
+	s.sideloadCache = newSideloadCache(
+		cfg.Settings, s.metrics.AddSSTableSideloadCacheHits, s.metrics.AddSSTableSideloadCacheMisses,
+	)
+	s.sideloadMetrics = newSideloadMetrics(s.metrics)
 	s.limiters.ConcurrentImportRequests = limit.MakeConcurrentRequestLimiter(
 		"importRequestLimiter", int(importRequestsLimit.Get(&cfg.Settings.SV)),
 	)
@@ -885,6 +931,14 @@ func NewStore(
 		}
 		s.limiters.AddSSTableRequestRate.SetLimit(rate.Limit(rateLimit))
 	})
+	s.ingestLimiter = rate.NewLimiter(rate.Limit(addSSTableIngestRate.Get(&cfg.Settings.SV)), 1 /* burst */)
+	addSSTableIngestRate.SetOnChange(&cfg.Settings.SV, func() {
+		rateLimit := addSSTableIngestRate.Get(&cfg.Settings.SV)
+		if math.IsInf(rateLimit, 0) {
+			rateLimit = float64(rate.Inf)
+		}
+		s.ingestLimiter.SetLimit(rate.Limit(rateLimit))
+	})
 	s.limiters.ConcurrentAddSSTableRequests = limit.MakeConcurrentRequestLimiter(
 		"addSSTableRequestLimiter", int(addSSTableRequestLimit.Get(&cfg.Settings.SV)),
 	)
@@ -1447,6 +1501,10 @@ func (s *Store) Start(ctx context.Context, stopper *stop.Stopper) error {
 		s.compactor.Start(s.AnnotateCtx(context.Background()), s.stopper)
 	}
 
+	// Start deleting the sideloaded files pending deletion, including those
+	// left behind before a restart.
+	s.startSideloadSweeper(ctx)
+
 	// Set the started flag (for unittests).
 	atomic.StoreInt32(&s.started, 1)
 
@@ -2189,9 +2247,10 @@ func splitPostApply(
 	// If the range was not properly replicated before the split, the replicate
 	// queue may not have picked it up (due to the need for a split). Enqueue
 	// both the left and right ranges to speed up a potentially necessary
-	// replication. See #7022 and #7800.
-	r.store.replicateQueue.MaybeAddAsync(ctx, r, now)
-	r.store.replicateQueue.MaybeAddAsync(ctx, rightRng, now)
+	// replication. See #7022 and #7800. To avoid churn during rapid successive
+	// splits, this may be deferred by kv.split.replication_grace_period.
+	r.store.enqueueReplicationAfterSplit(ctx, r, now)
+	r.store.enqueueReplicationAfterSplit(ctx, rightRng, now)
 
 	if len(split.RightDesc.Replicas().Unwrap()) == 1 {
 		// TODO(peter): In single-node clusters, we enqueue the right-hand side of
@@ -4392,6 +4451,22 @@ func (s *Store) ManuallyEnqueue(
 	return collect(), "", nil
 }
 
+// ReplicateQueueActivity summarizes the recent processing outcomes of the
+// store's replicate queue within the given window.
+func (s *Store) ReplicateQueueActivity(window time.Duration) ReplicateActivitySummary {
+	return s.replicateQueue.RecentActivity(window)
+}
+
+// DrainReplicateQueue processes the replicas currently in the store's
+// replicate queue, and retries those in its purgatory once, returning when no
+// more of them can make progress. Replicas which remain in purgatory are not
+// waited on, and the IDs of their ranges are returned, in increasing order.
+// It allows tests and operational drills to reach a stable replication state
+// without polling.
+func (s *Store) DrainReplicateQueue(ctx context.Context) ([]roachpb.RangeID, error) {
+	return s.replicateQueue.DrainAndWait(ctx)
+}
+
 // GetClusterVersion reads the the cluster version from the store-local version
 // key. Returns an empty version if the key is not found.
 func (s *Store) GetClusterVersion(ctx context.Context) (cluster.ClusterVersion, error) {
@@ -4413,6 +4488,133 @@ func ReadClusterVersion(ctx context.Context, reader engine.Reader) (cluster.Clus
 	return cv, err
 }
 
+// sideloadRelocationPath returns the path of the file which records the
+// auxiliary directory to which RebalanceSideloaded relocated the sideloaded
+// storage of the given range. It is kept next to the directory which the
+// storage uses otherwise.
+func sideloadRelocationPath(baseDir string, rangeID roachpb.RangeID) string {
+	return sideloadedPath(baseDir, rangeID) + ".relocated"
+}
+
+// sideloadLocation returns the base directory and the engine of the sideloaded
+// storage of the replica for the given range. These are those of the store's
+// engine, unless the storage was relocated by RebalanceSideloaded.
+func (s *Store) sideloadLocation(rangeID roachpb.RangeID) (string, engine.Engine, error) {
+	baseDir := s.engine.GetAuxiliaryDir()
+	path := sideloadRelocationPath(baseDir, rangeID)
+	if ok, err := exists(path); err != nil || !ok {
+		return baseDir, s.engine, err
+	}
+	b, err := s.engine.ReadFile(path)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "reading location of sideloaded storage of r%d", rangeID)
+	}
+	for _, eng := range s.cfg.SideloadEngines {
+		if eng.GetAuxiliaryDir() == string(b) {
+			return string(b), eng, nil
+		}
+	}
+	return "", nil, errors.Errorf("sideloaded storage of r%d was relocated to %s, "+
+		"which belongs to none of the sideload engines of the store", rangeID, b)
+}
+
+// setSideloadLocation records that the sideloaded storage of the replica for
+// the given range is located in the auxiliary directory of the given engine,
+// for sideloadLocation to find.
+func (s *Store) setSideloadLocation(rangeID roachpb.RangeID, eng engine.Engine) error {
+	path := sideloadRelocationPath(s.engine.GetAuxiliaryDir(), rangeID)
+	if eng == s.engine {
+		if ok, err := exists(path); err != nil || !ok {
+			return err
+		}
+		return s.engine.DeleteFile(path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// The file is replaced atomically, as a partially written one would
+	// reference none of the sideload engines, failing the initialization of
+	// the replica.
+	return writeFileAtomically(s.engine, path, []byte(eng.GetAuxiliaryDir()))
+}
+
+// RebalanceSideloaded relocates the sideloaded storage of the replica for the
+// given range to the auxiliary directory of the target engine, which allows
+// balancing disk usage across the engines of a multi-store node. The target
+// engine must be the store's own, or one of StoreConfig.SideloadEngines.
+//
+// All payloads are copied to the new location (see copySideloadStorage), and
+// the new location is persisted, before any payload is removed from the old
+// one, so that the replica finds its payloads when it is initialized again, for
+// example after a restart. Raft processing for the replica, which includes all
+// writes to and truncations of its sideloaded storage, is blocked for the
+// duration of the move.
+func (s *Store) RebalanceSideloaded(
+	ctx context.Context, rangeID roachpb.RangeID, targetEngine engine.Engine,
+) error {
+	known := targetEngine == s.engine
+	for _, eng := range s.cfg.SideloadEngines {
+		known = known || eng == targetEngine
+	}
+	if !known {
+		return errors.Errorf("r%d: target engine is none of the sideload engines of the store", rangeID)
+	}
+	repl, err := s.GetReplica(rangeID)
+	if err != nil {
+		return err
+	}
+
+	repl.raftMu.Lock()
+	defer repl.raftMu.Unlock()
+
+	src := repl.raftMu.sideloaded
+	if src == nil {
+		return errors.Errorf("r%d: sideloaded storage is uninitialized", rangeID)
+	}
+	if _, ok := src.(*cloudSideloadStorage); ok {
+		return errors.Errorf("r%d: sideloaded storage is kept in an external object store", rangeID)
+	}
+	_, replicaID := src.Identity()
+	dst, err := newDiskSideloadStorage(
+		s.cfg.Settings,
+		rangeID,
+		replicaID,
+		targetEngine.GetAuxiliaryDir(),
+		s.limiters.BulkIOWriteRate,
+		s.sideloadWriteLimiter,
+		s.sideloadCache,
+		targetEngine,
+	)
+	if err != nil {
+		return errors.Wrap(err, "while initializing target sideloaded storage")
+	}
+	dst.metrics = s.sideloadMetrics
+	if dst.Dir() == src.Dir() {
+		return nil
+	}
+
+	if err := func() error {
+		if err := copySideloadStorage(ctx, src, dst); err != nil {
+			return err
+		}
+		return s.setSideloadLocation(rangeID, targetEngine)
+	}(); err != nil {
+		if clearErr := dst.Clear(ctx); clearErr != nil {
+			log.Warningf(ctx, "unable to clean up partially relocated sideloaded storage: %s", clearErr)
+		}
+		return errors.Wrapf(err, "while relocating sideloaded storage of r%d", rangeID)
+	}
+	// dst is complete and persisted as the location of the storage, so a
+	// failure to clear src only leaves files behind.
+	if err := src.Clear(ctx); err != nil {
+		log.Warningf(ctx, "unable to clear sideloaded storage %s after moving it to %s: %s",
+			src.Dir(), dst.Dir(), err)
+	}
+	repl.raftMu.sideloaded = dst
+	log.Infof(ctx, "relocated sideloaded storage of r%d from %s to %s", rangeID, src.Dir(), dst.Dir())
+	return nil
+}
+
 // GetTxnWaitKnobs is part of txnwait.StoreInterface.
 func (s *Store) GetTxnWaitKnobs() txnwait.TestingKnobs {
 	return s.TestingKnobs().TxnWaitKnobs
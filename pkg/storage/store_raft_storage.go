@@ -0,0 +1,177 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package storage
+
+import (
+	"context"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/pkg/errors"
+)
+
+// raftStorageSummaryTopRanges is the number of ranges listed in
+// RaftStorageSummary.TopRangesByLogBytes.
+const raftStorageSummaryTopRanges = 10
+
+// RangeLogStat describes the Raft log storage of a single replica.
+type RangeLogStat struct {
+	RangeID roachpb.RangeID
+	// LogBytes is the size of the Raft log, including the sideloaded payloads
+	// of its entries.
+	LogBytes int64
+	// SideloadedBytes is the size of the sideloaded payloads.
+	SideloadedBytes int64
+}
+
+// RaftStorageSummary describes the storage used by the Raft logs of the
+// replicas of a store, as computed by Store.RaftStorageSummary.
+type RaftStorageSummary struct {
+	// TotalLogBytes is the total size of the Raft logs, including the
+	// sideloaded payloads of their entries.
+	TotalLogBytes int64
+	// TotalSideloadedBytes is the part of TotalLogBytes stored in sideloaded
+	// payloads.
+	TotalSideloadedBytes int64
+	// TopRangesByLogBytes lists the replicas with the largest Raft logs, in
+	// decreasing order of LogBytes.
+	TopRangesByLogBytes []RangeLogStat
+}
+
+// RaftStorageSummary recomputes the size of the Raft log of every replica on
+// the store (see Replica.RaftLogSizeBreakdown) and returns their totals along
+// with the replicas with the largest logs, which helps with planning disk
+// capacity. Replicas which are being removed are skipped. Like the breakdown,
+// it is expensive: it reads all Raft logs, and blocks the Raft processing of
+// each replica while its log is measured.
+func (s *Store) RaftStorageSummary(ctx context.Context) (RaftStorageSummary, error) {
+	var summary RaftStorageSummary
+	var stats []RangeLogStat
+	var err error
+	newStoreReplicaVisitor(s).Visit(func(r *Replica) bool {
+		if _, destroyErr := r.IsDestroyed(); destroyErr != nil {
+			return true
+		}
+		breakdown, breakdownErr := r.RaftLogSizeBreakdown(ctx)
+		if breakdownErr != nil {
+			// The replica may have been removed while its log was measured.
+			if _, destroyErr := r.IsDestroyed(); destroyErr != nil {
+				return true
+			}
+			err = errors.Wrapf(breakdownErr, "r%d", r.RangeID)
+			return false
+		}
+		summary.TotalLogBytes += breakdown.Recomputed
+		summary.TotalSideloadedBytes += breakdown.SideloadedBytes
+		stats = append(stats, RangeLogStat{
+			RangeID:         r.RangeID,
+			LogBytes:        breakdown.Recomputed,
+			SideloadedBytes: breakdown.SideloadedBytes,
+		})
+		return true
+	})
+	if err != nil {
+		return RaftStorageSummary{}, err
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].LogBytes != stats[j].LogBytes {
+			return stats[i].LogBytes > stats[j].LogBytes
+		}
+		return stats[i].RangeID < stats[j].RangeID
+	})
+	if len(stats) > raftStorageSummaryTopRanges {
+		stats = stats[:raftStorageSummaryTopRanges]
+	}
+	summary.TopRangesByLogBytes = stats
+	return summary, nil
+}
+
+// RangeDrift describes the discrepancy between the Raft log size tracked by a
+// replica and the size recomputed from storage.
+type RangeDrift struct {
+	RangeID roachpb.RangeID
+	// Drift is the tracked minus the recomputed size of the Raft log.
+	Drift int64
+	RaftLogSizeBreakdown
+}
+
+// SideloadAccountingDrift recomputes the size of the Raft log of every replica
+// on the store (see Replica.RaftLogSizeBreakdown) and returns the replicas
+// whose tracked size differs from it, in decreasing order of the magnitude of
+// the difference. The tracked size only covers the log as a whole, but the
+// sizes of sideloaded payloads are the usual source of drift, which the
+// SideloadedBytes of each breakdown help to confirm.
+//
+// Replicas which are being removed are skipped, as are replicas whose tracked
+// size isn't trusted and is thus expected to be inaccurate. Like
+// RaftStorageSummary, it is expensive.
+func (s *Store) SideloadAccountingDrift(ctx context.Context) ([]RangeDrift, error) {
+	var drifts []RangeDrift
+	var err error
+	newStoreReplicaVisitor(s).Visit(func(r *Replica) bool {
+		if _, destroyErr := r.IsDestroyed(); destroyErr != nil {
+			return true
+		}
+		breakdown, breakdownErr := r.RaftLogSizeBreakdown(ctx)
+		if breakdownErr != nil {
+			// The replica may have been removed while its log was measured.
+			if _, destroyErr := r.IsDestroyed(); destroyErr != nil {
+				return true
+			}
+			err = errors.Wrapf(breakdownErr, "r%d", r.RangeID)
+			return false
+		}
+		if !breakdown.TrackedTrusted || breakdown.Tracked == breakdown.Recomputed {
+			return true
+		}
+		drifts = append(drifts, RangeDrift{
+			RangeID:              r.RangeID,
+			Drift:                breakdown.Tracked - breakdown.Recomputed,
+			RaftLogSizeBreakdown: breakdown,
+		})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	abs := func(x int64) int64 {
+		if x < 0 {
+			return -x
+		}
+		return x
+	}
+	sort.Slice(drifts, func(i, j int) bool {
+		if a, b := abs(drifts[i].Drift), abs(drifts[j].Drift); a != b {
+			return a > b
+		}
+		return drifts[i].RangeID < drifts[j].RangeID
+	})
+	return drifts, nil
+}
+
+// QuarantineSideloaded moves the sideloaded storage of the given range's
+// replica, which has been found to be corrupt, into a quarantine area that
+// preserves it for investigation, and marks the replica as needing a snapshot
+// (see Replica.NeedsSnapshot). The replica is then queued for the Raft log
+// queue, which truncates the affected entries. It is idempotent.
+func (s *Store) QuarantineSideloaded(ctx context.Context, rangeID roachpb.RangeID) error {
+	r, err := s.GetReplica(rangeID)
+	if err != nil {
+		return err
+	}
+	if err := r.quarantineSideloaded(ctx); err != nil {
+		return err
+	}
+	s.raftLogQueue.MaybeAddAsync(ctx, r, s.Clock().Now())
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// defaultSideloadSweepInterval is the interval at which the store deletes the
+// sideloaded files whose deletion has been deferred (see
+// sideloadDeferredDeletion).
+const defaultSideloadSweepInterval = time.Minute
+
+// startSideloadSweeper deletes the sideloaded files left pending deletion by a
+// previous incarnation of the store, and then starts a worker which
+// periodically deletes the files pending deletion. Pending deletions are only
+// recorded in the filesystem, so a crash never loses track of them.
+func (s *Store) startSideloadSweeper(ctx context.Context) {
+	if _, err := sweepSideloadPendingDeletions(ctx, s.engine, s.engine.GetAuxiliaryDir()); err != nil {
+		log.Warningf(ctx, "unable to remove sideloaded files pending deletion: %s", err)
+	}
+	interval := s.cfg.TestingKnobs.SideloadSweepInterval
+	if interval == 0 {
+		interval = defaultSideloadSweepInterval
+	}
+	s.stopper.RunWorker(ctx, func(ctx context.Context) {
+		timer := timeutil.NewTimer()
+		defer timer.Stop()
+		for {
+			timer.Reset(interval)
+			select {
+			case <-timer.C:
+				timer.Read = true
+				if _, err := sweepSideloadPendingDeletions(ctx, s.engine, s.engine.GetAuxiliaryDir()); err != nil {
+					log.Warningf(ctx, "unable to remove sideloaded files pending deletion: %s", err)
+				}
+			case <-s.stopper.ShouldStop():
+				return
+			}
+		}
+	})
+}
+
+// sweepSideloadPendingDeletions deletes the sideloaded files pending deletion
+// in the sideloaded storages rooted in the given base directory (see
+// sideloadedPath) through the given engine, and returns their number. The
+// directories containing them are removed as well if they end up empty, which
+// the storages leave to the sweeper (see diskSideloadStorage.TruncateTo).
+func sweepSideloadPendingDeletions(
+	ctx context.Context, eng engine.Engine, baseDir string,
+) (int, error) {
+	root := filepath.Join(baseDir, "sideloading")
+	quarantine := filepath.Join(root, "quarantine")
+	var removed int
+	dirs := make(map[string]struct{})
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// The sideloaded directory of a replica may be removed
+				// concurrently.
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if path == quarantine {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, sideloadPendingDeleteSuffix) {
+			return nil
+		}
+		if err := eng.DeleteFile(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		dirs[filepath.Dir(path)] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return removed, err
+	}
+	for dir := range dirs {
+		// This fails if the directory is still in use, which is fine. The
+		// engine can only remove directories along with the files in them,
+		// which could include files written concurrently.
+		if err := os.Remove(dir); err == nil && (shardedSideloadFileNamer{}).isShard(filepath.Base(dir)) {
+			// The directory of the storage may have been left to the sweeper
+			// as well (see sideloadFileNamer).
+			_ = os.Remove(filepath.Dir(dir))
+		}
+	}
+	if removed > 0 {
+		log.VEventf(ctx, 2, "removed %d sideloaded files pending deletion", removed)
+	}
+	return removed, nil
+}
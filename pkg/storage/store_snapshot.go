@@ -24,12 +24,15 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/raftentry"
+	"github.com/cockroachdb/cockroach/pkg/storage/storagepb"
 	"github.com/cockroachdb/cockroach/pkg/util/envutil"
 	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+	"github.com/golang/snappy"
 	"github.com/pkg/errors"
 	"go.etcd.io/etcd/raft/raftpb"
 	"golang.org/x/time/rate"
@@ -104,6 +107,16 @@ type kvBatchSnapshotStrategy struct {
 	batchSize int64
 	limiter   *rate.Limiter
 	newBatch  func() engine.Batch
+	// logEntriesBatchSize is the approximate number of bytes of raft log
+	// entries sent per SnapshotRequest. If zero, all entries are sent in a
+	// single request.
+	logEntriesBatchSize int64
+	// compressLogEntries enables the compression of the raft log entries
+	// with inlined sideloaded payloads (see compressSnapshotLogEntry).
+	compressLogEntries bool
+	// missingSideloadedPolicy determines how a missing sideloaded payload is
+	// handled.
+	missingSideloadedPolicy snapshotMissingSideloadedPolicy
 }
 
 // Send implements the snapshotStrategy interface.
@@ -127,8 +140,12 @@ func (kvSS *kvBatchSnapshotStrategy) Receive(
 		if req.KVBatch != nil {
 			batches = append(batches, req.KVBatch)
 		}
-		if req.LogEntries != nil {
-			logEntries = append(logEntries, req.LogEntries...)
+		for _, entBytes := range req.LogEntries {
+			decoded, err := decompressSnapshotLogEntry(entBytes)
+			if err != nil {
+				return IncomingSnapshot{}, sendSnapshotError(stream, err)
+			}
+			logEntries = append(logEntries, decoded)
 		}
 		if req.Final {
 			snapUUID, err := uuid.FromBytes(header.RaftMessageRequest.Message.Snapshot.Data)
@@ -207,8 +224,7 @@ func (kvSS *kvBatchSnapshotStrategy) Send(
 		}
 	}
 
-	// Iterate over the specified range of Raft entries and send them all out
-	// together.
+	// Iterate over the specified range of Raft entries and send them out.
 	firstIndex := header.State.TruncatedState.Index + 1
 	endIndex := snap.RaftSnap.Metadata.Index + 1
 	preallocSize := endIndex - firstIndex
@@ -264,24 +280,29 @@ func (kvSS *kvBatchSnapshotStrategy) Send(
 		return err
 	}
 
-	// Inline the payloads for all sideloaded proposals.
+	// Inline the payloads for all sideloaded proposals and stream out the log
+	// entries, in batches of about logEntriesBatchSize bytes if requested.
 	//
 	// TODO(tschottdorf): could also send slim proposals and attach sideloaded
 	// SSTables directly to the snapshot. Probably the better long-term
 	// solution, but let's see if it ever becomes relevant. Snapshots with
 	// inlined proposals are hopefully the exception.
-	{
-		var ent raftpb.Entry
-		for i := range logEntries {
-			if err := protoutil.Unmarshal(logEntries[i], &ent); err != nil {
-				return err
-			}
-			if !sniffSideloadedRaftCommand(ent.Data) {
-				continue
-			}
+	var enc snapshotLogEntryEncoder
+	var ent raftpb.Entry
+	var batch [][]byte
+	var batchBytes int64
+	var sentBatches, compressed int
+	for i := range logEntries {
+		entBytes := logEntries[i]
+		if err := protoutil.Unmarshal(entBytes, &ent); err != nil {
+			return err
+		}
+		if sniffSideloadedRaftCommand(ent.Data) {
 			if err := snap.WithSideloaded(func(ss SideloadStorage) error {
+				// Streaming a snapshot does not perform read-repair, as it
+				// should not mutate the replica's on-disk state.
 				newEnt, err := maybeInlineSideloadedRaftCommand(
-					ctx, rangeID, ent, ss, snap.RaftEntryCache,
+					ctx, nil /* st */, rangeID, ent, ss, snap.RaftEntryCache,
 				)
 				if err != nil {
 					return err
@@ -292,6 +313,12 @@ func (kvSS *kvBatchSnapshotStrategy) Send(
 				return nil
 			}); err != nil {
 				if errors.Cause(err) == errSideloadedFileNotFound {
+					if kvSS.missingSideloadedPolicy == snapshotMissingSideloadedAbort {
+						return &errSnapshotSideloadedPayloadMissing{
+							index: ent.Index,
+							term:  ent.Term,
+						}
+					}
 					// We're creating the Raft snapshot based on a snapshot of
 					// the engine, but the Raft log may since have been
 					// truncated and corresponding on-disk sideloaded payloads
@@ -313,15 +340,112 @@ func (kvSS *kvBatchSnapshotStrategy) Send(
 				}
 				return err
 			}
-			// TODO(tschottdorf): it should be possible to reuse `logEntries[i]` here.
 			var err error
-			if logEntries[i], err = protoutil.Marshal(&ent); err != nil {
+			if entBytes, err = enc.encode(&ent); err != nil {
+				return err
+			}
+			if kvSS.compressLogEntries {
+				var ok bool
+				if entBytes, ok = compressSnapshotLogEntry(entBytes); ok {
+					compressed++
+				}
+			}
+		}
+		// The original encoding is no longer needed; drop it so that the
+		// entries already sent can be garbage collected.
+		logEntries[i] = nil
+		batch = append(batch, entBytes)
+		batchBytes += int64(len(entBytes))
+
+		if kvSS.logEntriesBatchSize > 0 && batchBytes >= kvSS.logEntriesBatchSize {
+			if err := stream.Send(&SnapshotRequest{LogEntries: batch}); err != nil {
 				return err
 			}
+			sentBatches++
+			// The stream doesn't retain the request once Send returns, so the
+			// batch and the encoded entries can be reused.
+			batch = batch[:0]
+			batchBytes = 0
+			enc.reset()
 		}
 	}
-	kvSS.status = fmt.Sprintf("kv pairs: %d, log entries: %d", n, len(logEntries))
-	return stream.Send(&SnapshotRequest{LogEntries: logEntries})
+	if len(batch) > 0 || sentBatches == 0 {
+		if err := stream.Send(&SnapshotRequest{LogEntries: batch}); err != nil {
+			return err
+		}
+		sentBatches++
+	}
+	kvSS.status = fmt.Sprintf("kv pairs: %d, log entries: %d (in %d requests, %d compressed)",
+		n, len(logEntries), sentBatches, compressed)
+	return nil
+}
+
+// snapshotLogEntryCompressedPrefix precedes the snappy-compressed encoding of a
+// raft log entry sent in a snapshot. The encoding of a raftpb.Entry never
+// starts with a zero byte, which isn't a valid protobuf field tag, so
+// compressed entries can be told apart from uncompressed ones.
+const snapshotLogEntryCompressedPrefix = byte(0)
+
+// compressSnapshotLogEntry returns the compressed form of the given encoded
+// raft log entry, and true, if it is smaller than the entry. Otherwise, it
+// returns the entry unchanged and false. Only entries with inlined sideloaded
+// payloads are worth compressing, as other entries are small.
+func compressSnapshotLogEntry(entBytes []byte) ([]byte, bool) {
+	buf := make([]byte, 1+snappy.MaxEncodedLen(len(entBytes)))
+	buf[0] = snapshotLogEntryCompressedPrefix
+	buf = buf[:1+len(snappy.Encode(buf[1:], entBytes))]
+	if len(buf) >= len(entBytes) {
+		return entBytes, false
+	}
+	return buf, true
+}
+
+// decompressSnapshotLogEntry is the inverse of compressSnapshotLogEntry. Entries
+// which weren't compressed are returned unchanged.
+func decompressSnapshotLogEntry(entBytes []byte) ([]byte, error) {
+	if len(entBytes) == 0 || entBytes[0] != snapshotLogEntryCompressedPrefix {
+		return entBytes, nil
+	}
+	decoded, err := snappy.Decode(nil, entBytes[1:])
+	if err != nil {
+		return nil, errors.Wrap(err, "decompressing snapshot log entry")
+	}
+	return decoded, nil
+}
+
+// snapshotLogEntryEncoder encodes the raft log entries sent in a snapshot into
+// a scratch buffer shared between them, which avoids allocating a buffer per
+// entry.
+type snapshotLogEntryEncoder struct {
+	scratch []byte
+}
+
+// encode returns the encoding of the given entry. The returned slice remains
+// valid until the next call to reset.
+func (e *snapshotLogEntryEncoder) encode(ent *raftpb.Entry) ([]byte, error) {
+	size := ent.Size()
+	if cap(e.scratch)-len(e.scratch) < size {
+		// Allocate a new buffer rather than growing the existing one, which
+		// would invalidate the entries encoded into it.
+		newCap := 2 * cap(e.scratch)
+		if newCap < size {
+			newCap = size
+		}
+		e.scratch = make([]byte, 0, newCap)
+	}
+	start := len(e.scratch)
+	n, err := ent.MarshalTo(e.scratch[start : start+size])
+	if err != nil {
+		return nil, err
+	}
+	e.scratch = e.scratch[:start+n]
+	return e.scratch[start : start+n : start+n], nil
+}
+
+// reset allows the scratch buffer to be reused, invalidating all entries
+// previously returned by encode.
+func (e *snapshotLogEntryEncoder) reset() {
+	e.scratch = e.scratch[:0]
 }
 
 func (kvSS *kvBatchSnapshotStrategy) sendBatch(
@@ -695,6 +819,42 @@ var recoverySnapshotRate = settings.RegisterByteSizeSetting(
 	envutil.EnvOrDefaultBytes("COCKROACH_RAFT_SNAPSHOT_RATE", 8<<20),
 )
 
+// snapshotLogEntryCompression enables the compression of the raft log entries
+// sent in snapshots which carry inlined sideloaded payloads, i.e. SSTables.
+// This only affects the data sent over the network, not the data at rest. It
+// has no effect until all nodes are able to decompress the entries.
+var snapshotLogEntryCompression = settings.RegisterBoolSetting(
+	"kv.snapshot_log_entries.compression.enabled",
+	"if enabled, raft log entries with inlined sideloaded payloads are compressed when sent in snapshots",
+	false,
+)
+
+// snapshotMissingSideloadedPolicy controls how the sender of a snapshot handles
+// a sideloaded payload which is missing from the sideloaded storage of the
+// replica, which usually means that the Raft log was truncated while the
+// snapshot was being sent.
+type snapshotMissingSideloadedPolicy int64
+
+const (
+	// snapshotMissingSideloadedRetry fails the snapshot with an
+	// errMustRetrySnapshotDueToTruncation, upon which the caller can retry.
+	snapshotMissingSideloadedRetry snapshotMissingSideloadedPolicy = iota
+	// snapshotMissingSideloadedAbort fails the snapshot with an
+	// errSnapshotSideloadedPayloadMissing, which indicates that the recipient
+	// should rather be sent a snapshot by another replica.
+	snapshotMissingSideloadedAbort
+)
+
+var snapshotMissingSideloadedPolicySetting = settings.RegisterEnumSetting(
+	"kv.snapshot.missing_sideloaded_policy",
+	"how the sender of a snapshot handles a missing sideloaded Raft payload",
+	"retry",
+	map[int64]string{
+		int64(snapshotMissingSideloadedRetry): "retry",
+		int64(snapshotMissingSideloadedAbort): "abort",
+	},
+)
+
 func snapshotRateLimit(
 	st *cluster.Settings, priority SnapshotRequest_Priority,
 ) (rate.Limit, error) {
@@ -708,6 +868,63 @@ func snapshotRateLimit(
 	}
 }
 
+// SideloadedIndexesForSnapshot returns the index and term of each sideloaded
+// Raft log entry whose payload has to be inlined when sending a snapshot with
+// the given header. The snapshot includes the log entries following the
+// truncated state up to and including the applied index; of these, the
+// sideloaded entries that are not already inlined are returned, in increasing
+// order of index. The reader must be the engine snapshot the header was
+// created from.
+//
+// The entries whose payload can be found neither in the given sideloaded
+// storage nor in the entry cache, which may be nil, are additionally returned
+// as missing, as the sender would fail to inline them.
+func SideloadedIndexesForSnapshot(
+	ctx context.Context,
+	reader engine.Reader,
+	header SnapshotRequest_Header,
+	ss SideloadStorage,
+	entryCache *raftentry.Cache,
+) (keys, missing []SideloadKey, _ error) {
+	rangeID := header.State.Desc.RangeID
+	firstIndex := header.State.TruncatedState.Index + 1
+	endIndex := header.State.RaftAppliedIndex + 1
+
+	var ent raftpb.Entry
+	scanFunc := func(kv roachpb.KeyValue) (bool, error) {
+		if err := kv.Value.GetProto(&ent); err != nil {
+			return false, err
+		}
+		if !sniffSideloadedRaftCommand(ent.Data) {
+			return false, nil
+		}
+		var command storagepb.RaftCommand
+		_, data := DecodeRaftCommand(ent.Data)
+		if err := protoutil.Unmarshal(data, &command); err != nil {
+			return false, err
+		}
+		field, ok := findSideloadableField(&command)
+		if !ok {
+			return false, nil
+		}
+		if payload, _ := field.get(&command); len(payload) > 0 {
+			return false, nil
+		}
+		key := SideloadKey{Index: ent.Index, Term: ent.Term}
+		keys = append(keys, key)
+		if ok, err := hasSideloadedPayload(ctx, rangeID, ent, ss, entryCache); err != nil {
+			return false, err
+		} else if !ok {
+			missing = append(missing, key)
+		}
+		return false, nil
+	}
+	if err := iterateEntries(ctx, reader, rangeID, firstIndex, endIndex, scanFunc); err != nil {
+		return nil, nil, err
+	}
+	return keys, missing, nil
+}
+
 type errMustRetrySnapshotDueToTruncation struct {
 	index, term uint64
 }
@@ -719,6 +936,21 @@ func (e *errMustRetrySnapshotDueToTruncation) Error() string {
 	)
 }
 
+// errSnapshotSideloadedPayloadMissing is returned instead of
+// errMustRetrySnapshotDueToTruncation if the snapshot sender is configured to
+// abort on missing sideloaded payloads (see snapshotMissingSideloadedAbort).
+type errSnapshotSideloadedPayloadMissing struct {
+	index, term uint64
+}
+
+func (e *errSnapshotSideloadedPayloadMissing) Error() string {
+	return fmt.Sprintf(
+		"aborting snapshot because the sideloaded SSTable at index %d, term %d is missing; "+
+			"the recipient needs a snapshot from another replica",
+		e.index, e.term,
+	)
+}
+
 // sendSnapshot sends an outgoing snapshot via a pre-opened GRPC stream.
 func sendSnapshot(
 	ctx context.Context,
@@ -733,6 +965,29 @@ func sendSnapshot(
 ) error {
 	start := timeutil.Now()
 	to := header.RaftMessageRequest.ToReplica
+	missingSideloadedPolicy := snapshotMissingSideloadedPolicy(
+		snapshotMissingSideloadedPolicySetting.Get(&st.SV))
+	if missingSideloadedPolicy == snapshotMissingSideloadedAbort && snap.WithSideloaded != nil {
+		// A snapshot which would be aborted due to a missing sideloaded
+		// payload is aborted before it takes up a reservation at the
+		// recipient. Payloads may still go missing while the snapshot is sent.
+		var missing []SideloadKey
+		if err := snap.WithSideloaded(func(ss SideloadStorage) error {
+			var err error
+			_, missing, err = SideloadedIndexesForSnapshot(
+				ctx, snap.EngineSnap, header, ss, snap.RaftEntryCache,
+			)
+			return err
+		}); err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			return &errSnapshotSideloadedPayloadMissing{
+				index: missing[0].Index,
+				term:  missing[0].Term,
+			}
+		}
+	}
 	if err := stream.Send(&SnapshotRequest{Header: &header}); err != nil {
 		return err
 	}
@@ -793,10 +1048,14 @@ func sendSnapshot(
 	switch header.Strategy {
 	case SnapshotRequest_KV_BATCH:
 		ss = &kvBatchSnapshotStrategy{
-			raftCfg:   raftCfg,
-			batchSize: batchSize,
-			limiter:   limiter,
-			newBatch:  newBatch,
+			raftCfg:             raftCfg,
+			batchSize:           batchSize,
+			limiter:             limiter,
+			newBatch:            newBatch,
+			logEntriesBatchSize: batchSize,
+			compressLogEntries: st.Version.IsActive(cluster.VersionSnapshotLogEntryCompression) &&
+				snapshotLogEntryCompression.Get(&st.SV),
+			missingSideloadedPolicy: missingSideloadedPolicy,
 		}
 	default:
 		log.Fatalf(ctx, "unknown snapshot strategy: %s", header.Strategy)
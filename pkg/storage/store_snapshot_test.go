@@ -13,7 +13,10 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -21,8 +24,12 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/storage/rditer"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/kr/pretty"
+	"github.com/pkg/errors"
 	"go.etcd.io/etcd/raft/raftpb"
 	"golang.org/x/time/rate"
 )
@@ -143,3 +150,256 @@ func TestSnapshotPreemptiveOnUninitializedReplica(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// recordingSnapshotSender is an outgoingSnapshotStream which records copies of
+// the requests sent to it. It doesn't expect any responses.
+type recordingSnapshotSender struct {
+	reqs []*SnapshotRequest
+}
+
+var _ outgoingSnapshotStream = (*recordingSnapshotSender)(nil)
+
+func (s *recordingSnapshotSender) Send(req *SnapshotRequest) error {
+	// The sender may reuse the memory of a request once Send returns.
+	reqCopy := protoutil.Clone(req).(*SnapshotRequest)
+	s.reqs = append(s.reqs, reqCopy)
+	return nil
+}
+
+func (s *recordingSnapshotSender) Recv() (*SnapshotResponse, error) {
+	return nil, errors.New("unexpected call to Recv")
+}
+
+// replayingSnapshotReceiver is an incomingSnapshotStream which replays the
+// requests recorded by a recordingSnapshotSender, followed by a final request.
+// The responses sent to it are discarded.
+type replayingSnapshotReceiver struct {
+	reqs []*SnapshotRequest
+}
+
+var _ incomingSnapshotStream = (*replayingSnapshotReceiver)(nil)
+
+func (s *replayingSnapshotReceiver) Send(*SnapshotResponse) error {
+	return nil
+}
+
+func (s *replayingSnapshotReceiver) Recv() (*SnapshotRequest, error) {
+	if len(s.reqs) == 0 {
+		return &SnapshotRequest{Final: true}, nil
+	}
+	req := s.reqs[0]
+	s.reqs = s.reqs[1:]
+	return req, nil
+}
+
+// TestSnapshotLogEntriesBatching verifies that the raft log entries of a
+// snapshot, including inlined sideloaded entries, are received intact when
+// they're sent in several batches.
+func TestSnapshotLogEntriesBatching(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	ctx := context.Background()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	tc.Start(t, stopper)
+	tc.store.SetRaftLogQueueActive(false)
+
+	for i := 0; i < 20; i++ {
+		key := roachpb.Key(fmt.Sprintf("key%02d", i))
+		args := putArgs(key, []byte(fmt.Sprintf("value%02d", i)))
+		if _, err := client.SendWrapped(ctx, tc.store.TestSender(), &args); err != nil {
+			t.Fatal(err)
+		}
+		if i%5 == 0 {
+			if err := ProposeAddSSTable(
+				ctx, fmt.Sprintf("sst%02d", i), "val", hlc.Timestamp{WallTime: 1}, tc.store,
+			); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	sendAndReceive := func(logEntriesBatchSize int64) (requests int, _ [][]byte) {
+		snap, err := tc.repl.GetSnapshot(ctx, snapTypeRaft)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snap.Close()
+
+		header := SnapshotRequest_Header{
+			State:    snap.State,
+			Strategy: SnapshotRequest_KV_BATCH,
+		}
+		header.RaftMessageRequest.Message.Snapshot = snap.RaftSnap
+		ss := kvBatchSnapshotStrategy{
+			raftCfg:             &tc.store.cfg.RaftConfig,
+			batchSize:           1 << 20,
+			limiter:             rate.NewLimiter(rate.Inf, 1),
+			newBatch:            tc.store.Engine().NewBatch,
+			logEntriesBatchSize: logEntriesBatchSize,
+		}
+		var stream recordingSnapshotSender
+		if err := ss.Send(ctx, &stream, header, snap); err != nil {
+			t.Fatal(err)
+		}
+		for _, req := range stream.reqs {
+			if len(req.LogEntries) > 0 {
+				requests++
+			}
+		}
+		inSnap, err := ss.Receive(ctx, &replayingSnapshotReceiver{reqs: stream.reqs}, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return requests, inSnap.LogEntries
+	}
+
+	unbatchedRequests, expected := sendAndReceive(0 /* logEntriesBatchSize */)
+	if unbatchedRequests != 1 {
+		t.Fatalf("expected log entries to be sent in a single request, got %d", unbatchedRequests)
+	}
+	var numSideloaded int
+	var ent raftpb.Entry
+	for _, entBytes := range expected {
+		if err := protoutil.Unmarshal(entBytes, &ent); err != nil {
+			t.Fatal(err)
+		}
+		if sniffSideloadedRaftCommand(ent.Data) {
+			numSideloaded++
+		}
+	}
+	if numSideloaded == 0 {
+		t.Fatal("expected the snapshot to contain sideloaded entries")
+	}
+
+	batchedRequests, actual := sendAndReceive(256 /* logEntriesBatchSize */)
+	if batchedRequests <= 1 {
+		t.Fatalf("expected log entries to be sent in several requests, got %d", batchedRequests)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("batched log entries differ from the unbatched ones:\n%s",
+			strings.Join(pretty.Diff(expected, actual), "\n"))
+	}
+}
+
+// TestSnapshotLogEntriesCompression verifies that compressing the raft log
+// entries with inlined sideloaded payloads reduces the bytes sent, and that the
+// receiver reconstructs the uncompressed entries.
+func TestSnapshotLogEntriesCompression(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer SetMockAddSSTable()()
+
+	ctx := context.Background()
+	tc := testContext{}
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	tc.Start(t, stopper)
+	tc.store.SetRaftLogQueueActive(false)
+
+	for i := 0; i < 3; i++ {
+		if err := ProposeAddSSTable(
+			ctx, fmt.Sprintf("sst%02d", i), strings.Repeat("val", 1024), hlc.Timestamp{WallTime: 1}, tc.store,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sendAndReceive := func(compress bool) (wireBytes int, _ [][]byte) {
+		snap, err := tc.repl.GetSnapshot(ctx, snapTypeRaft)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snap.Close()
+
+		header := SnapshotRequest_Header{
+			State:    snap.State,
+			Strategy: SnapshotRequest_KV_BATCH,
+		}
+		header.RaftMessageRequest.Message.Snapshot = snap.RaftSnap
+		ss := kvBatchSnapshotStrategy{
+			raftCfg:            &tc.store.cfg.RaftConfig,
+			batchSize:          1 << 20,
+			limiter:            rate.NewLimiter(rate.Inf, 1),
+			newBatch:           tc.store.Engine().NewBatch,
+			compressLogEntries: compress,
+		}
+		var stream recordingSnapshotSender
+		if err := ss.Send(ctx, &stream, header, snap); err != nil {
+			t.Fatal(err)
+		}
+		for _, req := range stream.reqs {
+			for _, entBytes := range req.LogEntries {
+				wireBytes += len(entBytes)
+			}
+		}
+		inSnap, err := ss.Receive(ctx, &replayingSnapshotReceiver{reqs: stream.reqs}, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wireBytes, inSnap.LogEntries
+	}
+
+	uncompressedBytes, expected := sendAndReceive(false /* compress */)
+	compressedBytes, actual := sendAndReceive(true /* compress */)
+	if compressedBytes >= uncompressedBytes {
+		t.Fatalf("expected compression to reduce the log entry bytes sent, got %d compressed and %d uncompressed",
+			compressedBytes, uncompressedBytes)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("decompressed log entries differ from the uncompressed ones:\n%s",
+			strings.Join(pretty.Diff(expected, actual), "\n"))
+	}
+
+	// Compression only applies to entries with inlined sideloaded payloads,
+	// which must be part of the snapshot for the test to be meaningful.
+	var numSideloaded int
+	var ent raftpb.Entry
+	for _, entBytes := range actual {
+		if err := protoutil.Unmarshal(entBytes, &ent); err != nil {
+			t.Fatal(err)
+		}
+		if sniffSideloadedRaftCommand(ent.Data) {
+			numSideloaded++
+		}
+	}
+	if numSideloaded != 3 {
+		t.Fatalf("expected the snapshot to contain 3 sideloaded entries, found %d", numSideloaded)
+	}
+}
+
+func BenchmarkSnapshotLogEntryEncoding(b *testing.B) {
+	ents := make([]raftpb.Entry, 100)
+	for i := range ents {
+		ents[i] = raftpb.Entry{
+			Term:  1,
+			Index: uint64(i + 1),
+			Type:  raftpb.EntryNormal,
+			Data:  bytes.Repeat([]byte("a"), 1024),
+		}
+	}
+
+	b.Run("marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := range ents {
+				if _, err := protoutil.Marshal(&ents[j]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("encoder", func(b *testing.B) {
+		b.ReportAllocs()
+		var enc snapshotLogEntryEncoder
+		for i := 0; i < b.N; i++ {
+			for j := range ents {
+				if _, err := enc.encode(&ents[j]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			enc.reset()
+		}
+	})
+}
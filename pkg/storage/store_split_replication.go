@@ -0,0 +1,134 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// splitReplicationGracePeriod delays the replication which is eagerly
+// triggered for both sides of a split. Without it, each of a rapid succession
+// of splits (as performed by bulk operations) immediately enqueues the
+// resulting ranges into the replicate queue.
+var splitReplicationGracePeriod = settings.RegisterNonNegativeDurationSetting(
+	"kv.split.replication_grace_period",
+	"time to wait after a split before enqueueing both sides of it for replication (0 to enqueue them immediately)",
+	0,
+)
+
+// deferredSplitReplication holds the ranges whose post-split replication is
+// deferred by splitReplicationGracePeriod.
+type deferredSplitReplication struct {
+	syncutil.Mutex
+	// pending maps the ranges to the time at which they're due to be added to
+	// the replicate queue.
+	pending map[roachpb.RangeID]time.Time
+	// running is set while an async task waits for pending ranges to be due.
+	running bool
+}
+
+// enqueueReplicationAfterSplit adds a replica which took part in a split to the
+// replicate queue, either right away or once the grace period configured by
+// kv.split.replication_grace_period has passed. A replica which is split again
+// within the grace period keeps its original deadline, so that successive
+// splits don't delay its replication indefinitely. The replica scanner may
+// still pick up the replica before the grace period has passed.
+func (s *Store) enqueueReplicationAfterSplit(
+	ctx context.Context, repl *Replica, now hlc.Timestamp,
+) {
+	gracePeriod := splitReplicationGracePeriod.Get(&s.cfg.Settings.SV)
+	if gracePeriod == 0 {
+		s.replicateQueue.MaybeAddAsync(ctx, repl, now)
+		return
+	}
+
+	s.splitReplication.Lock()
+	defer s.splitReplication.Unlock()
+	if s.splitReplication.pending == nil {
+		s.splitReplication.pending = make(map[roachpb.RangeID]time.Time)
+	}
+	if _, ok := s.splitReplication.pending[repl.RangeID]; !ok {
+		s.splitReplication.pending[repl.RangeID] = timeutil.Now().Add(gracePeriod)
+	}
+	if s.splitReplication.running {
+		return
+	}
+	// The task outlives the split, so it doesn't inherit its context.
+	taskCtx := s.AnnotateCtx(context.Background())
+	if err := s.stopper.RunAsyncTask(
+		taskCtx, "storage.Store: deferred split replication", s.runDeferredSplitReplication,
+	); err == nil {
+		s.splitReplication.running = true
+	}
+}
+
+// runDeferredSplitReplication adds the ranges whose post-split replication was
+// deferred to the replicate queue as they become due. It returns once no more
+// ranges are pending, or when the stopper quiesces.
+func (s *Store) runDeferredSplitReplication(ctx context.Context) {
+	timer := timeutil.NewTimer()
+	defer timer.Stop()
+	for {
+		next, ok := s.flushDeferredSplitReplication(ctx, timeutil.Now())
+		if !ok {
+			return
+		}
+		timer.Reset(timeutil.Until(next))
+		select {
+		case <-timer.C:
+			timer.Read = true
+		case <-s.stopper.ShouldQuiesce():
+			return
+		}
+	}
+}
+
+// flushDeferredSplitReplication adds the pending ranges which are due at the
+// given time to the replicate queue. It returns the time at which the next
+// pending range is due, or false if none remain, in which case the task
+// waiting for them is considered stopped.
+func (s *Store) flushDeferredSplitReplication(
+	ctx context.Context, now time.Time,
+) (next time.Time, ok bool) {
+	var due []roachpb.RangeID
+	s.splitReplication.Lock()
+	for rangeID, deadline := range s.splitReplication.pending {
+		if !deadline.After(now) {
+			due = append(due, rangeID)
+			delete(s.splitReplication.pending, rangeID)
+		} else if next.IsZero() || deadline.Before(next) {
+			next = deadline
+		}
+	}
+	ok = len(s.splitReplication.pending) > 0
+	if !ok {
+		s.splitReplication.running = false
+	}
+	s.splitReplication.Unlock()
+
+	hlcNow := s.Clock().Now()
+	for _, rangeID := range due {
+		// The range may have been merged away or removed in the meantime.
+		if repl, err := s.GetReplica(rangeID); err == nil {
+			s.replicateQueue.MaybeAddAsync(ctx, repl, hlcNow)
+		}
+	}
+	return next, ok
+}
@@ -16,8 +16,11 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"sync/atomic"
@@ -50,6 +53,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
 	"github.com/cockroachdb/cockroach/pkg/util/randutil"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 	"github.com/gogo/protobuf/proto"
 	"github.com/kr/pretty"
@@ -3381,3 +3385,151 @@ func BenchmarkStoreGetReplica(b *testing.B) {
 		}
 	})
 }
+
+// TestStoreSplitReplicationGracePeriod verifies that the replication which is
+// eagerly triggered by splits is deferred by kv.split.replication_grace_period,
+// and that successive splits don't defer it further.
+func TestStoreSplitReplicationGracePeriod(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+
+	const gracePeriod = time.Hour
+	cfg := TestStoreConfig(nil /* clock */)
+	splitReplicationGracePeriod.Override(&cfg.Settings.SV, gracePeriod)
+	store := createTestStoreWithConfig(t, stopper, testStoreOpts{}, &cfg)
+
+	pending := func() map[roachpb.RangeID]time.Time {
+		store.splitReplication.Lock()
+		defer store.splitReplication.Unlock()
+		m := make(map[roachpb.RangeID]time.Time, len(store.splitReplication.pending))
+		for rangeID, deadline := range store.splitReplication.pending {
+			m[rangeID] = deadline
+		}
+		return m
+	}
+	split := func(key string) {
+		args := &roachpb.AdminSplitRequest{
+			RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)},
+			SplitKey:      roachpb.Key(key),
+		}
+		if _, pErr := client.SendWrapped(ctx, store.TestSender(), args); pErr != nil {
+			t.Fatal(pErr)
+		}
+	}
+
+	begin := timeutil.Now()
+	split("a")
+	afterFirst := pending()
+	if len(afterFirst) != 2 {
+		t.Fatalf("expected both sides of the split to be pending, got %v", afterFirst)
+	}
+	// Split the right-hand side of each split right away.
+	split("b")
+	split("c")
+	afterAll := pending()
+	if len(afterAll) != 4 {
+		t.Fatalf("expected the four ranges to be pending, got %v", afterAll)
+	}
+	for rangeID, deadline := range afterFirst {
+		if afterAll[rangeID] != deadline {
+			t.Errorf("r%d: expected deadline %s to be kept, got %s", rangeID, deadline, afterAll[rangeID])
+		}
+	}
+	for rangeID, deadline := range afterAll {
+		if deadline.Before(begin.Add(gracePeriod)) {
+			t.Errorf("r%d: expected to be deferred by %s, but due at %s", rangeID, gracePeriod, deadline)
+		}
+	}
+
+	// Nothing is enqueued before the grace period has passed.
+	if _, ok := store.flushDeferredSplitReplication(ctx, timeutil.Now()); !ok {
+		t.Fatal("expected ranges to remain pending")
+	}
+	if n := len(pending()); n != 4 {
+		t.Fatalf("expected the four ranges to remain pending, got %d", n)
+	}
+
+	// Afterwards, all ranges are enqueued and end up in purgatory, since they
+	// can't be replicated with a single store.
+	if _, ok := store.flushDeferredSplitReplication(ctx, timeutil.Now().Add(gracePeriod)); ok {
+		t.Fatalf("expected no ranges to remain pending, got %v", pending())
+	}
+	testutils.SucceedsSoon(t, func() error {
+		store.replicateQueue.mu.Lock()
+		defer store.replicateQueue.mu.Unlock()
+		for rangeID := range afterAll {
+			if _, ok := store.replicateQueue.mu.purgatory[rangeID]; !ok {
+				return errors.Errorf("r%d is not in replicate queue purgatory", rangeID)
+			}
+		}
+		return nil
+	})
+}
+
+// TestStoreSideloadSweeper verifies that a store deletes the sideloaded files
+// pending deletion left behind before it was started, as well as those marked
+// for deletion while it is running.
+func TestStoreSideloadSweeper(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+
+	cfg := TestStoreConfig(nil /* clock */)
+	cfg.TestingKnobs.SideloadSweepInterval = time.Millisecond
+	store := createTestStoreWithoutStart(t, stopper, testStoreOpts{}, &cfg)
+
+	writePending := func(rangeID roachpb.RangeID, name string) string {
+		t.Helper()
+		dir := sideloadedPath(store.engine.GetAuxiliaryDir(), rangeID)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("payload"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	leftover := writePending(100, "i1.t1"+sideloadPendingDeleteSuffix)
+	live := writePending(101, "i1.t1")
+
+	if err := store.Gossip().AddInfoProto(gossip.KeySystemConfig,
+		&config.SystemConfigEntries{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Start(ctx, stopper); err != nil {
+		t.Fatal(err)
+	}
+	store.WaitForInit()
+
+	// The leftover file is removed during startup.
+	if ok, err := exists(leftover); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatalf("expected %s to be removed on startup", leftover)
+	}
+	if ok, err := exists(filepath.Dir(leftover)); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatalf("expected %s to be removed on startup", filepath.Dir(leftover))
+	}
+
+	pending := writePending(101, "i2.t1"+sideloadPendingDeleteSuffix)
+	testutils.SucceedsSoon(t, func() error {
+		if ok, err := exists(pending); err != nil {
+			return err
+		} else if ok {
+			return errors.Errorf("%s not removed yet", pending)
+		}
+		return nil
+	})
+	// Files which aren't pending deletion are left alone.
+	if ok, err := exists(live); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatalf("expected %s to be left in place", live)
+	}
+}
@@ -63,9 +63,42 @@ var sstWriteSyncRate = settings.RegisterByteSizeSetting(
 	bulkIOWriteBurst,
 )
 
+// writeFileUnsynced is like writeFileSyncing, but never syncs the file, and
+// returns it open rather than closing it. This allows callers writing several
+// files to sync all of them at the end, instead of each one as it is written.
+// The caller is responsible for syncing and closing the returned file. On
+// error, the file is closed, but may have been partially written.
+func writeFileUnsynced(
+	ctx context.Context, filename string, data []byte, eng engine.Engine, limiters ...*rate.Limiter,
+) (engine.DBFile, error) {
+	f, err := eng.OpenFile(filename)
+	if err != nil {
+		if strings.Contains(err.Error(), "No such file or directory") {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	for i := 0; i < len(data); i += bulkIOWriteBurst {
+		end := i + bulkIOWriteBurst
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[i:end]
+		for _, limiter := range limiters {
+			limitBulkIOWrite(ctx, limiter, len(chunk))
+		}
+		if err := f.Append(chunk); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
 // writeFileSyncing is essentially ioutil.WriteFile -- writes data to a file
 // named by filename -- but with rate limiting and periodic fsyncing controlled
-// by settings and the passed limiter (should be the store's limiter). Periodic
+// by settings and the passed limiters (should include the store's bulk io
+// limiter; each chunk is subject to all of them, in order). Periodic
 // fsync provides smooths out disk IO, as mentioned in #20352 and #20279, and
 // provides back-pressure, along with the explicit rate limiting. If the file
 // does not exist, WriteFile creates it with permissions perm; otherwise
@@ -77,7 +110,7 @@ func writeFileSyncing(
 	eng engine.Engine,
 	perm os.FileMode,
 	settings *cluster.Settings,
-	limiter *rate.Limiter,
+	limiters ...*rate.Limiter,
 ) error {
 	chunkSize := sstWriteSyncRate.Get(&settings.SV)
 	sync := true
@@ -102,7 +135,9 @@ func writeFileSyncing(
 		chunk := data[i:end]
 
 		// rate limit
-		limitBulkIOWrite(ctx, limiter, len(chunk))
+		for _, limiter := range limiters {
+			limitBulkIOWrite(ctx, limiter, len(chunk))
+		}
 		err = f.Append(chunk)
 		if err == nil && sync {
 			err = f.Sync()
@@ -118,3 +153,27 @@ func writeFileSyncing(
 	}
 	return err
 }
+
+// writeFileAtomically replaces the file named by filename with one holding the
+// given data. The data is written to, and synced in, a temporary file which is
+// then renamed to filename, so that a crash leaves either the previous file or
+// the new one in place, but never a partially written one.
+func writeFileAtomically(eng engine.Engine, filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	f, err := eng.OpenFile(tmp)
+	if err != nil {
+		return err
+	}
+	if err := f.Append(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -112,6 +112,11 @@ type StoreTestingKnobs struct {
 	// DisableReplicaRebalancing disables rebalancing of replicas but otherwise
 	// leaves the replicate queue operational.
 	DisableReplicaRebalancing bool
+	// DeterministicAllocator makes the decisions of the allocator used by the
+	// replicate queue reproducible: ties between equally good candidates are
+	// broken in favor of the lowest store ID rather than randomly, and any
+	// remaining randomness uses a fixed seed.
+	DeterministicAllocator bool
 	// DisableLoadBasedSplitting turns off LBS so no splits happen because of load.
 	DisableLoadBasedSplitting bool
 	// DisableSplitQueue disables the split queue.
@@ -183,6 +188,9 @@ type StoreTestingKnobs struct {
 	// TraceAllRaftEvents enables raft event tracing even when the current
 	// vmodule would not have enabled it.
 	TraceAllRaftEvents bool
+	// SideloadSweepInterval, if set, overrides the interval at which the store
+	// deletes sideloaded files pending deletion.
+	SideloadSweepInterval time.Duration
 }
 
 // ModuleTestingKnobs is part of the base.ModuleTestingKnobs interface.
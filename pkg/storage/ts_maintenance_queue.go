@@ -19,6 +19,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/config"
 	"github.com/cockroachdb/cockroach/pkg/gossip"
 	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
@@ -42,8 +43,9 @@ const (
 // maintenance can then be informed by data from the local store.
 type TimeSeriesDataStore interface {
 	ContainsTimeSeries(roachpb.RKey, roachpb.RKey) bool
-	MaintainTimeSeries(
+	MaintainTimeSeriesWithCheckpoints(
 		context.Context,
+		roachpb.RangeID,
 		engine.Reader,
 		roachpb.RKey,
 		roachpb.RKey,
@@ -51,9 +53,61 @@ type TimeSeriesDataStore interface {
 		*mon.BytesMonitor,
 		int64,
 		hlc.Timestamp,
+		TimeSeriesMaintenanceCheckpointer,
 	) error
 }
 
+// TimeSeriesMaintenanceCheckpointer records the progress of the time series
+// maintenance of a range, so that maintenance interrupted by a restart can
+// resume roughly where it left off. Checkpoints are advisory; losing one only
+// results in redundant work.
+type TimeSeriesMaintenanceCheckpointer interface {
+	// LoadCheckpoint returns the saved checkpoint, or nil if there is none.
+	LoadCheckpoint(context.Context) (roachpb.Key, error)
+	// SaveCheckpoint saves the given checkpoint, or removes the saved one if
+	// it is nil.
+	SaveCheckpoint(context.Context, roachpb.Key) error
+}
+
+// replicaTimeSeriesMaintenanceCheckpointer is a TimeSeriesMaintenanceCheckpointer
+// which keeps the checkpoint of a range under an unreplicated range-ID local
+// key. The checkpoint is thus removed along with the rest of the replica's
+// range-ID local data when the replica is destroyed or merged away.
+type replicaTimeSeriesMaintenanceCheckpointer struct {
+	eng     engine.Engine
+	rangeID roachpb.RangeID
+}
+
+var _ TimeSeriesMaintenanceCheckpointer = replicaTimeSeriesMaintenanceCheckpointer{}
+
+// LoadCheckpoint implements TimeSeriesMaintenanceCheckpointer.
+func (c replicaTimeSeriesMaintenanceCheckpointer) LoadCheckpoint(
+	ctx context.Context,
+) (roachpb.Key, error) {
+	value, _, err := engine.MVCCGet(
+		ctx, c.eng, keys.RangeTSMaintenanceCheckpointKey(c.rangeID), hlc.Timestamp{},
+		engine.MVCCGetOptions{},
+	)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	checkpoint, err := value.GetBytes()
+	return roachpb.Key(checkpoint), err
+}
+
+// SaveCheckpoint implements TimeSeriesMaintenanceCheckpointer.
+func (c replicaTimeSeriesMaintenanceCheckpointer) SaveCheckpoint(
+	ctx context.Context, checkpoint roachpb.Key,
+) error {
+	key := keys.RangeTSMaintenanceCheckpointKey(c.rangeID)
+	if checkpoint == nil {
+		return engine.MVCCDelete(ctx, c.eng, nil /* ms */, key, hlc.Timestamp{}, nil /* txn */)
+	}
+	return engine.MVCCPut(
+		ctx, c.eng, nil /* ms */, key, hlc.Timestamp{}, roachpb.MakeValueFromBytes(checkpoint), nil, /* txn */
+	)
+}
+
 // timeSeriesMaintenanceQueue identifies replicas that contain time series
 // data and performs necessary data maintenance on the time series located in
 // the replica. Currently, maintenance involves pruning time series data older
@@ -152,8 +206,10 @@ func (q *timeSeriesMaintenanceQueue) process(
 	snap := repl.store.Engine().NewSnapshot()
 	now := repl.store.Clock().Now()
 	defer snap.Close()
-	if err := q.tsData.MaintainTimeSeries(
-		ctx, snap, desc.StartKey, desc.EndKey, q.db, &q.mem, TimeSeriesMaintenanceMemoryBudget, now,
+	checkpointer := replicaTimeSeriesMaintenanceCheckpointer{eng: repl.store.Engine(), rangeID: desc.RangeID}
+	if err := q.tsData.MaintainTimeSeriesWithCheckpoints(
+		ctx, desc.RangeID, snap, desc.StartKey, desc.EndKey, q.db, &q.mem, TimeSeriesMaintenanceMemoryBudget, now,
+		checkpointer,
 	); err != nil {
 		return err
 	}
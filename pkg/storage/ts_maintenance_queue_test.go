@@ -28,6 +28,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/storage"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/rditer"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
 	"github.com/cockroachdb/cockroach/pkg/ts"
@@ -63,14 +64,16 @@ func (m *modelTimeSeriesDataStore) ContainsTimeSeries(start, end roachpb.RKey) b
 		roachpb.Key("z").Compare(end.AsRawKey()) > 0
 }
 
-func (m *modelTimeSeriesDataStore) MaintainTimeSeries(
+func (m *modelTimeSeriesDataStore) MaintainTimeSeriesWithCheckpoints(
 	ctx context.Context,
+	_ roachpb.RangeID,
 	snapshot engine.Reader,
 	start, end roachpb.RKey,
 	db *client.DB,
 	_ *mon.BytesMonitor,
 	_ int64,
 	now hlc.Timestamp,
+	checkpointer storage.TimeSeriesMaintenanceCheckpointer,
 ) error {
 	if snapshot == nil {
 		m.t.Fatal("MaintainTimeSeries was passed a nil snapshot")
@@ -78,6 +81,9 @@ func (m *modelTimeSeriesDataStore) MaintainTimeSeries(
 	if db == nil {
 		m.t.Fatal("MaintainTimeSeries was passed a nil client.DB")
 	}
+	if checkpointer == nil {
+		m.t.Fatal("MaintainTimeSeries was passed a nil checkpointer")
+	}
 	if !start.Less(end) {
 		m.t.Fatalf("MaintainTimeSeries passed start key %v which is not less than end key %v", start, end)
 	}
@@ -345,3 +351,57 @@ func TestTimeSeriesMaintenanceQueueServer(t *testing.T) {
 		return nil
 	})
 }
+
+// TestReplicaTimeSeriesMaintenanceCheckpointer verifies that the checkpoints
+// of the time series maintenance of a range survive a restart, independently
+// of those of other ranges, and are removed along with the range-ID local data
+// of the replica.
+func TestReplicaTimeSeriesMaintenanceCheckpointer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	eng := engine.NewInMem(roachpb.Attributes{}, 1<<20)
+	defer eng.Close()
+
+	assertCheckpoint := func(c storage.TimeSeriesMaintenanceCheckpointer, expected roachpb.Key) {
+		t.Helper()
+		if checkpoint, err := c.LoadCheckpoint(ctx); err != nil {
+			t.Fatal(err)
+		} else if !checkpoint.Equal(expected) {
+			t.Fatalf("expected checkpoint %s, got %s", expected, checkpoint)
+		}
+	}
+
+	c := storage.MakeReplicaTimeSeriesMaintenanceCheckpointer(eng, 1)
+	other := storage.MakeReplicaTimeSeriesMaintenanceCheckpointer(eng, 2)
+	assertCheckpoint(c, nil)
+	for _, key := range []string{"a", "b"} {
+		if err := c.SaveCheckpoint(ctx, roachpb.Key(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertCheckpoint(other, nil)
+
+	// A checkpointer created after a restart picks up the checkpoint.
+	restarted := storage.MakeReplicaTimeSeriesMaintenanceCheckpointer(eng, 1)
+	assertCheckpoint(restarted, roachpb.Key("b"))
+	if err := restarted.SaveCheckpoint(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertCheckpoint(c, nil)
+
+	// Clearing the range-ID local data of a replica, as is done when it is
+	// destroyed or merged away, removes its checkpoint only.
+	for _, c := range []storage.TimeSeriesMaintenanceCheckpointer{c, other} {
+		if err := c.SaveCheckpoint(ctx, roachpb.Key("c")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	desc := roachpb.RangeDescriptor{RangeID: 1, StartKey: roachpb.RKey("a"), EndKey: roachpb.RKey("z")}
+	rangeIDKeys := rditer.MakeAllKeyRanges(&desc)[0]
+	if err := eng.ClearRange(rangeIDKeys.Start, rangeIDKeys.End); err != nil {
+		t.Fatal(err)
+	}
+	assertCheckpoint(c, nil)
+	assertCheckpoint(other, roachpb.Key("c"))
+}
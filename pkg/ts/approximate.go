@@ -0,0 +1,117 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package ts
+
+import (
+	"context"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/ts/tspb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/pkg/errors"
+)
+
+// ApproximateTimeSeriesData holds samples of a time series which were
+// synthesized from its rollups by DB.ApproximateFromRollups.
+type ApproximateTimeSeriesData struct {
+	// Approximate is always true. The synthesized samples are indistinguishable
+	// from real ones otherwise, so this flags them as approximations wherever
+	// the result is passed along.
+	Approximate bool
+	// Resolution is the resolution of the synthesized samples, and
+	// RollupResolution that of the rollups they were synthesized from.
+	Resolution       Resolution
+	RollupResolution Resolution
+	// Data holds the synthesized samples of each source of the time series,
+	// ordered by source.
+	Data []tspb.TimeSeriesData
+}
+
+// ApproximateFromRollups synthesizes samples at the supplied resolution for
+// the time series with the supplied name between from and to (inclusive),
+// from the rollups of the time series. This allows showing data past the
+// retention of the resolution, once only the rollups computed from it remain.
+//
+// Each rollup is replaced by samples at all timestamps of the resolution
+// within the rollup period, which have the average of the rollup as their
+// value. The samples thus preserve the average of each period, but not its
+// variance or extremes. The samples are only present where rollups are, which
+// need not match the presence of the original samples.
+func (db *DB) ApproximateFromRollups(
+	ctx context.Context, name string, from, to hlc.Timestamp, targetResolution Resolution,
+) (ApproximateTimeSeriesData, error) {
+	rollupResolution, ok := targetResolution.TargetRollupResolution()
+	if !ok {
+		return ApproximateTimeSeriesData{}, errors.Errorf(
+			"resolution %s has no rollups to approximate it from", targetResolution)
+	}
+	if to.Less(from) {
+		return ApproximateTimeSeriesData{}, errors.Errorf(
+			"end timestamp %s precedes start timestamp %s", to, from)
+	}
+
+	rows, err := db.readAllSourcesFromDatabase(ctx, name, rollupResolution, QueryTimespan{
+		StartNanos: from.WallTime,
+		EndNanos:   to.WallTime,
+	})
+	if err != nil {
+		return ApproximateTimeSeriesData{}, err
+	}
+	// Rows are ordered by slab, and then by source.
+	sourceSpans := make(map[string]timeSeriesSpan)
+	for _, row := range rows {
+		var data roachpb.InternalTimeSeriesData
+		if err := row.ValueProto(&data); err != nil {
+			return ApproximateTimeSeriesData{}, err
+		}
+		_, source, _, _, err := DecodeDataKey(row.Key)
+		if err != nil {
+			return ApproximateTimeSeriesData{}, err
+		}
+		sourceSpans[source] = append(sourceSpans[source], data)
+	}
+
+	result := ApproximateTimeSeriesData{
+		Approximate:      true,
+		Resolution:       targetResolution,
+		RollupResolution: rollupResolution,
+	}
+	sampleDuration := targetResolution.SampleDuration()
+	rollupDuration := rollupResolution.SampleDuration()
+	for source, span := range sourceSpans {
+		series := tspb.TimeSeriesData{Name: name, Source: source}
+		for iter := makeTimeSeriesSpanIterator(span); iter.isValid(); iter.forward() {
+			if iter.count() == 0 {
+				continue
+			}
+			avg := iter.average()
+			for ts := iter.timestamp; ts < iter.timestamp+rollupDuration; ts += sampleDuration {
+				if ts < from.WallTime || ts > to.WallTime {
+					continue
+				}
+				series.Datapoints = append(series.Datapoints, tspb.TimeSeriesDatapoint{
+					TimestampNanos: ts,
+					Value:          avg,
+				})
+			}
+		}
+		if len(series.Datapoints) > 0 {
+			result.Data = append(result.Data, series)
+		}
+	}
+	sort.Slice(result.Data, func(i, j int) bool {
+		return result.Data[i].Source < result.Data[j].Source
+	})
+	return result, nil
+}
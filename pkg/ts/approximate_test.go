@@ -0,0 +1,109 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package ts
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/ts/tspb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// TestApproximateFromRollups verifies that samples synthesized from rollups
+// approximate the pruned data which the rollups were computed from.
+func TestApproximateFromRollups(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModelRunner(t)
+	tm.Start()
+	defer tm.Stop()
+
+	// The values of the series oscillate between 100 and 104, so that each
+	// rollup period has an average of 102.
+	const numSamples = 500
+	const tolerance = 2
+	original := make(map[string]tspb.TimeSeriesData)
+	for _, source := range []string{"a", "b"} {
+		series := tsd("test.metric", source)
+		for i := 0; i < numSamples; i++ {
+			series.Datapoints = append(series.Datapoints, tsdp(time.Duration(i), float64(100+i%5)))
+		}
+		original[source] = series
+		tm.storeTimeSeriesData(resolution1ns, []tspb.TimeSeriesData{series})
+	}
+
+	now := numSamples + resolution1nsDefaultRollupThreshold.Nanoseconds()
+	info := timeSeriesResolutionInfo{Name: "test.metric", Resolution: resolution1ns}
+	tm.rollup(now, info)
+	tm.prune(now, info)
+	// Only the rollups remain, in a single slab per source.
+	tm.assertKeyCount(2)
+
+	ctx := context.Background()
+	from, to := hlc.Timestamp{WallTime: 0}, hlc.Timestamp{WallTime: numSamples - 1}
+	result, err := tm.DB.ApproximateFromRollups(ctx, "test.metric", from, to, resolution1ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Approximate {
+		t.Fatal("expected the result to be flagged as approximate")
+	}
+	if result.Resolution != resolution1ns || result.RollupResolution != resolution50ns {
+		t.Fatalf("unexpected resolutions %s and %s", result.Resolution, result.RollupResolution)
+	}
+	if len(result.Data) != 2 || result.Data[0].Source != "a" || result.Data[1].Source != "b" {
+		t.Fatalf("expected approximations for sources a and b, got %+v", result.Data)
+	}
+	for _, series := range result.Data {
+		orig := original[series.Source]
+		if len(series.Datapoints) != len(orig.Datapoints) {
+			t.Fatalf("%s: expected %d samples, got %d",
+				series.Source, len(orig.Datapoints), len(series.Datapoints))
+		}
+		for i, dp := range series.Datapoints {
+			origDp := orig.Datapoints[i]
+			if dp.TimestampNanos != origDp.TimestampNanos {
+				t.Fatalf("%s: expected sample %d at %d, got %d",
+					series.Source, i, origDp.TimestampNanos, dp.TimestampNanos)
+			}
+			if math.Abs(dp.Value-origDp.Value) > tolerance {
+				t.Fatalf("%s: approximation %f at %d is off by more than %d from %f",
+					series.Source, dp.Value, dp.TimestampNanos, tolerance, origDp.Value)
+			}
+		}
+	}
+
+	// The approximation is restricted to the requested span.
+	result, err = tm.DB.ApproximateFromRollups(
+		ctx, "test.metric", hlc.Timestamp{WallTime: 120}, hlc.Timestamp{WallTime: 129}, resolution1ns,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, series := range result.Data {
+		if n := len(series.Datapoints); n != 10 || series.Datapoints[0].TimestampNanos != 120 {
+			t.Fatalf("%s: expected 10 samples starting at 120, got %+v", series.Source, series.Datapoints)
+		}
+	}
+
+	// Rollup resolutions can't be approximated.
+	if _, err := tm.DB.ApproximateFromRollups(
+		ctx, "test.metric", from, to, resolution50ns,
+	); !testutils.IsError(err, "resolution 50ns has no rollups") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
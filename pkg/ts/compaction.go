@@ -0,0 +1,120 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package ts
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+)
+
+// compactionMaxSlabsPerBatch is the maximum number of slabs read (and then
+// rewritten) by a single batch during slab compaction.
+const compactionMaxSlabsPerBatch = 1000
+
+// CompactTimeSeriesSlabs rewrites all slabs of the named time series which
+// start before the supplied timestamp into their compact form. Slabs are
+// stored by merging individually written samples; reading a slab returns the
+// merged result, which is then written back as a single columnar value. This
+// removes the per-sample overhead of the legacy row format as well as the
+// stacked merge operands in the storage engine.
+//
+// Compaction is lossless: the offset and value of each sample are retained
+// exactly, and slabs which are already in columnar format are left untouched,
+// which makes the operation idempotent.
+//
+// Because slabs are read and then written back, samples merged into a slab
+// concurrently with its compaction may be lost. The supplied timestamp should
+// thus be far enough in the past that no more samples are written to the
+// slabs being compacted.
+func (tsdb *DB) CompactTimeSeriesSlabs(
+	ctx context.Context, db *client.DB, name string, before hlc.Timestamp,
+) error {
+	for r := range tsdb.pruneThresholdByResolution {
+		span := roachpb.Span{
+			Key:    MakeDataKey(name, "" /* source */, r, 0),
+			EndKey: MakeDataKey(name, "" /* source */, r, before.WallTime),
+		}
+		for span.Valid() {
+			var err error
+			if span, err = compactSlabsForSpan(ctx, db, span); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compactSlabsForSpan compacts up to compactionMaxSlabsPerBatch slabs in the
+// given span, returning the span remaining to be compacted.
+func compactSlabsForSpan(
+	ctx context.Context, db *client.DB, span roachpb.Span,
+) (roachpb.Span, error) {
+	b := &client.Batch{}
+	b.Header.MaxSpanRequestKeys = compactionMaxSlabsPerBatch
+	b.Scan(span.Key, span.EndKey)
+	if err := db.Run(ctx, b); err != nil {
+		return roachpb.Span{}, err
+	}
+
+	wb := &client.Batch{}
+	var compacted int
+	for _, row := range b.Results[0].Rows {
+		var data roachpb.InternalTimeSeriesData
+		if err := row.ValueProto(&data); err != nil {
+			return roachpb.Span{}, err
+		}
+		if !compactSlab(&data) {
+			continue
+		}
+		var value roachpb.Value
+		if err := value.SetProto(&data); err != nil {
+			return roachpb.Span{}, err
+		}
+		wb.AddRawRequest(&roachpb.PutRequest{
+			RequestHeader: roachpb.RequestHeader{
+				Key: row.Key,
+			},
+			Value:  value,
+			Inline: true,
+		})
+		compacted++
+	}
+	if compacted > 0 {
+		if err := db.Run(ctx, wb); err != nil {
+			return roachpb.Span{}, err
+		}
+	}
+	return b.Results[0].ResumeSpanAsValue(), nil
+}
+
+// compactSlab converts a slab stored in the row format into the columnar
+// format, returning false if the slab did not need to be converted. Row format
+// slabs returned from a read have already been sorted and deduplicated by the
+// merge operator, and only their offset and sum are ever populated, so the
+// conversion is lossless (this mirrors convertToColumnar in libroach).
+func compactSlab(data *roachpb.InternalTimeSeriesData) bool {
+	if data.IsColumnar() || len(data.Samples) == 0 {
+		return false
+	}
+	data.Offset = make([]int32, len(data.Samples))
+	data.Last = make([]float64, len(data.Samples))
+	for i, sample := range data.Samples {
+		data.Offset[i] = sample.Offset
+		data.Last[i] = sample.Sum
+	}
+	data.Samples = nil
+	return true
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package ts
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/ts/tspb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/kr/pretty"
+)
+
+func TestCompactTimeSeriesSlabs(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModelRunner(t)
+	tm.Start()
+	defer tm.Stop()
+	tm.DB.forceRowFormat = true
+
+	// Write samples for the same slabs in several fragments, including a
+	// sample which is overwritten by a later fragment.
+	for _, source := range []string{"source1", "source2"} {
+		tm.storeTimeSeriesData(resolution1ns, []tspb.TimeSeriesData{
+			tsd("test.metric", source, tsdp(1, 100), tsdp(4, 200), tsdp(12, 300)),
+		})
+		tm.storeTimeSeriesData(resolution1ns, []tspb.TimeSeriesData{
+			tsd("test.metric", source, tsdp(2, 400), tsdp(15, 500), tsdp(23, 600)),
+		})
+		tm.storeTimeSeriesData(resolution1ns, []tspb.TimeSeriesData{
+			tsd("test.metric", source, tsdp(4, 700), tsdp(27, 800), tsdp(105, 900)),
+		})
+	}
+	tm.assertModelCorrect()
+	tm.assertKeyCount(8)
+
+	const before = 30
+	beforeData := tm.getActualData()
+	compact := func() {
+		t.Helper()
+		if err := tm.DB.CompactTimeSeriesSlabs(
+			context.Background(), tm.LocalTestCluster.DB, "test.metric", hlc.Timestamp{WallTime: before},
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compact()
+	afterData := tm.getActualData()
+
+	if a, e := len(afterData), len(beforeData); a != e {
+		t.Fatalf("expected %d keys after compaction, found %d", e, a)
+	}
+	for key, beforeVal := range beforeData {
+		afterVal := afterData[key]
+		_, _, _, startNanos, err := DecodeDataKey(roachpb.Key(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if startNanos >= before {
+			if !reflect.DeepEqual(afterVal, beforeVal) {
+				t.Errorf("slab at %d should not have been compacted", startNanos)
+			}
+			continue
+		}
+
+		var beforeSlab, afterSlab roachpb.InternalTimeSeriesData
+		if err := beforeVal.GetProto(&beforeSlab); err != nil {
+			t.Fatal(err)
+		}
+		if err := afterVal.GetProto(&afterSlab); err != nil {
+			t.Fatal(err)
+		}
+		if !afterSlab.IsColumnar() {
+			t.Errorf("slab at %d was not compacted: %v", startNanos, afterSlab)
+			continue
+		}
+		if a, e := len(afterVal.RawBytes), len(beforeVal.RawBytes); a >= e {
+			t.Errorf("slab at %d: expected compacted size %d to be smaller than %d", startNanos, a, e)
+		}
+		if a, e := afterSlab.SampleCount(), beforeSlab.SampleCount(); a != e {
+			t.Fatalf("slab at %d: expected %d samples, found %d", startNanos, e, a)
+		}
+		for i, sample := range beforeSlab.Samples {
+			if afterSlab.Offset[i] != sample.Offset || afterSlab.Last[i] != sample.Sum {
+				t.Errorf("slab at %d: sample %d changed from (%d, %f) to (%d, %f)", startNanos, i,
+					sample.Offset, sample.Sum, afterSlab.Offset[i], afterSlab.Last[i])
+			}
+		}
+	}
+
+	// Queries return the same results as before.
+	query := tm.makeQuery("test.metric", resolution1ns, 0, 200)
+	query.assertMatchesModel()
+
+	// Compacting again is a noop.
+	compact()
+	if again := tm.getActualData(); !reflect.DeepEqual(again, afterData) {
+		for _, diff := range pretty.Diff(again, afterData) {
+			t.Error(diff)
+		}
+	}
+}
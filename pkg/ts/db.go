@@ -24,6 +24,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/ts/tspb"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 )
 
 var (
@@ -104,10 +105,29 @@ type DB struct {
 	// eligible for deletion. Thresholds are specified in nanoseconds.
 	pruneThresholdByResolution map[Resolution]func() int64
 
+	// retentionResolver, if set, resolves range-specific retention policies
+	// which override pruneThresholdByResolution during maintenance.
+	retentionResolver RetentionResolver
+
+	// rollupColumns caches the per-metric rollup column policies parsed from
+	// the value of the timeseries.rollup.column_policies setting.
+	rollupColumns struct {
+		syncutil.Mutex
+		setting  string
+		policies map[string]RollupColumnPolicy
+	}
+
 	// forceRowFormat is set to true if the database should write in the old row
 	// format, regardless of the current cluster setting. Currently only set to
 	// true in tests to verify backwards compatibility.
 	forceRowFormat bool
+
+	// maintenance tracks the in-flight maintenance operations, see
+	// InflightMaintenance.
+	maintenance struct {
+		syncutil.Mutex
+		ops map[*inflightMaintenance]struct{}
+	}
 }
 
 // NewDB creates a new DB instance.
@@ -287,7 +307,9 @@ func (db *DB) tryStoreRollup(ctx context.Context, r Resolution, data []rollupDat
 	var kvs []roachpb.KeyValue
 
 	for _, d := range data {
-		idatas, err := d.toInternal(r.SlabDuration(), r.SampleDuration())
+		idatas, err := d.toInternal(
+			r.SlabDuration(), r.SampleDuration(), db.retainedRollupColumns(d.name, r),
+		)
 		if err != nil {
 			return err
 		}
@@ -304,11 +326,23 @@ func (db *DB) tryStoreRollup(ctx context.Context, r Resolution, data []rollupDat
 		}
 	}
 
-	return db.storeKvs(ctx, kvs)
+	// Rollups are computed during maintenance, so retry them like other
+	// maintenance operations. Merging the same rollup data more than once is
+	// harmless.
+	//
 	// TODO(mrtracy): metrics for rollups stored
+	_, err := db.runMaintenanceBatch(ctx, db.db, func() *client.Batch {
+		return makeMergeBatch(kvs)
+	})
+	return err
 }
 
 func (db *DB) storeKvs(ctx context.Context, kvs []roachpb.KeyValue) error {
+	return db.db.Run(ctx, makeMergeBatch(kvs))
+}
+
+// makeMergeBatch returns a batch merging the supplied key/value pairs.
+func makeMergeBatch(kvs []roachpb.KeyValue) *client.Batch {
 	b := &client.Batch{}
 	for _, kv := range kvs {
 		b.AddRawRequest(&roachpb.MergeRequest{
@@ -318,8 +352,7 @@ func (db *DB) storeKvs(ctx context.Context, kvs []roachpb.KeyValue) error {
 			Value: kv.Value,
 		})
 	}
-
-	return db.db.Run(ctx, b)
+	return b
 }
 
 // computeThresholds returns a map of timestamps for each resolution supported
@@ -183,7 +183,10 @@ func (tm *testModelRunner) getModelDiskLayout() map[string]roachpb.Value {
 			var err error
 			if resolution.IsRollup() {
 				rollup := computeRollupsFromData(tsdata, resolution.SampleDuration())
-				slabs, err = rollup.toInternal(resolution.SlabDuration(), resolution.SampleDuration())
+				slabs, err = rollup.toInternal(
+					resolution.SlabDuration(), resolution.SampleDuration(),
+					tm.DB.retainedRollupColumns(seriesName, resolution),
+				)
 			} else {
 				slabs, err = tsdata.ToInternal(resolution.SlabDuration(), resolution.SampleDuration(), columnar)
 			}
@@ -312,6 +315,7 @@ func (tm *testModelRunner) prune(nowNanos int64, timeSeries ...timeSeriesResolut
 			WallTime: nowNanos,
 			Logical:  0,
 		},
+		nil, /* policy */
 	); err != nil {
 		tm.t.Fatalf("error pruning time series data: %s", err)
 	}
@@ -360,6 +364,7 @@ func (tm *testModelRunner) rollupWithMemoryContext(
 			WallTime: nowNanos,
 			Logical:  0,
 		},
+		nil, /* policy */
 		qmc,
 	); err != nil {
 		tm.t.Fatalf("error rolling up time series data: %s", err)
@@ -407,16 +412,23 @@ func (tm *testModelRunner) rollupWithMemoryContext(
 // maintain calls the same operation called by the TS maintenance queue,
 // simulating the effects in the model at the same time.
 func (tm *testModelRunner) maintain(nowNanos int64) {
+	tm.maintainWithBudget(nowNanos, math.MaxInt64)
+}
+
+// maintainWithBudget is like maintain, but limits the memory used by the
+// maintenance to the supplied budget.
+func (tm *testModelRunner) maintainWithBudget(nowNanos int64, budgetBytes int64) {
 	snap := tm.Store.Engine().NewSnapshot()
 	defer snap.Close()
 	if err := tm.DB.MaintainTimeSeries(
 		context.TODO(),
+		0, /* rangeID */
 		snap,
 		roachpb.RKey(keys.TimeseriesPrefix),
 		roachpb.RKey(keys.TimeseriesKeyMax),
 		tm.LocalTestCluster.DB,
 		tm.workerMemMonitor,
-		math.MaxInt64,
+		budgetBytes,
 		hlc.Timestamp{
 			WallTime: nowNanos,
 			Logical:  0,
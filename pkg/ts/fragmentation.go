@@ -0,0 +1,168 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package ts
+
+import (
+	"context"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+)
+
+// fragmentationReportMaxSeries is the maximum number of time series listed in
+// FragmentationReport.MostFragmented.
+const fragmentationReportMaxSeries = 10
+
+// FragmentationReport describes how fragmented the slabs of the time series
+// data stored in a key span are, as computed by DB.TimeSeriesFragmentation.
+//
+// A slab is fragmented if it holds few samples compared to the number it can
+// hold, or if it is stored in the legacy row format, which
+// CompactTimeSeriesSlabs converts into the smaller columnar format.
+type FragmentationReport struct {
+	// NumSlabs and NumSamples are the number of slabs and the total number of
+	// samples contained in them.
+	NumSlabs   int
+	NumSamples int64
+	// AvgSamplesPerSlab is the average number of samples per slab.
+	AvgSamplesPerSlab float64
+	// NumRowFormatSlabs is the number of slabs stored in the row format.
+	NumRowFormatSlabs int
+	// Bytes is the total size of the values of the slabs, and WastedBytes is
+	// the part of it which compacting the slabs would save.
+	Bytes, WastedBytes int64
+	// MostFragmented lists the time series with the most wasted bytes, and
+	// among those with the same number, the least filled slabs first. At most
+	// fragmentationReportMaxSeries time series are listed.
+	MostFragmented []SeriesFragmentation
+}
+
+// SeriesFragmentation describes the fragmentation of the slabs of a single
+// source of a time series at a resolution.
+type SeriesFragmentation struct {
+	Name, Source string
+	Resolution   Resolution
+	NumSlabs     int
+	NumSamples   int64
+	// Fill is the ratio of NumSamples to the number of samples the slabs can
+	// hold, between 0 and 1.
+	Fill float64
+	// WastedBytes is the number of bytes compacting the slabs would save.
+	WastedBytes int64
+}
+
+// TimeSeriesFragmentation reports how fragmented the slabs of the time series
+// data which the supplied engine stores in the supplied key span are. Like
+// TimeSeriesHealthReport, it inspects the local data of a single range and
+// never writes. It is meant to inform whether running CompactTimeSeriesSlabs
+// is worthwhile.
+func (tsdb *DB) TimeSeriesFragmentation(
+	ctx context.Context, snapshot engine.Reader, start, end roachpb.RKey,
+) (FragmentationReport, error) {
+	var report FragmentationReport
+
+	startKey := engine.MakeMVCCMetadataKey(start.AsRawKey())
+	if first := engine.MakeMVCCMetadataKey(keys.TimeseriesPrefix); startKey.Less(first) {
+		startKey = first
+	}
+	endKey := engine.MakeMVCCMetadataKey(end.AsRawKey())
+	if last := engine.MakeMVCCMetadataKey(keys.TimeseriesPrefix.PrefixEnd()); last.Less(endKey) {
+		endKey = last
+	}
+
+	iter := snapshot.NewIterator(engine.IterOptions{UpperBound: endKey.Key})
+	defer iter.Close()
+
+	series := make(map[tsSourceKey]*SeriesFragmentation)
+	var meta enginepb.MVCCMetadata
+	for iter.Seek(startKey); ; iter.Next() {
+		if ok, err := iter.Valid(); err != nil {
+			return FragmentationReport{}, err
+		} else if !ok || !iter.UnsafeKey().Less(endKey) {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return FragmentationReport{}, err
+		}
+		if err := protoutil.Unmarshal(iter.UnsafeValue(), &meta); err != nil {
+			return FragmentationReport{}, err
+		}
+		if !meta.IsInline() {
+			// Time series data is always stored inline.
+			continue
+		}
+		name, source, res, _, err := DecodeDataKey(iter.UnsafeKey().Key)
+		if err != nil {
+			return FragmentationReport{}, err
+		}
+		data, err := roachpb.Value{RawBytes: meta.RawBytes}.GetTimeseries()
+		if err != nil {
+			return FragmentationReport{}, err
+		}
+
+		k := tsSourceKey{name: name, source: source, res: res}
+		s, ok := series[k]
+		if !ok {
+			s = &SeriesFragmentation{Name: name, Source: source, Resolution: res}
+			series[k] = s
+		}
+		samples := int64(data.SampleCount())
+		size := int64(data.Size())
+		s.NumSlabs++
+		s.NumSamples += samples
+		report.NumSlabs++
+		report.NumSamples += samples
+		report.Bytes += size
+		if !data.IsColumnar() && len(data.Samples) > 0 {
+			report.NumRowFormatSlabs++
+			compacted := data
+			compactSlab(&compacted)
+			wasted := size - int64(compacted.Size())
+			s.WastedBytes += wasted
+			report.WastedBytes += wasted
+		}
+	}
+
+	if report.NumSlabs > 0 {
+		report.AvgSamplesPerSlab = float64(report.NumSamples) / float64(report.NumSlabs)
+	}
+	for k, s := range series {
+		capacity := k.res.SlabDuration() / k.res.SampleDuration()
+		s.Fill = float64(s.NumSamples) / float64(int64(s.NumSlabs)*capacity)
+		report.MostFragmented = append(report.MostFragmented, *s)
+	}
+	sort.Slice(report.MostFragmented, func(i, j int) bool {
+		a, b := report.MostFragmented[i], report.MostFragmented[j]
+		if a.WastedBytes != b.WastedBytes {
+			return a.WastedBytes > b.WastedBytes
+		}
+		if a.Fill != b.Fill {
+			return a.Fill < b.Fill
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.Resolution < b.Resolution
+	})
+	if len(report.MostFragmented) > fragmentationReportMaxSeries {
+		report.MostFragmented = report.MostFragmented[:fragmentationReportMaxSeries]
+	}
+	return report, nil
+}
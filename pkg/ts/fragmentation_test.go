@@ -0,0 +1,91 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package ts
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/ts/tspb"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/kr/pretty"
+)
+
+// TestTimeSeriesFragmentation verifies that the fragmentation report tells
+// apart sparse slabs in the row format from full slabs in the columnar format.
+func TestTimeSeriesFragmentation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModelRunner(t)
+	tm.Start()
+	defer tm.Stop()
+
+	// The dense time series fills two slabs of 10 samples each.
+	var dense []tspb.TimeSeriesDatapoint
+	for i := 0; i < 20; i++ {
+		dense = append(dense, tsdp(time.Duration(i), float64(i)))
+	}
+	tm.storeTimeSeriesData(resolution1ns, []tspb.TimeSeriesData{
+		tsd("test.dense", "source1", dense...),
+	})
+	// The fragmented time series stores a single sample in each of four slabs,
+	// in the row format and written in several fragments.
+	tm.DB.forceRowFormat = true
+	tm.storeTimeSeriesData(resolution1ns, []tspb.TimeSeriesData{
+		tsd("test.fragmented", "source1", tsdp(1, 100), tsdp(23, 200)),
+	})
+	tm.storeTimeSeriesData(resolution1ns, []tspb.TimeSeriesData{
+		tsd("test.fragmented", "source1", tsdp(12, 300), tsdp(34, 400)),
+	})
+	tm.assertKeyCount(6)
+
+	snap := tm.Store.Engine().NewSnapshot()
+	defer snap.Close()
+	report, err := tm.DB.TimeSeriesFragmentation(
+		context.Background(), snap, roachpb.RKeyMin, roachpb.RKeyMax,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The report doesn't write anything.
+	tm.assertKeyCount(6)
+
+	if report.NumSlabs != 6 || report.NumSamples != 24 || report.NumRowFormatSlabs != 4 {
+		t.Errorf("unexpected totals: %s", pretty.Sprint(report))
+	}
+	if report.AvgSamplesPerSlab != 4 {
+		t.Errorf("expected 4 samples per slab on average, got %f", report.AvgSamplesPerSlab)
+	}
+	if report.WastedBytes <= 0 || report.WastedBytes >= report.Bytes {
+		t.Errorf("expected part of the %d bytes to be wasted, got %d", report.Bytes, report.WastedBytes)
+	}
+
+	if len(report.MostFragmented) != 2 {
+		t.Fatalf("expected 2 time series, got %s", pretty.Sprint(report.MostFragmented))
+	}
+	fragmented, denseSeries := report.MostFragmented[0], report.MostFragmented[1]
+	if fragmented.Name != "test.fragmented" || denseSeries.Name != "test.dense" {
+		t.Fatalf("expected the fragmented time series first, got %s", pretty.Sprint(report.MostFragmented))
+	}
+	if fragmented.NumSlabs != 4 || fragmented.NumSamples != 4 || fragmented.Fill != 0.1 {
+		t.Errorf("unexpected fragmentation: %s", pretty.Sprint(fragmented))
+	}
+	if fragmented.WastedBytes != report.WastedBytes {
+		t.Errorf("expected all %d wasted bytes to belong to %s, got %d",
+			report.WastedBytes, fragmented.Name, fragmented.WastedBytes)
+	}
+	if denseSeries.NumSlabs != 2 || denseSeries.NumSamples != 20 || denseSeries.Fill != 1 || denseSeries.WastedBytes != 0 {
+		t.Errorf("unexpected fragmentation: %s", pretty.Sprint(denseSeries))
+	}
+}
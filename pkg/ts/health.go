@@ -0,0 +1,269 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package ts
+
+import (
+	"context"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+)
+
+// TSHealthReport describes the time series data stored in a key span, as
+// computed by DB.TimeSeriesHealthReport.
+type TSHealthReport struct {
+	// NumSeries is the number of distinct time series names with data in the
+	// span.
+	NumSeries int
+	// Resolutions holds statistics about the data stored at each resolution.
+	Resolutions map[Resolution]TSResolutionStats
+	// RollupGaps lists the periods for which neither the data of a time series
+	// nor its rollups are stored, ordered by name, source and resolution.
+	RollupGaps []TSRollupGap
+}
+
+// TSResolutionStats describes the time series data stored at a resolution.
+type TSResolutionStats struct {
+	// NumSeries is the number of distinct time series names with data at the
+	// resolution.
+	NumSeries int
+	// NumPrunableSeries is the number of those time series which have data
+	// that maintenance would prune.
+	NumPrunableSeries int
+	// NumSlabs and NumSamples are the number of slabs and the total number of
+	// samples contained in them.
+	NumSlabs   int
+	NumSamples int64
+	// Bytes is the total size of the keys and values of the slabs.
+	Bytes int64
+	// PrunableBytes is the part of Bytes which maintenance would prune, based on
+	// the retention for the resolution.
+	PrunableBytes int64
+	// OldestNanos and NewestNanos are the timestamps of the oldest and newest
+	// samples. They are zero if the resolution stores no samples.
+	OldestNanos, NewestNanos int64
+}
+
+// TSRollupGap is a period in which the data of a time series has been pruned
+// at a resolution, but isn't covered by rollups at the target rollup
+// resolution. Such gaps appear when data is pruned without having been rolled
+// up, for example while rollups are disabled.
+type TSRollupGap struct {
+	Name, Source string
+	// Resolution is the resolution of the pruned data; the rollups are stored at
+	// its target rollup resolution.
+	Resolution Resolution
+	// StartNanos and EndNanos delimit the gap: StartNanos is the end of the
+	// period covered by the newest rollup, and EndNanos is the start of the
+	// rollup period containing the oldest sample at Resolution.
+	StartNanos, EndNanos int64
+}
+
+// tsSourceKey identifies the data of a single source of a time series at a
+// resolution.
+type tsSourceKey struct {
+	name, source string
+	res          Resolution
+}
+
+// tsSampleSpan is the span of timestamps of the samples of a tsSourceKey.
+type tsSampleSpan struct {
+	oldest, newest int64
+}
+
+// TimeSeriesHealthReport computes statistics about the time series data which
+// the supplied engine stores in the supplied key span, such as the number of
+// samples per resolution, the amount of data that maintenance would prune
+// and gaps in the coverage of rollups. Like MaintainTimeSeries, it is intended
+// to inspect the local data of a single range, and uses the retention policy
+// which applies to the range. Unlike it, it never writes.
+//
+// Rollup gaps are detected between the rollups of a time series and the data
+// they are computed from, so a gap which precedes all rollups, or which
+// affects a time series without any rollups, isn't reported.
+func (tsdb *DB) TimeSeriesHealthReport(
+	ctx context.Context, snapshot engine.Reader, start, end roachpb.RKey, now hlc.Timestamp,
+) (TSHealthReport, error) {
+	report := TSHealthReport{Resolutions: make(map[Resolution]TSResolutionStats)}
+
+	policy, err := tsdb.resolveRetentionPolicy(start, end)
+	if err != nil {
+		return TSHealthReport{}, err
+	}
+	prunable, err := tsdb.findTimeSeries(snapshot, start, end, now, policy)
+	if err != nil {
+		return TSHealthReport{}, err
+	}
+	for _, series := range prunable {
+		stats := report.Resolutions[series.Resolution]
+		stats.NumPrunableSeries++
+		report.Resolutions[series.Resolution] = stats
+	}
+	thresholds := tsdb.computeThresholdsWithPolicy(now.WallTime, policy)
+
+	startKey := engine.MakeMVCCMetadataKey(start.AsRawKey())
+	if first := engine.MakeMVCCMetadataKey(keys.TimeseriesPrefix); startKey.Less(first) {
+		startKey = first
+	}
+	endKey := engine.MakeMVCCMetadataKey(end.AsRawKey())
+	if last := engine.MakeMVCCMetadataKey(keys.TimeseriesPrefix.PrefixEnd()); last.Less(endKey) {
+		endKey = last
+	}
+
+	iter := snapshot.NewIterator(engine.IterOptions{UpperBound: endKey.Key})
+	defer iter.Close()
+
+	names := make(map[string]struct{})
+	namesByRes := make(map[Resolution]map[string]struct{})
+	spans := make(map[tsSourceKey]tsSampleSpan)
+	var meta enginepb.MVCCMetadata
+	for iter.Seek(startKey); ; iter.Next() {
+		if ok, err := iter.Valid(); err != nil {
+			return TSHealthReport{}, err
+		} else if !ok || !iter.UnsafeKey().Less(endKey) {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return TSHealthReport{}, err
+		}
+		if err := protoutil.Unmarshal(iter.UnsafeValue(), &meta); err != nil {
+			return TSHealthReport{}, err
+		}
+		if !meta.IsInline() {
+			// Time series data is always stored inline.
+			continue
+		}
+		name, source, res, tsNanos, err := DecodeDataKey(iter.UnsafeKey().Key)
+		if err != nil {
+			return TSHealthReport{}, err
+		}
+		data, err := roachpb.Value{RawBytes: meta.RawBytes}.GetTimeseries()
+		if err != nil {
+			return TSHealthReport{}, err
+		}
+
+		names[name] = struct{}{}
+		if namesByRes[res] == nil {
+			namesByRes[res] = make(map[string]struct{})
+		}
+		namesByRes[res][name] = struct{}{}
+
+		stats := report.Resolutions[res]
+		hadSamples := stats.NumSamples > 0
+		size := int64(len(iter.UnsafeKey().Key) + len(iter.UnsafeValue()))
+		stats.NumSlabs++
+		stats.NumSamples += int64(data.SampleCount())
+		stats.Bytes += size
+		// Maintenance deletes the slabs preceding the slab which contains the
+		// threshold, and all slabs of unsupported resolutions.
+		if threshold, ok := thresholds[res]; !ok || tsNanos < res.normalizeToSlab(threshold) {
+			stats.PrunableBytes += size
+		}
+		if oldest, newest, ok := sampleSpan(&data); ok {
+			if !hadSamples || oldest < stats.OldestNanos {
+				stats.OldestNanos = oldest
+			}
+			if !hadSamples || newest > stats.NewestNanos {
+				stats.NewestNanos = newest
+			}
+			k := tsSourceKey{name: name, source: source, res: res}
+			span, ok := spans[k]
+			if !ok || oldest < span.oldest {
+				span.oldest = oldest
+			}
+			if !ok || newest > span.newest {
+				span.newest = newest
+			}
+			spans[k] = span
+		}
+		report.Resolutions[res] = stats
+	}
+
+	report.NumSeries = len(names)
+	for res, resNames := range namesByRes {
+		stats := report.Resolutions[res]
+		stats.NumSeries = len(resNames)
+		report.Resolutions[res] = stats
+	}
+	report.RollupGaps = findRollupGaps(spans)
+	return report, nil
+}
+
+// sampleSpan returns the timestamps of the oldest and newest samples in the
+// supplied data, or false if it doesn't contain any samples.
+func sampleSpan(data *roachpb.InternalTimeSeriesData) (oldest, newest int64, ok bool) {
+	n := data.SampleCount()
+	if n == 0 {
+		return 0, 0, false
+	}
+	for i := 0; i < n; i++ {
+		var offset int32
+		if data.IsColumnar() {
+			offset = data.Offset[i]
+		} else {
+			offset = data.Samples[i].Offset
+		}
+		ts := data.TimestampForOffset(offset)
+		if i == 0 || ts < oldest {
+			oldest = ts
+		}
+		if i == 0 || ts > newest {
+			newest = ts
+		}
+	}
+	return oldest, newest, true
+}
+
+// findRollupGaps returns the gaps between the rollups of each time series
+// source and the data they are computed from. A gap exists if the newest
+// rollup ends before the rollup period containing the oldest sample of the
+// data, which means that the data in between was pruned without being rolled
+// up.
+func findRollupGaps(spans map[tsSourceKey]tsSampleSpan) []TSRollupGap {
+	var gaps []TSRollupGap
+	for k, span := range spans {
+		target, ok := k.res.TargetRollupResolution()
+		if !ok {
+			continue
+		}
+		rollupSpan, ok := spans[tsSourceKey{name: k.name, source: k.source, res: target}]
+		if !ok {
+			continue
+		}
+		rollupEnd := rollupSpan.newest + target.SampleDuration()
+		if dataStart := normalizeToPeriod(span.oldest, target.SampleDuration()); rollupEnd < dataStart {
+			gaps = append(gaps, TSRollupGap{
+				Name:       k.name,
+				Source:     k.source,
+				Resolution: k.res,
+				StartNanos: rollupEnd,
+				EndNanos:   dataStart,
+			})
+		}
+	}
+	sort.Slice(gaps, func(i, j int) bool {
+		if gaps[i].Name != gaps[j].Name {
+			return gaps[i].Name < gaps[j].Name
+		}
+		if gaps[i].Source != gaps[j].Source {
+			return gaps[i].Source < gaps[j].Source
+		}
+		return gaps[i].Resolution < gaps[j].Resolution
+	})
+	return gaps
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package ts
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/ts/tspb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/kr/pretty"
+)
+
+// TestTimeSeriesHealthReport verifies the statistics reported for seeded time
+// series data, including a gap between the rollups of a time series and its
+// high-resolution data.
+func TestTimeSeriesHealthReport(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModelRunner(t)
+	tm.Start()
+	defer tm.Stop()
+
+	const day = 24 * time.Hour
+	now := 1475700000 * time.Second
+	tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+		// The oldest sample is beyond the default retention of 10 days.
+		tsd("metric.a", "source1",
+			tsdp(now-20*day, 1),
+			tsdp(now-2*time.Hour, 2),
+			tsdp(now, 3),
+		),
+		tsd("metric.b", "source1",
+			tsdp(now-time.Hour, 1),
+			tsdp(now, 2),
+		),
+	})
+	tm.storeTimeSeriesData(Resolution30m, []tspb.TimeSeriesData{
+		// The rollups of metric.a end long before its 10s data begins, and the
+		// oldest one is beyond the default retention of 90 days.
+		tsd("metric.a", "source1",
+			tsdp(now-100*day, 1),
+			tsdp(now-30*day, 2),
+		),
+		// The rollups of metric.b end right where its 10s data begins.
+		tsd("metric.b", "source1",
+			tsdp(now-90*time.Minute, 1),
+		),
+	})
+	tm.assertKeyCount(8)
+
+	snap := tm.Store.Engine().NewSnapshot()
+	defer snap.Close()
+	report, err := tm.DB.TimeSeriesHealthReport(
+		context.Background(), snap, roachpb.RKeyMin, roachpb.RKeyMax, hlc.Timestamp{WallTime: now.Nanoseconds()},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The report doesn't write anything.
+	tm.assertKeyCount(8)
+
+	if report.NumSeries != 2 {
+		t.Errorf("expected 2 time series, got %d", report.NumSeries)
+	}
+	if len(report.Resolutions) != 2 {
+		t.Fatalf("expected stats for 2 resolutions, got %s", pretty.Sprint(report.Resolutions))
+	}
+	halfHour := func(ts time.Duration) int64 {
+		return normalizeToPeriod(ts.Nanoseconds(), Resolution30m.SampleDuration())
+	}
+	for _, tc := range []struct {
+		res      Resolution
+		expected TSResolutionStats
+	}{
+		{Resolution10s, TSResolutionStats{
+			NumSeries:         2,
+			NumPrunableSeries: 1,
+			NumSlabs:          5,
+			NumSamples:        5,
+			OldestNanos:       (now - 20*day).Nanoseconds(),
+			NewestNanos:       now.Nanoseconds(),
+		}},
+		{Resolution30m, TSResolutionStats{
+			NumSeries:         2,
+			NumPrunableSeries: 1,
+			NumSlabs:          3,
+			NumSamples:        3,
+			OldestNanos:       halfHour(now - 100*day),
+			NewestNanos:       halfHour(now - 90*time.Minute),
+		}},
+	} {
+		stats := report.Resolutions[tc.res]
+		// Exactly one slab of each resolution is beyond retention.
+		if stats.PrunableBytes <= 0 || stats.PrunableBytes >= stats.Bytes {
+			t.Errorf("%s: expected part of the %d bytes to be prunable, got %d",
+				tc.res, stats.Bytes, stats.PrunableBytes)
+		}
+		stats.Bytes, stats.PrunableBytes = 0, 0
+		if !reflect.DeepEqual(stats, tc.expected) {
+			t.Errorf("%s: unexpected stats:\n%s", tc.res, pretty.Diff(stats, tc.expected))
+		}
+	}
+
+	expGaps := []TSRollupGap{{
+		Name:       "metric.a",
+		Source:     "source1",
+		Resolution: Resolution10s,
+		StartNanos: halfHour(now-30*day) + Resolution30m.SampleDuration(),
+		EndNanos:   halfHour(now - 20*day),
+	}}
+	if !reflect.DeepEqual(report.RollupGaps, expGaps) {
+		t.Errorf("unexpected rollup gaps:\n%s", pretty.Diff(report.RollupGaps, expGaps))
+	}
+}
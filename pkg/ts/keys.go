@@ -69,11 +69,17 @@ func MakeDataKey(name string, source string, r Resolution, timestamp int64) roac
 	return k
 }
 
+// makeDataKeyNamePrefix creates a key prefix for a time series at all
+// resolutions.
+func makeDataKeyNamePrefix(name string) roachpb.Key {
+	k := append(roachpb.Key(nil), keys.TimeseriesPrefix...)
+	return encoding.EncodeBytesAscending(k, []byte(name))
+}
+
 // makeDataKeySeriesPrefix creates a key prefix for a time series at a specific
 // resolution.
 func makeDataKeySeriesPrefix(name string, r Resolution) roachpb.Key {
-	k := append(roachpb.Key(nil), keys.TimeseriesPrefix...)
-	k = encoding.EncodeBytesAscending(k, []byte(name))
+	k := makeDataKeyNamePrefix(name)
 	k = encoding.EncodeVarintAscending(k, int64(r))
 	return k
 }
@@ -14,13 +14,50 @@ package ts
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/internal/client"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/storage"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/pkg/errors"
+)
+
+// maintenanceMaxRetries limits how often a KV operation performed during time
+// series maintenance is retried after failing with a retryable error.
+var maintenanceMaxRetries = settings.RegisterNonNegativeIntSetting(
+	"timeseries.maintenance.max_retries",
+	"maximum number of times a time series maintenance operation is retried after "+
+		"a retryable error, such as a range split or lease transfer",
+	5,
+)
+
+// maintenanceRetryOptions are the backoff options used when retrying time
+// series maintenance operations. MaxRetries is taken from
+// maintenanceMaxRetries.
+var maintenanceRetryOptions = retry.Options{
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Multiplier:     2,
+}
+
+// maintenanceCheckpointInterval is the minimum interval between two
+// checkpoints of the progress of time series maintenance (see
+// MaintainTimeSeriesWithCheckpoints).
+var maintenanceCheckpointInterval = settings.RegisterNonNegativeDurationSetting(
+	"timeseries.maintenance.checkpoint_interval",
+	"the minimum interval between checkpoints of the progress of time series maintenance, "+
+		"which allow maintenance interrupted by a restart to resume",
+	10*time.Second,
 )
 
 // ContainsTimeSeries returns true if the given key range overlaps the
@@ -33,8 +70,9 @@ func (tsdb *DB) ContainsTimeSeries(start, end roachpb.RKey) bool {
 // process periodically in order to perform "maintenance" work on time series
 // data. Currently, this includes computing rollups and pruning data which has
 // exceeded its retention threshold, as well as computing low-resolution rollups
-// of data. This system was designed specifically to be used by scanner queue
-// from the storage package.
+// of data and deleting slabs which no longer contain any samples. This system
+// was designed specifically to be used by scanner queue from the storage
+// package.
 //
 // The snapshot should be supplied by a local store, and is used only to
 // discover the names of time series which are store in that snapshot. The KV
@@ -47,28 +85,590 @@ func (tsdb *DB) ContainsTimeSeries(start, end roachpb.RKey) bool {
 // individual ranges which contain that time series data. Because replicas of
 // those ranges are guaranteed to have time series data locally, we can use the
 // snapshot to quickly obtain a set of keys to be pruned with no network calls.
+//
+// Each time series is maintained independently. If maintenance fails for some
+// of them, the others are still maintained, and the returned error describes
+// all failures.
+//
+// Memory used by maintenance is accounted against the supplied monitor. Each
+// time series is rolled up with a separate account bounded by budgetBytes,
+// which is released before the next time series is maintained, so that a
+// single dense time series can't starve the others.
+//
+// If a RetentionResolver has been set, the retention policy it resolves for
+// the supplied key range takes precedence over the cluster-wide retention.
+//
+// The operation is listed by InflightMaintenance while it runs, and can be
+// canceled through CancelMaintenance with the supplied range ID.
 func (tsdb *DB) MaintainTimeSeries(
 	ctx context.Context,
+	rangeID roachpb.RangeID,
+	snapshot engine.Reader,
+	start, end roachpb.RKey,
+	db *client.DB,
+	mem *mon.BytesMonitor,
+	budgetBytes int64,
+	now hlc.Timestamp,
+) error {
+	return tsdb.MaintainTimeSeriesWithSink(
+		ctx, rangeID, snapshot, start, end, db, mem, budgetBytes, now,
+		nil /* sink */, false, /* abortOnSinkError */
+	)
+}
+
+// MaintainTimeSeriesWithSink is like MaintainTimeSeries, but additionally
+// emits the events of the maintenance to the supplied sink as they happen,
+// which allows external processors to observe it. The sink, which may be nil,
+// is called synchronously, so a slow sink slows down the maintenance. If
+// abortOnSinkError is set, an error returned by the sink stops the maintenance
+// and is returned; otherwise it is logged and the maintenance continues.
+func (tsdb *DB) MaintainTimeSeriesWithSink(
+	ctx context.Context,
+	rangeID roachpb.RangeID,
 	snapshot engine.Reader,
 	start, end roachpb.RKey,
 	db *client.DB,
 	mem *mon.BytesMonitor,
 	budgetBytes int64,
 	now hlc.Timestamp,
+	sink MaintenanceSink,
+	abortOnSinkError bool,
 ) error {
-	series, err := tsdb.findTimeSeries(snapshot, start, end, now)
+	events := &maintenanceEvents{sink: sink, abortOnError: abortOnSinkError, rangeID: rangeID}
+	return tsdb.maintainTimeSeries(
+		ctx, rangeID, snapshot, start, end, db, mem, budgetBytes, now, events, nil, /* checkpointer */
+	)
+}
+
+// MaintainTimeSeriesWithCheckpoints is like MaintainTimeSeries, but
+// periodically records its progress with the supplied checkpointer, at most
+// once per timeseries.maintenance.checkpoint_interval. The checkpoint is the
+// key of the last time series which has been maintained. If a checkpoint
+// within the key span exists when maintenance starts, which is the case if
+// the previous maintenance was interrupted, for example by a restart, the time
+// series up to and including it are skipped. The checkpoint is cleared once
+// all time series have been maintained.
+//
+// Checkpoints are advisory: failing to load or save them only results in
+// redundant work, and is merely logged.
+func (tsdb *DB) MaintainTimeSeriesWithCheckpoints(
+	ctx context.Context,
+	rangeID roachpb.RangeID,
+	snapshot engine.Reader,
+	start, end roachpb.RKey,
+	db *client.DB,
+	mem *mon.BytesMonitor,
+	budgetBytes int64,
+	now hlc.Timestamp,
+	checkpointer storage.TimeSeriesMaintenanceCheckpointer,
+) error {
+	events := &maintenanceEvents{rangeID: rangeID}
+	return tsdb.maintainTimeSeries(
+		ctx, rangeID, snapshot, start, end, db, mem, budgetBytes, now, events, checkpointer,
+	)
+}
+
+// maintainTimeSeries implements MaintainTimeSeriesWithSink and
+// MaintainTimeSeriesWithCheckpoints. The checkpointer may be nil.
+func (tsdb *DB) maintainTimeSeries(
+	ctx context.Context,
+	rangeID roachpb.RangeID,
+	snapshot engine.Reader,
+	start, end roachpb.RKey,
+	db *client.DB,
+	mem *mon.BytesMonitor,
+	budgetBytes int64,
+	now hlc.Timestamp,
+	events *maintenanceEvents,
+	checkpointer storage.TimeSeriesMaintenanceCheckpointer,
+) error {
+	policy, err := tsdb.resolveRetentionPolicy(start, end)
+	if err != nil {
+		return err
+	}
+	series, emptySlabs, err := tsdb.findTimeSeriesAndEmptySlabs(snapshot, start, end, now, policy)
 	if err != nil {
 		return err
 	}
-	if tsdb.WriteRollups() {
-		qmc := MakeQueryMemoryContext(mem, mem, QueryMemoryOptions{
-			BudgetBytes: budgetBytes,
-		})
-		if err := tsdb.rollupTimeSeries(ctx, series, now, qmc); err != nil {
+	cp := maintenanceCheckpoint{
+		checkpointer: checkpointer,
+		interval:     maintenanceCheckpointInterval.Get(&tsdb.st.SV),
+		lastSaved:    timeutil.Now(),
+	}
+	series = cp.resume(ctx, series, start, end)
+	for _, timeSeries := range series {
+		if err := events.emit(ctx, MaintenanceEvent{
+			Type:       MaintenanceSeriesDiscovered,
+			Name:       timeSeries.Name,
+			Resolution: timeSeries.Resolution,
+		}); err != nil {
+			return err
+		}
+	}
+	qmc := MakeQueryMemoryContext(mem, mem, QueryMemoryOptions{
+		BudgetBytes: budgetBytes,
+	})
+
+	ctx, op := tsdb.startMaintenance(ctx, MaintenanceOp{
+		RangeID:   rangeID,
+		StartKey:  start,
+		EndKey:    end,
+		Started:   timeutil.Now(),
+		NumSeries: len(series),
+	})
+	defer tsdb.finishMaintenance(op)
+	// If the maintenance stops early, record how far it got.
+	defer cp.save(ctx, true /* force */)
+
+	var errs []error
+	// The time series which have been rolled up are pruned together, which
+	// allows their deletions to be coalesced (see pruneTimeSeries). This
+	// happens after the last time series, and before a checkpoint is saved,
+	// so that checkpoints only cover time series which have been pruned.
+	var pending, rolledUp []timeSeriesResolutionInfo
+	prune := func() error {
+		pruneErrs, err := tsdb.pruneMaintainedTimeSeries(
+			ctx, db, snapshot, start, end, rolledUp, now, policy, events,
+		)
+		if err != nil {
+			return err
+		}
+		errs = append(errs, pruneErrs...)
+		for _, timeSeries := range pending {
+			cp.advance(ctx, timeSeries)
+		}
+		pending, rolledUp = pending[:0], rolledUp[:0]
+		return nil
+	}
+	for i, timeSeries := range series {
+		// Cancellation is checked between time series, leaving the remaining
+		// ones untouched. Time series which have been rolled up but not
+		// pruned when the operation is canceled are consistent, since data is
+		// only pruned after being rolled up; the next pass completes their
+		// maintenance.
+		if err := ctx.Err(); err != nil {
+			return errors.Wrapf(err, "time series maintenance stopped after %d of %d time series",
+				i, len(series))
+		}
+		err := tsdb.rollupMaintainedTimeSeries(ctx, timeSeries, now, policy, qmc, events)
+		tsdb.advanceMaintenance(op)
+		if err != nil && ctx.Err() != nil {
+			return errors.Wrapf(ctx.Err(), "time series maintenance stopped after %d of %d time series",
+				i, len(series))
+		}
+		if _, ok := err.(*maintenanceSinkError); ok {
+			return errors.Wrapf(err, "time series maintenance stopped after %d of %d time series",
+				i, len(series))
+		}
+		pending = append(pending, timeSeries)
+		if err != nil {
+			errs = append(errs, tsdb.maintenanceSeriesError(ctx, timeSeries, err))
+		} else {
+			rolledUp = append(rolledUp, timeSeries)
+		}
+		if i == len(series)-1 || cp.due() {
+			if err := prune(); err != nil {
+				return errors.Wrapf(err, "time series maintenance stopped after %d of %d time series",
+					i+1, len(series))
+			}
+		}
+	}
+	// All time series have been maintained (or failed to be), so the next
+	// maintenance starts from scratch.
+	cp.clear(ctx)
+	if len(errs) > 0 {
+		return &maintenanceError{errs: errs, numSeries: len(series)}
+	}
+
+	// Slabs which no longer contain any samples are deleted even if they are
+	// within their retention period, as they don't hold any data worth
+	// retaining. Only slabs whose time span ended before now have been found,
+	// as others may still receive samples.
+	if err := tsdb.pruneEmptySlabs(ctx, db, emptySlabs); err != nil {
+		return err
+	}
+	if len(emptySlabs) == 0 || !events.enabled() {
+		return nil
+	}
+	ev := MaintenanceEvent{Type: MaintenanceEmptySlabsPruned}
+	for _, key := range emptySlabs {
+		numSlabs, bytes, err := measureSlabs(snapshot, key, key.Next())
+		if err != nil {
 			return err
 		}
+		ev.NumSlabs += numSlabs
+		ev.Bytes += bytes
+	}
+	return events.emit(ctx, ev)
+}
+
+// maintenanceCheckpoint tracks the progress of a maintenance operation and
+// records it with a checkpointer (see MaintainTimeSeriesWithCheckpoints). All
+// methods are no-ops without a checkpointer.
+type maintenanceCheckpoint struct {
+	checkpointer storage.TimeSeriesMaintenanceCheckpointer
+	interval     time.Duration
+	// key is the key of the last time series which has been maintained, and
+	// saved is whether it has been recorded.
+	key       roachpb.Key
+	saved     bool
+	lastSaved time.Time
+}
+
+// resume returns the time series which remain to be maintained after the
+// checkpoint left by a previous maintenance of the key span, if any. The time
+// series are sorted by key, as returned by findTimeSeries.
+func (c *maintenanceCheckpoint) resume(
+	ctx context.Context, series []timeSeriesResolutionInfo, start, end roachpb.RKey,
+) []timeSeriesResolutionInfo {
+	if c.checkpointer == nil {
+		return series
+	}
+	key, err := c.checkpointer.LoadCheckpoint(ctx)
+	if err != nil {
+		log.Warningf(ctx, "unable to load time series maintenance checkpoint: %s", err)
+		return series
+	}
+	// The key span may have changed since the checkpoint was saved, for
+	// example by a split or merge, in which case the checkpoint is ignored.
+	if key == nil || key.Compare(start.AsRawKey()) < 0 || key.Compare(end.AsRawKey()) >= 0 {
+		return series
+	}
+	c.key, c.saved = key, true
+	i := sort.Search(len(series), func(i int) bool {
+		return seriesKey(series[i]).Compare(key) > 0
+	})
+	log.VEventf(ctx, 2, "resuming time series maintenance after %s, skipping %d time series", key, i)
+	return series[i:]
+}
+
+// advance records that the given time series has been maintained, and saves
+// the checkpoint if the checkpoint interval has passed since it was last
+// saved.
+func (c *maintenanceCheckpoint) advance(ctx context.Context, timeSeries timeSeriesResolutionInfo) {
+	if c.checkpointer == nil {
+		return
+	}
+	c.key, c.saved = seriesKey(timeSeries), false
+	c.save(ctx, false /* force */)
+}
+
+// due returns whether the checkpoint interval has passed since the checkpoint
+// was last saved, so that advancing it would save it.
+func (c *maintenanceCheckpoint) due() bool {
+	return c.checkpointer != nil && timeutil.Since(c.lastSaved) >= c.interval
+}
+
+// save saves the checkpoint if it has advanced since it was last saved, and
+// either force is set or the checkpoint interval has passed.
+func (c *maintenanceCheckpoint) save(ctx context.Context, force bool) {
+	if c.checkpointer == nil || c.saved || c.key == nil {
+		return
+	}
+	if !force && timeutil.Since(c.lastSaved) < c.interval {
+		return
+	}
+	if err := c.checkpointer.SaveCheckpoint(ctx, c.key); err != nil {
+		log.Warningf(ctx, "unable to save time series maintenance checkpoint: %s", err)
+		return
+	}
+	c.saved, c.lastSaved = true, timeutil.Now()
+}
+
+// clear removes the checkpoint once all time series have been maintained.
+func (c *maintenanceCheckpoint) clear(ctx context.Context) {
+	if c.checkpointer == nil {
+		return
+	}
+	c.key, c.saved = nil, true
+	if err := c.checkpointer.SaveCheckpoint(ctx, nil); err != nil {
+		log.Warningf(ctx, "unable to clear time series maintenance checkpoint: %s", err)
+	}
+}
+
+// seriesKey returns the key at which the data of the given time series starts.
+func seriesKey(timeSeries timeSeriesResolutionInfo) roachpb.Key {
+	return makeDataKeySeriesPrefix(timeSeries.Name, timeSeries.Resolution)
+}
+
+// MaintenanceOp describes an in-flight time series maintenance operation, as
+// started by MaintainTimeSeries.
+type MaintenanceOp struct {
+	// RangeID is the range on behalf of which the maintenance is performed.
+	RangeID roachpb.RangeID
+	// StartKey and EndKey delimit the maintained key span.
+	StartKey, EndKey roachpb.RKey
+	// Started is the time at which the maintenance started.
+	Started time.Time
+	// NumSeries is the number of time series (per resolution) to maintain, of
+	// which NumSeriesDone have been maintained so far.
+	NumSeries, NumSeriesDone int
+	// Canceled is set once the operation has been canceled, until it stops.
+	Canceled bool
+}
+
+// inflightMaintenance is an in-flight maintenance operation.
+type inflightMaintenance struct {
+	// op is protected by DB.maintenance.
+	op     MaintenanceOp
+	cancel context.CancelFunc
+}
+
+// startMaintenance registers an in-flight maintenance operation. It returns
+// the context with which the operation must be carried out, which is canceled
+// by CancelMaintenance.
+func (tsdb *DB) startMaintenance(
+	ctx context.Context, op MaintenanceOp,
+) (context.Context, *inflightMaintenance) {
+	ctx, cancel := context.WithCancel(ctx)
+	m := &inflightMaintenance{op: op, cancel: cancel}
+	tsdb.maintenance.Lock()
+	defer tsdb.maintenance.Unlock()
+	if tsdb.maintenance.ops == nil {
+		tsdb.maintenance.ops = make(map[*inflightMaintenance]struct{})
+	}
+	tsdb.maintenance.ops[m] = struct{}{}
+	return ctx, m
+}
+
+// advanceMaintenance records that the operation has maintained another time
+// series.
+func (tsdb *DB) advanceMaintenance(m *inflightMaintenance) {
+	tsdb.maintenance.Lock()
+	defer tsdb.maintenance.Unlock()
+	m.op.NumSeriesDone++
+}
+
+// finishMaintenance unregisters an in-flight maintenance operation.
+func (tsdb *DB) finishMaintenance(m *inflightMaintenance) {
+	tsdb.maintenance.Lock()
+	defer tsdb.maintenance.Unlock()
+	delete(tsdb.maintenance.ops, m)
+	m.cancel()
+}
+
+// InflightMaintenance returns the time series maintenance operations which are
+// currently in flight, ordered by range ID and start time.
+func (tsdb *DB) InflightMaintenance() []MaintenanceOp {
+	tsdb.maintenance.Lock()
+	defer tsdb.maintenance.Unlock()
+	ops := make([]MaintenanceOp, 0, len(tsdb.maintenance.ops))
+	for m := range tsdb.maintenance.ops {
+		ops = append(ops, m.op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].RangeID != ops[j].RangeID {
+			return ops[i].RangeID < ops[j].RangeID
+		}
+		return ops[i].Started.Before(ops[j].Started)
+	})
+	return ops
+}
+
+// CancelMaintenance cancels the in-flight time series maintenance operations
+// of the given range, and returns whether there were any. A canceled operation
+// stops before maintaining the next time series, and aborts the KV operations
+// of the current one. It doesn't wait for the operations to stop.
+func (tsdb *DB) CancelMaintenance(rangeID roachpb.RangeID) bool {
+	tsdb.maintenance.Lock()
+	defer tsdb.maintenance.Unlock()
+	var found bool
+	for m := range tsdb.maintenance.ops {
+		if m.op.RangeID == rangeID {
+			m.op.Canceled = true
+			m.cancel()
+			found = true
+		}
+	}
+	return found
+}
+
+// rollupMaintainedTimeSeries rolls up the data of a single time series, if
+// rollups are enabled. Each time series is rolled up in isolation, so that a
+// failure for one of them doesn't prevent the others from being maintained.
+func (tsdb *DB) rollupMaintainedTimeSeries(
+	ctx context.Context,
+	timeSeries timeSeriesResolutionInfo,
+	now hlc.Timestamp,
+	policy RetentionPolicy,
+	qmc QueryMemoryContext,
+	events *maintenanceEvents,
+) error {
+	if !tsdb.WriteRollups() {
+		return nil
+	}
+	thresholds := tsdb.computeThresholdsWithPolicy(now.WallTime, policy)
+	numDatapoints, err := tsdb.rollupSingleTimeSeries(
+		ctx, timeSeries, thresholds[timeSeries.Resolution], qmc,
+	)
+	if err != nil {
+		return err
+	}
+	return events.emit(ctx, MaintenanceEvent{
+		Type:          MaintenanceSeriesRolledUp,
+		Name:          timeSeries.Name,
+		Resolution:    timeSeries.Resolution,
+		NumDatapoints: numDatapoints,
+	})
+}
+
+// pruneMaintainedTimeSeries prunes the data of the given time series, which
+// have been rolled up, with a single batch. Only if that batch fails is each
+// time series pruned on its own, so that a failure for one of them doesn't
+// prevent the others from being pruned. It returns an error for each time
+// series which couldn't be pruned, and separately an error which stops the
+// maintenance. The snapshot and the maintained key span are only used to
+// measure the pruned data for the events.
+func (tsdb *DB) pruneMaintainedTimeSeries(
+	ctx context.Context,
+	db *client.DB,
+	snapshot engine.Reader,
+	start, end roachpb.RKey,
+	series []timeSeriesResolutionInfo,
+	now hlc.Timestamp,
+	policy RetentionPolicy,
+	events *maintenanceEvents,
+) ([]error, error) {
+	if len(series) == 0 {
+		return nil, nil
+	}
+	// The pruned data is measured before it is deleted. Only the part of it
+	// within the maintained key span is stored in the snapshot.
+	type measurement struct {
+		numSlabs int
+		bytes    int64
+	}
+	measurements := make([]measurement, len(series))
+	if events.enabled() {
+		thresholds := tsdb.computeThresholdsWithPolicy(now.WallTime, policy)
+		for i, timeSeries := range series {
+			pruneStart, pruneEnd := pruneSpan(timeSeries, thresholds)
+			if startKey := start.AsRawKey(); pruneStart.Compare(startKey) < 0 {
+				pruneStart = startKey
+			}
+			if endKey := end.AsRawKey(); endKey.Compare(pruneEnd) < 0 {
+				pruneEnd = endKey
+			}
+			m := &measurements[i]
+			var err error
+			if m.numSlabs, m.bytes, err = measureSlabs(snapshot, pruneStart, pruneEnd); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	pruneErrs := make([]error, len(series))
+	if err := tsdb.pruneTimeSeries(ctx, db, series, now, policy); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if len(series) == 1 {
+			pruneErrs[0] = err
+		} else {
+			log.VEventf(ctx, 2, "pruning %d time series individually after error: %s", len(series), err)
+			for i, timeSeries := range series {
+				pruneErrs[i] = tsdb.pruneTimeSeries(
+					ctx, db, []timeSeriesResolutionInfo{timeSeries}, now, policy,
+				)
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+			}
+		}
+	}
+
+	var errs []error
+	for i, timeSeries := range series {
+		if err := pruneErrs[i]; err != nil {
+			errs = append(errs, tsdb.maintenanceSeriesError(ctx, timeSeries, err))
+			continue
+		}
+		if err := events.emit(ctx, MaintenanceEvent{
+			Type:       MaintenanceSeriesPruned,
+			Name:       timeSeries.Name,
+			Resolution: timeSeries.Resolution,
+			NumSlabs:   measurements[i].numSlabs,
+			Bytes:      measurements[i].bytes,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return errs, nil
+}
+
+// maintenanceSeriesError records that the maintenance of the given time series
+// failed with the given error, and returns the error to report for it.
+func (tsdb *DB) maintenanceSeriesError(
+	ctx context.Context, timeSeries timeSeriesResolutionInfo, err error,
+) error {
+	tsdb.metrics.MaintenanceErrors.Inc(1)
+	log.Warningf(ctx, "error maintaining time series %s at resolution %s: %s",
+		timeSeries.Name, timeSeries.Resolution, err)
+	return errors.Wrapf(err, "time series %s at resolution %s",
+		timeSeries.Name, timeSeries.Resolution)
+}
+
+// maintenanceError is returned from MaintainTimeSeries if the maintenance of
+// one or more time series failed. It contains an error for each of them.
+type maintenanceError struct {
+	errs      []error
+	numSeries int
+}
+
+func (e *maintenanceError) Error() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "maintenance failed for %d of %d time series", len(e.errs), e.numSeries)
+	for _, err := range e.errs {
+		fmt.Fprintf(&buf, "; %s", err)
+	}
+	return buf.String()
+}
+
+// runMaintenanceBatch runs the batch returned by makeBatch, retrying with a new
+// batch and exponential backoff when it fails with a retryable error. A fresh
+// batch is needed for each attempt since a batch can only be run once. The
+// batch which ran successfully is returned.
+func (tsdb *DB) runMaintenanceBatch(
+	ctx context.Context, db *client.DB, makeBatch func() *client.Batch,
+) (*client.Batch, error) {
+	opts := maintenanceRetryOptions
+	opts.MaxRetries = int(maintenanceMaxRetries.Get(&tsdb.st.SV))
+	if opts.MaxRetries == 0 {
+		// A zero MaxRetries would retry indefinitely.
+		b := makeBatch()
+		return b, db.Run(ctx, b)
+	}
+	var err error
+	for r := retry.StartWithCtx(ctx, opts); r.Next(); {
+		b := makeBatch()
+		if err = db.Run(ctx, b); err == nil {
+			return b, nil
+		}
+		if !isRetryableMaintenanceError(err) {
+			return nil, err
+		}
+		log.VEventf(ctx, 2, "retrying time series maintenance operation after error: %s", err)
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	return nil, err
+}
+
+// isRetryableMaintenanceError returns true if the error is caused by a change
+// in the cluster, such as a range split or a lease transfer, which is likely to
+// resolve itself. All time series maintenance operations are idempotent, which
+// makes ambiguous results safe to retry as well.
+func isRetryableMaintenanceError(err error) bool {
+	switch errors.Cause(err).(type) {
+	case *roachpb.NotLeaseHolderError,
+		*roachpb.RangeKeyMismatchError,
+		*roachpb.RangeNotFoundError,
+		*roachpb.AmbiguousResultError,
+		*roachpb.SendError:
+		return true
 	}
-	return tsdb.pruneTimeSeries(ctx, db, series, now)
+	return false
 }
 
 // Assert that DB implements the necessary interface from the storage package.
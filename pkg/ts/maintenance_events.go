@@ -0,0 +1,141 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package ts
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// MaintenanceEventType is the type of a MaintenanceEvent.
+type MaintenanceEventType int
+
+const (
+	// MaintenanceSeriesDiscovered is emitted for each time series (per
+	// resolution) found in the maintained key span, before any of them is
+	// maintained.
+	MaintenanceSeriesDiscovered MaintenanceEventType = iota
+	// MaintenanceSeriesRolledUp is emitted after the rollups of a time series
+	// have been written.
+	MaintenanceSeriesRolledUp
+	// MaintenanceSeriesPruned is emitted after the data of a time series which
+	// exceeded its retention has been deleted.
+	MaintenanceSeriesPruned
+	// MaintenanceEmptySlabsPruned is emitted after the slabs which no longer
+	// contained any samples have been deleted.
+	MaintenanceEmptySlabsPruned
+)
+
+func (t MaintenanceEventType) String() string {
+	switch t {
+	case MaintenanceSeriesDiscovered:
+		return "discovered"
+	case MaintenanceSeriesRolledUp:
+		return "rolled-up"
+	case MaintenanceSeriesPruned:
+		return "pruned"
+	case MaintenanceEmptySlabsPruned:
+		return "empty-slabs-pruned"
+	}
+	return fmt.Sprintf("MaintenanceEventType(%d)", int(t))
+}
+
+// MaintenanceEvent describes a step of time series maintenance, as emitted to
+// a MaintenanceSink by MaintainTimeSeriesWithSink.
+type MaintenanceEvent struct {
+	Type MaintenanceEventType
+	// RangeID is the range on behalf of which the maintenance is performed.
+	RangeID roachpb.RangeID
+	// Name and Resolution identify the time series. They are unset for
+	// MaintenanceEmptySlabsPruned.
+	Name       string
+	Resolution Resolution
+	// NumDatapoints is the number of rollup datapoints written, for
+	// MaintenanceSeriesRolledUp.
+	NumDatapoints int
+	// NumSlabs and Bytes are the number of slabs deleted and the size of their
+	// keys and values, for MaintenanceSeriesPruned and
+	// MaintenanceEmptySlabsPruned. They are measured in the snapshot the
+	// maintenance was started with, and thus don't include data written since.
+	NumSlabs int
+	Bytes    int64
+}
+
+// MaintenanceSink receives the events of time series maintenance. It is called
+// synchronously, so maintenance doesn't proceed until it returns.
+type MaintenanceSink func(MaintenanceEvent) error
+
+// maintenanceSinkError wraps an error returned by a MaintenanceSink which
+// aborts the maintenance.
+type maintenanceSinkError struct {
+	err error
+}
+
+func (e *maintenanceSinkError) Error() string {
+	return fmt.Sprintf("time series maintenance event sink: %s", e.err)
+}
+
+// maintenanceEvents emits the events of a maintenance operation to its sink,
+// if any.
+type maintenanceEvents struct {
+	sink         MaintenanceSink
+	abortOnError bool
+	rangeID      roachpb.RangeID
+}
+
+// enabled returns whether events are emitted at all, which allows skipping
+// the work of computing them.
+func (e *maintenanceEvents) enabled() bool {
+	return e.sink != nil
+}
+
+// emit sends the event to the sink. Errors returned by the sink are returned
+// as a *maintenanceSinkError if they abort the maintenance, and logged
+// otherwise.
+func (e *maintenanceEvents) emit(ctx context.Context, ev MaintenanceEvent) error {
+	if e.sink == nil {
+		return nil
+	}
+	ev.RangeID = e.rangeID
+	if err := e.sink(ev); err != nil {
+		if e.abortOnError {
+			return &maintenanceSinkError{err: err}
+		}
+		log.Warningf(ctx, "error emitting %s event of time series maintenance: %s", ev.Type, err)
+	}
+	return nil
+}
+
+// measureSlabs returns the number of slabs stored in the supplied snapshot
+// within the key span, and the total size of their keys and values.
+func measureSlabs(snapshot engine.Reader, start, end roachpb.Key) (int, int64, error) {
+	iter := snapshot.NewIterator(engine.IterOptions{UpperBound: end})
+	defer iter.Close()
+	var numSlabs int
+	var bytes int64
+	endKey := engine.MakeMVCCMetadataKey(end)
+	for iter.Seek(engine.MakeMVCCMetadataKey(start)); ; iter.Next() {
+		if ok, err := iter.Valid(); err != nil {
+			return 0, 0, err
+		} else if !ok || !iter.UnsafeKey().Less(endKey) {
+			break
+		}
+		numSlabs++
+		bytes += int64(len(iter.UnsafeKey().Key) + len(iter.UnsafeValue()))
+	}
+	return numSlabs, bytes, nil
+}
@@ -139,10 +139,14 @@ func (qmc QueryMemoryContext) GetMaxTimespan(r Resolution) (int64, error) {
 }
 
 // GetMaxRollupSlabs returns the maximum number of rows that should be processed
-// at one time when rolling up the given resolution.
+// at one time when rolling up the given resolution. At least one row is
+// processed at a time, even if it exceeds the budget.
 func (qmc QueryMemoryContext) GetMaxRollupSlabs(r Resolution) int64 {
 	// Rollup computations only occur when columnar is true.
-	return qmc.BudgetBytes / qmc.computeSizeOfSlab(r)
+	if n := qmc.BudgetBytes / qmc.computeSizeOfSlab(r); n > 0 {
+		return n
+	}
+	return 1
 }
 
 // computeSizeOfSlab returns the size of a completely full data slab for the supplied
@@ -34,6 +34,14 @@ var (
 		Measurement: "Errors",
 		Unit:        metric.Unit_COUNT,
 	}
+
+	// Maintenance metrics.
+	metaMaintenanceErrors = metric.Metadata{
+		Name:        "timeseries.maintenance.errors",
+		Help:        "Total number of time series for which a maintenance pass failed",
+		Measurement: "Errors",
+		Unit:        metric.Unit_COUNT,
+	}
 )
 
 // TimeSeriesMetrics contains metrics relevant to the time series system.
@@ -41,6 +49,8 @@ type TimeSeriesMetrics struct {
 	WriteSamples *metric.Counter
 	WriteBytes   *metric.Counter
 	WriteErrors  *metric.Counter
+
+	MaintenanceErrors *metric.Counter
 }
 
 // NewTimeSeriesMetrics creates a new instance of TimeSeriesMetrics.
@@ -49,5 +59,7 @@ func NewTimeSeriesMetrics() *TimeSeriesMetrics {
 		WriteSamples: metric.NewCounter(metaWriteSamples),
 		WriteBytes:   metric.NewCounter(metaWriteBytes),
 		WriteErrors:  metric.NewCounter(metaWriteErrors),
+
+		MaintenanceErrors: metric.NewCounter(metaMaintenanceErrors),
 	}
 }
@@ -14,12 +14,16 @@ package ts
 
 import (
 	"context"
+	"sort"
 
 	"github.com/cockroachdb/cockroach/pkg/internal/client"
 	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+	"github.com/pkg/errors"
 )
 
 var (
@@ -41,10 +45,50 @@ type timeSeriesResolutionInfo struct {
 // An engine snapshot is used, rather than a client, because this function is
 // intended to be called by a storage queue which can inspect the local data for
 // a single range without the need for expensive network calls.
+//
+// The supplied retention policy, which may be nil, overrides the cluster-wide
+// retention when determining whether a time series has data to prune.
 func (tsdb *DB) findTimeSeries(
-	snapshot engine.Reader, startKey, endKey roachpb.RKey, now hlc.Timestamp,
+	snapshot engine.Reader,
+	startKey, endKey roachpb.RKey,
+	now hlc.Timestamp,
+	policy RetentionPolicy,
 ) ([]timeSeriesResolutionInfo, error) {
+	results, _, err := tsdb.scanTimeSeries(
+		snapshot, startKey, endKey, now, policy, false, /* findEmptySlabs */
+	)
+	return results, err
+}
+
+// findTimeSeriesAndEmptySlabs is like findTimeSeries, but additionally
+// identifies slabs which are stored but contain no samples, within the same
+// scan. Such slabs can remain behind when all samples have been removed from a
+// slab by an operation which rewrites it, and only waste space and scan time.
+//
+// Only slabs whose time span ended before the supplied timestamp are returned.
+// Slabs covering the current time may still receive samples, which would be
+// lost if the slab was deleted concurrently.
+func (tsdb *DB) findTimeSeriesAndEmptySlabs(
+	snapshot engine.Reader,
+	startKey, endKey roachpb.RKey,
+	now hlc.Timestamp,
+	policy RetentionPolicy,
+) ([]timeSeriesResolutionInfo, []roachpb.Key, error) {
+	return tsdb.scanTimeSeries(snapshot, startKey, endKey, now, policy, true /* findEmptySlabs */)
+}
+
+// scanTimeSeries implements findTimeSeries and findTimeSeriesAndEmptySlabs.
+// Unless findEmptySlabs is set, it skips over the remaining keys of each
+// discovered time series instead of visiting every slab.
+func (tsdb *DB) scanTimeSeries(
+	snapshot engine.Reader,
+	startKey, endKey roachpb.RKey,
+	now hlc.Timestamp,
+	policy RetentionPolicy,
+	findEmptySlabs bool,
+) ([]timeSeriesResolutionInfo, []roachpb.Key, error) {
 	var results []timeSeriesResolutionInfo
+	var emptySlabs []roachpb.Key
 
 	// Set start boundary for the search, which is the lesser of the range start
 	// key and the beginning of time series data.
@@ -62,36 +106,100 @@ func (tsdb *DB) findTimeSeries(
 		end = lastTS
 	}
 
-	thresholds := tsdb.computeThresholds(now.WallTime)
+	thresholds := tsdb.computeThresholdsWithPolicy(now.WallTime, policy)
 
 	iter := snapshot.NewIterator(engine.IterOptions{UpperBound: endKey.AsRawKey()})
 	defer iter.Close()
 
-	for iter.Seek(next); ; iter.Seek(next) {
+	// seriesEnd is the end of the keys of the last discovered time series.
+	var seriesEnd roachpb.Key
+	var meta enginepb.MVCCMetadata
+	for iter.Seek(next); ; {
 		if ok, err := iter.Valid(); err != nil {
-			return nil, err
+			return nil, nil, err
 		} else if !ok || !iter.UnsafeKey().Less(end) {
 			break
 		}
-		foundKey := iter.Key().Key
+		foundKey := iter.UnsafeKey().Key
 
 		// Extract the name and resolution from the discovered key.
 		name, _, res, tsNanos, err := DecodeDataKey(foundKey)
 		if err != nil {
+			return nil, nil, err
+		}
+		if seriesEnd == nil || foundKey.Compare(seriesEnd) >= 0 {
+			// Skip this time series if there's nothing to prune. We check the
+			// oldest (first) time series record's timestamp against the
+			// pruning threshold.
+			if threshold, ok := thresholds[res]; !ok || threshold > tsNanos {
+				results = append(results, timeSeriesResolutionInfo{
+					Name:       name,
+					Resolution: res,
+				})
+			}
+			seriesEnd = makeDataKeySeriesPrefix(name, res).PrefixEnd()
+		}
+
+		if !findEmptySlabs {
+			// Skip to the next possible time series key which could belong to
+			// a previously undiscovered time series.
+			iter.Seek(engine.MakeMVCCMetadataKey(seriesEnd))
+			continue
+		}
+		if tsNanos+res.SlabDuration() <= now.WallTime {
+			if err := protoutil.Unmarshal(iter.UnsafeValue(), &meta); err != nil {
+				return nil, nil, err
+			}
+			// Time series data is always stored inline.
+			if meta.IsInline() {
+				data, err := roachpb.Value{RawBytes: meta.RawBytes}.GetTimeseries()
+				if err != nil {
+					return nil, nil, err
+				}
+				if data.SampleCount() == 0 {
+					emptySlabs = append(emptySlabs, iter.Key().Key)
+				}
+			}
+		}
+		iter.Next()
+	}
+
+	return results, emptySlabs, nil
+}
+
+// AvailableResolutions returns the resolutions at which the supplied engine
+// stores data for the named time series, in ascending order of their encoded
+// value. Like findTimeSeries, it inspects local data only, so it only reports
+// resolutions for which the snapshot contains data. An empty slice is returned
+// for a time series without data.
+func (tsdb *DB) AvailableResolutions(
+	ctx context.Context, snapshot engine.Reader, name string,
+) ([]Resolution, error) {
+	results := []Resolution{}
+
+	prefix := makeDataKeyNamePrefix(name)
+	end := engine.MakeMVCCMetadataKey(prefix.PrefixEnd())
+	next := engine.MakeMVCCMetadataKey(prefix)
+
+	iter := snapshot.NewIterator(engine.IterOptions{UpperBound: end.Key})
+	defer iter.Close()
+
+	for iter.Seek(next); ; iter.Seek(next) {
+		if ok, err := iter.Valid(); err != nil {
 			return nil, err
+		} else if !ok || !iter.UnsafeKey().Less(end) {
+			break
 		}
-		// Skip this time series if there's nothing to prune. We check the
-		// oldest (first) time series record's timestamp against the
-		// pruning threshold.
-		if threshold, ok := thresholds[res]; !ok || threshold > tsNanos {
-			results = append(results, timeSeriesResolutionInfo{
-				Name:       name,
-				Resolution: res,
-			})
+		foundName, _, res, _, err := DecodeDataKey(iter.Key().Key)
+		if err != nil {
+			return nil, err
 		}
+		if foundName != name {
+			return nil, errors.Errorf("unexpected time series %q in key span of time series %q", foundName, name)
+		}
+		results = append(results, res)
 
-		// Set 'next' is initialized to the next possible time series key
-		// which could belong to a previously undiscovered time series.
+		// Skip the remaining data of the time series at this resolution.
 		next = engine.MakeMVCCMetadataKey(makeDataKeySeriesPrefix(name, res).PrefixEnd())
 	}
 
@@ -104,46 +212,125 @@ func (tsdb *DB) findTimeSeries(
 // For each time series supplied, the pruning operation will delete all data
 // older than a constant threshold. The threshold is different depending on the
 // resolution; typically, lower-resolution time series data will be retained for
-// a longer period.
+// a longer period. The supplied retention policy, which may be nil, overrides
+// the threshold for the resolutions it contains.
 //
 // If data is stored at a resolution which is not known to the system, it is
 // assumed that the resolution has been deprecated and all data for that time
 // series at that resolution will be deleted.
 //
 // As range deletion of inline data is an idempotent operation, it is safe to
-// run this operation concurrently on multiple nodes at the same time.
+// run this operation concurrently on multiple nodes at the same time. For the
+// same reason, the deletion is retried on retryable errors.
+//
+// Since time series data is stored inline, the deletion leaves no MVCC
+// tombstones behind for GC to collect, only the tombstones of the storage
+// engine. If kv.delete_range.inline_compaction_hint.enabled is set, a
+// compaction of the pruned spans is suggested to remove them promptly.
 func (tsdb *DB) pruneTimeSeries(
-	ctx context.Context, db *client.DB, timeSeriesList []timeSeriesResolutionInfo, now hlc.Timestamp,
+	ctx context.Context,
+	db *client.DB,
+	timeSeriesList []timeSeriesResolutionInfo,
+	now hlc.Timestamp,
+	policy RetentionPolicy,
 ) error {
-	thresholds := tsdb.computeThresholds(now.WallTime)
-
-	b := &client.Batch{}
+	thresholds := tsdb.computeThresholdsWithPolicy(now.WallTime, policy)
+	spans := make([]roachpb.Span, 0, len(timeSeriesList))
 	for _, timeSeries := range timeSeriesList {
-		// Time series data for a specific resolution falls in a contiguous key
-		// range, and can be deleted with a DelRange command.
-		// The start key is the prefix unique to this name/resolution pair.
-		start := makeDataKeySeriesPrefix(timeSeries.Name, timeSeries.Resolution)
-
-		// The end key can be created by generating a time series key with the
-		// threshold timestamp for the resolution. If the resolution is not
-		// supported, the start key's PrefixEnd is used instead (which will clear
-		// the time series entirely).
-		var end roachpb.Key
-		threshold, ok := thresholds[timeSeries.Resolution]
-		if ok {
-			end = MakeDataKey(timeSeries.Name, "", timeSeries.Resolution, threshold)
-		} else {
-			end = start.PrefixEnd()
+		start, end := pruneSpan(timeSeries, thresholds)
+		spans = append(spans, roachpb.Span{Key: start, EndKey: end})
+	}
+	spans = coalescePruneSpans(spans)
+
+	makeBatch := func() *client.Batch {
+		b := &client.Batch{}
+		for _, span := range spans {
+			b.AddRawRequest(&roachpb.DeleteRangeRequest{
+				RequestHeader: roachpb.RequestHeader{
+					Key:    span.Key,
+					EndKey: span.EndKey,
+				},
+				Inline: true,
+			})
 		}
+		return b
+	}
+
+	_, err := tsdb.runMaintenanceBatch(ctx, db, makeBatch)
+	return err
+}
 
-		b.AddRawRequest(&roachpb.DeleteRangeRequest{
-			RequestHeader: roachpb.RequestHeader{
-				Key:    start,
-				EndKey: end,
-			},
-			Inline: true,
-		})
+// coalescePruneSpans sorts the supplied spans of pruned keys and merges those
+// which overlap or are adjacent, which reduces the number of DeleteRange
+// operations needed to prune many time series in the same range.
+//
+// Spans are never merged across a gap, even one which holds no data: time
+// series data can be written to the gap concurrently, or even earlier during
+// the same maintenance, for example the rollups of the time series ending the
+// first span, which sort directly after its pruned data.
+func coalescePruneSpans(spans []roachpb.Span) []roachpb.Span {
+	if len(spans) < 2 {
+		return spans
 	}
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].Key.Compare(spans[j].Key) < 0
+	})
 
-	return db.Run(ctx, b)
+	coalesced := []roachpb.Span{spans[0]}
+	for _, span := range spans[1:] {
+		last := &coalesced[len(coalesced)-1]
+		if span.Key.Compare(last.EndKey) > 0 {
+			coalesced = append(coalesced, span)
+			continue
+		}
+		if last.EndKey.Compare(span.EndKey) < 0 {
+			last.EndKey = span.EndKey
+		}
+	}
+	return coalesced
+}
+
+// pruneSpan returns the span of keys which pruning deletes for the supplied
+// time series, given the thresholds of computeThresholdsWithPolicy.
+func pruneSpan(
+	timeSeries timeSeriesResolutionInfo, thresholds map[Resolution]int64,
+) (start, end roachpb.Key) {
+	// Time series data for a specific resolution falls in a contiguous key
+	// range, and can be deleted with a DelRange command.
+	// The start key is the prefix unique to this name/resolution pair.
+	start = makeDataKeySeriesPrefix(timeSeries.Name, timeSeries.Resolution)
+
+	// The end key can be created by generating a time series key with the
+	// threshold timestamp for the resolution. If the resolution is not
+	// supported, the start key's PrefixEnd is used instead (which will clear
+	// the time series entirely).
+	if threshold, ok := thresholds[timeSeries.Resolution]; ok {
+		end = MakeDataKey(timeSeries.Name, "", timeSeries.Resolution, threshold)
+	} else {
+		end = start.PrefixEnd()
+	}
+	return start, end
+}
+
+// pruneEmptySlabs deletes the supplied slabs, which have been identified as
+// empty by findTimeSeriesAndEmptySlabs.
+func (tsdb *DB) pruneEmptySlabs(ctx context.Context, db *client.DB, slabs []roachpb.Key) error {
+	if len(slabs) == 0 {
+		return nil
+	}
+	makeBatch := func() *client.Batch {
+		b := &client.Batch{}
+		for _, key := range slabs {
+			b.AddRawRequest(&roachpb.DeleteRangeRequest{
+				RequestHeader: roachpb.RequestHeader{
+					Key:    key,
+					EndKey: key.Next(),
+				},
+				Inline: true,
+			})
+		}
+		return b
+	}
+	_, err := tsdb.runMaintenanceBatch(ctx, db, makeBatch)
+	return err
 }
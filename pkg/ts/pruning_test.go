@@ -13,15 +13,29 @@
 package ts
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
 	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/batcheval"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/storagepb"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/ts/tspb"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+	"github.com/pkg/errors"
 )
 
 func TestContainsTimeSeries(t *testing.T) {
@@ -275,12 +289,23 @@ func TestFindTimeSeries(t *testing.T) {
 		},
 	} {
 		snap := e.NewSnapshot()
-		actual, err := tm.DB.findTimeSeries(snap, tcase.start, tcase.end, tcase.timestamp)
-		snap.Close()
+		actual, err := tm.DB.findTimeSeries(snap, tcase.start, tcase.end, tcase.timestamp, nil /* policy */)
 		if err != nil {
 			t.Fatalf("case %d: unexpected error %q", i, err)
 		}
+		if !reflect.DeepEqual(actual, tcase.expected) {
+			t.Fatalf("case %d: got %v, expected %v", i, actual, tcase.expected)
+		}
 
+		// Visiting every slab to find empty ones discovers the same time
+		// series.
+		actual, _, err = tm.DB.findTimeSeriesAndEmptySlabs(
+			snap, tcase.start, tcase.end, tcase.timestamp, nil, /* policy */
+		)
+		snap.Close()
+		if err != nil {
+			t.Fatalf("case %d: unexpected error %q", i, err)
+		}
 		if !reflect.DeepEqual(actual, tcase.expected) {
 			t.Fatalf("case %d: got %v, expected %v", i, actual, tcase.expected)
 		}
@@ -289,6 +314,41 @@ func TestFindTimeSeries(t *testing.T) {
 
 // Verifies that pruning works as expected when the server has not yet switched
 // to columnar format, and thus does not yet support rollups.
+func TestAvailableResolutions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModelRunner(t)
+	tm.Start()
+	defer tm.Stop()
+
+	for _, resolution := range []Resolution{Resolution10s, resolution1ns} {
+		tm.storeTimeSeriesData(resolution, []tspb.TimeSeriesData{
+			tsd("metric.a", "source1", tsdp(400*time.Second, 1), tsdp(500*time.Hour, 2)),
+			tsd("metric.a", "source2", tsdp(400*time.Second, 1)),
+		})
+	}
+	tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+		tsd("metric.ab", "source1", tsdp(400*time.Second, 1)),
+	})
+
+	for _, tc := range []struct {
+		name     string
+		expected []Resolution
+	}{
+		{"metric.a", []Resolution{Resolution10s, resolution1ns}},
+		{"metric.ab", []Resolution{Resolution10s}},
+		{"metric", []Resolution{}},
+		{"metric.unknown", []Resolution{}},
+	} {
+		actual, err := tm.DB.AvailableResolutions(context.Background(), tm.LocalTestCluster.Eng, tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("%s: expected resolutions %v, got %v", tc.name, tc.expected, actual)
+		}
+	}
+}
+
 func TestPruneTimeSeries(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	runTestCaseMultipleFormats(t, func(t *testing.T, tm testModelRunner) {
@@ -387,6 +447,156 @@ func TestPruneTimeSeries(t *testing.T) {
 	})
 }
 
+// TestPruneTimeSeriesCompactionHint verifies that pruning time series data
+// suggests a compaction of the pruned span if enabled, so that the deletion
+// tombstones left behind by a large prune are compacted away promptly.
+func TestPruneTimeSeriesCompactionHint(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModelRunner(t)
+	tm.Start()
+	defer tm.Stop()
+
+	now := 1475700000 * time.Second
+	old := now - 2*365*24*time.Hour
+	names := []string{"metric.a", "metric.b"}
+	const numSources = 100
+	for _, name := range names {
+		for i := 0; i < numSources; i++ {
+			tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+				tsd(name, fmt.Sprintf("source%d", i), tsdp(old, 1), tsdp(now, 2)),
+			})
+		}
+	}
+	tm.assertKeyCount(2 * len(names) * numSources)
+
+	suggestedCompactions := func() map[string]storagepb.Compaction {
+		compactions := make(map[string]storagepb.Compaction)
+		if err := tm.Eng.Iterate(
+			engine.MVCCKey{Key: keys.LocalStoreSuggestedCompactionsMin},
+			engine.MVCCKey{Key: keys.LocalStoreSuggestedCompactionsMax},
+			func(kv engine.MVCCKeyValue) (bool, error) {
+				start, end, err := keys.DecodeStoreSuggestedCompactionKey(kv.Key.Key)
+				if err != nil {
+					return true, err
+				}
+				var c storagepb.Compaction
+				if err := protoutil.Unmarshal(kv.Value, &c); err != nil {
+					return true, err
+				}
+				compactions[roachpb.Span{Key: start, EndKey: end}.String()] = c
+				return false, nil
+			},
+		); err != nil {
+			t.Fatal(err)
+		}
+		return compactions
+	}
+	prune := func(name string) roachpb.Span {
+		tm.prune(now.Nanoseconds(), timeSeriesResolutionInfo{Name: name, Resolution: Resolution10s})
+		start, end := pruneSpan(
+			timeSeriesResolutionInfo{Name: name, Resolution: Resolution10s},
+			tm.DB.computeThresholds(now.Nanoseconds()),
+		)
+		return roachpb.Span{Key: start, EndKey: end}
+	}
+
+	// No compaction is suggested unless enabled.
+	prune(names[0])
+	tm.assertModelCorrect()
+	tm.assertKeyCount((2*len(names) - 1) * numSources)
+	if compactions := suggestedCompactions(); len(compactions) != 0 {
+		t.Fatalf("expected no suggested compactions, got %v", compactions)
+	}
+
+	batcheval.InlineDeleteCompactionHintEnabled.Override(&tm.Cfg.Settings.SV, true)
+	span := prune(names[1])
+	tm.assertModelCorrect()
+	tm.assertKeyCount(len(names) * numSources)
+	compactions := suggestedCompactions()
+	if len(compactions) != 1 {
+		t.Fatalf("expected a single suggested compaction, got %v", compactions)
+	}
+	c, ok := compactions[span.String()]
+	if !ok {
+		t.Fatalf("expected a suggested compaction of %s, got %v", span, compactions)
+	}
+	// The suggestion accounts for all the pruned data, which the compactor
+	// considers when deciding whether the compaction is worthwhile.
+	if c.Bytes <= 0 {
+		t.Fatalf("expected the suggested compaction to account for the pruned data, got %+v", c)
+	}
+}
+
+// TestPruneTimeSeriesCoalescing verifies that overlapping and adjacent
+// deletions are coalesced, but not deletions separated by a gap.
+func TestPruneTimeSeriesCoalescing(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	span := func(start, end string) roachpb.Span {
+		return roachpb.Span{Key: roachpb.Key(start), EndKey: roachpb.Key(end)}
+	}
+	// Sorting must not depend on the order of the spans.
+	spans := []roachpb.Span{span("h", "i"), span("b", "d"), span("a", "c"), span("d", "e"), span("f", "g")}
+	expected := []roachpb.Span{span("a", "e"), span("f", "g"), span("h", "i")}
+	if coalesced := coalescePruneSpans(spans); !reflect.DeepEqual(coalesced, expected) {
+		t.Fatalf("expected spans %v, got %v", expected, coalesced)
+	}
+
+	// The deletions of distinct time series are separated by the retained data
+	// of the first one, or the space where it would be, and aren't coalesced.
+	thresholds := map[Resolution]int64{Resolution10s: 1475700000 * 1e9}
+	spans = spans[:0]
+	for _, name := range []string{"metric.b", "metric.a"} {
+		start, end := pruneSpan(timeSeriesResolutionInfo{Name: name, Resolution: Resolution10s}, thresholds)
+		spans = append(spans, roachpb.Span{Key: start, EndKey: end})
+	}
+	if coalesced := coalescePruneSpans(spans); len(coalesced) != 2 {
+		t.Fatalf("expected 2 spans, got %v", coalesced)
+	}
+}
+
+// TestMaintainTimeSeriesRollupIntoEmptyResolution verifies that pruning the
+// data of time series after rolling it up into a resolution which held no data
+// keeps the rollups, which sort between the pruned data of adjacent time
+// series.
+func TestMaintainTimeSeriesRollupIntoEmptyResolution(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModelRunner(t)
+	tm.Start()
+	defer tm.Stop()
+
+	var now int64 = 1475700000 * 1e9
+
+	// Both time series only have data which is older than the 10s resolution
+	// keeps, but young enough to be kept at the 30m resolution.
+	for _, metric := range []string{"metric.a", "metric.b"} {
+		tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+			{
+				Name:   metric,
+				Source: "source1",
+				Datapoints: []tspb.TimeSeriesDatapoint{
+					{
+						TimestampNanos: now - int64(20*24*time.Hour),
+						Value:          1,
+					},
+				},
+			},
+		})
+	}
+	tm.assertModelCorrect()
+	tm.assertKeyCount(2)
+
+	// The data is rolled up into the 30m resolution and pruned at the 10s
+	// resolution, leaving the rollups of both time series.
+	tm.maintain(now)
+	tm.assertModelCorrect()
+	tm.assertKeyCount(2)
+	for _, metric := range []string{"metric.a", "metric.b"} {
+		query := tm.makeQuery(metric, Resolution30m, 0, now)
+		query.assertSuccess(1, 1)
+	}
+}
+
 func TestMaintainTimeSeriesWithRollups(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	tm := newTestModelRunner(t)
@@ -488,3 +698,572 @@ func TestMaintainTimeSeriesNoRollups(t *testing.T) {
 	tm.assertModelCorrect()
 	tm.assertKeyCount(8)
 }
+
+func TestMaintainTimeSeriesRetries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModelRunner(t)
+	tm.Start()
+	defer tm.Stop()
+
+	var now int64 = 1475700000 * 1e9
+	storeOldData := func() {
+		tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+			tsd("metric.a", "source1",
+				tsdp(time.Duration(now)-2*365*24*time.Hour, 2),
+				tsdp(time.Duration(now), 1),
+			),
+		})
+	}
+	storeOldData()
+	tm.assertModelCorrect()
+	tm.assertKeyCount(2)
+
+	// Route all maintenance operations through a KV client which fails the
+	// next few batches with a retryable error.
+	var failures int
+	realDB := tm.LocalTestCluster.DB
+	flakyDB := client.NewDB(
+		log.AmbientContext{Tracer: tracing.NewTracer()},
+		client.NonTransactionalFactoryFunc(func(
+			ctx context.Context, ba roachpb.BatchRequest,
+		) (*roachpb.BatchResponse, *roachpb.Error) {
+			if failures > 0 {
+				failures--
+				return nil, roachpb.NewError(&roachpb.NotLeaseHolderError{})
+			}
+			return realDB.NonTransactionalSender().Send(ctx, ba)
+		}),
+		tm.Clock,
+	)
+	tm.LocalTestCluster.DB = flakyDB
+	tm.DB.db = flakyDB
+	defer func() {
+		tm.LocalTestCluster.DB = realDB
+		tm.DB.db = realDB
+	}()
+
+	// The maintenance pass succeeds despite the failures.
+	failures = 2
+	tm.maintain(now)
+	if failures != 0 {
+		t.Fatalf("expected all failures to be consumed, %d remaining", failures)
+	}
+	tm.assertModelCorrect()
+
+	// Without any retries, the pass fails.
+	maintenanceMaxRetries.Override(&tm.Cfg.Settings.SV, 0)
+	storeOldData()
+	failures = 1
+	snap := tm.Store.Engine().NewSnapshot()
+	defer snap.Close()
+	err := tm.DB.MaintainTimeSeries(
+		context.Background(),
+		0, /* rangeID */
+		snap,
+		roachpb.RKey(keys.TimeseriesPrefix),
+		roachpb.RKey(keys.TimeseriesKeyMax),
+		flakyDB,
+		tm.workerMemMonitor,
+		math.MaxInt64,
+		hlc.Timestamp{WallTime: now},
+	)
+	if !testutils.IsError(err, "not lease holder") {
+		t.Fatalf("expected NotLeaseHolderError, got %v", err)
+	}
+}
+
+func TestMaintainTimeSeriesErrorIsolation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModelRunner(t)
+	tm.Start()
+	defer tm.Stop()
+
+	now := 1475700000 * time.Second
+	old := now - 2*365*24*time.Hour
+	for _, name := range []string{"metric.a", "metric.b", "metric.c"} {
+		tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+			tsd(name, "source1", tsdp(old, 1), tsdp(now, 2)),
+		})
+	}
+	tm.assertKeyCount(6)
+
+	// Fail all KV operations on the data of metric.b, or only the deletions if
+	// failOnlyPruning is set.
+	failPrefix := makeDataKeySeriesPrefix("metric.b", Resolution10s)
+	failOnlyPruning := false
+	realDB := tm.LocalTestCluster.DB
+	flakyDB := client.NewDB(
+		log.AmbientContext{Tracer: tracing.NewTracer()},
+		client.NonTransactionalFactoryFunc(func(
+			ctx context.Context, ba roachpb.BatchRequest,
+		) (*roachpb.BatchResponse, *roachpb.Error) {
+			for _, ru := range ba.Requests {
+				if failOnlyPruning && ru.GetDeleteRange() == nil {
+					continue
+				}
+				if bytes.HasPrefix(ru.GetInner().Header().Key, failPrefix) {
+					return nil, roachpb.NewErrorf("injected failure")
+				}
+			}
+			return realDB.NonTransactionalSender().Send(ctx, ba)
+		}),
+		tm.Clock,
+	)
+
+	maintain := func(expErrors int64) {
+		t.Helper()
+		snap := tm.Store.Engine().NewSnapshot()
+		defer snap.Close()
+		err := tm.DB.MaintainTimeSeries(
+			context.Background(),
+			0, /* rangeID */
+			snap,
+			roachpb.RKey(keys.TimeseriesPrefix),
+			roachpb.RKey(keys.TimeseriesKeyMax),
+			flakyDB,
+			tm.workerMemMonitor,
+			math.MaxInt64,
+			hlc.Timestamp{WallTime: now.Nanoseconds()},
+		)
+		if !testutils.IsError(err, "maintenance failed for 1 of 3 time series; "+
+			"time series metric.b at resolution 10s: injected failure") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if a, e := tm.DB.Metrics().MaintenanceErrors.Count(), expErrors; a != e {
+			t.Fatalf("expected %d maintenance errors, got %d", e, a)
+		}
+
+		// The old data of all other time series was pruned.
+		oldSlab := Resolution10s.normalizeToSlab(old.Nanoseconds())
+		var foundFailed bool
+		for key := range tm.getActualData() {
+			name, _, res, tsNanos, err := DecodeDataKey(roachpb.Key(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res != Resolution10s || tsNanos != oldSlab {
+				continue
+			}
+			if name == "metric.b" {
+				foundFailed = true
+			} else {
+				t.Errorf("old data of %s was not pruned", name)
+			}
+		}
+		if !foundFailed {
+			t.Error("old data of metric.b was unexpectedly pruned")
+		}
+	}
+	maintain(1 /* expErrors */)
+
+	// If only pruning fails, the batch pruning all time series fails as a
+	// whole, and the time series are then pruned individually.
+	for _, name := range []string{"metric.a", "metric.c"} {
+		tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+			tsd(name, "source1", tsdp(old, 1)),
+		})
+	}
+	failOnlyPruning = true
+	maintain(2 /* expErrors */)
+}
+
+// TestMaintainTimeSeriesEmptySlabs verifies that maintenance deletes slabs from
+// which all samples have been removed, but neither slabs which still contain
+// samples nor the slab covering the current time.
+func TestMaintainTimeSeriesEmptySlabs(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModelRunner(t)
+	tm.Start()
+	defer tm.Stop()
+
+	now := 1475700000 * time.Second
+	tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+		tsd("metric.a", "source1",
+			tsdp(now-3*time.Hour, 1),
+			tsdp(now-2*time.Hour, 2),
+			tsdp(now, 3),
+		),
+	})
+	tm.assertKeyCount(3)
+
+	// Remove all samples from two of the slabs by rewriting them.
+	slabKey := func(ts time.Duration) roachpb.Key {
+		return MakeDataKey("metric.a", "source1", Resolution10s, ts.Nanoseconds())
+	}
+	emptied := []roachpb.Key{slabKey(now - 2*time.Hour), slabKey(now)}
+	b := &client.Batch{}
+	for _, key := range emptied {
+		_, _, _, tsNanos, err := DecodeDataKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var value roachpb.Value
+		if err := value.SetProto(&roachpb.InternalTimeSeriesData{
+			StartTimestampNanos: tsNanos,
+			SampleDurationNanos: Resolution10s.SampleDuration(),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		b.AddRawRequest(&roachpb.PutRequest{
+			RequestHeader: roachpb.RequestHeader{Key: key},
+			Value:         value,
+			Inline:        true,
+		})
+	}
+	if err := tm.LocalTestCluster.DB.Run(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	tm.assertKeyCount(3)
+
+	tm.maintain(now.Nanoseconds())
+
+	// The emptied slab in the past is deleted, whereas the one covering the
+	// current time is retained along with the slab that still holds data.
+	actual := tm.getActualData()
+	for _, key := range []roachpb.Key{slabKey(now - 3*time.Hour), slabKey(now)} {
+		if _, ok := actual[string(key)]; !ok {
+			t.Errorf("expected slab %s to be retained", key)
+		}
+	}
+	if _, ok := actual[string(emptied[0])]; ok {
+		t.Errorf("expected empty slab %s to be deleted", emptied[0])
+	}
+	tm.assertKeyCount(2)
+}
+
+// TestCancelMaintenance verifies that an in-flight maintenance operation is
+// listed by InflightMaintenance, and that canceling it stops it before the
+// remaining time series are maintained.
+func TestCancelMaintenance(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModelRunner(t)
+	tm.Start()
+	defer tm.Stop()
+
+	now := 1475700000 * time.Second
+	old := now - 2*365*24*time.Hour
+	for _, name := range []string{"metric.a", "metric.b", "metric.c"} {
+		tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+			tsd(name, "source1", tsdp(old, 1), tsdp(now, 2)),
+		})
+	}
+	tm.assertKeyCount(6)
+
+	// Block all KV operations on the data of metric.b until they're canceled.
+	blockPrefix := makeDataKeySeriesPrefix("metric.b", Resolution10s)
+	blocked := make(chan struct{})
+	var blockedOnce sync.Once
+	realDB := tm.LocalTestCluster.DB
+	slowDB := client.NewDB(
+		log.AmbientContext{Tracer: tracing.NewTracer()},
+		client.NonTransactionalFactoryFunc(func(
+			ctx context.Context, ba roachpb.BatchRequest,
+		) (*roachpb.BatchResponse, *roachpb.Error) {
+			for _, ru := range ba.Requests {
+				if bytes.HasPrefix(ru.GetInner().Header().Key, blockPrefix) {
+					blockedOnce.Do(func() { close(blocked) })
+					<-ctx.Done()
+					return nil, roachpb.NewError(ctx.Err())
+				}
+			}
+			return realDB.NonTransactionalSender().Send(ctx, ba)
+		}),
+		tm.Clock,
+	)
+	tm.DB.db = slowDB
+	defer func() {
+		tm.DB.db = realDB
+	}()
+
+	const rangeID = 7
+	snap := tm.Store.Engine().NewSnapshot()
+	defer snap.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- tm.DB.MaintainTimeSeries(
+			context.Background(),
+			rangeID,
+			snap,
+			roachpb.RKey(keys.TimeseriesPrefix),
+			roachpb.RKey(keys.TimeseriesKeyMax),
+			slowDB,
+			tm.workerMemMonitor,
+			math.MaxInt64,
+			hlc.Timestamp{WallTime: now.Nanoseconds()},
+		)
+	}()
+	<-blocked
+
+	ops := tm.DB.InflightMaintenance()
+	if len(ops) != 1 {
+		t.Fatalf("expected a single in-flight maintenance operation, got %+v", ops)
+	}
+	if op := ops[0]; op.RangeID != rangeID || op.NumSeries != 3 || op.NumSeriesDone != 1 || op.Canceled {
+		t.Fatalf("unexpected in-flight maintenance operation %+v", op)
+	}
+	if tm.DB.CancelMaintenance(rangeID + 1) {
+		t.Fatal("unexpectedly canceled maintenance of another range")
+	}
+	if !tm.DB.CancelMaintenance(rangeID) {
+		t.Fatal("expected maintenance to be canceled")
+	}
+	if err := <-errCh; !testutils.IsError(
+		err, "time series maintenance stopped after 1 of 3 time series: context canceled",
+	) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ops := tm.DB.InflightMaintenance(); len(ops) != 0 {
+		t.Fatalf("expected no in-flight maintenance operations, got %+v", ops)
+	}
+	if a := tm.DB.Metrics().MaintenanceErrors.Count(); a != 0 {
+		t.Fatalf("expected cancellation not to count as a maintenance error, got %d errors", a)
+	}
+
+	// Only the old data of the time series maintained before the cancellation
+	// was pruned; all recent data is intact.
+	oldSlab := Resolution10s.normalizeToSlab(old.Nanoseconds())
+	remaining := make(map[string]bool)
+	for key := range tm.getActualData() {
+		name, _, res, tsNanos, err := DecodeDataKey(roachpb.Key(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != Resolution10s {
+			continue
+		}
+		if tsNanos == oldSlab {
+			remaining[name] = true
+		} else {
+			remaining[name+" (recent)"] = true
+		}
+	}
+	expRemaining := map[string]bool{
+		"metric.b":          true,
+		"metric.c":          true,
+		"metric.a (recent)": true,
+		"metric.b (recent)": true,
+		"metric.c (recent)": true,
+	}
+	if !reflect.DeepEqual(remaining, expRemaining) {
+		t.Fatalf("expected remaining data %v, got %v", expRemaining, remaining)
+	}
+}
+
+// testMaintenanceCheckpointer is an in-memory
+// storage.TimeSeriesMaintenanceCheckpointer which records the checkpoints
+// saved with it.
+type testMaintenanceCheckpointer struct {
+	checkpoint roachpb.Key
+	saved      []roachpb.Key
+}
+
+func (c *testMaintenanceCheckpointer) LoadCheckpoint(context.Context) (roachpb.Key, error) {
+	return c.checkpoint, nil
+}
+
+func (c *testMaintenanceCheckpointer) SaveCheckpoint(_ context.Context, key roachpb.Key) error {
+	c.checkpoint = key
+	c.saved = append(c.saved, key)
+	return nil
+}
+
+// TestMaintainTimeSeriesWithCheckpoints verifies that maintenance records its
+// progress with a checkpointer, and that maintenance which finds a checkpoint
+// resumes after it.
+func TestMaintainTimeSeriesWithCheckpoints(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModelRunner(t)
+	tm.Start()
+	defer tm.Stop()
+
+	// Save a checkpoint after every time series.
+	maintenanceCheckpointInterval.Override(&tm.Cfg.Settings.SV, 0)
+
+	now := 1475700000 * time.Second
+	old := now - 2*365*24*time.Hour
+	oldSlab := Resolution10s.normalizeToSlab(old.Nanoseconds())
+	names := []string{"metric.a", "metric.b", "metric.c"}
+	storeData := func() {
+		for _, name := range names {
+			tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+				tsd(name, "source1", tsdp(old, 1), tsdp(now, 2)),
+			})
+		}
+	}
+	maintain := func(checkpointer *testMaintenanceCheckpointer) {
+		snap := tm.Store.Engine().NewSnapshot()
+		defer snap.Close()
+		if err := tm.DB.MaintainTimeSeriesWithCheckpoints(
+			context.Background(),
+			0, /* rangeID */
+			snap,
+			roachpb.RKey(keys.TimeseriesPrefix),
+			roachpb.RKey(keys.TimeseriesKeyMax),
+			tm.LocalTestCluster.DB,
+			tm.workerMemMonitor,
+			math.MaxInt64,
+			hlc.Timestamp{WallTime: now.Nanoseconds()},
+			checkpointer,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertOldData := func(expected map[string]bool) {
+		t.Helper()
+		actual := tm.getActualData()
+		for _, name := range names {
+			_, ok := actual[string(MakeDataKey(name, "source1", Resolution10s, oldSlab))]
+			if ok != expected[name] {
+				t.Errorf("expected old slab of %s to be present: %t, found %t", name, expected[name], ok)
+			}
+		}
+	}
+
+	// Maintenance without a checkpoint maintains all time series, saving a
+	// checkpoint after each of them, and clears the checkpoint at the end.
+	storeData()
+	var checkpointer testMaintenanceCheckpointer
+	maintain(&checkpointer)
+	assertOldData(map[string]bool{})
+	expSaved := []roachpb.Key{
+		makeDataKeySeriesPrefix("metric.a", Resolution10s),
+		makeDataKeySeriesPrefix("metric.b", Resolution10s),
+		makeDataKeySeriesPrefix("metric.c", Resolution10s),
+		nil,
+	}
+	if !reflect.DeepEqual(checkpointer.saved, expSaved) {
+		t.Fatalf("expected checkpoints %v, got %v", expSaved, checkpointer.saved)
+	}
+
+	// Maintenance which was interrupted after metric.a resumes with metric.b,
+	// leaving the old data of metric.a in place.
+	storeData()
+	resumed := testMaintenanceCheckpointer{
+		checkpoint: makeDataKeySeriesPrefix("metric.a", Resolution10s),
+	}
+	maintain(&resumed)
+	assertOldData(map[string]bool{"metric.a": true})
+	if resumed.checkpoint != nil {
+		t.Fatalf("expected checkpoint to be cleared, got %s", resumed.checkpoint)
+	}
+
+	// A checkpoint outside of the maintained key span is ignored.
+	outside := testMaintenanceCheckpointer{checkpoint: roachpb.Key("a")}
+	maintain(&outside)
+	assertOldData(map[string]bool{})
+}
+
+// TestMaintainTimeSeriesEventSink verifies that the events emitted to a
+// maintenance sink match the changes made by the maintenance, and that errors
+// returned by the sink abort the maintenance only if requested.
+func TestMaintainTimeSeriesEventSink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModelRunner(t)
+	tm.Start()
+	defer tm.Stop()
+
+	now := 1475700000 * time.Second
+	old := now - 2*365*24*time.Hour
+	names := []string{"metric.a", "metric.b"}
+	storeData := func() {
+		for _, name := range names {
+			tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+				tsd(name, "source1", tsdp(old, 1), tsdp(now, 2)),
+			})
+		}
+	}
+	maintain := func(sink MaintenanceSink, abortOnSinkError bool) error {
+		snap := tm.Store.Engine().NewSnapshot()
+		defer snap.Close()
+		return tm.DB.MaintainTimeSeriesWithSink(
+			context.Background(),
+			0, /* rangeID */
+			snap,
+			roachpb.RKey(keys.TimeseriesPrefix),
+			roachpb.RKey(keys.TimeseriesKeyMax),
+			tm.LocalTestCluster.DB,
+			tm.workerMemMonitor,
+			math.MaxInt64,
+			hlc.Timestamp{WallTime: now.Nanoseconds()},
+			sink,
+			abortOnSinkError,
+		)
+	}
+
+	storeData()
+	tm.assertKeyCount(4)
+
+	var events []MaintenanceEvent
+	if err := maintain(func(ev MaintenanceEvent) error {
+		events = append(events, ev)
+		return nil
+	}, true /* abortOnSinkError */); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old slab of each time series was rolled up into a single datapoint
+	// and pruned, leaving the recent slabs and the rollups.
+	oldSlab := Resolution10s.normalizeToSlab(old.Nanoseconds())
+	actual := tm.getActualData()
+	for _, name := range names {
+		if _, ok := actual[string(MakeDataKey(name, "source1", Resolution10s, oldSlab))]; ok {
+			t.Errorf("expected old slab of %s to be pruned", name)
+		}
+	}
+	tm.assertKeyCount(4)
+
+	type event struct {
+		typ           MaintenanceEventType
+		name          string
+		numDatapoints int
+		numSlabs      int
+	}
+	var actualEvents []event
+	for _, ev := range events {
+		actualEvents = append(actualEvents, event{
+			typ:           ev.Type,
+			name:          ev.Name,
+			numDatapoints: ev.NumDatapoints,
+			numSlabs:      ev.NumSlabs,
+		})
+		if ev.Resolution != Resolution10s {
+			t.Errorf("unexpected resolution in event %+v", ev)
+		}
+		if (ev.NumSlabs > 0) != (ev.Bytes > 0) {
+			t.Errorf("expected bytes to be reported along with slabs in event %+v", ev)
+		}
+	}
+	expEvents := []event{
+		{typ: MaintenanceSeriesDiscovered, name: "metric.a"},
+		{typ: MaintenanceSeriesDiscovered, name: "metric.b"},
+		{typ: MaintenanceSeriesRolledUp, name: "metric.a", numDatapoints: 1},
+		{typ: MaintenanceSeriesRolledUp, name: "metric.b", numDatapoints: 1},
+		{typ: MaintenanceSeriesPruned, name: "metric.a", numSlabs: 1},
+		{typ: MaintenanceSeriesPruned, name: "metric.b", numSlabs: 1},
+	}
+	if !reflect.DeepEqual(actualEvents, expEvents) {
+		t.Fatalf("expected events %+v, got %+v", expEvents, actualEvents)
+	}
+
+	// A sink error aborts the maintenance if requested, before anything is
+	// pruned.
+	storeData()
+	tm.assertKeyCount(6)
+	failingSink := func(ev MaintenanceEvent) error {
+		if ev.Type == MaintenanceSeriesRolledUp {
+			return errors.New("sink unavailable")
+		}
+		return nil
+	}
+	if err := maintain(failingSink, true /* abortOnSinkError */); !testutils.IsError(err, "sink unavailable") {
+		t.Fatalf("expected sink error, got %v", err)
+	}
+	tm.assertKeyCount(6)
+
+	// Otherwise, the maintenance proceeds regardless. This pass also discovers
+	// the rollups, which are beyond their retention and thus pruned as well.
+	if err := maintain(failingSink, false /* abortOnSinkError */); err != nil {
+		t.Fatal(err)
+	}
+	tm.assertKeyCount(2)
+}
@@ -475,6 +475,11 @@ func (db *DB) Query(
 	resolutions := []Resolution{diskResolution}
 	if rollupResolution, ok := diskResolution.TargetRollupResolution(); ok {
 		if timespan.verifyDiskResolution(rollupResolution) == nil {
+			if err := db.verifyRollupColumnsForQuery(
+				query.Name, rollupResolution, query.GetDownsampler(),
+			); err != nil {
+				return nil, nil, err
+			}
 			resolutions = []Resolution{rollupResolution, diskResolution}
 		}
 	}
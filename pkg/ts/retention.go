@@ -0,0 +1,114 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package ts
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/pkg/errors"
+)
+
+// RetentionPolicy overrides the maximum age of time series data retained at
+// individual resolutions. Resolutions which are not present in the policy use
+// the retention configured by the cluster settings.
+type RetentionPolicy map[Resolution]time.Duration
+
+// RetentionResolver resolves the retention policy which applies to the time
+// series data stored in a range, identified by the range's span.
+type RetentionResolver interface {
+	// ResolveRetention returns the retention policy for the given span, or
+	// false if the span uses the cluster-wide retention.
+	ResolveRetention(span roachpb.RSpan) (RetentionPolicy, bool)
+}
+
+// SpanRetention associates a retention policy with a span of time series keys.
+type SpanRetention struct {
+	Span   roachpb.RSpan
+	Policy RetentionPolicy
+}
+
+// SpanRetentionConfig is a RetentionResolver which assigns retention policies
+// to spans of time series keys, similar to how zone configs assign replication
+// policies to spans of the key space. A range uses the policy of the first
+// entry whose span fully contains the range's time series keys.
+type SpanRetentionConfig []SpanRetention
+
+var _ RetentionResolver = SpanRetentionConfig(nil)
+
+// ResolveRetention implements RetentionResolver.
+func (c SpanRetentionConfig) ResolveRetention(span roachpb.RSpan) (RetentionPolicy, bool) {
+	// Only the time series keys of the range are subject to the policy.
+	if span.Key.Less(firstTSRKey) {
+		span.Key = firstTSRKey
+	}
+	if lastTSRKey.Less(span.EndKey) {
+		span.EndKey = lastTSRKey
+	}
+	for _, entry := range c {
+		if entry.Span.ContainsKeyRange(span.Key, span.EndKey) {
+			return entry.Policy, true
+		}
+	}
+	return nil, false
+}
+
+// computeThresholdsWithPolicy is like computeThresholds, but uses the retention
+// of the supplied policy for those resolutions it contains. A nil policy
+// results in the same thresholds as computeThresholds.
+func (db *DB) computeThresholdsWithPolicy(
+	timestamp int64, policy RetentionPolicy,
+) map[Resolution]int64 {
+	result := db.computeThresholds(timestamp)
+	for r, ttl := range policy {
+		result[r] = timestamp - ttl.Nanoseconds()
+	}
+	return result
+}
+
+// validateRetentionPolicy returns an error if the supplied policy cannot be
+// used for maintenance by this DB. Like the cluster-wide retention settings, a
+// policy may only configure a positive retention for resolutions which are
+// maintained by the system.
+func (db *DB) validateRetentionPolicy(policy RetentionPolicy) error {
+	for r, ttl := range policy {
+		if _, ok := db.pruneThresholdByResolution[r]; !ok {
+			return errors.Errorf("retention policy specified for unsupported resolution %s", r)
+		}
+		if ttl <= 0 {
+			return errors.Errorf("retention for resolution %s must be positive, got %s", r, ttl)
+		}
+	}
+	return nil
+}
+
+// resolveRetentionPolicy returns the retention policy which the retention
+// resolver, if any, resolves for the supplied key span. A nil policy is
+// returned if the span uses the cluster-wide retention.
+func (db *DB) resolveRetentionPolicy(start, end roachpb.RKey) (RetentionPolicy, error) {
+	if db.retentionResolver == nil {
+		return nil, nil
+	}
+	policy, _ := db.retentionResolver.ResolveRetention(roachpb.RSpan{Key: start, EndKey: end})
+	if err := db.validateRetentionPolicy(policy); err != nil {
+		return nil, errors.Wrapf(err, "invalid time series retention policy for span [%s,%s)", start, end)
+	}
+	return policy, nil
+}
+
+// SetRetentionResolver sets the resolver consulted by MaintainTimeSeries for
+// range-specific retention policies. A nil resolver (the default) causes all
+// ranges to use the cluster-wide retention.
+func (db *DB) SetRetentionResolver(resolver RetentionResolver) {
+	db.retentionResolver = resolver
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package ts
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/ts/tspb"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+// TestMaintainTimeSeriesRetentionOverride verifies that time series maintenance
+// prunes the data in each range against the retention policy resolved for that
+// range.
+func TestMaintainTimeSeriesRetentionOverride(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModelRunner(t)
+	tm.Start()
+	defer tm.Stop()
+
+	now := 1475700000 * time.Second
+	for _, name := range []string{"metric.a", "metric.b"} {
+		tm.storeTimeSeriesData(Resolution10s, []tspb.TimeSeriesData{
+			tsd(name, "source1",
+				tsdp(now-72*time.Hour, 1),
+				tsdp(now-24*time.Hour, 2),
+				tsdp(now, 3),
+			),
+		})
+	}
+	tm.assertKeyCount(6)
+
+	// Each time series is stored in its own (simulated) range.
+	spanFor := func(name string) roachpb.RSpan {
+		prefix := makeDataKeySeriesPrefix(name, Resolution10s)
+		return roachpb.RSpan{Key: roachpb.RKey(prefix), EndKey: roachpb.RKey(prefix.PrefixEnd())}
+	}
+	tm.DB.SetRetentionResolver(SpanRetentionConfig{
+		{Span: spanFor("metric.a"), Policy: RetentionPolicy{Resolution10s: 12 * time.Hour}},
+		{Span: spanFor("metric.b"), Policy: RetentionPolicy{Resolution10s: 48 * time.Hour}},
+	})
+
+	maintain := func(span roachpb.RSpan) error {
+		snap := tm.Store.Engine().NewSnapshot()
+		defer snap.Close()
+		return tm.DB.MaintainTimeSeries(
+			context.Background(),
+			0, /* rangeID */
+			snap,
+			span.Key,
+			span.EndKey,
+			tm.LocalTestCluster.DB,
+			tm.workerMemMonitor,
+			math.MaxInt64,
+			hlc.Timestamp{WallTime: now.Nanoseconds()},
+		)
+	}
+	for _, name := range []string{"metric.a", "metric.b"} {
+		if err := maintain(spanFor(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	remaining := make(map[string][]time.Duration)
+	for key := range tm.getActualData() {
+		name, _, res, tsNanos, err := DecodeDataKey(roachpb.Key(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res == Resolution10s {
+			remaining[name] = append(remaining[name], time.Duration(tsNanos))
+		}
+	}
+	for _, ts := range remaining {
+		sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+	}
+	slab := func(ts time.Duration) time.Duration {
+		return time.Duration(Resolution10s.normalizeToSlab(ts.Nanoseconds()))
+	}
+	expected := map[string][]time.Duration{
+		"metric.a": {slab(now)},
+		"metric.b": {slab(now - 24*time.Hour), slab(now)},
+	}
+	if !reflect.DeepEqual(remaining, expected) {
+		t.Fatalf("expected remaining slabs %v, got %v", expected, remaining)
+	}
+
+	// Invalid policies are rejected.
+	for _, policy := range []RetentionPolicy{
+		{Resolution10s: 0},
+		{resolutionInvalid: time.Hour},
+	} {
+		tm.DB.SetRetentionResolver(SpanRetentionConfig{
+			{Span: spanFor("metric.b"), Policy: policy},
+		})
+		if err := maintain(spanFor("metric.b")); !testutils.IsError(err, "invalid time series retention policy") {
+			t.Fatalf("expected invalid policy error for %v, got %v", policy, err)
+		}
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/ts/tspb"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
 )
 
 type rollupDatapoint struct {
@@ -35,14 +36,42 @@ type rollupDatapoint struct {
 	variance       float64
 }
 
+// pruneColumns zeroes the aggregates of the datapoint which are not in the
+// supplied set of columns.
+func (dp *rollupDatapoint) pruneColumns(columns RollupColumns) {
+	if !columns.Contains(RollupColumnFirst) {
+		dp.first = 0
+	}
+	if !columns.Contains(RollupColumnLast) {
+		dp.last = 0
+	}
+	if !columns.Contains(RollupColumnMin) {
+		dp.min = 0
+	}
+	if !columns.Contains(RollupColumnMax) {
+		dp.max = 0
+	}
+	if !columns.Contains(RollupColumnSum) {
+		dp.sum = 0
+	}
+	if !columns.Contains(RollupColumnCount) {
+		dp.count = 0
+	}
+	if !columns.Contains(RollupColumnVariance) {
+		dp.variance = 0
+	}
+}
+
 type rollupData struct {
 	name       string
 	source     string
 	datapoints []rollupDatapoint
 }
 
+// toInternal converts the rollup data into slabs of the supplied durations.
+// Columns which are not in the supplied set are zeroed.
 func (rd *rollupData) toInternal(
-	keyDuration, sampleDuration int64,
+	keyDuration, sampleDuration int64, columns RollupColumns,
 ) ([]roachpb.InternalTimeSeriesData, error) {
 	if err := tspb.VerifySlabAndSampleDuration(keyDuration, sampleDuration); err != nil {
 		return nil, err
@@ -68,6 +97,7 @@ func (rd *rollupData) toInternal(
 			resultByKeyTime[keyTime] = itsd
 		}
 
+		dp.pruneColumns(columns)
 		itsd.Offset = append(itsd.Offset, itsd.OffsetForTimestamp(dp.timestampNanos))
 		itsd.Last = append(itsd.Last, dp.last)
 		itsd.First = append(itsd.First, dp.first)
@@ -140,62 +170,141 @@ func (db *DB) rollupTimeSeries(
 	ctx context.Context,
 	timeSeriesList []timeSeriesResolutionInfo,
 	now hlc.Timestamp,
+	policy RetentionPolicy,
 	qmc QueryMemoryContext,
 ) error {
-	thresholds := db.computeThresholds(now.WallTime)
+	thresholds := db.computeThresholdsWithPolicy(now.WallTime, policy)
 	for _, timeSeries := range timeSeriesList {
-		// Only process rollup if this resolution has a target rollup resolution.
-		targetResolution, hasRollup := timeSeries.Resolution.TargetRollupResolution()
-		if !hasRollup {
-			continue
+		if _, err := db.rollupSingleTimeSeries(
+			ctx, timeSeries, thresholds[timeSeries.Resolution], qmc,
+		); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		// Query from beginning of time up to the threshold for this resolution.
-		threshold := thresholds[timeSeries.Resolution]
-
-		// Create an initial targetSpan to find data for this series, starting at
-		// the beginning of time and ending with the threshold time. Queries use
-		// MaxSpanRequestKeys to limit the number of rows in memory at one time,
-		// and will use ResumeSpan to issue additional queries if necessary.
-		targetSpan := roachpb.Span{
-			Key: MakeDataKey(timeSeries.Name, "" /* source */, timeSeries.Resolution, 0),
-			EndKey: MakeDataKey(
-				timeSeries.Name, "" /* source */, timeSeries.Resolution, threshold,
-			),
-		}
+// rollupSingleTimeSeries computes and stores the rollups of the data of a
+// single time series which precedes the supplied threshold. It returns the
+// number of rollup datapoints written, which is zero if the resolution of the
+// time series isn't rolled up.
+//
+// The memory budget of the query memory context is split evenly between the
+// data read by each query, whose number of slabs depends on the resolution,
+// and the rollups computed from it. Once the rollups exceed their share, those
+// which are complete are written and released, so that a dense time series is
+// rolled up incrementally within the budget rather than exhausting it.
+func (db *DB) rollupSingleTimeSeries(
+	ctx context.Context, timeSeries timeSeriesResolutionInfo, threshold int64, qmc QueryMemoryContext,
+) (int, error) {
+	// Only process rollup if this resolution has a target rollup resolution.
+	targetResolution, hasRollup := timeSeries.Resolution.TargetRollupResolution()
+	if !hasRollup {
+		return 0, nil
+	}
+
+	// Create an initial targetSpan to find data for this series, starting at
+	// the beginning of time and ending with the threshold time. Queries use
+	// MaxSpanRequestKeys to limit the number of rows in memory at one time,
+	// and will use ResumeSpan to issue additional queries if necessary.
+	targetSpan := roachpb.Span{
+		Key: MakeDataKey(timeSeries.Name, "" /* source */, timeSeries.Resolution, 0),
+		EndKey: MakeDataKey(
+			timeSeries.Name, "" /* source */, timeSeries.Resolution, threshold,
+		),
+	}
 
-		// For each row, generate a rollup datapoint and add it to the correct
-		// rollupData object.
-		rollupDataMap := make(map[string]rollupData)
+	// For each row, generate a rollup datapoint and add it to the correct
+	// rollupData object.
+	rollupDataMap := make(map[string]rollupData)
 
-		account := qmc.workerMonitor.MakeBoundAccount()
-		defer account.Close(ctx)
+	account := qmc.workerMonitor.MakeBoundAccount()
+	defer account.Close(ctx)
 
-		childQmc := QueryMemoryContext{
-			workerMonitor:      qmc.workerMonitor,
-			resultAccount:      &account,
-			QueryMemoryOptions: qmc.QueryMemoryOptions,
+	childQmc := QueryMemoryContext{
+		workerMonitor:      qmc.workerMonitor,
+		resultAccount:      &account,
+		QueryMemoryOptions: qmc.QueryMemoryOptions,
+	}
+	childQmc.BudgetBytes = qmc.BudgetBytes / 2
+	rollupBudget := qmc.BudgetBytes - childQmc.BudgetBytes
+
+	var numDatapoints int
+	for querySpan := targetSpan; querySpan.Valid(); {
+		var err error
+		querySpan, err = db.queryAndComputeRollupsForSpan(
+			ctx, timeSeries, querySpan, targetResolution, rollupDataMap, childQmc,
+		)
+		if err != nil {
+			return 0, err
 		}
-		for querySpan := targetSpan; querySpan.Valid(); {
-			var err error
-			querySpan, err = db.queryAndComputeRollupsForSpan(
-				ctx, timeSeries, querySpan, targetResolution, rollupDataMap, childQmc,
-			)
-			if err != nil {
-				return err
-			}
+		if !querySpan.Valid() || account.Used() <= rollupBudget {
+			continue
 		}
-
-		// Write computed rollupDataMap to disk
-		var rollupDataSlice []rollupData
-		for _, data := range rollupDataMap {
-			rollupDataSlice = append(rollupDataSlice, data)
+		// The rollup datapoints whose period ends before the data which remains
+		// to be read are complete.
+		_, _, _, resumeNanos, err := DecodeDataKey(querySpan.Key)
+		if err != nil {
+			return 0, err
 		}
-		if err := db.storeRollup(ctx, targetResolution, rollupDataSlice); err != nil {
-			return err
+		n, err := db.storeCompleteRollups(
+			ctx, targetResolution, rollupDataMap, resumeNanos, &account,
+		)
+		if err != nil {
+			return 0, err
 		}
+		numDatapoints += n
 	}
-	return nil
+
+	// Write computed rollupDataMap to disk
+	var rollupDataSlice []rollupData
+	for _, data := range rollupDataMap {
+		rollupDataSlice = append(rollupDataSlice, data)
+		numDatapoints += len(data.datapoints)
+	}
+	if err := db.storeRollup(ctx, targetResolution, rollupDataSlice); err != nil {
+		return 0, err
+	}
+	return numDatapoints, nil
+}
+
+// storeCompleteRollups writes the rollup datapoints whose period ends at or
+// before the supplied timestamp, removes them from rollupDataMap and releases
+// them from the supplied account. It returns the number of datapoints written.
+func (db *DB) storeCompleteRollups(
+	ctx context.Context,
+	targetResolution Resolution,
+	rollupDataMap map[string]rollupData,
+	beforeNanos int64,
+	account *mon.BoundAccount,
+) (int, error) {
+	rollupPeriod := targetResolution.SampleDuration()
+	var complete []rollupData
+	var numDatapoints int
+	for source, data := range rollupDataMap {
+		n := sort.Search(len(data.datapoints), func(i int) bool {
+			return data.datapoints[i].timestampNanos+rollupPeriod > beforeNanos
+		})
+		if n == 0 {
+			continue
+		}
+		complete = append(complete, rollupData{
+			name:       data.name,
+			source:     data.source,
+			datapoints: data.datapoints[:n],
+		})
+		data.datapoints = append([]rollupDatapoint(nil), data.datapoints[n:]...)
+		rollupDataMap[source] = data
+		numDatapoints += n
+	}
+	if numDatapoints == 0 {
+		return 0, nil
+	}
+	if err := db.storeRollup(ctx, targetResolution, complete); err != nil {
+		return 0, err
+	}
+	account.Shrink(ctx, int64(numDatapoints)*int64(unsafe.Sizeof(rollupDatapoint{})))
+	return numDatapoints, nil
 }
 
 // queryAndComputeRollupsForSpan queries time series data from the provided
@@ -208,10 +317,13 @@ func (db *DB) queryAndComputeRollupsForSpan(
 	rollupDataMap map[string]rollupData,
 	qmc QueryMemoryContext,
 ) (roachpb.Span, error) {
-	b := &client.Batch{}
-	b.Header.MaxSpanRequestKeys = qmc.GetMaxRollupSlabs(series.Resolution)
-	b.Scan(span.Key, span.EndKey)
-	if err := db.db.Run(ctx, b); err != nil {
+	b, err := db.runMaintenanceBatch(ctx, db.db, func() *client.Batch {
+		b := &client.Batch{}
+		b.Header.MaxSpanRequestKeys = qmc.GetMaxRollupSlabs(series.Resolution)
+		b.Scan(span.Key, span.EndKey)
+		return b
+	})
+	if err != nil {
 		return roachpb.Span{}, err
 	}
 
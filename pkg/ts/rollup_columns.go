@@ -0,0 +1,234 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package ts
+
+import (
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/ts/tspb"
+	"github.com/pkg/errors"
+)
+
+// rollupColumnPolicies holds the rollup column policies of all metrics, see
+// parseRollupColumnPolicies. Being a cluster setting, the policies are the
+// same on all nodes, so that every node computes the same rollups and rejects
+// the same queries.
+var rollupColumnPolicies = settings.RegisterValidatedStringSetting(
+	"timeseries.rollup.column_policies",
+	"semicolon-separated list of <metric>@<resolution>=<column>,... entries which restrict the "+
+		"aggregate columns retained in the rollups of a metric at a resolution, e.g. "+
+		"cr.node.sql.service.latency-p99@30m=sum,count,max; sum and count are always required",
+	"",
+	func(_ *settings.Values, s string) error {
+		_, err := parseRollupColumnPolicies(s)
+		return err
+	},
+)
+
+// RollupColumns is a set of the aggregate columns recorded for each datapoint
+// of rollup data.
+type RollupColumns uint8
+
+// The aggregate columns of rollup data.
+const (
+	RollupColumnFirst RollupColumns = 1 << iota
+	RollupColumnLast
+	RollupColumnMin
+	RollupColumnMax
+	RollupColumnSum
+	RollupColumnCount
+	RollupColumnVariance
+
+	// AllRollupColumns retains every aggregate column, which is the default
+	// for metrics without a rollup column policy.
+	AllRollupColumns = RollupColumnFirst | RollupColumnLast | RollupColumnMin |
+		RollupColumnMax | RollupColumnSum | RollupColumnCount | RollupColumnVariance
+)
+
+// requiredRollupColumns are the columns which may not be dropped from rollup
+// data: the average, which is the default downsampler and source aggregator,
+// is computed from the sum and count of each datapoint.
+const requiredRollupColumns = RollupColumnSum | RollupColumnCount
+
+var rollupColumnNames = []struct {
+	column RollupColumns
+	name   string
+}{
+	{RollupColumnFirst, "first"},
+	{RollupColumnLast, "last"},
+	{RollupColumnMin, "min"},
+	{RollupColumnMax, "max"},
+	{RollupColumnSum, "sum"},
+	{RollupColumnCount, "count"},
+	{RollupColumnVariance, "variance"},
+}
+
+// Contains returns true if all of the supplied columns are in the set.
+func (c RollupColumns) Contains(columns RollupColumns) bool {
+	return c&columns == columns
+}
+
+func (c RollupColumns) String() string {
+	var names []string
+	for _, n := range rollupColumnNames {
+		if c.Contains(n.column) {
+			names = append(names, n.name)
+		}
+	}
+	return "{" + strings.Join(names, ",") + "}"
+}
+
+// RollupColumnPolicy configures which aggregate columns of a metric are
+// retained at individual rollup resolutions. Resolutions which are not present
+// in the policy retain all columns.
+//
+// The columnar format requires all rollup columns to be aligned, so dropped
+// columns are still present in the stored rollups but are zeroed, which
+// allows them to be compressed away by the storage engine.
+type RollupColumnPolicy map[Resolution]RollupColumns
+
+// validateRollupColumnPolicy returns an error if the supplied policy is not
+// internally consistent.
+func validateRollupColumnPolicy(policy RollupColumnPolicy) error {
+	for r, columns := range policy {
+		if !r.IsRollup() {
+			return errors.Errorf("rollup column policy specified for non-rollup resolution %s", r)
+		}
+		if columns&^AllRollupColumns != 0 {
+			return errors.Errorf("rollup column policy for resolution %s specifies unknown columns", r)
+		}
+		if !columns.Contains(requiredRollupColumns) {
+			return errors.Errorf(
+				"rollup column policy for resolution %s must retain columns %s, got %s",
+				r, requiredRollupColumns, columns,
+			)
+		}
+	}
+	return nil
+}
+
+// parseRollupColumnPolicies parses the value of the rollup column policies
+// setting into the policies of the named metrics. Each entry of the
+// semicolon-separated list has the form <metric>@<resolution>=<columns>, where
+// the columns are comma-separated names such as "max" or "sum".
+func parseRollupColumnPolicies(s string) (map[string]RollupColumnPolicy, error) {
+	var policies map[string]RollupColumnPolicy
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		at, eq := -1, strings.LastIndexByte(entry, '=')
+		if eq > 0 {
+			at = strings.LastIndexByte(entry[:eq], '@')
+		}
+		if at <= 0 {
+			return nil, errors.Errorf(
+				"invalid rollup column policy %q: expected <metric>@<resolution>=<columns>", entry,
+			)
+		}
+		name := entry[:at]
+		r, ok := parseRollupResolution(entry[at+1 : eq])
+		if !ok {
+			return nil, errors.Errorf("invalid rollup column policy %q: unknown resolution", entry)
+		}
+		var columns RollupColumns
+		for _, c := range strings.Split(entry[eq+1:], ",") {
+			column, ok := parseRollupColumn(strings.TrimSpace(c))
+			if !ok {
+				return nil, errors.Errorf("invalid rollup column policy %q: unknown column %q", entry, c)
+			}
+			columns |= column
+		}
+		if _, ok := policies[name][r]; ok {
+			return nil, errors.Errorf("duplicate rollup column policy for metric %s at resolution %s", name, r)
+		}
+		if policies == nil {
+			policies = make(map[string]RollupColumnPolicy)
+		}
+		if policies[name] == nil {
+			policies[name] = make(RollupColumnPolicy)
+		}
+		policies[name][r] = columns
+	}
+	for name, policy := range policies {
+		if err := validateRollupColumnPolicy(policy); err != nil {
+			return nil, errors.Wrapf(err, "invalid rollup column policy for metric %s", name)
+		}
+	}
+	return policies, nil
+}
+
+// parseRollupResolution returns the resolution with the supplied name, as
+// returned by Resolution.String.
+func parseRollupResolution(s string) (Resolution, bool) {
+	for _, r := range []Resolution{Resolution10s, Resolution30m, resolution1ns, resolution50ns} {
+		if r.String() == s {
+			return r, true
+		}
+	}
+	return 0, false
+}
+
+// parseRollupColumn returns the column with the supplied name.
+func parseRollupColumn(s string) (RollupColumns, bool) {
+	for _, n := range rollupColumnNames {
+		if n.name == s {
+			return n.column, true
+		}
+	}
+	return 0, false
+}
+
+// retainedRollupColumns returns the aggregate columns of the named metric
+// which are retained at the supplied rollup resolution. The policies are
+// parsed again whenever the setting changes.
+func (db *DB) retainedRollupColumns(name string, r Resolution) RollupColumns {
+	s := rollupColumnPolicies.Get(&db.st.SV)
+	db.rollupColumns.Lock()
+	defer db.rollupColumns.Unlock()
+	if s != db.rollupColumns.setting {
+		// The setting is validated when it is set, so this can't fail.
+		policies, _ := parseRollupColumnPolicies(s)
+		db.rollupColumns.setting, db.rollupColumns.policies = s, policies
+	}
+	if columns, ok := db.rollupColumns.policies[name][r]; ok {
+		return columns
+	}
+	return AllRollupColumns
+}
+
+// verifyRollupColumnsForQuery returns an error if the supplied downsampler
+// requires a column which the named metric doesn't retain at the supplied
+// rollup resolution.
+func (db *DB) verifyRollupColumnsForQuery(
+	name string, r Resolution, downsampler tspb.TimeSeriesQueryAggregator,
+) error {
+	var required RollupColumns
+	switch downsampler {
+	case tspb.TimeSeriesQueryAggregator_MAX:
+		required = RollupColumnMax
+	case tspb.TimeSeriesQueryAggregator_MIN:
+		required = RollupColumnMin
+	default:
+		return nil
+	}
+	if !db.retainedRollupColumns(name, r).Contains(required) {
+		return errors.Errorf(
+			"downsampler %s cannot be used on metric %s: column %s is not retained at resolution %s",
+			downsampler, name, required, r,
+		)
+	}
+	return nil
+}
@@ -23,6 +23,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/ts/tspb"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
@@ -114,7 +115,7 @@ func TestComputeRollupFromData(t *testing.T) {
 	} {
 		t.Run("", func(t *testing.T) {
 			rollups := computeRollupsFromData(tc.input, 50)
-			internal, err := rollups.toInternal(1000, 50)
+			internal, err := rollups.toInternal(1000, 50, AllRollupColumns)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -218,6 +219,7 @@ func TestRollupBasic(t *testing.T) {
 			WallTime: 500 + resolution1nsDefaultRollupThreshold.Nanoseconds(),
 			Logical:  0,
 		},
+		nil, /* policy */
 		MakeQueryMemoryContext(tm.workerMemMonitor, tm.resultMemMonitor, memOpts),
 	); err != nil {
 		t.Fatal(err)
@@ -236,6 +238,7 @@ func TestRollupBasic(t *testing.T) {
 			WallTime: 500 + resolution1nsDefaultRollupThreshold.Nanoseconds(),
 			Logical:  0,
 		},
+		nil, /* policy */
 	); err != nil {
 		t.Fatal(err)
 	}
@@ -247,6 +250,118 @@ func TestRollupBasic(t *testing.T) {
 	}
 }
 
+func TestRollupColumnPolicy(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModelRunner(t)
+	tm.Start()
+	defer tm.Stop()
+
+	series := tsd("test.metric", "a")
+	other := tsd("test.othermetric", "a")
+	for i := 0; i < 500; i++ {
+		series.Datapoints = append(series.Datapoints, tsdp(time.Duration(i), float64(i)))
+		other.Datapoints = append(other.Datapoints, tsdp(time.Duration(i), float64(i)))
+	}
+	tm.storeTimeSeriesData(resolution1ns, []tspb.TimeSeriesData{series, other})
+
+	// Invalid policies are rejected.
+	for _, policy := range []string{
+		"test.metric@50ns=sum",
+		"test.metric@50ns=count,min",
+		"test.metric@1ns=first,last,min,max,sum,count,variance",
+		"test.metric@BAD=sum,count",
+		"test.metric@50ns=sum,count,median",
+		"test.metric=sum,count",
+		"@50ns=sum,count",
+		"test.metric@50ns=sum,count;test.metric@50ns=sum,count,max",
+	} {
+		if err := rollupColumnPolicies.Validate(&tm.DB.st.SV, policy); !testutils.IsError(
+			err, "rollup column policy",
+		) {
+			t.Fatalf("expected policy %q to be rejected, got %v", policy, err)
+		}
+	}
+
+	// Retain only the sum and count of the metric at the coarse resolution.
+	// The policy of the other metric applies to another resolution.
+	retained := RollupColumnSum | RollupColumnCount
+	const policies = "test.metric@50ns=sum,count; test.othermetric@30m=sum,count"
+	if err := rollupColumnPolicies.Validate(&tm.DB.st.SV, policies); err != nil {
+		t.Fatal(err)
+	}
+	rollupColumnPolicies.Override(&tm.DB.st.SV, policies)
+
+	now := 500 + resolution1nsDefaultRollupThreshold.Nanoseconds()
+	for _, name := range []string{"test.metric", "test.othermetric"} {
+		tm.rollup(now, timeSeriesResolutionInfo{Name: name, Resolution: resolution1ns})
+		tm.prune(now, timeSeriesResolutionInfo{Name: name, Resolution: resolution1ns})
+	}
+	tm.assertKeyCount(2)
+	tm.assertModelCorrect()
+
+	// Only the retained columns of the metric with a policy contain data.
+	for key, value := range tm.getActualData() {
+		name, _, res, _, err := DecodeDataKey(roachpb.Key(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != resolution50ns {
+			t.Fatalf("unexpected data at resolution %s for %s", res, name)
+		}
+		var idata roachpb.InternalTimeSeriesData
+		if err := value.GetProto(&idata); err != nil {
+			t.Fatal(err)
+		}
+		expected := computeRollupsFromData(series, resolution50ns.SampleDuration())
+		columns := AllRollupColumns
+		if name == "test.metric" {
+			columns = retained
+		}
+		expectedSlabs, err := expected.toInternal(
+			resolution50ns.SlabDuration(), resolution50ns.SampleDuration(), columns,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(expectedSlabs) != 1 {
+			t.Fatalf("expected a single slab, got %d", len(expectedSlabs))
+		}
+		if !reflect.DeepEqual(idata, expectedSlabs[0]) {
+			t.Fatalf("unexpected rollup for %s: %s", name, pretty.Diff(idata, expectedSlabs[0]))
+		}
+		for i := range idata.Offset {
+			if idata.Count[i] != 50 || idata.Sum[i] == 0 {
+				t.Fatalf("expected sum and count to be retained for %s, got %v", name, idata)
+			}
+			dropped := idata.First[i] == 0 && idata.Last[i] == 0 && idata.Min[i] == 0 &&
+				idata.Max[i] == 0 && idata.Variance[i] == 0
+			if dropped != (name == "test.metric") {
+				t.Fatalf("unexpected columns retained for %s: %v", name, idata)
+			}
+		}
+	}
+
+	// Queries which only require the retained columns succeed, while those
+	// which require a dropped column are rejected.
+	{
+		query := tm.makeQuery("test.metric", resolution1ns, 0, 500)
+		query.SampleDurationNanos = 50
+		query.assertSuccess(10, 1)
+	}
+	{
+		query := tm.makeQuery("test.metric", resolution1ns, 0, 500)
+		query.SampleDurationNanos = 50
+		query.setDownsampler(tspb.TimeSeriesQueryAggregator_MAX)
+		query.assertError("column {max} is not retained")
+	}
+	{
+		query := tm.makeQuery("test.othermetric", resolution1ns, 0, 500)
+		query.SampleDurationNanos = 50
+		query.setDownsampler(tspb.TimeSeriesQueryAggregator_MAX)
+		query.assertSuccess(10, 1)
+	}
+}
+
 func TestRollupMemoryConstraint(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	tm := newTestModelRunner(t)
@@ -355,3 +470,65 @@ func TestRollupMemoryConstraint(t *testing.T) {
 		}
 	}
 }
+
+func TestMaintainTimeSeriesBudgetSkew(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	tm := newTestModelRunner(t)
+	tm.Start()
+	defer tm.Stop()
+
+	// Arbitrary timestamp
+	var now int64 = 1475700000 * 1e9
+	start := Resolution10s.normalizeToSlab(now - int64(30*24*time.Hour))
+
+	// A single dense time series with two samples in each of several hundred
+	// slabs, and several sparse time series with a single sample each. All of
+	// the data is old enough to be rolled up, but young enough for the rollups
+	// to be retained.
+	const hugeSlabs = 300
+	huge := tsd("metric.huge", "source1")
+	for i := 0; i < hugeSlabs; i++ {
+		slabStart := start + int64(i)*Resolution10s.SlabDuration()
+		huge.Datapoints = append(huge.Datapoints,
+			tspb.TimeSeriesDatapoint{TimestampNanos: slabStart, Value: float64(i)},
+			tspb.TimeSeriesDatapoint{TimestampNanos: slabStart + int64(30*time.Minute), Value: float64(i)},
+		)
+	}
+	data := []tspb.TimeSeriesData{huge}
+	const numSmall = 5
+	for i := 0; i < numSmall; i++ {
+		small := tsd(fmt.Sprintf("metric.small.%d", i), "source1")
+		small.Datapoints = append(small.Datapoints, tspb.TimeSeriesDatapoint{
+			TimestampNanos: start + int64(i)*Resolution10s.SlabDuration(),
+			Value:          float64(i),
+		})
+		data = append(data, small)
+	}
+	tm.storeTimeSeriesData(Resolution10s, data)
+	tm.assertKeyCount(hugeSlabs + numSmall)
+	tm.assertModelCorrect()
+
+	// The budget allows reading only a few slabs at once, and is much smaller
+	// than the rollups of the dense time series, which thus have to be written
+	// incrementally.
+	budget := 2 * (QueryMemoryContext{
+		QueryMemoryOptions: QueryMemoryOptions{Columnar: tm.DB.WriteColumnar()},
+	}).computeSizeOfSlab(Resolution10s)
+	tm.maintainWithBudget(now, budget)
+	tm.assertModelCorrect()
+
+	{
+		query := tm.makeQuery("metric.huge", Resolution30m, start, now)
+		query.assertSuccess(2*hugeSlabs, 1)
+	}
+	for i := 0; i < numSmall; i++ {
+		query := tm.makeQuery(fmt.Sprintf("metric.small.%d", i), Resolution30m, start, now)
+		query.assertSuccess(1, 1)
+	}
+
+	// All of the rolled up data has been pruned.
+	{
+		query := tm.makeQuery("metric.huge", Resolution10s, start, now)
+		query.assertSuccess(0, 0)
+	}
+}